@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/logcli"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/backup"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/server"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/server/metrics"
 
 	"github.com/apex/log"
 	"github.com/urfave/cli"
@@ -101,6 +103,7 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
@@ -143,6 +146,7 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
@@ -209,6 +213,7 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
@@ -255,6 +260,7 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
@@ -273,10 +279,60 @@ func main() {
 		{
 			Name:      "restore",
 			Usage:     "Create schema and restore data from backup",
-			UsageText: "clickhouse-backup restore  [-t, --tables=<db>.<table>] [-m, --restore-database-mapping=<originDB>:<targetDB>[,<...>]] [--partitions=<partitions_names>] [-s, --schema] [-d, --data] [--rm, --drop] [-i, --ignore-dependencies] [--rbac] [--configs] <backup_name>",
+			UsageText: "clickhouse-backup restore  [-t, --tables=<db>.<table>] [--tables-file=<path>] [-m, --restore-database-mapping=<originDB>:<targetDB>[,<...>]] [--restore-mapping-file=<path>] [--partitions=<partitions_names>] [--last-partitions=<N>] [-s, --schema] [-d, --data] [--rm, --drop] [-i, --ignore-dependencies] [--rbac] [--configs] [--skip-attach] [--schema-as-attach=<true|false>] [--restore-functions-pattern=<function_name>] [--validation-query=<query>] [--validation-report=<path>] [--preview] [--metrics-listen=<host:port>] [--rbac-types=<USER,ROLE,...>] [--rbac-names=<name_pattern>] [--schema-output=<path>] [--schema-output-only] [--attach-incrementally] [--part=<part_name>] [--force-drop] [--freeze-after-restore] [--replace-partitions] [--only-new-partitions] [--metrics-file=<path>] [--no-restart] [--sync-parts] [--sync-parts-detach] <backup_name>",
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(config.GetConfigFromCli(c))
-				return b.Restore(c.Args().First(), c.String("t"), c.StringSlice("restore-database-mapping"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("d"), c.Bool("rm"), c.Bool("ignore-dependencies"), c.Bool("rbac"), c.Bool("configs"), c.Int("command-id"))
+				if c.Bool("rbac") && (c.String("rbac-types") != "" || c.String("rbac-names") != "") {
+					return b.RestoreRBACOnly(c.Args().First(), c.String("rbac-types"), c.String("rbac-names"), c.Bool("no-restart"), c.Int("command-id"))
+				}
+				if c.String("metrics-listen") != "" {
+					stopMetrics, err := serveRestoreMetrics(c.String("metrics-listen"))
+					if err != nil {
+						return err
+					}
+					defer stopMetrics()
+				}
+				databaseMapping, err := getRestoreDatabaseMapping(c)
+				if err != nil {
+					return err
+				}
+				tablePattern, err := getRestoreTablePattern(c)
+				if err != nil {
+					return err
+				}
+				if c.Bool("preview") {
+					return b.PrintRestorableTables(c.Args().First(), tablePattern, databaseMapping)
+				}
+				if len(c.StringSlice("validation-query")) > 0 {
+					return b.RestoreAndValidate(c.Args().First(), tablePattern, c.String("restore-functions-pattern"), databaseMapping, c.StringSlice("partitions"), c.Bool("rm"), c.Bool("ignore-dependencies"), c.BoolT("schema-as-attach"), c.Int("last-partitions"), c.StringSlice("validation-query"), c.String("validation-report"), c.Int("command-id"))
+				}
+				return b.Restore(c.Args().First(), backup.RestoreOptions{
+					TablePattern:        tablePattern,
+					FunctionsPattern:    c.String("restore-functions-pattern"),
+					DatabaseMapping:     databaseMapping,
+					Partitions:          c.StringSlice("partitions"),
+					Parts:               c.StringSlice("part"),
+					LastPartitions:      c.Int("last-partitions"),
+					SchemaOnly:          c.Bool("s"),
+					DataOnly:            c.Bool("d"),
+					DropTable:           c.Bool("rm"),
+					ForceDrop:           c.Bool("force-drop"),
+					IgnoreDependencies:  c.Bool("ignore-dependencies"),
+					RBACOnly:            c.Bool("rbac"),
+					ConfigsOnly:         c.Bool("configs"),
+					SkipAttach:          c.Bool("skip-attach"),
+					AttachIncrementally: c.Bool("attach-incrementally"),
+					FreezeAfterRestore:  c.Bool("freeze-after-restore"),
+					ReplacePartitions:   c.Bool("replace-partitions"),
+					OnlyNewPartitions:   c.Bool("only-new-partitions"),
+					NoRestart:           c.Bool("no-restart"),
+					SyncParts:           c.Bool("sync-parts"),
+					SyncPartsDetach:     c.Bool("sync-parts-detach"),
+					SchemaAsAttach:      c.BoolT("schema-as-attach"),
+					SchemaOutput:        c.String("schema-output"),
+					SchemaOutputOnly:    c.Bool("schema-output-only"),
+					MetricsFile:         c.String("metrics-file"),
+				}, c.Int("command-id"))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -296,9 +352,16 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
+						"prefix value with table name from backup to calculate partition_id and filter partitions only for matched tables, --partitions=db.table:('value'), allow ? and * as wildcard in table name\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
+				cli.IntFlag{
+					Name:   "last-partitions",
+					Hidden: false,
+					Usage:  "Restore data only for N lexicographically highest partition ids for each table, for date based PARTITION BY it means N most recent partitions, could be used together with --partitions",
+				},
 				cli.BoolFlag{
 					Name:   "schema, s",
 					Hidden: false,
@@ -329,15 +392,209 @@ func main() {
 					Hidden: false,
 					Usage:  "Restore 'clickhouse-server' CONFIG related files only",
 				},
+				cli.BoolFlag{
+					Name:   "skip-attach",
+					Hidden: false,
+					Usage:  "Copy data parts to 'detached' folder only, skip ATTACH PART execution and print ATTACH queries for manual execution",
+				},
+				cli.StringSliceFlag{
+					Name:   "validation-query",
+					Hidden: false,
+					Usage:  "Execute query for each restored table after restore, {database} and {table} placeholders replaced with restored table names, for example --validation-query=\"SELECT count() FROM `{database}`.`{table}`\", could be used multiple times, results saved as JSON report, schema and data always restored together",
+				},
+				cli.StringFlag{
+					Name:   "validation-report",
+					Hidden: false,
+					Usage:  "Path to save JSON report with --validation-query results, print report to stdout when empty",
+				},
+				cli.BoolFlag{
+					Name:   "preview",
+					Hidden: false,
+					Usage:  "Print source and destination names and parts count for tables matched by --tables and --restore-database-mapping, without restore",
+				},
+				cli.BoolTFlag{
+					Name:   "schema-as-attach",
+					Hidden: false,
+					Usage:  "Restore materialized, window and live views via ATTACH instead of CREATE query, enabled by default, use --schema-as-attach=false when inner tables of views can't be restored before views",
+				},
+				cli.StringFlag{
+					Name:   "restore-functions-pattern",
+					Hidden: false,
+					Usage:  "Restore only user defined functions which matched with function name patterns, separated by comma, allow ? and * as wildcard",
+				},
+				cli.StringFlag{
+					Name:   "metrics-listen",
+					Hidden: false,
+					Usage:  "Expose restore progress prometheus metrics on http://<host:port>/metrics during restore, for example --metrics-listen=localhost:7172",
+				},
+				cli.StringFlag{
+					Name:   "restore-mapping-file",
+					Hidden: false,
+					Usage:  "YAML or JSON file with srcDatabase: destinationDatabase pairs, merged with --restore-database-mapping, inline rules have priority",
+				},
+				cli.StringFlag{
+					Name:   "tables-file",
+					Hidden: false,
+					Usage:  "File with table names or patterns in db.table format, one per line, `#` starts comment, merged with --tables, patterns which don't match any table in backup reported as warning",
+				},
+				cli.StringFlag{
+					Name:   "rbac-types",
+					Hidden: false,
+					Usage:  "Restore only RBAC objects with selected types, separated by comma, allowed USER, ROLE, ROW_POLICY, QUOTA, SETTINGS_PROFILE, works only with --rbac, other RBAC objects in ClickHouse stay untouched",
+				},
+				cli.StringFlag{
+					Name:   "rbac-names",
+					Hidden: false,
+					Usage:  "Restore only RBAC objects which matched with name patterns, separated by comma, allow ? and * as wildcard, works only with --rbac, other RBAC objects in ClickHouse stay untouched",
+				},
+				cli.StringFlag{
+					Name:   "schema-output",
+					Hidden: false,
+					Usage:  "Save CREATE DATABASE queries and executed CREATE queries for tables, views and dictionaries after all mapping and rewrite rules to SQL file in dependency order",
+				},
+				cli.BoolFlag{
+					Name:   "schema-output-only",
+					Hidden: false,
+					Usage:  "Only generate --schema-output file without changes in ClickHouse, could be used as migration script generator",
+				},
+				cli.BoolFlag{
+					Name:   "attach-incrementally",
+					Hidden: false,
+					Usage:  "Copy and attach data parts partition by partition, restored partitions available for queries before the whole table restored",
+				},
+				cli.StringSliceFlag{
+					Name:   "part",
+					Hidden: false,
+					Usage:  "Restore only data parts with specified names, could be used multiple times, fail when part not found in backup metadata",
+				},
+				cli.BoolFlag{
+					Name:   "force-drop",
+					Hidden: false,
+					Usage:  "Drop each restored database with all tables, including tables which absent in backup, before create it again, uses `restore_schema_on_cluster` when defined",
+				},
+				cli.BoolFlag{
+					Name:   "freeze-after-restore",
+					Hidden: false,
+					Usage:  "Execute ALTER TABLE ... FREEZE PARTITION for restored partitions after attach, data snapshot placed to `shadow/restored_<backup_name>` folder with random suffix on each table disk, `clean` command removes it",
+				},
+				cli.BoolFlag{
+					Name:   "replace-partitions",
+					Hidden: false,
+					Usage:  "Attach data parts to temporary table and execute ALTER TABLE ... REPLACE PARTITION for each restored partition of existing table, old partition data replaced atomically instead of appended",
+				},
+				cli.BoolFlag{
+					Name:   "only-new-partitions",
+					Hidden: false,
+					Usage:  "Restore data only for partitions which don't have active parts in destination table, for incremental top-up of existing tables",
+				},
+				cli.StringFlag{
+					Name:   "metrics-file",
+					Hidden: false,
+					Usage:  "Write restore summary with restored tables, bytes, duration and success status in OpenMetrics format into <path> after restore finished, for CI pipelines which don't scrape prometheus metrics",
+				},
+				cli.BoolFlag{
+					Name:   "sync-parts",
+					Hidden: false,
+					Usage:  "Compare backup parts with active parts of existing table in restored partitions by data checksums from checksums.txt, copy and attach only parts which absent in table, parts merged after previous restore don't match any backup part and will attached again, requires local access to table part files",
+				},
+				cli.BoolFlag{
+					Name:   "sync-parts-detach",
+					Hidden: false,
+					Usage:  "Together with --sync-parts, after restore detach active parts of table in restored partitions which absent in backup, detached parts kept in 'detached' folder, not supported for Replicated*MergeTree tables, cause DETACH PART applied on all replicas",
+				},
+				cli.BoolFlag{
+					Name:   "no-restart",
+					Hidden: false,
+					Usage:  "Restore RBAC objects and configs without execute `restart_command`, for deployments where ClickHouse restart managed externally, ClickHouse shall be restarted manually to apply them",
+				},
+			),
+		},
+		{
+			Name:      "restore_merged",
+			Usage:     "Create schema and restore union of data parts from several local backups",
+			UsageText: "clickhouse-backup restore_merged [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] [-d, --data] [--rm, --drop] [--skip-attach] <backup_name> <backup_name> [<backup_name> ...]",
+			Action: func(c *cli.Context) error {
+				b := backup.NewBackuper(config.GetConfigFromCli(c))
+				return b.RestoreMerged(c.Args(), c.String("t"), c.StringSlice("partitions"), c.Bool("d"), c.Bool("rm"), c.Bool("skip-attach"), c.Int("command-id"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Usage:  "Restore only objects which matched with table name patterns, separated by comma, allow ? and * as wildcard",
+					Hidden: false,
+				},
+				cli.StringSliceFlag{
+					Name:   "partitions",
+					Hidden: false,
+					Usage:  "Restore only selected partition names, separated by comma, the same format as `restore --partitions`",
+				},
+				cli.BoolFlag{
+					Name:   "data, d",
+					Hidden: false,
+					Usage:  "Restore data only, tables shall be created before",
+				},
+				cli.BoolFlag{
+					Name:   "rm, drop",
+					Hidden: false,
+					Usage:  "Drop exists schema objects before restore",
+				},
+				cli.BoolFlag{
+					Name:   "skip-attach",
+					Hidden: false,
+					Usage:  "Copy data parts to 'detached' folder without ATTACH PART, log ATTACH queries for manual execution",
+				},
 			),
 		},
 		{
 			Name:      "restore_remote",
 			Usage:     "Download and restore",
-			UsageText: "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [-m, --restore-database-mapping=<originDB>:<targetDB>[,<...>]] [--partitions=<partitions_names>] [--rm, --drop] [-i, --ignore-dependencies] [--rbac] [--configs] [--skip-rbac] [--skip-configs] [--resumable] <backup_name>",
+			UsageText: "clickhouse-backup restore_remote [--schema] [--data] [-t, --tables=<db>.<table>] [--tables-file=<path>] [-m, --restore-database-mapping=<originDB>:<targetDB>[,<...>]] [--restore-mapping-file=<path>] [--partitions=<partitions_names>] [--last-partitions=<N>] [--rm, --drop] [-i, --ignore-dependencies] [--rbac] [--configs] [--skip-rbac] [--skip-configs] [--skip-attach] [--schema-as-attach=<true|false>] [--restore-functions-pattern=<function_name>] [--resumable] [--by-table] [--metrics-listen=<host:port>] [--no-restart] <backup_name>",
 			Action: func(c *cli.Context) error {
 				b := backup.NewBackuper(config.GetConfigFromCli(c))
-				return b.RestoreFromRemote(c.Args().First(), c.String("t"), c.StringSlice("restore-database-mapping"), c.StringSlice("partitions"), c.Bool("s"), c.Bool("d"), c.Bool("rm"), c.Bool("i"), c.Bool("rbac"), c.Bool("configs"), c.Bool("resume"), c.Int("command-id"))
+				if c.String("metrics-listen") != "" {
+					stopMetrics, err := serveRestoreMetrics(c.String("metrics-listen"))
+					if err != nil {
+						return err
+					}
+					defer stopMetrics()
+				}
+				databaseMapping, err := getRestoreDatabaseMapping(c)
+				if err != nil {
+					return err
+				}
+				tablePattern, err := getRestoreTablePattern(c)
+				if err != nil {
+					return err
+				}
+				opts := backup.RestoreOptions{
+					TablePattern:       tablePattern,
+					FunctionsPattern:   c.String("restore-functions-pattern"),
+					DatabaseMapping:    databaseMapping,
+					Partitions:         c.StringSlice("partitions"),
+					LastPartitions:     c.Int("last-partitions"),
+					SchemaOnly:         c.Bool("s"),
+					DataOnly:           c.Bool("d"),
+					DropTable:          c.Bool("rm"),
+					IgnoreDependencies: c.Bool("i"),
+					RBACOnly:           c.Bool("rbac"),
+					ConfigsOnly:        c.Bool("configs"),
+					SkipAttach:         c.Bool("skip-attach"),
+					NoRestart:          c.Bool("no-restart"),
+					SchemaAsAttach:     c.BoolT("schema-as-attach"),
+				}
+				if c.Bool("by-table") {
+					var incompatibleFlags []string
+					for _, flag := range []string{"schema", "rbac", "configs", "resume", "no-restart"} {
+						if c.Bool(flag) {
+							incompatibleFlags = append(incompatibleFlags, "--"+flag)
+						}
+					}
+					if len(incompatibleFlags) > 0 {
+						return fmt.Errorf("--by-table is not compatible with %s", strings.Join(incompatibleFlags, ", "))
+					}
+					return b.RestoreFromRemoteByTable(c.Args().First(), opts, c.Int("command-id"))
+				}
+				return b.RestoreFromRemote(c.Args().First(), opts, c.Bool("resume"), c.Int("command-id"))
 			},
 			Flags: append(cliapp.Flags,
 				cli.StringFlag{
@@ -357,9 +614,16 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
+						"prefix value with table name from backup to calculate partition_id and filter partitions only for matched tables, --partitions=db.table:('value'), allow ? and * as wildcard in table name\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
+				cli.IntFlag{
+					Name:   "last-partitions",
+					Hidden: false,
+					Usage:  "Restore data only for N lexicographically highest partition ids for each table, for date based PARTITION BY it means N most recent partitions, could be used together with --partitions",
+				},
 				cli.BoolFlag{
 					Name:   "schema, s",
 					Hidden: false,
@@ -390,11 +654,87 @@ func main() {
 					Hidden: false,
 					Usage:  "Download and Restore 'clickhouse-server' CONFIG related files only",
 				},
+				cli.BoolFlag{
+					Name:   "skip-attach",
+					Hidden: false,
+					Usage:  "Download and copy data parts to 'detached' folder only, skip ATTACH PART execution and print ATTACH queries for manual execution",
+				},
+				cli.BoolTFlag{
+					Name:   "schema-as-attach",
+					Hidden: false,
+					Usage:  "Restore materialized, window and live views via ATTACH instead of CREATE query, enabled by default, use --schema-as-attach=false when inner tables of views can't be restored before views",
+				},
+				cli.StringFlag{
+					Name:   "restore-functions-pattern",
+					Hidden: false,
+					Usage:  "Restore only user defined functions which matched with function name patterns, separated by comma, allow ? and * as wildcard",
+				},
 				cli.BoolFlag{
 					Name:   "resume, resumable",
 					Hidden: false,
 					Usage:  "Save intermediate upload state and resume upload if backup exists on remote storage, ignored with 'remote_storage: custom' or 'use_embedded_backup_restore: true'",
 				},
+				cli.BoolFlag{
+					Name:   "by-table",
+					Hidden: false,
+					Usage:  "Restore schema for all tables first, then download and restore data table by table with removing local copy after each table, bound local disk usage by the biggest table, not compatible with --schema, --rbac, --configs, --resume and --no-restart",
+				},
+				cli.StringFlag{
+					Name:   "metrics-listen",
+					Hidden: false,
+					Usage:  "Expose restore progress prometheus metrics on http://<host:port>/metrics during restore, for example --metrics-listen=localhost:7172",
+				},
+				cli.StringFlag{
+					Name:   "restore-mapping-file",
+					Hidden: false,
+					Usage:  "YAML or JSON file with srcDatabase: destinationDatabase pairs, merged with --restore-database-mapping, inline rules have priority",
+				},
+				cli.StringFlag{
+					Name:   "tables-file",
+					Hidden: false,
+					Usage:  "File with table names or patterns in db.table format, one per line, `#` starts comment, merged with --tables, patterns which don't match any table in backup reported as warning",
+				},
+				cli.BoolFlag{
+					Name:   "no-restart",
+					Hidden: false,
+					Usage:  "Restore RBAC objects and configs without execute `restart_command`, for deployments where ClickHouse restart managed externally, ClickHouse shall be restarted manually to apply them",
+				},
+			),
+		},
+		{
+			Name:      "validate",
+			Usage:     "Check local backup metadata and data parts consistency",
+			UsageText: "clickhouse-backup validate <backup_name>",
+			Action: func(c *cli.Context) error {
+				b := backup.NewBackuper(config.GetConfigFromCli(c))
+				return b.Validate(c.Args().First(), c.Int("command-id"))
+			},
+			Flags: cliapp.Flags,
+		},
+		{
+			Name:      "copier_config",
+			Usage:     "Print clickhouse-copier task XML for copy tables from restored local backup to destination cluster, password of current server replaced with ****** and shall be set manually",
+			UsageText: "clickhouse-backup copier_config --destination-cluster=<cluster> [-t, --tables=<db>.<table>] [--partitions=<partitions_names>] <backup_name>",
+			Action: func(c *cli.Context) error {
+				b := backup.NewBackuper(config.GetConfigFromCli(c))
+				return b.PrintCopierConfig(c.Args().First(), c.String("t"), c.String("destination-cluster"), c.StringSlice("partitions"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "destination-cluster",
+					Hidden: false,
+					Usage:  "Cluster name from system.clusters which will used as clickhouse-copier cluster_push, current server used as cluster_pull",
+				},
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+					Usage:  "Generate task only for tables which matched with table name patterns, separated by comma, allow ? and * as wildcard",
+				},
+				cli.StringSliceFlag{
+					Name:   "partitions",
+					Hidden: false,
+					Usage:  "Generate task only for selected partition names, separated by comma, format the same as `restore --partitions`",
+				},
 			),
 		},
 		{
@@ -440,6 +780,52 @@ func main() {
 			},
 			Flags: cliapp.Flags,
 		},
+		{
+			Name:      "clean_detached",
+			Usage:     "Remove empty directories from 'detached' folder of tables, which could be left after restore",
+			UsageText: "clickhouse-backup clean_detached [-t, --tables=<db>.<table>] [--dry-run]",
+			Action: func(c *cli.Context) error {
+				b := backup.NewBackuper(config.GetConfigFromCli(c))
+				return b.CleanDetached(c.String("t"), c.Bool("dry-run"), status.NotFromAPI)
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringFlag{
+					Name:   "table, tables, t",
+					Hidden: false,
+					Usage:  "Clean 'detached' only for tables which matched with table name patterns, separated by comma, allow ? and * as wildcard",
+				},
+				cli.BoolFlag{
+					Name:   "dry-run",
+					Hidden: false,
+					Usage:  "Only print empty directories which will be removed",
+				},
+			),
+		},
+		{
+			Name:      "fix_restore_ownership",
+			Usage:     "Change owner of data and 'detached' folders of tables restored from local backup to clickhouse user, for repair after interrupted restore",
+			UsageText: "clickhouse-backup fix_restore_ownership [-m, --restore-database-mapping=<originDB>:<targetDB>[,<...>]] [--restore-mapping-file=<path>] <backup_name>",
+			Action: func(c *cli.Context) error {
+				b := backup.NewBackuper(config.GetConfigFromCli(c))
+				databaseMapping, err := getRestoreDatabaseMapping(c)
+				if err != nil {
+					return err
+				}
+				return b.FixRestoreOwnership(c.Args().First(), databaseMapping, c.Int("command-id"))
+			},
+			Flags: append(cliapp.Flags,
+				cli.StringSliceFlag{
+					Name:   "restore-database-mapping, m",
+					Usage:  "Database mapping used for interrupted restore, ownership fixed for destination tables",
+					Hidden: false,
+				},
+				cli.StringFlag{
+					Name:   "restore-mapping-file",
+					Hidden: false,
+					Usage:  "YAML or JSON file with srcDatabase: destinationDatabase pairs, merged with --restore-database-mapping, inline rules have priority",
+				},
+			),
+		},
 		{
 			Name:  "clean_remote_broken",
 			Usage: "Remove all broken remote backups",
@@ -487,6 +873,7 @@ func main() {
 						"if PARTITION BY clause returns numeric not hashed values for `partition_id` field in system.parts table, then use --partitions=partition_id1,partition_id2 format\n" +
 						"if PARTITION BY clause returns hashed string values, then use --partitions=('non_numeric_field_value_for_part1'),('non_numeric_field_value_for_part2') format\n" +
 						"if PARTITION BY clause returns tuple with multiple fields, then use --partitions=(numeric_value1,'string_value1','date_or_datetime_value'),(...) format\n" +
+						"ALTER TABLE like format also allowed, --partitions=\"PARTITION 'value'\" or --partitions=\"PARTITION toDate('2023-01-15')\", expression evaluated by ClickHouse and result used as partition key field value\n" +
 						"values depends on field types in your table, use single quote for String and Date/DateTime related types\n" +
 						"look to system.parts partition and partition_id fields for details https://clickhouse.com/docs/en/operations/system-tables/parts/",
 				},
@@ -541,3 +928,36 @@ func main() {
 		log.Fatal(err.Error())
 	}
 }
+
+// getRestoreDatabaseMapping - rules from --restore-mapping-file go first, so the same source databases in --restore-database-mapping override them
+func getRestoreDatabaseMapping(c *cli.Context) ([]string, error) {
+	if c.String("restore-mapping-file") == "" {
+		return c.StringSlice("restore-database-mapping"), nil
+	}
+	databaseMapping, err := backup.LoadRestoreDatabaseMappingFile(c.String("restore-mapping-file"))
+	if err != nil {
+		return nil, err
+	}
+	return append(databaseMapping, c.StringSlice("restore-database-mapping")...), nil
+}
+
+// getRestoreTablePattern - patterns from --tables-file added to --tables
+func getRestoreTablePattern(c *cli.Context) (string, error) {
+	if c.String("tables-file") == "" {
+		return c.String("t"), nil
+	}
+	tablePattern, err := backup.LoadRestoreTablesFile(c.String("tables-file"))
+	if err != nil {
+		return "", err
+	}
+	if c.String("t") != "" {
+		tablePattern = c.String("t") + "," + tablePattern
+	}
+	return tablePattern, nil
+}
+
+// serveRestoreMetrics - expose restore metrics during CLI restore, API server expose them on own /metrics
+func serveRestoreMetrics(listenAddress string) (func(), error) {
+	metrics.Restore.Register()
+	return metrics.ListenAndServe(listenAddress)
+}
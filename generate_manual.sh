@@ -9,11 +9,16 @@ cmds=(
   list
   download
   restore
+  restore_merged
   restore_remote
+  validate
+  copier_config
   delete
   default-config
   print-config
   clean
+  clean_detached
+  fix_restore_ownership
   clean_remote_broken
   watch
   server
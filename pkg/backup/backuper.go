@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/resumable"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/storage"
 	apexLog "github.com/apex/log"
@@ -23,6 +25,9 @@ type Backuper struct {
 	isEmbedded             bool
 	resume                 bool
 	resumableState         *resumable.State
+	reflinkDisks           common.EmptyMap
+	// transformedQueries - results of `restore_schema_transform_rules` and `restore_schema_transform_command` by destination table, to avoid run command twice
+	transformedQueries map[metadata.TableTitle]string
 }
 
 func NewBackuper(cfg *config.Config) *Backuper {
@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+)
+
+// https://clickhouse.com/docs/en/operations/utilities/clickhouse-copier
+type copierReplica struct {
+	Host     string `xml:"host"`
+	Port     uint   `xml:"port"`
+	User     string `xml:"user,omitempty"`
+	Password string `xml:"password,omitempty"`
+	Secure   int    `xml:"secure,omitempty"`
+}
+
+type copierShard struct {
+	InternalReplication bool            `xml:"internal_replication"`
+	Replicas            []copierReplica `xml:"replica"`
+}
+
+type copierCluster struct {
+	XMLName xml.Name
+	Shards  []copierShard `xml:"shard"`
+}
+
+type copierTable struct {
+	XMLName           xml.Name
+	ClusterPull       string   `xml:"cluster_pull"`
+	DatabasePull      string   `xml:"database_pull"`
+	TablePull         string   `xml:"table_pull"`
+	ClusterPush       string   `xml:"cluster_push"`
+	DatabasePush      string   `xml:"database_push"`
+	TablePush         string   `xml:"table_push"`
+	Engine            string   `xml:"engine"`
+	ShardingKey       string   `xml:"sharding_key"`
+	EnabledPartitions []string `xml:"enabled_partitions>partition,omitempty"`
+}
+
+type copierTask struct {
+	XMLName       xml.Name        `xml:"clickhouse"`
+	RemoteServers []copierCluster `xml:"remote_servers>cluster"`
+	MaxWorkers    int             `xml:"max_workers"`
+	SettingsPull  string          `xml:"settings_pull>readonly"`
+	SettingsPush  string          `xml:"settings_push>readonly"`
+	Tables        []copierTable   `xml:"tables>table"`
+}
+
+const copierSourceCluster = "source_cluster"
+
+// copierPasswordMask - task XML printed to stdout, so real password replaced and shall be filled manually before run clickhouse-copier
+const copierPasswordMask = "******"
+
+var copierEngineRE = regexp.MustCompile(`(?s)\sENGINE\s*=\s*.+$`)
+var copierTableNameRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// GenerateCopierConfig - generate clickhouse-copier task XML for tables matched by tablePattern from backup which restored to current ClickHouse server,
+// current server used as source cluster, destinationCluster shall be defined in system.clusters of current server
+func (b *Backuper) GenerateCopierConfig(backupName, tablePattern, destinationCluster string, partitions []string) ([]byte, error) {
+	ctx, cancel, _ := status.Current.GetContextWithCancel(status.NotFromAPI)
+	defer cancel()
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	if destinationCluster == "" {
+		return nil, fmt.Errorf("destination cluster is required")
+	}
+	if err := b.ch.Connect(); err != nil {
+		return nil, fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer b.ch.Close()
+	_, disks, err := b.getLocalBackup(ctx, backupName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	tablesForCopy, err := getTableListByPatternLocal(b.cfg, b.ch, path.Join(defaultDataPath, "backup", backupName, "metadata"), tablePattern, false, partitions)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := b.getCopierCluster(ctx, destinationCluster)
+	if err != nil {
+		return nil, err
+	}
+	if b.cfg.ClickHouse.Password != "" {
+		b.log.Warnf("password of %s replaced with %s, set it manually before run clickhouse-copier", copierSourceCluster, copierPasswordMask)
+	}
+	task := copierTask{
+		RemoteServers: []copierCluster{
+			getCopierSourceCluster(b.cfg.ClickHouse),
+			destination,
+		},
+		MaxWorkers:   int(b.cfg.General.DownloadConcurrency),
+		SettingsPull: "1",
+		SettingsPush: "0",
+	}
+	for _, table := range tablesForCopy {
+		if table.MetadataOnly || !strings.Contains(table.Query, "MergeTree") {
+			continue
+		}
+		engine := copierEngineRE.FindString(table.Query)
+		if engine == "" {
+			continue
+		}
+		enabledPartitions, err := b.getCopierPartitions(ctx, table.Database, table.Table, table.Parts)
+		if err != nil {
+			return nil, err
+		}
+		task.Tables = append(task.Tables, getCopierTable(table.Database, table.Table, engine, destinationCluster, enabledPartitions))
+	}
+	if len(task.Tables) == 0 {
+		return nil, fmt.Errorf("no MergeTree tables found by %s in %s", tablePattern, backupName)
+	}
+	body, err := xml.MarshalIndent(task, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// PrintCopierConfig - print result of GenerateCopierConfig
+func (b *Backuper) PrintCopierConfig(backupName, tablePattern, destinationCluster string, partitions []string) error {
+	body, err := b.GenerateCopierConfig(backupName, tablePattern, destinationCluster, partitions)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+// getCopierSourceCluster - current server as single replica cluster, password is masked
+func getCopierSourceCluster(cfg config.ClickHouseConfig) copierCluster {
+	secure := 0
+	if cfg.Secure {
+		secure = 1
+	}
+	password := ""
+	if cfg.Password != "" {
+		password = copierPasswordMask
+	}
+	return copierCluster{
+		XMLName: xml.Name{Local: copierSourceCluster},
+		Shards: []copierShard{{
+			InternalReplication: false,
+			Replicas: []copierReplica{{
+				Host:     cfg.Host,
+				Port:     cfg.Port,
+				User:     cfg.Username,
+				Password: password,
+				Secure:   secure,
+			}},
+		}},
+	}
+}
+
+func getCopierTable(database, table, engine, destinationCluster string, enabledPartitions []string) copierTable {
+	return copierTable{
+		XMLName:           xml.Name{Local: "table_" + copierTableNameRE.ReplaceAllString(database+"_"+table, "_")},
+		ClusterPull:       copierSourceCluster,
+		DatabasePull:      database,
+		TablePull:         table,
+		ClusterPush:       destinationCluster,
+		DatabasePush:      database,
+		TablePush:         table,
+		Engine:            strings.TrimSpace(engine),
+		ShardingKey:       "rand()",
+		EnabledPartitions: enabledPartitions,
+	}
+}
+
+func (b *Backuper) getCopierCluster(ctx context.Context, cluster string) (copierCluster, error) {
+	var replicas []struct {
+		ShardNum uint32 `db:"shard_num"`
+		HostName string `db:"host_name"`
+		Port     uint16 `db:"port"`
+	}
+	if err := b.ch.SelectContext(ctx, &replicas, "SELECT shard_num, host_name, port FROM system.clusters WHERE cluster=? ORDER BY shard_num, replica_num", cluster); err != nil {
+		return copierCluster{}, err
+	}
+	if len(replicas) == 0 {
+		return copierCluster{}, fmt.Errorf("cluster '%s' not found in system.clusters", cluster)
+	}
+	result := copierCluster{XMLName: xml.Name{Local: cluster}}
+	shardIndex := map[uint32]int{}
+	for _, replica := range replicas {
+		i, exists := shardIndex[replica.ShardNum]
+		if !exists {
+			result.Shards = append(result.Shards, copierShard{InternalReplication: true})
+			i = len(result.Shards) - 1
+			shardIndex[replica.ShardNum] = i
+		}
+		result.Shards[i].Replicas = append(result.Shards[i].Replicas, copierReplica{
+			Host: replica.HostName,
+			Port: uint(replica.Port),
+		})
+	}
+	return result, nil
+}
+
+// getCopierPartitions - clickhouse-copier require partition values in system.parts `partition` format, resolve them from partition_id of backup parts on restored table
+func (b *Backuper) getCopierPartitions(ctx context.Context, database, table string, parts map[string][]metadata.Part) ([]string, error) {
+	partitionIds := common.EmptyMap{}
+	for _, diskParts := range parts {
+		for _, part := range diskParts {
+			partitionIds[strings.Split(part.Name, "_")[0]] = struct{}{}
+		}
+	}
+	if len(partitionIds) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(partitionIds))
+	for id := range partitionIds {
+		ids = append(ids, id)
+	}
+	enabledPartitions := make([]string, 0)
+	if err := b.ch.SelectContext(ctx, &enabledPartitions, "SELECT DISTINCT partition FROM system.parts WHERE active AND database=? AND table=? AND partition_id IN (?) ORDER BY partition", database, table, ids); err != nil {
+		return nil, err
+	}
+	return enabledPartitions, nil
+}
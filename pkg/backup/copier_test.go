@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCopierSourceCluster(t *testing.T) {
+	cfg := config.DefaultConfig().ClickHouse
+	cfg.Host = "source-host"
+	cfg.Port = 9440
+	cfg.Username = "backup"
+	cfg.Password = "secret"
+	cfg.Secure = true
+	cluster := getCopierSourceCluster(cfg)
+	assert.Equal(t, copierSourceCluster, cluster.XMLName.Local)
+	assert.Equal(t, []copierReplica{{Host: "source-host", Port: 9440, User: "backup", Password: copierPasswordMask, Secure: 1}}, cluster.Shards[0].Replicas)
+
+	cfg.Password = ""
+	cfg.Secure = false
+	assert.Equal(t, []copierReplica{{Host: "source-host", Port: 9440, User: "backup"}}, getCopierSourceCluster(cfg).Shards[0].Replicas)
+}
+
+func TestCopierTaskXML(t *testing.T) {
+	cfg := config.DefaultConfig().ClickHouse
+	cfg.Host = "localhost"
+	cfg.Port = 9000
+	cfg.Password = "secret"
+	task := copierTask{
+		RemoteServers: []copierCluster{getCopierSourceCluster(cfg)},
+		MaxWorkers:    1,
+		SettingsPull:  "1",
+		SettingsPush:  "0",
+		Tables:        []copierTable{getCopierTable("db-1", "t.1", " ENGINE = MergeTree ORDER BY id", "dst", []string{"202301"})},
+	}
+	body, err := xml.MarshalIndent(task, "", "  ")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "secret")
+	assert.Contains(t, string(body), "<password>******</password>")
+	assert.Contains(t, string(body), "<table_db_1_t_1>")
+	assert.Contains(t, string(body), "<engine>ENGINE = MergeTree ORDER BY id</engine>")
+	assert.Contains(t, string(body), "<enabled_partitions>\n        <partition>202301</partition>\n      </enabled_partitions>")
+}
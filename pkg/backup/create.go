@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -132,10 +133,20 @@ func (b *Backuper) CreateBackup(backupName, tablePattern string, partitions []st
 	for _, disk := range disks {
 		diskMap[disk.Name] = disk.Path
 	}
-	partitionsToBackupMap, partitions := filesystemhelper.CreatePartitionsToBackupMap(b.ch, tables, nil, partitions)
+	tableTitles := make([]metadata.TableTitle, len(tables))
+	for i, table := range tables {
+		tableTitles[i] = metadata.TableTitle{Database: table.Database, Table: table.Name}
+	}
+	if unmatchedScopes := filesystemhelper.GetUnmatchedPartitionTableScopes(partitions, tableTitles); len(unmatchedScopes) > 0 {
+		return fmt.Errorf("--partitions table scope %s doesn't match any table", strings.Join(unmatchedScopes, ", "))
+	}
+	partitionsToBackupMap, err := filesystemhelper.CreatePartitionsToBackupMap(b.ch, tables, nil, partitions)
+	if err != nil {
+		return err
+	}
 	// create
 	if b.cfg.ClickHouse.UseEmbeddedBackupRestore {
-		err = b.createBackupEmbedded(ctx, backupName, tablePattern, partitions, partitionsToBackupMap, schemaOnly, rbacOnly, configsOnly, tables, allDatabases, allFunctions, disks, diskMap, log, startBackup, version)
+		err = b.createBackupEmbedded(ctx, backupName, tablePattern, partitionsToBackupMap, schemaOnly, rbacOnly, configsOnly, tables, allDatabases, allFunctions, disks, diskMap, log, startBackup, version)
 	} else {
 		err = b.createBackupLocal(ctx, backupName, partitionsToBackupMap, tables, doBackupData, schemaOnly, rbacOnly, configsOnly, version, disks, diskMap, allDatabases, allFunctions, log, startBackup)
 	}
@@ -150,17 +161,32 @@ func (b *Backuper) CreateBackup(backupName, tablePattern string, partitions []st
 	return nil
 }
 
-func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, partitionsToBackupMap common.EmptyMap, tables []clickhouse.Table, doBackupData bool, schemaOnly bool, rbacOnly bool, configsOnly bool, version string, disks []clickhouse.Disk, diskMap map[string]string, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, log *apexLog.Entry, startBackup time.Time) error {
+func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, partitionsToBackupMap map[metadata.TableTitle]common.EmptyMap, tables []clickhouse.Table, doBackupData bool, schemaOnly bool, rbacOnly bool, configsOnly bool, version string, disks []clickhouse.Disk, diskMap map[string]string, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, log *apexLog.Entry, startBackup time.Time) error {
 	// Create backup dir on all clickhouse disks
 	for _, disk := range disks {
 		if err := filesystemhelper.Mkdir(path.Join(disk.Path, "backup"), b.ch, disks); err != nil {
 			return err
 		}
 	}
+	b.reflinkDisks = common.EmptyMap{}
+	if b.cfg.ClickHouse.UseReflink {
+		b.reflinkDisks = getReflinkDisks(disks, log)
+	}
 	defaultPath, err := b.ch.GetDefaultPath(disks)
 	if err != nil {
 		return err
 	}
+	var baseBackup string
+	var baseBackupChain []string
+	if b.cfg.General.CreateLocalIncremental && doBackupData {
+		if baseBackup, baseBackupChain, err = b.getLocalIncrementalBase(ctx, disks); err != nil {
+			return err
+		}
+		if baseBackup != "" {
+			log.Infof("unchanged parts will not be stored, they will be required from '%s'", baseBackup)
+		}
+	}
+	requiredBackup := ""
 	backupPath := path.Join(defaultPath, "backup", backupName)
 	if _, err := os.Stat(path.Join(backupPath, "metadata.json")); err == nil || !os.IsNotExist(err) {
 		return fmt.Errorf("'%s' medatata.json already exists", backupName)
@@ -188,7 +214,7 @@ func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, par
 			if doBackupData {
 				log.Debug("create data")
 				shadowBackupUUID := strings.ReplaceAll(uuid.New().String(), "-", "")
-				disksToPartsMap, realSize, err = b.AddTableToBackup(ctx, backupName, shadowBackupUUID, disks, &table, partitionsToBackupMap)
+				disksToPartsMap, realSize, err = b.AddTableToBackup(ctx, backupName, shadowBackupUUID, disks, &table, partitionsToBackupMap[metadata.TableTitle{Database: table.Database, Table: table.Name}])
 				if err != nil {
 					log.Error(err.Error())
 					if removeBackupErr := b.RemoveBackupLocal(ctx, backupName, disks); removeBackupErr != nil {
@@ -200,6 +226,18 @@ func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, par
 					}
 					return err
 				}
+				if baseBackup != "" {
+					duplicatedParts, err := b.markDuplicatedPartsLocal(ctx, backupName, baseBackup, baseBackupChain, table, disks, disksToPartsMap, realSize, log)
+					if err != nil {
+						if removeBackupErr := b.RemoveBackupLocal(ctx, backupName, disks); removeBackupErr != nil {
+							log.Error(removeBackupErr.Error())
+						}
+						return err
+					}
+					if duplicatedParts > 0 {
+						requiredBackup = baseBackup
+					}
+				}
 				// more precise data size calculation
 				for _, size := range realSize {
 					backupDataSize += uint64(size)
@@ -211,6 +249,7 @@ func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, par
 				Database:     table.Database,
 				Query:        table.CreateTableQuery,
 				TotalBytes:   table.TotalBytes,
+				TotalRows:    getPartsRows(disksToPartsMap),
 				Size:         realSize,
 				Parts:        disksToPartsMap,
 				MetadataOnly: schemaOnly,
@@ -247,14 +286,14 @@ func (b *Backuper) createBackupLocal(ctx context.Context, backupName string, par
 	}
 
 	backupMetaFile := path.Join(defaultPath, "backup", backupName, "metadata.json")
-	if err := b.createBackupMetadata(ctx, backupMetaFile, backupName, version, "regular", diskMap, disks, backupDataSize, backupMetadataSize, backupRBACSize, backupConfigSize, tableMetas, allDatabases, allFunctions, log); err != nil {
+	if err := b.createBackupMetadata(ctx, backupMetaFile, backupName, requiredBackup, version, "regular", diskMap, disks, backupDataSize, backupMetadataSize, backupRBACSize, backupConfigSize, tableMetas, allDatabases, allFunctions, log); err != nil {
 		return err
 	}
 	log.WithField("duration", utils.HumanizeDuration(time.Since(startBackup))).Info("done")
 	return nil
 }
 
-func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePattern string, partitions []string, partitionsToBackupMap common.EmptyMap, schemaOnly, rbacOnly, configsOnly bool, tables []clickhouse.Table, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, disks []clickhouse.Disk, diskMap map[string]string, log *apexLog.Entry, startBackup time.Time, backupVersion string) error {
+func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePattern string, partitionsToBackupMap map[metadata.TableTitle]common.EmptyMap, schemaOnly, rbacOnly, configsOnly bool, tables []clickhouse.Table, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, disks []clickhouse.Disk, diskMap map[string]string, log *apexLog.Entry, startBackup time.Time, backupVersion string) error {
 	if _, isBackupDiskExists := diskMap[b.cfg.ClickHouse.EmbeddedBackupDisk]; !isBackupDiskExists {
 		return fmt.Errorf("backup disk `%s` not exists in system.disks", b.cfg.ClickHouse.EmbeddedBackupDisk)
 	}
@@ -288,8 +327,13 @@ func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePa
 
 		tablesSQL += "TABLE `" + table.Database + "`.`" + table.Name + "`"
 		tableSizeSQL += "'" + table.Database + "." + table.Name + "'"
-		if len(partitions) > 0 {
-			tablesSQL += fmt.Sprintf(" PARTITIONS '%s'", strings.Join(partitions, "','"))
+		if tablePartitions := partitionsToBackupMap[tableMetas[i-1]]; len(tablePartitions) > 0 {
+			partitionIds := make([]string, 0, len(tablePartitions))
+			for partitionId := range tablePartitions {
+				partitionIds = append(partitionIds, partitionId)
+			}
+			sort.Strings(partitionIds)
+			tablesSQL += fmt.Sprintf(" PARTITIONS '%s'", strings.Join(partitionIds, "','"))
 		}
 		if i < l {
 			tablesSQL += ", "
@@ -337,7 +381,7 @@ func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePa
 			if table.Skip {
 				continue
 			}
-			disksToPartsMap, err := b.getPartsFromBackupDisk(backupPath, table, partitionsToBackupMap)
+			disksToPartsMap, err := b.getPartsFromBackupDisk(backupPath, table, partitionsToBackupMap[metadata.TableTitle{Database: table.Database, Table: table.Name}])
 			if err != nil {
 				if removeBackupErr := b.RemoveBackupLocal(ctx, backupName, disks); removeBackupErr != nil {
 					log.Error(removeBackupErr.Error())
@@ -363,7 +407,7 @@ func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePa
 		}
 	}
 	backupMetaFile := path.Join(diskMap[b.cfg.ClickHouse.EmbeddedBackupDisk], backupName, "metadata.json")
-	if err := b.createBackupMetadata(ctx, backupMetaFile, backupName, backupVersion, "embedded", diskMap, disks, backupDataSize[0], backupMetadataSize, 0, 0, tableMetas, allDatabases, allFunctions, log); err != nil {
+	if err := b.createBackupMetadata(ctx, backupMetaFile, backupName, "", backupVersion, "embedded", diskMap, disks, backupDataSize[0], backupMetadataSize, 0, 0, tableMetas, allDatabases, allFunctions, log); err != nil {
 		return err
 	}
 
@@ -377,7 +421,8 @@ func (b *Backuper) createBackupEmbedded(ctx context.Context, backupName, tablePa
 
 func (b *Backuper) getPartsFromBackupDisk(backupPath string, table clickhouse.Table, partitionsToBackupMap common.EmptyMap) (map[string][]metadata.Part, error) {
 	parts := map[string][]metadata.Part{}
-	dirList, err := os.ReadDir(path.Join(backupPath, "data", common.TablePathEncode(table.Database), common.TablePathEncode(table.Name)))
+	// embedded backup `data` directory created by ClickHouse, so names escaped by ClickHouse rules
+	dirList, err := os.ReadDir(path.Join(backupPath, "data", common.ClickHouseFileNameEncode(table.Database), common.ClickHouseFileNameEncode(table.Name)))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return parts, nil
@@ -490,7 +535,8 @@ func (b *Backuper) AddTableToBackup(ctx context.Context, backupName, shadowBacku
 				return nil, nil, err
 			}
 			// If partitionsToBackupMap is not empty, only parts in this partition will back up.
-			parts, size, err := filesystemhelper.MoveShadow(shadowPath, backupShadowPath, partitionsToBackupMap)
+			_, useReflink := b.reflinkDisks[disk.Name]
+			parts, size, err := filesystemhelper.MoveShadow(ctx, shadowPath, backupShadowPath, partitionsToBackupMap, useReflink)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -508,7 +554,7 @@ func (b *Backuper) AddTableToBackup(ctx context.Context, backupName, shadowBacku
 	return disksToPartsMap, realSize, nil
 }
 
-func (b *Backuper) createBackupMetadata(ctx context.Context, backupMetaFile, backupName, version, tags string, diskMap map[string]string, disks []clickhouse.Disk, backupDataSize, backupMetadataSize, backupRBACSize, backupConfigSize uint64, tableMetas []metadata.TableTitle, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, log *apexLog.Entry) error {
+func (b *Backuper) createBackupMetadata(ctx context.Context, backupMetaFile, backupName, requiredBackup, version, tags string, diskMap map[string]string, disks []clickhouse.Disk, backupDataSize, backupMetadataSize, backupRBACSize, backupConfigSize uint64, tableMetas []metadata.TableTitle, allDatabases []clickhouse.Database, allFunctions []clickhouse.Function, log *apexLog.Entry) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -517,6 +563,7 @@ func (b *Backuper) createBackupMetadata(ctx context.Context, backupMetaFile, bac
 			BackupName:              backupName,
 			Disks:                   diskMap,
 			ClickhouseBackupVersion: version,
+			FormatVersion:           metadata.FormatVersion,
 			CreationDate:            time.Now().UTC(),
 			Tags:                    tags,
 			ClickHouseVersion:       b.ch.GetVersionDescribe(ctx),
@@ -527,6 +574,7 @@ func (b *Backuper) createBackupMetadata(ctx context.Context, backupMetaFile, bac
 			Tables:                  tableMetas,
 			Databases:               []metadata.DatabasesMeta{},
 			Functions:               []metadata.FunctionsMeta{},
+			RequiredBackup:          requiredBackup,
 		}
 		for _, database := range allDatabases {
 			backupMetadata.Databases = append(backupMetadata.Databases, metadata.DatabasesMeta(database))
@@ -550,6 +598,136 @@ func (b *Backuper) createBackupMetadata(ctx context.Context, backupMetaFile, bac
 	}
 }
 
+// getLocalIncrementalBase - the latest local regular backup and its increments chain, empty name when no backup found
+func (b *Backuper) getLocalIncrementalBase(ctx context.Context, disks []clickhouse.Disk) (string, []string, error) {
+	backupList, _, err := b.GetLocalBackups(ctx, disks)
+	if err != nil {
+		return "", nil, err
+	}
+	var baseBackup *LocalBackup
+	for i := range backupList {
+		if backupList[i].Legacy || backupList[i].Broken != "" || strings.Contains(backupList[i].Tags, "embedded") || len(backupList[i].Tables) == 0 {
+			continue
+		}
+		if baseBackup == nil || backupList[i].CreationDate.After(baseBackup.CreationDate) {
+			baseBackup = &backupList[i]
+		}
+	}
+	if baseBackup == nil {
+		return "", nil, nil
+	}
+	baseBackupChain, err := b.getRequiredBackupsChain(ctx, baseBackup.BackupMetadata, disks)
+	if err != nil {
+		return "", nil, err
+	}
+	return baseBackup.BackupName, baseBackupChain, nil
+}
+
+// markDuplicatedPartsLocal - parts which exist in baseBackup with the same files replaced by hardlinks to baseBackup files and marked as required,
+// files copied when backups placed on different filesystems, upload skip required parts, return count of duplicated parts
+func (b *Backuper) markDuplicatedPartsLocal(ctx context.Context, backupName, baseBackup string, baseBackupChain []string, table clickhouse.Table, disks []clickhouse.Disk, disksToPartsMap map[string][]metadata.Part, realSize map[string]int64, log *apexLog.Entry) (int, error) {
+	defaultPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return 0, err
+	}
+	encodedTablePath := path.Join(common.TablePathEncode(table.Database), common.TablePathEncode(table.Name))
+	baseTableBody, err := os.ReadFile(path.Join(defaultPath, "backup", baseBackup, "metadata", encodedTablePath+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var baseTable metadata.TableMetadata
+	if err = json.Unmarshal(baseTableBody, &baseTable); err != nil {
+		return 0, err
+	}
+	duplicatedParts := 0
+	for _, disk := range disks {
+		parts := disksToPartsMap[disk.Name]
+		if len(parts) == 0 || len(baseTable.Parts[disk.Name]) == 0 {
+			continue
+		}
+		baseParts := common.EmptyMap{}
+		for _, part := range baseTable.Parts[disk.Name] {
+			baseParts[part.Name] = struct{}{}
+		}
+		for i := range parts {
+			if _, exists := baseParts[parts[i].Name]; !exists {
+				continue
+			}
+			basePartPath := filesystemhelper.GetBackupPartPath(baseBackup, baseBackupChain, baseTable, disk, parts[i].Name)
+			newPartPath := path.Join(disk.Path, "backup", backupName, "shadow", encodedTablePath, disk.Name, parts[i].Name)
+			if err = filesystemhelper.IsDuplicatedParts(basePartPath, newPartPath, b.cfg.General.ComparePartsByContent); err != nil {
+				log.Debugf("part '%s' and '%s' are different: %v", basePartPath, newPartPath, err)
+				continue
+			}
+			partSize, err := getDirSize(newPartPath)
+			if err != nil {
+				return duplicatedParts, err
+			}
+			if err = filesystemhelper.LinkDir(ctx, basePartPath, newPartPath, nil); err != nil {
+				return duplicatedParts, err
+			}
+			realSize[disk.Name] -= partSize
+			parts[i].Required = true
+			duplicatedParts++
+		}
+	}
+	if duplicatedParts > 0 {
+		log.Debugf("%d parts are unchanged since '%s'", duplicatedParts, baseBackup)
+	}
+	return duplicatedParts, nil
+}
+
+func getDirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// getReflinkDisks - disks which support ioctl(FICLONE) in backup directory, probe error shall not fail backup, such disk is processed as usual
+func getReflinkDisks(disks []clickhouse.Disk, log *apexLog.Entry) common.EmptyMap {
+	reflinkDisks := common.EmptyMap{}
+	var unsupportedDisks []string
+	for _, disk := range disks {
+		if isSupported, err := filesystemhelper.IsReflinkSupported(path.Join(disk.Path, "backup")); err != nil {
+			log.Warnf("can't check ioctl(FICLONE) support on disk %s: %v", disk.Name, err)
+			unsupportedDisks = append(unsupportedDisks, disk.Name)
+		} else if isSupported {
+			reflinkDisks[disk.Name] = struct{}{}
+		} else {
+			unsupportedDisks = append(unsupportedDisks, disk.Name)
+		}
+	}
+	if len(unsupportedDisks) > 0 {
+		log.Warnf("`use_reflink: true`, but ioctl(FICLONE) is not supported on disks %v, will move shadow files as usual", unsupportedDisks)
+	}
+	return reflinkDisks
+}
+
+// getPartsRows - sum of rows for all parts, 0 when rows count unknown for any part
+func getPartsRows(disksToPartsMap map[string][]metadata.Part) uint64 {
+	rows := uint64(0)
+	for _, parts := range disksToPartsMap {
+		for _, part := range parts {
+			if part.Rows == 0 {
+				return 0
+			}
+			rows += part.Rows
+		}
+	}
+	return rows
+}
+
 func (b *Backuper) createTableMetadata(metadataPath string, table metadata.TableMetadata, disks []clickhouse.Disk) (uint64, error) {
 	if err := filesystemhelper.Mkdir(metadataPath, b.ch, disks); err != nil {
 		return 0, err
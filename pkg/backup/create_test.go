@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkDuplicatedPartsLocal(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	writePart := func(backupName, partName, content string) string {
+		partPath := path.Join(tmpDir, "backup", backupName, "shadow", "db", "t", "default", partName)
+		assert.NoError(t, os.MkdirAll(partPath, 0750))
+		assert.NoError(t, os.WriteFile(path.Join(partPath, "checksums.txt"), []byte("checksums "+content), 0640))
+		assert.NoError(t, os.WriteFile(path.Join(partPath, "data.bin"), []byte(content), 0640))
+		return partPath
+	}
+	basePart := writePart("base", "all_1_1_0", "unchanged")
+	writePart("base", "all_2_2_0", "old")
+	baseTableBody, err := json.Marshal(metadata.TableMetadata{Database: "db", Table: "t", Parts: map[string][]metadata.Part{
+		"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+	}})
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(path.Join(tmpDir, "backup", "base", "metadata", "db"), 0750))
+	assert.NoError(t, os.WriteFile(path.Join(tmpDir, "backup", "base", "metadata", "db", "t.json"), baseTableBody, 0640))
+
+	newPart := writePart("increment", "all_1_1_0", "unchanged")
+	writePart("increment", "all_2_2_0", "new")
+	writePart("increment", "all_3_3_0", "inserted")
+	parts := map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_3_3_0"}}}
+	realSize := map[string]int64{"default": 100}
+
+	cfg := config.DefaultConfig()
+	// files of both backups are copied, so they are not hard links to the same inode
+	cfg.General.ComparePartsByContent = true
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{}}
+	duplicatedParts, err := b.markDuplicatedPartsLocal(context.Background(), "increment", "base", nil, clickhouse.Table{Database: "db", Name: "t"}, disks, parts, realSize, apexLog.WithField("test", t.Name()))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, duplicatedParts)
+	assert.Equal(t, []bool{true, false, false}, []bool{parts["default"][0].Required, parts["default"][1].Required, parts["default"][2].Required})
+	assert.Equal(t, int64(100-len("checksums unchanged")-len("unchanged")), realSize["default"])
+	for _, fileName := range []string{"checksums.txt", "data.bin"} {
+		baseInfo, err := os.Stat(path.Join(basePart, fileName))
+		assert.NoError(t, err)
+		newInfo, err := os.Stat(path.Join(newPart, fileName))
+		assert.NoError(t, err)
+		assert.True(t, os.SameFile(baseInfo, newInfo), fileName)
+	}
+	_, err = os.Stat(newPart + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetReflinkDisks(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "broken", Path: path.Join(t.TempDir(), "not_exists"), Type: "local"}}
+	assert.Equal(t, 0, len(getReflinkDisks(disks, apexLog.WithField("test", t.Name()))))
+}
@@ -9,9 +9,11 @@ import (
 	"github.com/pkg/errors"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/storage"
 
 	apexLog "github.com/apex/log"
@@ -42,6 +44,55 @@ func (b *Backuper) Clean(ctx context.Context) error {
 	return nil
 }
 
+// CleanDetached - remove empty directories inside `detached` folder for tables matched by tablePattern, when dryRun is true only print them
+func (b *Backuper) CleanDetached(tablePattern string, dryRun bool, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	log := b.log.WithField("logger", "CleanDetached")
+	if err = b.ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	defer b.ch.Close()
+	tables, err := b.ch.GetTables(ctx, tablePattern)
+	if err != nil {
+		return fmt.Errorf("can't get tables from clickhouse: %v", err)
+	}
+	removedCount := 0
+	for _, table := range filterTablesByPattern(tables, tablePattern) {
+		if table.Skip {
+			continue
+		}
+		for _, dataPath := range table.DataPaths {
+			detachedPaths, err := filepath.Glob(path.Join(dataPath, "detached", "*"))
+			if err != nil {
+				return err
+			}
+			removedPaths, err := filesystemhelper.RemoveEmptyDetachedDirs(detachedPaths, dryRun)
+			if err != nil {
+				return fmt.Errorf("can't clean detached for '%s.%s': %v", table.Database, table.Name, err)
+			}
+			for _, removedPath := range removedPaths {
+				if dryRun {
+					log.Infof("%s will be removed", removedPath)
+				} else {
+					log.Infof("%s removed", removedPath)
+				}
+			}
+			removedCount += len(removedPaths)
+		}
+	}
+	if dryRun {
+		log.Infof("%d empty directories found in 'detached', run without --dry-run to remove them", removedCount)
+	} else {
+		log.Infof("%d empty directories removed from 'detached'", removedCount)
+	}
+	return nil
+}
+
 func (b *Backuper) cleanDir(dirName string) error {
 	if items, err := os.ReadDir(dirName); err != nil {
 		return err
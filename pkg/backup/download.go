@@ -209,6 +209,11 @@ func (b *Backuper) Download(backupName string, tablePattern string, partitions [
 		for _, t := range tableMetadataAfterDownload {
 			for disk := range t.Parts {
 				if _, diskExists := b.DiskToPathMap[disk]; !diskExists && disk != b.cfg.ClickHouse.EmbeddedBackupDisk {
+					if mappedDiskPath, isMapped := b.DiskToPathMap[b.cfg.General.RestoreDiskNameMapping[disk]]; isMapped {
+						b.DiskToPathMap[disk] = mappedDiskPath
+						log.Infof("table '%s.%s' require disk '%s', data will download to %s according to `restore_disk_name_mapping`", t.Database, t.Table, disk, mappedDiskPath)
+						continue
+					}
 					b.DiskToPathMap[disk] = b.DiskToPathMap["default"]
 					log.Warnf("table '%s.%s' require disk '%s' that not found in clickhouse table system.disks, you can add nonexistent disks to `disk_mapping` in  `clickhouse` config section, data will download to %s", t.Database, t.Table, disk, b.DiskToPathMap["default"])
 				}
@@ -337,8 +342,11 @@ func (b *Backuper) downloadTableMetadata(ctx context.Context, backupName string,
 				if err = json.Unmarshal(tmBody, &tableMetadata); err != nil {
 					return nil, 0, err
 				}
-				partitionsFilter, _ := filesystemhelper.CreatePartitionsToBackupMap(b.ch, nil, []metadata.TableMetadata{tableMetadata}, partitions)
-				filterPartsAndFilesByPartitionsFilter(tableMetadata, partitionsFilter)
+				partitionsFilter, err := filesystemhelper.CreatePartitionsToBackupMap(b.ch, nil, []metadata.TableMetadata{tableMetadata}, partitions)
+				if err != nil {
+					return nil, 0, err
+				}
+				filterPartsAndFilesByPartitionsFilter(tableMetadata, partitionsFilter[metadata.TableTitle{Database: tableMetadata.Database, Table: tableMetadata.Table}])
 			}
 			if isProcessed {
 				size += uint64(processedSize)
@@ -383,8 +391,11 @@ func (b *Backuper) downloadTableMetadata(ctx context.Context, backupName string,
 			if err = json.Unmarshal(tmBody, &tableMetadata); err != nil {
 				return nil, 0, err
 			}
-			partitionsFilter, _ := filesystemhelper.CreatePartitionsToBackupMap(b.ch, nil, []metadata.TableMetadata{tableMetadata}, partitions)
-			filterPartsAndFilesByPartitionsFilter(tableMetadata, partitionsFilter)
+			partitionsFilter, err := filesystemhelper.CreatePartitionsToBackupMap(b.ch, nil, []metadata.TableMetadata{tableMetadata}, partitions)
+			if err != nil {
+				return nil, 0, err
+			}
+			filterPartsAndFilesByPartitionsFilter(tableMetadata, partitionsFilter[metadata.TableTitle{Database: tableMetadata.Database, Table: tableMetadata.Table}])
 			// save metadata
 			jsonSize := uint64(0)
 			jsonSize, err = tableMetadata.Save(localMetadataFile, schemaOnly)
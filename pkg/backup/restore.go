@@ -1,14 +1,19 @@
 package backup
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"io"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,26 +22,60 @@ import (
 	"github.com/mattn/go-shellwords"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/resumable"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/server/metrics"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 	apexLog "github.com/apex/log"
 	recursiveCopy "github.com/otiai10/copy"
 	"github.com/yargevad/filepathx"
+	"gopkg.in/yaml.v3"
 )
 
 var CreateDatabaseRE = regexp.MustCompile(`(?m)^CREATE DATABASE (\s*)(\S+)(\s*)`)
 
-// Restore - restore tables matched by tablePattern from backupName
-func (b *Backuper) Restore(backupName, tablePattern string, databaseMapping, partitions []string, schemaOnly, dataOnly, dropTable, ignoreDependencies, rbacOnly, configsOnly bool, commandId int) error {
+// RestoreOptions - what and how to restore, filled from CLI flags and API query parameters
+type RestoreOptions struct {
+	TablePattern        string
+	FunctionsPattern    string
+	DatabaseMapping     []string
+	Partitions          []string
+	Parts               []string
+	LastPartitions      int
+	SchemaOnly          bool
+	DataOnly            bool
+	DropTable           bool
+	ForceDrop           bool
+	IgnoreDependencies  bool
+	RBACOnly            bool
+	ConfigsOnly         bool
+	SkipAttach          bool
+	AttachIncrementally bool
+	FreezeAfterRestore  bool
+	ReplacePartitions   bool
+	OnlyNewPartitions   bool
+	NoRestart           bool
+	SyncParts           bool
+	SyncPartsDetach     bool
+	SchemaAsAttach      bool
+	SchemaOutput        string
+	SchemaOutputOnly    bool
+	MetricsFile         string
+}
+
+// Restore - restore tables matched by opts.TablePattern from backupName, summary saved into opts.MetricsFile in OpenMetrics format when it is not empty
+func (b *Backuper) Restore(backupName string, opts RestoreOptions, commandId int) (restoreErr error) {
 	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
 	if err != nil {
 		return err
 	}
 	ctx, cancel = context.WithCancel(ctx)
 	defer cancel()
+	startRestore := time.Now()
 	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
-	if err := b.prepareRestoreDatabaseMapping(databaseMapping); err != nil {
+	if err := b.prepareRestoreDatabaseMapping(opts.DatabaseMapping); err != nil {
 		return err
 	}
 
@@ -44,10 +83,35 @@ func (b *Backuper) Restore(backupName, tablePattern string, databaseMapping, par
 		"backup":    backupName,
 		"operation": "restore",
 	})
-	doRestoreData := !schemaOnly || dataOnly
+	if opts.MetricsFile != "" {
+		var before restoreSummary
+		if before.Tables, before.Bytes, before.Errors, err = metrics.Restore.GetCounters(backupName); err != nil {
+			return fmt.Errorf("can't get restore metrics: %v", err)
+		}
+		defer func() {
+			if err := writeRestoreMetricsFile(opts.MetricsFile, backupName, before, startRestore, restoreErr, log); err != nil {
+				if restoreErr != nil {
+					log.Error(err.Error())
+					return
+				}
+				restoreErr = err
+			}
+		}()
+	}
+	// only generate DDL script, nothing changes in ClickHouse
+	if opts.SchemaOutputOnly {
+		if opts.SchemaOutput == "" {
+			return fmt.Errorf("--schema-output-only requires --schema-output")
+		}
+		opts.SchemaOnly, opts.DataOnly, opts.DropTable, opts.ForceDrop, opts.RBACOnly, opts.ConfigsOnly = true, false, false, false, false, false
+	}
+	if opts.ForceDrop && opts.DataOnly {
+		return fmt.Errorf("--force-drop can't be used together with --data")
+	}
+	doRestoreData := !opts.SchemaOnly || opts.DataOnly
 
-	if err := b.ch.Connect(); err != nil {
-		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	if err := b.connectRestore(); err != nil {
+		return err
 	}
 	defer b.ch.Close()
 
@@ -82,47 +146,85 @@ func (b *Backuper) Restore(backupName, tablePattern string, databaseMapping, par
 			break
 		}
 	}
+	// restore lock released on return, also when restore canceled
+	var lock *restoreLock
+	lockPath := path.Join(defaultDataPath, "backup")
+	defer func() {
+		lock.Release(log)
+	}()
 	if b.cfg.General.RestoreSchemaOnCluster != "" {
 		b.cfg.General.RestoreSchemaOnCluster, err = b.ch.ApplyMacros(ctx, b.cfg.General.RestoreSchemaOnCluster)
 	}
+	// backupDatabases - used for CREATE DATABASE queries in --schema-output
+	var backupDatabases []metadata.DatabasesMeta
 	if err == nil {
 		backupMetadata := metadata.BackupMetadata{}
 		if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
 			return err
 		}
+		backupDatabases = backupMetadata.Databases
+		if err = checkBackupFormatVersion(backupMetadata); err != nil {
+			return err
+		}
+		if err = b.checkRestoreDatabaseMapping(backupMetadata, log); err != nil {
+			return err
+		}
+		if unmatchedPatterns := getUnmatchedTablePatterns(opts.TablePattern, backupMetadata.Tables); len(unmatchedPatterns) > 0 && !opts.RBACOnly && !opts.ConfigsOnly {
+			log.Warnf("%s doesn't match any table in backup", strings.Join(unmatchedPatterns, ", "))
+		}
+		if !opts.SchemaOutputOnly {
+			exclusiveLocks, sharedLocks := getRestoreLockNames(b.cfg.General.RestoreLockMode, backupMetadata.Tables, opts.TablePattern, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping, opts.RBACOnly, opts.ConfigsOnly)
+			if lock, err = b.acquireRestoreLock(ctx, lockPath, exclusiveLocks, sharedLocks, log); err != nil {
+				return err
+			}
+		}
 
-		if schemaOnly || doRestoreData {
+		if (opts.SchemaOnly || doRestoreData) && !opts.SchemaOutputOnly {
 			for _, database := range backupMetadata.Databases {
 				targetDB := database.Name
 				if !IsInformationSchema(targetDB) {
-					if err = b.restoreEmptyDatabase(ctx, targetDB, tablePattern, database, dropTable, schemaOnly); err != nil {
+					if err = b.restoreEmptyDatabase(ctx, targetDB, opts.TablePattern, database, opts.DropTable, opts.ForceDrop, opts.SchemaOnly); err != nil {
 						return err
 					}
 				}
 			}
-			for _, function := range backupMetadata.Functions {
-				if err = b.ch.CreateUserDefinedFunction(function.Name, function.CreateQuery, b.cfg.General.RestoreSchemaOnCluster); err != nil {
-					return err
-				}
+			if err = b.restoreFunctions(ctx, backupMetadata.Functions, opts.FunctionsPattern); err != nil {
+				return err
 			}
 		}
 		if len(backupMetadata.Tables) == 0 {
+			if b.cfg.General.FailOnEmptyBackup && isEmptyBackup(backupMetadata) {
+				return fmt.Errorf("'%s' doesn't contain tables, RBAC objects, configs or functions for restore and `fail_on_empty_backup: true`", backupName)
+			}
 			log.Warnf("'%s' doesn't contains tables for restore", backupName)
-			if (!rbacOnly) && (!configsOnly) {
+			if (!opts.RBACOnly) && (!opts.ConfigsOnly) {
 				return nil
 			}
 		}
 	} else if !os.IsNotExist(err) { // Legacy backups don't contain metadata.json
 		return err
 	}
+	if lock == nil && !opts.SchemaOutputOnly {
+		exclusiveLocks, sharedLocks := getRestoreLockNames(b.cfg.General.RestoreLockMode, nil, opts.TablePattern, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping, opts.RBACOnly, opts.ConfigsOnly)
+		if lock, err = b.acquireRestoreLock(ctx, lockPath, exclusiveLocks, sharedLocks, log); err != nil {
+			return err
+		}
+	}
+	// embedded backups store access entities inside ClickHouse backup format, which can't be restored via copy access files
+	if opts.RBACOnly && isEmbedded {
+		return fmt.Errorf("'%s' is embedded backup, restore RBAC objects from embedded backups is not supported now", backupName)
+	}
+	if opts.ConfigsOnly && isEmbedded {
+		return fmt.Errorf("'%s' is embedded backup, it doesn't contain 'clickhouse-server' configs", backupName)
+	}
 	needRestart := false
-	if rbacOnly && !isEmbedded {
+	if opts.RBACOnly && !isEmbedded {
 		if err := b.restoreRBAC(ctx, backupName, disks); err != nil {
 			return err
 		}
 		needRestart = true
 	}
-	if configsOnly && !isEmbedded {
+	if opts.ConfigsOnly && !isEmbedded {
 		if err := b.restoreConfigs(backupName, disks); err != nil {
 			return err
 		}
@@ -130,39 +232,122 @@ func (b *Backuper) Restore(backupName, tablePattern string, databaseMapping, par
 	}
 
 	if needRestart {
-		log.Warnf("%s contains `access` or `configs` directory, so we need exec %s", backupName, b.ch.Config.RestartCommand)
-		cmd, err := shellwords.Parse(b.ch.Config.RestartCommand)
-		if err != nil {
-			return err
-		}
-		ctx, cancel := context.WithTimeout(ctx, 180*time.Second)
-		log.Infof("run %s", b.ch.Config.RestartCommand)
-		var out []byte
-		if len(cmd) > 1 {
-			out, err = exec.CommandContext(ctx, cmd[0], cmd[1:]...).CombinedOutput()
-		} else {
-			out, err = exec.CommandContext(ctx, cmd[0]).CombinedOutput()
+		if opts.NoRestart {
+			log.Warnf("%s contains `access` or `configs` directory, --no-restart used, restart clickhouse-server manually to apply them", backupName)
+			return nil
 		}
-		cancel()
-		log.Debug(string(out))
-		return err
+		log.Warnf("%s contains `access` or `configs` directory, so we need exec %s", backupName, b.ch.Config.RestartCommand)
+		return b.restartClickHouse(ctx, log)
 	}
 
-	if schemaOnly || (schemaOnly == dataOnly) {
-		if err := b.RestoreSchema(ctx, backupName, tablePattern, dropTable, ignoreDependencies, disks, isEmbedded); err != nil {
+	if opts.SchemaOnly || (opts.SchemaOnly == opts.DataOnly) {
+		// tables re-created empty, opts.Parts attached by previous restore shall be attached again
+		if opts.DropTable || opts.ForceDrop {
+			if err := os.Remove(getRestoreAttachStateFile(defaultDataPath, backupName)); err != nil && !os.IsNotExist(err) {
+				log.Warnf("can't remove attach.state: %v", err)
+			}
+		}
+		if err := b.RestoreSchema(ctx, backupName, opts, disks, isEmbedded, backupDatabases); err != nil {
+			metrics.Restore.Errors.WithLabelValues(backupName).Inc()
 			return err
 		}
 	}
-	if dataOnly || (schemaOnly == dataOnly) {
-		if err := b.RestoreData(ctx, backupName, tablePattern, partitions, disks, isEmbedded); err != nil {
+	if opts.DataOnly || (opts.SchemaOnly == opts.DataOnly) {
+		if err := b.RestoreData(ctx, backupName, opts, disks, isEmbedded, commandId); err != nil {
 			return err
 		}
 	}
+	metrics.Restore.Duration.WithLabelValues(backupName).Set(time.Since(startRestore).Seconds())
 	log.Info("done")
 	return nil
 }
 
-func (b *Backuper) restoreEmptyDatabase(ctx context.Context, targetDB, tablePattern string, database metadata.DatabasesMeta, dropTable, schemaOnly bool) error {
+// getNotAttachedParts - exclude parts which attached during previous restore and saved in attach state, return count of excluded parts
+func getNotAttachedParts(tableParts map[string][]metadata.Part, attachState *resumable.State, attachStateKey func(disk, part string) string) (map[string][]metadata.Part, int) {
+	alreadyAttachedParts := 0
+	notAttachedParts := make(map[string][]metadata.Part, len(tableParts))
+	for disk, parts := range tableParts {
+		for _, part := range parts {
+			if attachState.IsAlreadyProcessedBool(attachStateKey(disk, part.Name)) {
+				alreadyAttachedParts++
+				continue
+			}
+			notAttachedParts[disk] = append(notAttachedParts[disk], part)
+		}
+	}
+	return notAttachedParts, alreadyAttachedParts
+}
+
+// isRowsVerificationSupported - ATTACH PART into Replicated*MergeTree table could be skipped as duplicate of part which already fetched from other replica,
+// and parts attached on other replicas are fetched during restore, so count() difference doesn't match restored rows
+func isRowsVerificationSupported(dstTable clickhouse.Table) bool {
+	return !strings.HasPrefix(dstTable.Engine, "Replicated")
+}
+
+// isEmptyBackup - backup metadata doesn't contain anything for restore
+func isEmptyBackup(backupMetadata metadata.BackupMetadata) bool {
+	return len(backupMetadata.Tables) == 0 && len(backupMetadata.Functions) == 0 && backupMetadata.RBACSize == 0 && backupMetadata.ConfigSize == 0
+}
+
+// restartClickHouse - run `restart_command` with `restart_command_env` and `restart_command_dir`, stdout and stderr logged line by line during execution
+func (b *Backuper) restartClickHouse(ctx context.Context, log *apexLog.Entry) error {
+	args, err := shellwords.Parse(b.ch.Config.RestartCommand)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("`restart_command` is empty, restart clickhouse-server manually")
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.ch.Config.RestartCommandTimeoutDuration)
+	defer cancel()
+	log.Infof("run %s", b.ch.Config.RestartCommand)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if len(b.ch.Config.RestartCommandEnv) > 0 {
+		cmd.Env = append(os.Environ(), b.ch.Config.RestartCommandEnv...)
+	}
+	cmd.Dir = b.ch.Config.RestartCommandDir
+	outReader, outWriter := io.Pipe()
+	cmd.Stdout = outWriter
+	cmd.Stderr = outWriter
+	if err = cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("restart command '%s' not found, check `restart_command` in `clickhouse` config section and PATH: %v", args[0], err)
+		}
+		return fmt.Errorf("can't start restart command '%s': %v", b.ch.Config.RestartCommand, err)
+	}
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		scanner := bufio.NewScanner(outReader)
+		for scanner.Scan() {
+			log.Info(scanner.Text())
+		}
+		// drain the rest when line is too long for scanner, otherwise command will block on write
+		_, _ = io.Copy(io.Discard, outReader)
+	}()
+	err = cmd.Wait()
+	_ = outWriter.Close()
+	<-outDone
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("restart command '%s' doesn't finish after `restart_command_timeout: %s`", b.ch.Config.RestartCommand, b.ch.Config.RestartCommandTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("restart command '%s' failed: %v", b.ch.Config.RestartCommand, err)
+	}
+	return nil
+}
+
+// getRestoreDatabaseActions - `default` database always exists on fresh server and could be re-created by admin with other engine,
+// so it is never dropped and re-created, tables restored into it with current engine
+func getRestoreDatabaseActions(targetDB string, isExists, dropTable, forceDrop, schemaOnly bool) (bool, bool) {
+	if targetDB == "default" && isExists {
+		return false, false
+	}
+	return ((schemaOnly && dropTable) || forceDrop) && targetDB != "default", true
+}
+
+// restoreEmptyDatabase - create database from backup metadata, with --force-drop database dropped before create with all tables, even tables which absent in backup
+func (b *Backuper) restoreEmptyDatabase(ctx context.Context, targetDB, tablePattern string, database metadata.DatabasesMeta, dropTable, forceDrop, schemaOnly bool) error {
 	isMapped := false
 	if targetDB, isMapped = b.cfg.General.RestoreDatabaseMapping[database.Name]; !isMapped {
 		targetDB = database.Name
@@ -171,8 +356,27 @@ func (b *Backuper) restoreEmptyDatabase(ctx context.Context, targetDB, tablePatt
 	if ShallSkipDatabase(b.cfg, targetDB, tablePattern) {
 		return nil
 	}
+	if IsSystemDatabase(targetDB) {
+		return nil
+	}
+	isExists := false
+	if targetDB == "default" {
+		engines := make([]string, 0)
+		if err := b.ch.SelectContext(ctx, &engines, "SELECT engine FROM system.databases WHERE name=?", targetDB); err != nil {
+			return err
+		}
+		isExists = len(engines) > 0
+		if isExists && forceDrop {
+			b.log.WithField("database", targetDB).Warn("`default` database is not dropped by --force-drop, only restored tables will re-created")
+		}
+	}
+	isDrop, isCreate := getRestoreDatabaseActions(targetDB, isExists, dropTable, forceDrop, schemaOnly)
+	if !isCreate {
+		b.log.WithField("database", targetDB).Debug("database already exists, keep current engine")
+		return nil
+	}
 	//https://github.com/AlexAkulov/clickhouse-backup/issues/514
-	if schemaOnly && dropTable {
+	if isDrop {
 		onCluster := ""
 		if b.cfg.General.RestoreSchemaOnCluster != "" {
 			onCluster = fmt.Sprintf(" ON CLUSTER '%s'", b.cfg.General.RestoreSchemaOnCluster)
@@ -180,15 +384,72 @@ func (b *Backuper) restoreEmptyDatabase(ctx context.Context, targetDB, tablePatt
 		if _, err := b.ch.QueryContext(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS `%s` %s SYNC", targetDB, onCluster)); err != nil {
 			return err
 		}
+		if forceDrop {
+			b.log.WithField("database", targetDB).Warn("database dropped by --force-drop")
+		}
+	}
+	if err := b.ch.CreateDatabaseFromQuery(ctx, changeDatabaseQueryToAdjustDatabaseMapping(database.Query, database.Name, targetDB), b.cfg.General.RestoreSchemaOnCluster); err != nil {
+		return err
+	}
+	return nil
+}
 
+// restoreFunctions - create user defined functions matched by functionsPattern, functions which already exist will replace or skip depends on `restore_functions_mode`
+// functions which already exist with the same query skipped, so running restore with `restore_schema_on_cluster` on each replica doesn't conflict
+func (b *Backuper) restoreFunctions(ctx context.Context, functions []metadata.FunctionsMeta, functionsPattern string) error {
+	log := b.log.WithField("logger", "restoreFunctions")
+	if len(functions) == 0 {
+		return nil
 	}
-	substitution := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS ${1}`%s`${3}", targetDB)
-	if err := b.ch.CreateDatabaseFromQuery(ctx, CreateDatabaseRE.ReplaceAllString(database.Query, substitution), b.cfg.General.RestoreSchemaOnCluster); err != nil {
+	chFunctions, err := b.ch.GetUserDefinedFunctions(ctx)
+	if err != nil {
 		return err
 	}
+	existsFunctions := make(map[string]string, len(chFunctions))
+	for _, f := range chFunctions {
+		existsFunctions[f.Name] = normalizeFunctionQuery(f.CreateQuery)
+	}
+	for _, function := range getFunctionsForRestore(functions, functionsPattern, existsFunctions, b.cfg.General.RestoreFunctionsMode, log) {
+		if err := b.ch.CreateUserDefinedFunction(ctx, function.Name, function.CreateQuery, b.cfg.General.RestoreSchemaOnCluster); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// getFunctionsForRestore - functions matched by functionsPattern in dependency order, existsFunctions contains normalized queries of functions which already exist in ClickHouse
+func getFunctionsForRestore(functions []metadata.FunctionsMeta, functionsPattern string, existsFunctions map[string]string, functionsMode string, log *apexLog.Entry) []metadata.FunctionsMeta {
+	functionsPatterns := []string{"*"}
+	if functionsPattern != "" {
+		functionsPatterns = strings.Split(functionsPattern, ",")
+	}
+	var functionsForRestore []metadata.FunctionsMeta
+	for _, function := range sortFunctionsByDependencies(functions) {
+		isMatched := false
+		for _, pattern := range functionsPatterns {
+			if isMatched, _ = filepath.Match(strings.Trim(pattern, " \t\r\n"), function.Name); isMatched {
+				break
+			}
+		}
+		if !isMatched {
+			log.Debugf("function `%s` doesn't match with %s, skipped", function.Name, functionsPattern)
+			continue
+		}
+		if existsQuery, exists := existsFunctions[function.Name]; exists {
+			if existsQuery == normalizeFunctionQuery(function.CreateQuery) {
+				log.Infof("function `%s` already exists with the same query, skipped", function.Name)
+				continue
+			}
+			if functionsMode == "skip" {
+				log.Infof("function `%s` already exists, skipped", function.Name)
+				continue
+			}
+		}
+		functionsForRestore = append(functionsForRestore, function)
+	}
+	return functionsForRestore
+}
+
 func (b *Backuper) prepareRestoreDatabaseMapping(databaseMapping []string) error {
 	for i := 0; i < len(databaseMapping); i++ {
 		splitByCommas := strings.Split(databaseMapping[i], ",")
@@ -200,199 +461,845 @@ func (b *Backuper) prepareRestoreDatabaseMapping(databaseMapping []string) error
 			b.cfg.General.RestoreDatabaseMapping[splitByColon[0]] = splitByColon[1]
 		}
 	}
+	if b.cfg.General.RestoreDatabaseMappingAllowSystem {
+		return nil
+	}
+	for sourceDb, targetDb := range b.cfg.General.RestoreDatabaseMapping {
+		if IsSystemDatabase(sourceDb) || IsSystemDatabase(targetDb) {
+			apexLog.Warnf("restore-database-mapping %s:%s excluded, system databases can't be mapped, use `restore_database_mapping_allow_system: true` to override", sourceDb, targetDb)
+			delete(b.cfg.General.RestoreDatabaseMapping, sourceDb)
+		}
+	}
 	return nil
 }
 
-// restoreRBAC - copy backup_name>/rbac folder to access_data_path
-func (b *Backuper) restoreRBAC(ctx context.Context, backupName string, disks []clickhouse.Disk) error {
-	log := b.log.WithField("logger", "restoreRBAC")
-	accessPath, err := b.ch.GetAccessManagementPath(ctx, nil)
-	if err != nil {
-		return err
+// checkRestoreDatabaseMapping - rules for databases which absent in backup do nothing, but add target database to table pattern for restore data
+// such rules excluded with warning, or return error when `restore_database_mapping_strict: true`
+func (b *Backuper) checkRestoreDatabaseMapping(backupMetadata metadata.BackupMetadata, log *apexLog.Entry) error {
+	unmatchedDatabases := getUnmatchedDatabaseMappingRules(b.cfg.General.RestoreDatabaseMapping, backupMetadata)
+	if len(unmatchedDatabases) == 0 {
+		return nil
 	}
-	if err = b.restoreBackupRelatedDir(backupName, "access", accessPath, disks); err == nil {
-		markFile := path.Join(accessPath, "need_rebuild_lists.mark")
-		log.Infof("create %s for properly rebuild RBAC after restart clickhouse-server", markFile)
-		file, err := os.Create(markFile)
-		if err != nil {
-			return err
-		}
-		_ = file.Close()
-		_ = filesystemhelper.Chown(markFile, b.ch, disks, false)
-		listFilesPattern := path.Join(accessPath, "*.list")
-		log.Infof("remove %s for properly rebuild RBAC after restart clickhouse-server", listFilesPattern)
-		if listFiles, err := filepathx.Glob(listFilesPattern); err != nil {
-			return err
-		} else {
-			for _, f := range listFiles {
-				if err := os.Remove(f); err != nil {
-					return err
-				}
-			}
-		}
+	if b.cfg.General.RestoreDatabaseMappingStrict {
+		return fmt.Errorf("restore-database-mapping contains rules for databases %s which not found in backup '%s'", strings.Join(unmatchedDatabases, ", "), backupMetadata.BackupName)
 	}
-	if !os.IsNotExist(err) {
-		return err
+	for _, sourceDb := range unmatchedDatabases {
+		log.Warnf("restore-database-mapping %s:%s excluded, database '%s' not found in backup, use `restore_database_mapping_strict: true` to fail restore", sourceDb, b.cfg.General.RestoreDatabaseMapping[sourceDb], sourceDb)
+		delete(b.cfg.General.RestoreDatabaseMapping, sourceDb)
 	}
 	return nil
 }
 
-// restoreConfigs - copy backup_name/configs folder to /etc/clickhouse-server/
-func (b *Backuper) restoreConfigs(backupName string, disks []clickhouse.Disk) error {
-	if err := b.restoreBackupRelatedDir(backupName, "configs", b.ch.Config.ConfigDir, disks); err != nil && os.IsNotExist(err) {
-		return nil
-	} else {
-		return err
+// getUnmatchedDatabaseMappingRules - sorted source databases from mapping rules which absent in backup databases and tables
+func getUnmatchedDatabaseMappingRules(databaseMapping map[string]string, backupMetadata metadata.BackupMetadata) []string {
+	backupDatabases := common.EmptyMap{}
+	for _, database := range backupMetadata.Databases {
+		backupDatabases[database.Name] = struct{}{}
+	}
+	for _, table := range backupMetadata.Tables {
+		backupDatabases[table.Database] = struct{}{}
+	}
+	var unmatchedDatabases []string
+	for sourceDb := range databaseMapping {
+		if _, exists := backupDatabases[sourceDb]; !exists {
+			unmatchedDatabases = append(unmatchedDatabases, sourceDb)
+		}
 	}
+	sort.Strings(unmatchedDatabases)
+	return unmatchedDatabases
 }
 
-func (b *Backuper) restoreBackupRelatedDir(backupName, backupPrefixDir, destinationDir string, disks []clickhouse.Disk) error {
-	log := b.log.WithField("logger", "restoreBackupRelatedDir")
-	defaultDataPath, err := b.ch.GetDefaultPath(disks)
-	if err != nil {
-		return ErrUnknownClickhouseDataPath
-	}
-	srcBackupDir := path.Join(defaultDataPath, "backup", backupName, backupPrefixDir)
-	info, err := os.Stat(srcBackupDir)
+// LoadRestoreDatabaseMappingFile - read YAML or JSON object with `srcDatabase: destinationDatabase` pairs and return them in `--restore-database-mapping` format
+func LoadRestoreDatabaseMappingFile(mappingFile string) ([]string, error) {
+	body, err := os.ReadFile(mappingFile)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("can't read restore mapping file: %v", err)
 	}
+	return parseRestoreDatabaseMapping(mappingFile, body)
+}
 
-	if !info.IsDir() {
-		return fmt.Errorf("%s is not a dir", srcBackupDir)
+var yamlErrorLineRE = regexp.MustCompile(`line (\d+)`)
+
+func parseRestoreDatabaseMapping(mappingFile string, body []byte) ([]string, error) {
+	var doc yaml.Node
+	// file values are not quoted in errors, API server returns them to caller
+	if err := yaml.Unmarshal(body, &doc); err != nil {
+		if matches := yamlErrorLineRE.FindStringSubmatch(err.Error()); len(matches) == 2 {
+			return nil, fmt.Errorf("%s line %s: invalid YAML or JSON format", mappingFile, matches[1])
+		}
+		return nil, fmt.Errorf("%s has invalid YAML or JSON format", mappingFile)
 	}
-	log.Debugf("copy %s -> %s", srcBackupDir, destinationDir)
-	copyOptions := recursiveCopy.Options{OnDirExists: func(src, dest string) recursiveCopy.DirExistsAction {
-		return recursiveCopy.Merge
-	}}
-	if err := recursiveCopy.Copy(srcBackupDir, destinationDir, copyOptions); err != nil {
-		return err
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s is empty", mappingFile)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s line %d: shall contain srcDatabase: destinationDatabase object", mappingFile, root.Line)
+	}
+	mapping := make([]string, 0, len(root.Content)/2)
+	sourceDatabases := map[string]int{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		src, dst := root.Content[i], root.Content[i+1]
+		if src.Kind != yaml.ScalarNode || dst.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s line %d: srcDatabase and destinationDatabase shall be strings", mappingFile, src.Line)
+		}
+		for _, database := range []string{src.Value, dst.Value} {
+			if database == "" || strings.ContainsAny(database, ":,") {
+				return nil, fmt.Errorf("%s line %d: invalid database name, shall be not empty and doesn't contain ':' or ','", mappingFile, src.Line)
+			}
+		}
+		if line, exists := sourceDatabases[src.Value]; exists {
+			return nil, fmt.Errorf("%s line %d: duplicated srcDatabase, already defined at line %d", mappingFile, src.Line, line)
+		}
+		sourceDatabases[src.Value] = src.Line
+		mapping = append(mapping, src.Value+":"+dst.Value)
 	}
+	return mapping, nil
+}
 
-	files, err := filepathx.Glob(path.Join(destinationDir, "**"))
+// LoadRestoreTablesFile - read `db.table` exact names or patterns, one per line, `#` starts comment, return them in `--tables` format
+func LoadRestoreTablesFile(tablesFile string) (string, error) {
+	body, err := os.ReadFile(tablesFile)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("can't read tables file: %v", err)
 	}
-	files = append(files, destinationDir)
-	for _, localFile := range files {
-		if err := filesystemhelper.Chown(localFile, b.ch, disks, false); err != nil {
-			return err
+	patterns, err := parseRestoreTablesFile(tablesFile, string(body))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(patterns, ","), nil
+}
+
+func parseRestoreTablesFile(tablesFile, body string) ([]string, error) {
+	var patterns []string
+	for i, line := range strings.Split(body, "\n") {
+		if commentStart := strings.Index(line, "#"); commentStart != -1 {
+			line = line[:commentStart]
 		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.ContainsAny(line, ", \t") {
+			return nil, fmt.Errorf("%s line %d shall contain one table name or pattern without spaces and commas", tablesFile, i+1)
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s line %d contains invalid pattern: %v", tablesFile, i+1, err)
+		}
+		patterns = append(patterns, line)
 	}
-	return nil
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("%s doesn't contain any table name", tablesFile)
+	}
+	return patterns, nil
 }
 
-// RestoreSchema - restore schemas matched by tablePattern from backupName
-func (b *Backuper) RestoreSchema(ctx context.Context, backupName, tablePattern string, dropTable, ignoreDependencies bool, disks []clickhouse.Disk, isEmbedded bool) error {
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "restore",
-	})
+// getUnmatchedTablePatterns - table patterns which don't match any table in backup, usually mistyped lines of --tables-file
+func getUnmatchedTablePatterns(tablePattern string, backupTables []metadata.TableTitle) []string {
+	if tablePattern == "" {
+		return nil
+	}
+	var unmatchedPatterns []string
+	for _, pattern := range strings.Split(tablePattern, ",") {
+		pattern = strings.Trim(pattern, " \t\r\n")
+		isMatched := false
+		for _, t := range backupTables {
+			if isMatched, _ = filepath.Match(pattern, t.Database+"."+t.Table); isMatched {
+				break
+			}
+		}
+		if !isMatched {
+			unmatchedPatterns = append(unmatchedPatterns, pattern)
+		}
+	}
+	return unmatchedPatterns
+}
 
+// restoreRBAC - copy backup_name>/rbac folder to access_data_path
+func (b *Backuper) restoreRBAC(ctx context.Context, backupName string, disks []clickhouse.Disk) error {
+	log := b.log.WithField("logger", "restoreRBAC")
+	accessPath, err := b.ch.GetAccessManagementPath(ctx, nil)
+	if err != nil {
+		return err
+	}
 	defaultDataPath, err := b.ch.GetDefaultPath(disks)
 	if err != nil {
 		return ErrUnknownClickhouseDataPath
 	}
-	version, err := b.ch.GetVersion(ctx)
+	srcAccessPath := path.Join(defaultDataPath, "backup", backupName, "access")
+	if _, err = os.Stat(srcAccessPath); os.IsNotExist(err) {
+		return nil
+	}
+	entityFiles, err := getRBACEntityFiles(srcAccessPath)
 	if err != nil {
 		return err
 	}
-	metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
-	if isEmbedded {
-		defaultDataPath, err = b.ch.GetEmbeddedBackupPath(disks)
-		if err != nil {
-			return err
-		}
-		metadataPath = path.Join(defaultDataPath, backupName, "metadata")
-	}
-	info, err := os.Stat(metadataPath)
+	existingIDs, err := getRBACEntityIDs(accessPath)
 	if err != nil {
 		return err
 	}
-	if !info.IsDir() {
-		return fmt.Errorf("%s is not a dir", metadataPath)
+	orderedFiles := sortRBACEntityFiles(entityFiles)
+	for _, dangling := range getDanglingRBACReferences(orderedFiles, existingIDs) {
+		log.Warn(dangling)
 	}
-	if tablePattern == "" {
-		tablePattern = "*"
+	log.Infof("RBAC restore order: %s", getRBACOrderDescription(orderedFiles))
+	if err = filesystemhelper.MkdirAll(accessPath, b.ch, disks); err != nil {
+		return err
 	}
-	tablesForRestore, err := getTableListByPatternLocal(b.cfg, b.ch, metadataPath, tablePattern, dropTable, nil)
+	copyFiles, err := getRBACCopyFiles(srcAccessPath, orderedFiles)
 	if err != nil {
 		return err
 	}
-	// if restore-database-mapping specified, create database in mapping rules instead of in backup files.
-	if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
-		err = changeTableQueryToAdjustDatabaseMapping(&tablesForRestore, b.cfg.General.RestoreDatabaseMapping)
-		if err != nil {
+	for _, f := range copyFiles {
+		if err = b.copyRBACFile(path.Join(srcAccessPath, f), path.Join(accessPath, f), disks); err != nil {
 			return err
 		}
 	}
-	if len(tablesForRestore) == 0 {
-		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
-	}
-	if dropErr := b.dropExistsTables(tablesForRestore, ignoreDependencies, version, log); dropErr != nil {
-		return dropErr
+	return b.rebuildRBACLists(accessPath, disks, log)
+}
+
+// getRBACEntityIDs - UUIDs of entities from access/*.sql files
+func getRBACEntityIDs(dir string) (map[string]struct{}, error) {
+	entityFiles, err := getRBACEntityFiles(dir)
+	if err != nil {
+		return nil, err
 	}
-	var restoreErr error
-	if isEmbedded {
-		restoreErr = b.restoreSchemaEmbedded(backupName, tablesForRestore)
-	} else {
-		restoreErr = b.restoreSchemaRegular(tablesForRestore, version, log)
+	ids := make(map[string]struct{}, len(entityFiles))
+	for _, entityFile := range entityFiles {
+		ids[entityFile.ID] = struct{}{}
 	}
-	if restoreErr != nil {
-		return restoreErr
+	return ids, nil
+}
+
+func (b *Backuper) copyRBACFile(srcFile, dstFile string, disks []clickhouse.Disk) error {
+	if err := recursiveCopy.Copy(srcFile, dstFile); err != nil {
+		return err
 	}
-	return nil
+	return filesystemhelper.Chown(dstFile, b.ch, disks, false)
 }
 
-var UUIDWithReplicatedMergeTreeRE = regexp.MustCompile(`^(.+)(UUID)(\s+)'([^']+)'(.+)({uuid})(.*)`)
+var rbacEntityRE = regexp.MustCompile("(?m)^ATTACH\\s+(USER|ROLE|ROW POLICY|QUOTA|SETTINGS PROFILE)\\s+(`[^`]+`|\"[^\"]+\"|[^\\s;]+)(?:\\s+ON\\s+((?:`[^`]+`|[^\\s.;]+)\\.(?:`[^`]+`|[^\\s;]+)))?")
+
+// rbacEntityTypes - entity types which could be defined in access/*.sql files, allowed values for entityTypes in RestoreRBACOnly
+var rbacEntityTypes = []string{"USER", "ROLE", "ROW POLICY", "QUOTA", "SETTINGS PROFILE"}
 
-func (b *Backuper) restoreSchemaEmbedded(backupName string, tablesForRestore ListOfTables) error {
-	return b.restoreEmbedded(backupName, true, tablesForRestore, nil)
+type rbacEntity struct {
+	Type string
+	Name string
+	// Table - `db.table` for ROW POLICY, policies with the same name on different tables are different entities
+	Table string
 }
 
-func (b *Backuper) restoreSchemaRegular(tablesForRestore ListOfTables, version int, log *apexLog.Entry) error {
-	totalRetries := len(tablesForRestore)
-	restoreRetries := 0
-	isDatabaseCreated := common.EmptyMap{}
-	var restoreErr error
-	for restoreRetries < totalRetries {
-		var notRestoredTables ListOfTables
-		for _, schema := range tablesForRestore {
-			// if metadata.json doesn't contain "databases", we will re-create tables with default engine
-			if _, isCreated := isDatabaseCreated[schema.Database]; !isCreated {
-				if err := b.ch.CreateDatabase(schema.Database, b.cfg.General.RestoreSchemaOnCluster); err != nil {
-					return fmt.Errorf("can't create database '%s': %v", schema.Database, err)
-				} else {
-					isDatabaseCreated[schema.Database] = struct{}{}
-				}
-			}
-			//materialized and window views should restore via ATTACH
-			schema.Query = strings.Replace(
-				schema.Query, "CREATE MATERIALIZED VIEW", "ATTACH MATERIALIZED VIEW", 1,
-			)
-			schema.Query = strings.Replace(
-				schema.Query, "CREATE WINDOW VIEW", "ATTACH WINDOW VIEW", 1,
-			)
-			schema.Query = strings.Replace(
-				schema.Query, "CREATE LIVE VIEW", "ATTACH LIVE VIEW", 1,
-			)
-			// https://github.com/AlexAkulov/clickhouse-backup/issues/466
-			if b.cfg.General.RestoreSchemaOnCluster == "" && strings.Contains(schema.Query, "{uuid}") && strings.Contains(schema.Query, "Replicated") {
-				if !strings.Contains(schema.Query, "UUID") {
-					log.Warnf("table query doesn't contains UUID, can't guarantee properly restore for ReplicatedMergeTree")
-				} else {
-					schema.Query = UUIDWithReplicatedMergeTreeRE.ReplaceAllString(schema.Query, "$1$2$3'$4'$5$4$7")
-				}
+// parseRBACEntity - get entity type and name from first ATTACH statement of access/<uuid>.sql file
+func parseRBACEntity(body string) (rbacEntity, bool) {
+	matches := rbacEntityRE.FindStringSubmatch(body)
+	if len(matches) == 0 {
+		return rbacEntity{}, false
+	}
+	return rbacEntity{Type: matches[1], Name: strings.Trim(matches[2], "`\""), Table: strings.ReplaceAll(matches[3], "`", "")}, true
+}
+
+// normalizeRBACEntityType - allow lower case and `_` instead of space, like `row_policy`
+func normalizeRBACEntityType(entityType string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(entityType), "_", " "))
+}
+
+// isRBACEntityMatched - entityTypes and namePatterns are optional, namePatterns allow ? and * as wildcard
+func isRBACEntityMatched(entity rbacEntity, entityTypes, namePatterns []string) bool {
+	if len(entityTypes) > 0 {
+		isTypeMatched := false
+		for _, entityType := range entityTypes {
+			if normalizeRBACEntityType(entityType) == entity.Type {
+				isTypeMatched = true
+				break
+			}
+		}
+		if !isTypeMatched {
+			return false
+		}
+	}
+	if len(namePatterns) == 0 {
+		return true
+	}
+	for _, pattern := range namePatterns {
+		if matched, _ := filepath.Match(strings.TrimSpace(pattern), entity.Name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// getRBACEntities - read access/*.sql entity files from dir, return file names per entity
+func getRBACEntities(dir string) (map[rbacEntity][]string, error) {
+	entities := map[rbacEntity][]string{}
+	files, err := filepath.Glob(path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		body, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if entity, ok := parseRBACEntity(string(body)); ok {
+			entities[entity] = append(entities[entity], filepath.Base(f))
+		}
+	}
+	return entities, nil
+}
+
+// RestoreRBACOnly - restore only RBAC entities from backupName/access matched by entityTypes and namePatterns, other access entities in ClickHouse stay untouched
+func (b *Backuper) RestoreRBACOnly(backupName, entityTypesFilter, namePatternsFilter string, noRestart bool, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore_rbac",
+	})
+	var entityTypes, namePatterns []string
+	if entityTypesFilter != "" {
+		entityTypes = strings.Split(entityTypesFilter, ",")
+	}
+	if namePatternsFilter != "" {
+		namePatterns = strings.Split(namePatternsFilter, ",")
+	}
+	for _, entityType := range entityTypes {
+		if !isRBACEntityMatched(rbacEntity{Type: normalizeRBACEntityType(entityType)}, rbacEntityTypes, nil) {
+			return fmt.Errorf("unknown RBAC entity type '%s', allowed types: %s", entityType, strings.Join(rbacEntityTypes, ", "))
+		}
+	}
+	if err = b.connectRestore(); err != nil {
+		return err
+	}
+	defer b.ch.Close()
+	disks, err := b.ch.GetDisks(ctx)
+	if err != nil {
+		return err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	// access files shared for all databases, so RBAC restore excludes other RBAC and global restores
+	exclusiveLocks, sharedLocks := getRestoreLockNames(b.cfg.General.RestoreLockMode, nil, "", nil, nil, true, false)
+	lock, err := b.acquireRestoreLock(ctx, path.Join(defaultDataPath, "backup"), exclusiveLocks, sharedLocks, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(log)
+	accessPath, err := b.ch.GetAccessManagementPath(ctx, nil)
+	if err != nil {
+		return err
+	}
+	srcAccessPath := path.Join(defaultDataPath, "backup", backupName, "access")
+	backupEntityFiles, err := getRBACEntityFiles(srcAccessPath)
+	if err != nil {
+		return err
+	}
+	if len(backupEntityFiles) == 0 {
+		return fmt.Errorf("'%s' doesn't contain RBAC objects in %s", backupName, srcAccessPath)
+	}
+	existsEntities, err := getRBACEntities(accessPath)
+	if err != nil {
+		return err
+	}
+	matchedFiles := make([]rbacEntityFile, 0, len(backupEntityFiles))
+	for _, entityFile := range backupEntityFiles {
+		if isRBACEntityMatched(entityFile.rbacEntity, entityTypes, namePatterns) {
+			matchedFiles = append(matchedFiles, entityFile)
+		}
+	}
+	if len(matchedFiles) == 0 {
+		return fmt.Errorf("no RBAC objects matched with types=%v names=%v in '%s'", entityTypes, namePatterns, backupName)
+	}
+	orderedFiles := sortRBACEntityFiles(matchedFiles)
+	existingIDs, err := getRBACEntityIDs(accessPath)
+	if err != nil {
+		return err
+	}
+	for _, dangling := range getDanglingRBACReferences(orderedFiles, existingIDs) {
+		log.Warn(dangling)
+	}
+	log.Infof("RBAC restore order: %s", getRBACOrderDescription(orderedFiles))
+	restoredEntities := map[rbacEntity]struct{}{}
+	for _, entityFile := range orderedFiles {
+		// the same entity could be re-created after backup with other UUID, keep only backup definition to avoid name conflicts after rebuild lists
+		if _, isRestored := restoredEntities[entityFile.rbacEntity]; !isRestored {
+			for _, existsFile := range existsEntities[entityFile.rbacEntity] {
+				if err = os.Remove(path.Join(accessPath, existsFile)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			restoredEntities[entityFile.rbacEntity] = struct{}{}
+		}
+		dstFile := path.Join(accessPath, entityFile.File)
+		log.Infof("restore %s %s -> %s", entityFile.Type, entityFile.Name, dstFile)
+		if err = b.copyRBACFile(path.Join(srcAccessPath, entityFile.File), dstFile, disks); err != nil {
+			return err
+		}
+	}
+	restored := len(restoredEntities)
+	if err = b.rebuildRBACLists(accessPath, disks, log); err != nil {
+		return err
+	}
+	if noRestart {
+		log.Warnf("%d RBAC objects restored, --no-restart used, restart clickhouse-server manually to apply them", restored)
+		return nil
+	}
+	log.Infof("%d RBAC objects restored, need exec %s", restored, b.ch.Config.RestartCommand)
+	return b.restartClickHouse(ctx, log)
+}
+
+// rebuildRBACLists - create need_rebuild_lists.mark and remove *.list files, ClickHouse rebuild lists from *.sql files after restart
+func (b *Backuper) rebuildRBACLists(accessPath string, disks []clickhouse.Disk, log *apexLog.Entry) error {
+	markFile := path.Join(accessPath, "need_rebuild_lists.mark")
+	log.Infof("create %s for properly rebuild RBAC after restart clickhouse-server", markFile)
+	file, err := os.Create(markFile)
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	_ = filesystemhelper.Chown(markFile, b.ch, disks, false)
+	listFilesPattern := path.Join(accessPath, "*.list")
+	log.Infof("remove %s for properly rebuild RBAC after restart clickhouse-server", listFilesPattern)
+	listFiles, err := filepathx.Glob(listFilesPattern)
+	if err != nil {
+		return err
+	}
+	for _, f := range listFiles {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreConfigs - copy backup_name/configs folder to /etc/clickhouse-server/
+func (b *Backuper) restoreConfigs(backupName string, disks []clickhouse.Disk) error {
+	if err := b.restoreBackupRelatedDir(backupName, "configs", b.ch.Config.ConfigDir, disks); err != nil && os.IsNotExist(err) {
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (b *Backuper) restoreBackupRelatedDir(backupName, backupPrefixDir, destinationDir string, disks []clickhouse.Disk) error {
+	log := b.log.WithField("logger", "restoreBackupRelatedDir")
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	srcBackupDir := path.Join(defaultDataPath, "backup", backupName, backupPrefixDir)
+	info, err := os.Stat(srcBackupDir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a dir", srcBackupDir)
+	}
+	log.Debugf("copy %s -> %s", srcBackupDir, destinationDir)
+	copyOptions := recursiveCopy.Options{OnDirExists: func(src, dest string) recursiveCopy.DirExistsAction {
+		return recursiveCopy.Merge
+	}}
+	if err := recursiveCopy.Copy(srcBackupDir, destinationDir, copyOptions); err != nil {
+		return err
+	}
+
+	files, err := filepathx.Glob(path.Join(destinationDir, "**"))
+	if err != nil {
+		return err
+	}
+	files = append(files, destinationDir)
+	for _, localFile := range files {
+		if err := filesystemhelper.Chown(localFile, b.ch, disks, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreSchema - restore schemas matched by opts.TablePattern from backupName
+// opts.SchemaOutput - path to save executed DDL queries, when opts.SchemaOutputOnly is true queries are only saved without execution, databases from backup metadata define CREATE DATABASE queries in opts.SchemaOutput
+func (b *Backuper) RestoreSchema(ctx context.Context, backupName string, opts RestoreOptions, disks []clickhouse.Disk, isEmbedded bool, databases []metadata.DatabasesMeta) error {
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore",
+	})
+
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	version, err := b.ch.GetVersion(ctx)
+	if err != nil {
+		return err
+	}
+	metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
+	if isEmbedded {
+		defaultDataPath, err = b.ch.GetEmbeddedBackupPath(disks)
+		if err != nil {
+			return err
+		}
+		metadataPath = path.Join(defaultDataPath, backupName, "metadata")
+	}
+	info, err := os.Stat(metadataPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a dir", metadataPath)
+	}
+	tablePattern := opts.TablePattern
+	if tablePattern == "" {
+		tablePattern = "*"
+	}
+	tablesForRestore, err := getTableListByPatternLocal(b.cfg, b.ch, metadataPath, tablePattern, opts.DropTable, nil)
+	if err != nil {
+		return err
+	}
+	if len(b.cfg.General.RestoreColumnExclude) > 0 {
+		if isEmbedded {
+			return fmt.Errorf("`restore_column_exclude` is not compatible with `use_embedded_backup_restore: true`")
+		}
+		if err = changeTableQueryToExcludeColumns(tablesForRestore, b.cfg, log); err != nil {
+			return err
+		}
+	}
+	if len(b.cfg.General.RestoreTableMapping) > 0 {
+		if isEmbedded {
+			return fmt.Errorf("`restore_table_mapping` is not compatible with `use_embedded_backup_restore: true`")
+		}
+		if err = changeTableQueryToAdjustTableMapping(&tablesForRestore, b.cfg.General.RestoreTableMapping); err != nil {
+			return err
+		}
+	}
+	// if restore-database-mapping specified, create database in mapping rules instead of in backup files.
+	if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
+		err = changeTableQueryToAdjustDatabaseMapping(&tablesForRestore, b.cfg.General.RestoreDatabaseMapping)
+		if err != nil {
+			return err
+		}
+	}
+	if len(b.cfg.General.DictionarySourceMapping) > 0 && !isEmbedded {
+		changeDictionaryQueryToAdjustSourceMapping(tablesForRestore, b.cfg.General.DictionarySourceMapping)
+	}
+	if len(tablesForRestore) == 0 {
+		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
+	}
+	if isEmbedded && opts.SchemaOutput != "" {
+		return fmt.Errorf("--schema-output is not supported for embedded backups")
+	}
+	databaseQueries := b.getSchemaOutputDatabaseQueries(databases)
+	if opts.SchemaOutputOnly {
+		schemaQueries, err := b.restoreSchemaRegular(tablesForRestore, version, opts.SchemaAsAttach, true, databaseQueries, log)
+		if err != nil {
+			return err
+		}
+		return writeSchemaOutput(opts.SchemaOutput, schemaQueries, log)
+	}
+	if dropErr := b.dropExistsTables(tablesForRestore, opts.IgnoreDependencies, version, log); dropErr != nil {
+		return dropErr
+	}
+	var restoreErr error
+	var schemaQueries []string
+	if isEmbedded {
+		restoreErr = b.restoreSchemaEmbedded(ctx, backupName, tablesForRestore)
+	} else {
+		schemaQueries, restoreErr = b.restoreSchemaRegular(tablesForRestore, version, opts.SchemaAsAttach, false, databaseQueries, log)
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+	if opts.SchemaOutput != "" {
+		return writeSchemaOutput(opts.SchemaOutput, schemaQueries, log)
+	}
+	return nil
+}
+
+// getSchemaOutputDatabaseQueries - CREATE DATABASE queries from backup metadata with applied `restore_database_mapping`, key is target database name
+func (b *Backuper) getSchemaOutputDatabaseQueries(databases []metadata.DatabasesMeta) map[string]string {
+	databaseQueries := make(map[string]string, len(databases))
+	for _, database := range databases {
+		targetDB, isMapped := b.cfg.General.RestoreDatabaseMapping[database.Name]
+		if !isMapped {
+			targetDB = database.Name
+		}
+		if database.Query == "" || IsSystemDatabase(targetDB) || IsInformationSchema(targetDB) {
+			continue
+		}
+		databaseQueries[targetDB] = changeDatabaseQueryToAdjustDatabaseMapping(database.Query, database.Name, targetDB)
+	}
+	return databaseQueries
+}
+
+// getSchemaOutputDatabaseQuery - database created with default engine when metadata.json doesn't contain "databases"
+func getSchemaOutputDatabaseQuery(database string, databaseQueries map[string]string) string {
+	if query, exists := databaseQueries[database]; exists {
+		return query
+	}
+	return fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", database)
+}
+
+// writeSchemaOutput - save DDL queries in execution order as SQL script, ON CLUSTER clause is not included
+func writeSchemaOutput(schemaOutput string, schemaQueries []string, log *apexLog.Entry) error {
+	var body strings.Builder
+	for _, query := range schemaQueries {
+		body.WriteString(strings.TrimRight(strings.TrimSpace(query), ";"))
+		body.WriteString(";\n\n")
+	}
+	if err := os.WriteFile(schemaOutput, []byte(body.String()), 0640); err != nil {
+		return fmt.Errorf("can't write schema output to %s: %v", schemaOutput, err)
+	}
+	log.Infof("%d schema queries saved to %s", len(schemaQueries), schemaOutput)
+	return nil
+}
+
+var UUIDWithReplicatedMergeTreeRE = regexp.MustCompile(`^(.+)(UUID)(\s+)'([^']+)'(.+)({uuid})(.*)`)
+
+func (b *Backuper) restoreSchemaEmbedded(ctx context.Context, backupName string, tablesForRestore ListOfTables) error {
+	return b.restoreEmbedded(ctx, backupName, true, tablesForRestore, nil, status.NotFromAPI)
+}
+
+// RestoreSchemaFailedTable - table which can't be created after all retries
+type RestoreSchemaFailedTable struct {
+	Database  string `json:"database"`
+	Table     string `json:"table"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+}
+
+// RestoreSchemaReport - diagnostic for schema dependencies issues, written to `restore_schema_report_path`
+type RestoreSchemaReport struct {
+	// AttemptsOrder - tables in order of CREATE execution for each retry pass
+	AttemptsOrder [][]string                 `json:"attempts_order"`
+	FailedTables  []RestoreSchemaFailedTable `json:"failed_tables"`
+}
+
+// connectRestore - each restore related command connects with `restore_session_settings` and `restore_ddl_preamble` settings
+func (b *Backuper) connectRestore() error {
+	preambleSettings, err := config.ParseDDLPreamble(b.cfg.General.RestoreDDLPreamble)
+	if err != nil {
+		return err
+	}
+	b.ch.SessionSettings = getRestoreSessionSettings(b.cfg.General.RestoreSessionSettings, preambleSettings)
+	if err = b.ch.Connect(); err != nil {
+		return fmt.Errorf("can't connect to clickhouse: %v", err)
+	}
+	if len(preambleSettings) > 0 {
+		if err = checkDDLPreambleApplied(b.ch.GetNotAppliedSessionSettings(), preambleSettings); err != nil {
+			b.ch.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// getRestoreSessionSettings - `restore_session_settings` and `restore_ddl_preamble` settings passed via connection string, preamble overrides the same settings
+func getRestoreSessionSettings(sessionSettings, preambleSettings map[string]string) map[string]string {
+	settings := make(map[string]string, len(sessionSettings)+len(preambleSettings))
+	for name, value := range sessionSettings {
+		settings[name] = value
+	}
+	for name, value := range preambleSettings {
+		settings[name] = value
+	}
+	return settings
+}
+
+// checkDDLPreambleApplied - CREATE queries shall not run without `restore_ddl_preamble` settings, so not applied preamble setting is an error instead of warning
+func checkDDLPreambleApplied(notAppliedSettings []string, preambleSettings map[string]string) error {
+	var notAppliedPreamble []string
+	for _, name := range notAppliedSettings {
+		if _, isPreamble := preambleSettings[name]; isPreamble {
+			notAppliedPreamble = append(notAppliedPreamble, name)
+		}
+	}
+	if len(notAppliedPreamble) > 0 {
+		return fmt.Errorf("`restore_ddl_preamble` settings %s are not applied, clickhouse-go driver doesn't support them or server doesn't know them, set them in default profile of clickhouse-backup user instead", strings.Join(notAppliedPreamble, ", "))
+	}
+	return nil
+}
+
+// getDDLPreamble - `restore_ddl_preamble` statements applied via connection string, returned to keep them at the beginning of --schema-output
+func (b *Backuper) getDDLPreamble() []string {
+	preamble := make([]string, len(b.cfg.General.RestoreDDLPreamble))
+	for i, statement := range b.cfg.General.RestoreDDLPreamble {
+		preamble[i] = strings.TrimRight(strings.TrimSpace(statement), "; \t")
+	}
+	return preamble
+}
+
+// restoreSchemaRegular - create tables in dependency order, return queries in order of successful execution
+// when dryRun is true, queries are only prepared and returned without execution, databaseQueries define CREATE DATABASE in returned queries
+func (b *Backuper) restoreSchemaRegular(tablesForRestore ListOfTables, version int, schemaAsAttach, dryRun bool, databaseQueries map[string]string, log *apexLog.Entry) ([]string, error) {
+	totalRetries := len(tablesForRestore)
+	restoreRetries := 0
+	isDatabaseCreated := common.EmptyMap{}
+	isDatabaseQueryAdded := common.EmptyMap{}
+	var restoreErr error
+	if len(b.cfg.General.RestoreStoragePolicyMapping) > 0 {
+		changeTableQueryToAdjustStoragePolicyMapping(tablesForRestore, b.cfg.General.RestoreStoragePolicyMapping, log)
+	}
+	if len(b.cfg.General.RestoreDistributedClusterMapping) > 0 {
+		changeTableQueryToAdjustDistributedClusterMapping(tablesForRestore, b.cfg.General.RestoreDistributedClusterMapping, b.cfg.General.RestoreDatabaseMapping, log)
+	}
+	if len(b.cfg.General.RestoreZookeeperPathMapping) > 0 {
+		rules, err := compileZookeeperPathMapping(b.cfg.General.RestoreZookeeperPathMapping)
+		if err != nil {
+			return nil, err
+		}
+		changedTables, err := changeTableQueryToAdjustZookeeperPathMapping(tablesForRestore, rules, log)
+		if err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			if err = b.checkMappedZookeeperPaths(changedTables, log); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(b.cfg.General.RestoreSchemaTransformRules) > 0 || b.cfg.General.RestoreSchemaTransformCommand != "" {
+		if err := b.transformSchemaQueries(tablesForRestore, log); err != nil {
+			return nil, err
+		}
+		if b.transformedQueries == nil {
+			b.transformedQueries = make(map[metadata.TableTitle]string, len(tablesForRestore))
+		}
+		for _, table := range tablesForRestore {
+			b.transformedQueries[metadata.TableTitle{Database: table.Database, Table: table.Table}] = table.Query
+		}
+	}
+	if b.cfg.General.RestoreDropTTL {
+		for i := range tablesForRestore {
+			if query, isRemoved := removeTTLFromCreateQuery(tablesForRestore[i].Query); isRemoved {
+				tablesForRestore[i].Query = query
+				log.Warnf("%s.%s TTL removed from schema due `restore_drop_ttl: true`", tablesForRestore[i].Database, tablesForRestore[i].Table)
+			}
+		}
+	}
+	tablesForRestore, cyclicTables := tablesForRestore.SortByDependencies()
+	if len(cyclicTables) > 0 {
+		log.Warnf("can't resolve schema dependencies order for %s, will retry to create them", strings.Join(cyclicTables, ", "))
+	}
+	var detachedStreamingTables, detachedConsumerViews map[metadata.TableTitle]struct{}
+	if b.cfg.General.RestoreStreamingTablesMode == "skip" || b.cfg.General.RestoreStreamingTablesMode == "detach" {
+		tablesForRestore, detachedStreamingTables, detachedConsumerViews = b.filterStreamingTables(tablesForRestore, log)
+	}
+	// streaming tables detached after all tables created, cause materialized views which read from them can't be created for detached table
+	var streamingTablesDetachQueries []string
+	b.checkMaterializedViewTargets(tablesForRestore, log)
+	if b.cfg.General.RestoreSchemaOnCluster == "" && !dryRun {
+		if err := b.checkReplicatedZookeeperPaths(tablesForRestore, log); err != nil {
+			return nil, err
+		}
+	}
+	report := RestoreSchemaReport{}
+	tableAttempts := map[metadata.TableTitle]int{}
+	tableErrors := map[metadata.TableTitle]error{}
+	var deferredDictionaries ListOfTables
+	isDictionaryDeferred := map[metadata.TableTitle]struct{}{}
+	replicatedDatabases := map[string]bool{}
+	executedQueries := b.getDDLPreamble()
+	for restoreRetries < totalRetries {
+		var notRestoredTables ListOfTables
+		var attemptsOrder []string
+		for _, schema := range tablesForRestore {
+			if _, isAdded := isDatabaseQueryAdded[schema.Database]; !isAdded {
+				executedQueries = append(executedQueries, getSchemaOutputDatabaseQuery(schema.Database, databaseQueries))
+				isDatabaseQueryAdded[schema.Database] = struct{}{}
+			}
+			// if metadata.json doesn't contain "databases", we will re-create tables with default engine
+			if _, isCreated := isDatabaseCreated[schema.Database]; !isCreated && !dryRun {
+				if err := b.ch.CreateDatabase(schema.Database, b.cfg.General.RestoreSchemaOnCluster); err != nil {
+					return nil, fmt.Errorf("can't create database '%s': %v", schema.Database, err)
+				} else {
+					isDatabaseCreated[schema.Database] = struct{}{}
+				}
+			}
+			//materialized and window views should restore via ATTACH, when inner tables restored before views
+			if schemaAsAttach {
+				schema.Query = strings.Replace(
+					schema.Query, "CREATE MATERIALIZED VIEW", "ATTACH MATERIALIZED VIEW", 1,
+				)
+				schema.Query = strings.Replace(
+					schema.Query, "CREATE WINDOW VIEW", "ATTACH WINDOW VIEW", 1,
+				)
+				schema.Query = strings.Replace(
+					schema.Query, "CREATE LIVE VIEW", "ATTACH LIVE VIEW", 1,
+				)
+			}
+			tableTitle := metadata.TableTitle{Database: schema.Database, Table: schema.Table}
+			if _, isDeferred := isDictionaryDeferred[tableTitle]; !isDeferred && !dryRun && b.cfg.General.RestoreDictionariesDeferSource && strings.HasPrefix(schema.Query, "CREATE DICTIONARY") {
+				if nullSourceQuery, isReplaced := replaceDictionarySourceWithNull(schema.Query); isReplaced {
+					deferredDictionaries = append(deferredDictionaries, schema)
+					isDictionaryDeferred[tableTitle] = struct{}{}
+					schema.Query = nullSourceQuery
+				}
+			}
+			if b.cfg.General.RestoreIfNotExists {
+				schema.Query = addIfNotExistsToCreateQuery(schema.Query)
+			}
+			// https://github.com/AlexAkulov/clickhouse-backup/issues/466
+			if b.cfg.General.RestoreSchemaOnCluster == "" && strings.Contains(schema.Query, "{uuid}") && strings.Contains(schema.Query, "Replicated") {
+				if !strings.Contains(schema.Query, "UUID") {
+					log.Warnf("table query doesn't contains UUID, can't guarantee properly restore for ReplicatedMergeTree")
+				} else {
+					schema.Query = UUIDWithReplicatedMergeTreeRE.ReplaceAllString(schema.Query, "$1$2$3'$4'$5$4$7")
+				}
+			}
+			if dryRun {
+				executedQueries = append(executedQueries, schema.Query)
+				if _, isDetached := detachedConsumerViews[tableTitle]; isDetached {
+					executedQueries = append(executedQueries, getDetachStreamingTableQuery(schema.Database, schema.Table, b.cfg.General.RestoreSchemaOnCluster))
+				}
+				if _, isDetached := detachedStreamingTables[tableTitle]; isDetached {
+					streamingTablesDetachQueries = append(streamingTablesDetachQueries, getDetachStreamingTableQuery(schema.Database, schema.Table, b.cfg.General.RestoreSchemaOnCluster))
+				}
+				continue
+			}
+			onCluster := b.getRestoreSchemaOnCluster(schema.Database, replicatedDatabases, log)
+			// DDL in Replicated database engine executed on all replicas, table could be already created by restore on another replica
+			if b.isReplicatedDatabase(schema.Database, replicatedDatabases, log) && b.isTableExists(schema.Database, schema.Table) {
+				log.Infof("%s.%s already exists in Replicated database, skip CREATE", schema.Database, schema.Table)
+				delete(tableErrors, tableTitle)
+				continue
+			}
+			attemptsOrder = append(attemptsOrder, fmt.Sprintf("%s.%s", schema.Database, schema.Table))
+			tableAttempts[tableTitle]++
+			restoreErr = b.ch.CreateTable(clickhouse.Table{
+				Database: schema.Database,
+				Name:     schema.Table,
+			}, schema.Query, false, false, onCluster, version)
+			for restoreErr != nil && b.cfg.General.RestoreStripUnknownSettings {
+				unknownSetting := getUnknownSettingFromError(restoreErr)
+				if unknownSetting == "" {
+					break
+				}
+				strippedQuery, isStripped := removeSettingFromCreateQuery(schema.Query, unknownSetting)
+				if !isStripped {
+					break
+				}
+				log.Warnf("%s.%s: setting `%s` stripped from CREATE query, it is not supported by current ClickHouse version", schema.Database, schema.Table, unknownSetting)
+				schema.Query = strippedQuery
+				restoreErr = b.ch.CreateTable(clickhouse.Table{
+					Database: schema.Database,
+					Name:     schema.Table,
+				}, schema.Query, false, false, onCluster, version)
 			}
-			restoreErr = b.ch.CreateTable(clickhouse.Table{
-				Database: schema.Database,
-				Name:     schema.Table,
-			}, schema.Query, false, false, b.cfg.General.RestoreSchemaOnCluster, version)
 
 			if restoreErr != nil {
+				tableErrors[tableTitle] = restoreErr
 				restoreRetries++
 				if restoreRetries >= totalRetries {
-					return fmt.Errorf(
+					report.AttemptsOrder = append(report.AttemptsOrder, attemptsOrder)
+					b.writeRestoreSchemaReport(report, tableAttempts, tableErrors, log)
+					return nil, fmt.Errorf(
 						"can't create table `%s`.`%s`: %v after %d times, please check your schema dependencies",
 						schema.Database, schema.Table, restoreErr, restoreRetries,
 					)
@@ -401,156 +1308,1304 @@ func (b *Backuper) restoreSchemaRegular(tablesForRestore ListOfTables, version i
 						"can't create table '%s.%s': %v, will try again", schema.Database, schema.Table, restoreErr,
 					)
 				}
-				notRestoredTables = append(notRestoredTables, schema)
+				notRestoredTables = append(notRestoredTables, schema)
+			} else {
+				delete(tableErrors, tableTitle)
+				executedQueries = append(executedQueries, schema.Query)
+				if _, isDetached := detachedConsumerViews[tableTitle]; isDetached {
+					detachQuery := getDetachStreamingTableQuery(schema.Database, schema.Table, onCluster)
+					if _, err := b.ch.Query(detachQuery); err != nil {
+						return nil, fmt.Errorf("can't detach materialized view '%s.%s': %v", schema.Database, schema.Table, err)
+					}
+					log.Infof("%s.%s materialized view detached permanently due `restore_streaming_tables_mode: detach`, execute ATTACH TABLE after streaming table attached when ready to consume", schema.Database, schema.Table)
+					executedQueries = append(executedQueries, detachQuery)
+				}
+				if _, isDetached := detachedStreamingTables[tableTitle]; isDetached {
+					streamingTablesDetachQueries = append(streamingTablesDetachQueries, getDetachStreamingTableQuery(schema.Database, schema.Table, onCluster))
+				}
+			}
+		}
+		report.AttemptsOrder = append(report.AttemptsOrder, attemptsOrder)
+		tablesForRestore = notRestoredTables
+		if len(tablesForRestore) == 0 {
+			break
+		}
+	}
+	for _, detachQuery := range streamingTablesDetachQueries {
+		if !dryRun {
+			if _, err := b.ch.Query(detachQuery); err != nil {
+				return nil, fmt.Errorf("can't execute %s: %v", detachQuery, err)
+			}
+			log.Infof("%s executed due `restore_streaming_tables_mode: detach`, execute ATTACH TABLE when ready to consume", detachQuery)
+		}
+		executedQueries = append(executedQueries, detachQuery)
+	}
+	executedQueries = append(executedQueries, b.restoreDeferredDictionarySources(deferredDictionaries, version, replicatedDatabases, log)...)
+	return executedQueries, nil
+}
+
+// filterStreamingTables - exclude Kafka, RabbitMQ and other streaming tables and materialized views which read from them for `skip` mode to avoid consuming messages during restore,
+// for `detach` mode all tables are kept and returned streaming tables and consumer views shall be detached after create
+func (b *Backuper) filterStreamingTables(tablesForRestore ListOfTables, log *apexLog.Entry) (ListOfTables, map[metadata.TableTitle]struct{}, map[metadata.TableTitle]struct{}) {
+	streamingTables, consumerViews := getStreamingTables(tablesForRestore)
+	if len(streamingTables) == 0 {
+		return tablesForRestore, nil, nil
+	}
+	if b.cfg.General.RestoreStreamingTablesMode == "detach" {
+		return tablesForRestore, streamingTables, consumerViews
+	}
+	filteredTables := make(ListOfTables, 0, len(tablesForRestore))
+	for _, t := range tablesForRestore {
+		title := metadata.TableTitle{Database: t.Database, Table: t.Table}
+		if _, isConsumer := consumerViews[title]; isConsumer {
+			log.Warnf("%s.%s materialized view reads from streaming table, skipped due `restore_streaming_tables_mode: skip`", t.Database, t.Table)
+			continue
+		}
+		if _, isStreaming := streamingTables[title]; isStreaming {
+			log.Warnf("%s.%s streaming table skipped due `restore_streaming_tables_mode: skip`", t.Database, t.Table)
+			continue
+		}
+		filteredTables = append(filteredTables, t)
+	}
+	return filteredTables, nil, nil
+}
+
+func getDetachStreamingTableQuery(database, table, onCluster string) string {
+	if onCluster != "" {
+		return fmt.Sprintf("DETACH TABLE `%s`.`%s` ON CLUSTER '%s' PERMANENTLY", database, table, onCluster)
+	}
+	return fmt.Sprintf("DETACH TABLE `%s`.`%s` PERMANENTLY", database, table)
+}
+
+// checkMaterializedViewTargets - materialized view with `TO` clause restored via ATTACH without target table will fail on first INSERT into source table
+func (b *Backuper) checkMaterializedViewTargets(tablesForRestore ListOfTables, log *apexLog.Entry) {
+	isRestored := make(map[metadata.TableTitle]struct{}, len(tablesForRestore))
+	for _, t := range tablesForRestore {
+		isRestored[metadata.TableTitle{Database: t.Database, Table: t.Table}] = struct{}{}
+	}
+	for _, t := range tablesForRestore {
+		target, isTargetDefined := getMaterializedViewTarget(t)
+		if !isTargetDefined {
+			continue
+		}
+		if _, exists := isRestored[target]; !exists && !b.isTableExists(target.Database, target.Table) {
+			log.Warnf("%s.%s materialized view target table %s.%s doesn't exist and not present in backup, create it before insert into source tables", t.Database, t.Table, target.Database, target.Table)
+		}
+	}
+}
+
+// checkReplicatedZookeeperPaths - without ON CLUSTER each replica restores schema separately, and macros on current server could differ from source server
+// fail early when macros in ZooKeeper path are not defined, or replica with the same name already registered in ZooKeeper for not existing table
+func (b *Backuper) checkReplicatedZookeeperPaths(tablesForRestore ListOfTables, log *apexLog.Entry) error {
+	ctx := context.Background()
+	replicatedDatabases := map[string]bool{}
+	for _, t := range tablesForRestore {
+		zkPath, replica, isReplicated := getReplicatedZookeeperPath(t.Query, t.Database, t.Table)
+		// tables in Replicated database engine use database ZooKeeper path
+		if !isReplicated || b.isReplicatedDatabase(t.Database, replicatedDatabases, log) {
+			continue
+		}
+		var err error
+		if zkPath, err = b.ch.ApplyMacros(ctx, zkPath); err != nil {
+			return err
+		}
+		if replica, err = b.ch.ApplyMacros(ctx, replica); err != nil {
+			return err
+		}
+		if undefinedMacros := getUndefinedMacros(zkPath + replica); len(undefinedMacros) > 0 {
+			return fmt.Errorf("%s.%s ZooKeeper path '%s' or replica name '%s' contains macros %s which are not defined in system.macros on current server", t.Database, t.Table, zkPath, replica, strings.Join(undefinedMacros, ", "))
+		}
+		if b.isTableExists(t.Database, t.Table) {
+			continue
+		}
+		var replicas []uint64
+		if err = b.ch.Select(&replicas, "SELECT count() FROM system.zookeeper WHERE path=? AND name=?", strings.TrimSuffix(zkPath, "/")+"/replicas", replica); err != nil {
+			log.Debugf("can't check replica %s in ZooKeeper path %s: %v", replica, zkPath, err)
+			continue
+		}
+		if len(replicas) > 0 && replicas[0] > 0 {
+			return fmt.Errorf("%s.%s replica '%s' already exists in ZooKeeper path '%s', execute SYSTEM DROP REPLICA '%s' FROM ZKPATH '%s' or check `macros` on current server", t.Database, t.Table, replica, zkPath, replica, zkPath)
+		}
+	}
+	return nil
+}
+
+// checkMappedZookeeperPaths - ZooKeeper path after `restore_zookeeper_path_mapping` shall not exist for not existing table,
+// otherwise created table becomes replica of other table which already uses this path
+func (b *Backuper) checkMappedZookeeperPaths(changedTables ListOfTables, log *apexLog.Entry) error {
+	ctx := context.Background()
+	replicatedDatabases := map[string]bool{}
+	for _, t := range changedTables {
+		zkPath, _, isReplicated := getReplicatedZookeeperPath(t.Query, t.Database, t.Table)
+		if !isReplicated || b.isReplicatedDatabase(t.Database, replicatedDatabases, log) || b.isTableExists(t.Database, t.Table) {
+			continue
+		}
+		zkPath, err := b.ch.ApplyMacros(ctx, zkPath)
+		if err != nil {
+			return err
+		}
+		zkPath = strings.TrimSuffix(zkPath, "/")
+		if len(getUndefinedMacros(zkPath)) > 0 || !strings.Contains(zkPath, "/") {
+			continue
+		}
+		var nodes []uint64
+		if err = b.ch.Select(&nodes, "SELECT count() FROM system.zookeeper WHERE path=? AND name=?", path.Dir(zkPath), path.Base(zkPath)); err != nil {
+			log.Debugf("can't check ZooKeeper path %s: %v", zkPath, err)
+			continue
+		}
+		if len(nodes) > 0 && nodes[0] > 0 {
+			return fmt.Errorf("%s.%s ZooKeeper path '%s' after `restore_zookeeper_path_mapping` already exists, table would become replica of other table, change mapping or remove this path", t.Database, t.Table, zkPath)
+		}
+	}
+	return nil
+}
+
+// isReplicatedDatabase - check target database engine, result cached in replicatedDatabases
+func (b *Backuper) isReplicatedDatabase(database string, replicatedDatabases map[string]bool, log *apexLog.Entry) bool {
+	if isReplicated, isChecked := replicatedDatabases[database]; isChecked {
+		return isReplicated
+	}
+	var engines []string
+	if err := b.ch.Select(&engines, "SELECT engine FROM system.databases WHERE name=?", database); err != nil {
+		log.Warnf("can't get engine for database `%s`: %v", database, err)
+		return false
+	}
+	replicatedDatabases[database] = len(engines) > 0 && engines[0] == "Replicated"
+	if replicatedDatabases[database] && b.cfg.General.RestoreSchemaOnCluster != "" {
+		log.Warnf("`%s` database has Replicated engine, DDL will replicated by database engine, `restore_schema_on_cluster: %s` ignored for its tables", database, b.cfg.General.RestoreSchemaOnCluster)
+	}
+	return replicatedDatabases[database]
+}
+
+// getRestoreSchemaOnCluster - ON CLUSTER is not allowed for tables inside Replicated database engine
+func (b *Backuper) getRestoreSchemaOnCluster(database string, replicatedDatabases map[string]bool, log *apexLog.Entry) string {
+	if b.cfg.General.RestoreSchemaOnCluster == "" || b.isReplicatedDatabase(database, replicatedDatabases, log) {
+		return ""
+	}
+	return b.cfg.General.RestoreSchemaOnCluster
+}
+
+func (b *Backuper) isTableExists(database, table string) bool {
+	var tablesCount []uint64
+	if err := b.ch.Select(&tablesCount, "SELECT count() FROM system.tables WHERE database=? AND name=?", database, table); err != nil {
+		return false
+	}
+	return len(tablesCount) > 0 && tablesCount[0] > 0
+}
+
+// transformSchemaQueries - apply `restore_schema_transform_rules` and `restore_schema_transform_command` to each query once, before retries of CREATE
+func (b *Backuper) transformSchemaQueries(tables ListOfTables, log *apexLog.Entry) error {
+	rules, err := compileRegexpReplaceRules("restore_schema_transform_rules", b.cfg.General.RestoreSchemaTransformRules)
+	if err != nil {
+		return err
+	}
+	var cmd []string
+	if b.cfg.General.RestoreSchemaTransformCommand != "" {
+		if cmd, err = shellwords.Parse(b.cfg.General.RestoreSchemaTransformCommand); err != nil {
+			return err
+		}
+	}
+	for i := range tables {
+		if tables[i].Query == "" {
+			continue
+		}
+		query := applySchemaTransformRules(tables[i].Query, rules)
+		if len(cmd) > 0 {
+			if query, err = runSchemaTransformCommand(cmd, tables[i].Database, tables[i].Table, query); err != nil {
+				return fmt.Errorf("restore_schema_transform_command failed for %s.%s: %v", tables[i].Database, tables[i].Table, err)
+			}
+		}
+		if query != tables[i].Query {
+			log.Debugf("%s.%s query transformed to: %s", tables[i].Database, tables[i].Table, query)
+			tables[i].Query = query
+		}
+	}
+	return nil
+}
+
+func runSchemaTransformCommand(cmd []string, database, table, query string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	transform := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	transform.Stdin = strings.NewReader(query)
+	transform.Env = append(os.Environ(), "CLICKHOUSE_BACKUP_DATABASE="+database, "CLICKHOUSE_BACKUP_TABLE="+table)
+	out, err := transform.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	transformedQuery := strings.TrimSpace(string(out))
+	if transformedQuery == "" {
+		return "", fmt.Errorf("empty output")
+	}
+	return transformedQuery, nil
+}
+
+// restoreDeferredDictionarySources - replace SOURCE(NULL()) placeholders created with `restore_dictionaries_defer_source` by original dictionary queries
+// failed dictionaries keep NULL source and only logged, cause external source could be unreachable during restore
+func (b *Backuper) restoreDeferredDictionarySources(deferredDictionaries ListOfTables, version int, replicatedDatabases map[string]bool, log *apexLog.Entry) []string {
+	var executedQueries []string
+	for _, dictionary := range deferredDictionaries {
+		var placeholders []uint64
+		if err := b.ch.Select(&placeholders, "SELECT count() FROM system.tables WHERE database=? AND name=? AND create_table_query LIKE '%SOURCE(NULL())%'", dictionary.Database, dictionary.Table); err != nil {
+			log.Warnf("can't check dictionary `%s`.`%s` SOURCE: %v", dictionary.Database, dictionary.Table, err)
+			continue
+		}
+		// dictionary already existed with restore_if_not_exists: true
+		if len(placeholders) == 0 || placeholders[0] == 0 {
+			continue
+		}
+		replaceQuery := strings.Replace(dictionary.Query, "CREATE DICTIONARY", "CREATE OR REPLACE DICTIONARY", 1)
+		if err := b.ch.CreateTable(clickhouse.Table{
+			Database: dictionary.Database,
+			Name:     dictionary.Table,
+		}, replaceQuery, false, false, b.getRestoreSchemaOnCluster(dictionary.Database, replicatedDatabases, log), version); err != nil {
+			log.Warnf("can't restore SOURCE for dictionary `%s`.`%s`, it keeps SOURCE(NULL()), re-create it manually when source will available: %v", dictionary.Database, dictionary.Table, err)
+		} else {
+			log.Debugf("dictionary `%s`.`%s` SOURCE restored", dictionary.Database, dictionary.Table)
+			executedQueries = append(executedQueries, replaceQuery)
+		}
+	}
+	return executedQueries
+}
+
+// writeRestoreSchemaReport - save JSON diagnostic when `restore_schema_report_path` is defined, errors only logged to keep original error
+func (b *Backuper) writeRestoreSchemaReport(report RestoreSchemaReport, tableAttempts map[metadata.TableTitle]int, tableErrors map[metadata.TableTitle]error, log *apexLog.Entry) {
+	if b.cfg.General.RestoreSchemaReportPath == "" {
+		return
+	}
+	report.FailedTables = make([]RestoreSchemaFailedTable, 0, len(tableErrors))
+	for tableTitle, tableErr := range tableErrors {
+		report.FailedTables = append(report.FailedTables, RestoreSchemaFailedTable{
+			Database:  tableTitle.Database,
+			Table:     tableTitle.Table,
+			Attempts:  tableAttempts[tableTitle],
+			LastError: tableErr.Error(),
+		})
+	}
+	sort.Slice(report.FailedTables, func(i, j int) bool {
+		if report.FailedTables[i].Database != report.FailedTables[j].Database {
+			return report.FailedTables[i].Database < report.FailedTables[j].Database
+		}
+		return report.FailedTables[i].Table < report.FailedTables[j].Table
+	})
+	body, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		log.Warnf("can't marshal restore schema report: %v", err)
+		return
+	}
+	if err = os.WriteFile(b.cfg.General.RestoreSchemaReportPath, body, 0640); err != nil {
+		log.Warnf("can't write restore schema report to %s: %v", b.cfg.General.RestoreSchemaReportPath, err)
+		return
+	}
+	log.Infof("restore schema report saved to %s", b.cfg.General.RestoreSchemaReportPath)
+}
+
+func (b *Backuper) dropExistsTables(tablesForDrop ListOfTables, ignoreDependencies bool, version int, log *apexLog.Entry) error {
+	var dropErr error
+	dropRetries := 0
+	totalRetries := len(tablesForDrop)
+	replicatedDatabases := map[string]bool{}
+	for dropRetries < totalRetries {
+		var notDroppedTables ListOfTables
+		for i, schema := range tablesForDrop {
+			if schema.Query == "" {
+				possibleQueries := []string{
+					fmt.Sprintf("CREATE DICTIONARY `%s`.`%s`", schema.Database, schema.Table),
+					fmt.Sprintf("CREATE MATERIALIZED VIEW `%s`.`%s`", schema.Database, schema.Table),
+				}
+				if len(schema.Parts) > 0 {
+					possibleQueries = append([]string{
+						fmt.Sprintf("CREATE TABLE `%s`.`%s`", schema.Database, schema.Table),
+					}, possibleQueries...)
+				}
+				for _, query := range possibleQueries {
+					dropErr = b.ch.DropTable(clickhouse.Table{
+						Database: schema.Database,
+						Name:     schema.Table,
+					}, query, b.getRestoreSchemaOnCluster(schema.Database, replicatedDatabases, log), ignoreDependencies, version)
+					if dropErr == nil {
+						tablesForDrop[i].Query = query
+					}
+				}
+			} else {
+				dropErr = b.ch.DropTable(clickhouse.Table{
+					Database: schema.Database,
+					Name:     schema.Table,
+				}, schema.Query, b.getRestoreSchemaOnCluster(schema.Database, replicatedDatabases, log), ignoreDependencies, version)
+			}
+
+			if dropErr != nil {
+				dropRetries++
+				if dropRetries >= totalRetries {
+					return fmt.Errorf(
+						"can't drop table `%s`.`%s`: %v after %d times, please check your schema dependencies",
+						schema.Database, schema.Table, dropErr, dropRetries,
+					)
+				} else {
+					log.Warnf(
+						"can't drop table '%s.%s': %v, will try again", schema.Database, schema.Table, dropErr,
+					)
+				}
+				notDroppedTables = append(notDroppedTables, schema)
+			}
+		}
+		tablesForDrop = notDroppedTables
+		if len(tablesForDrop) == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// checkBackupFormatVersion - backups without format_version created before it was introduced and compatible with FormatVersion=1
+func checkBackupFormatVersion(backupMetadata metadata.BackupMetadata) error {
+	if backupMetadata.FormatVersion > metadata.FormatVersion {
+		return fmt.Errorf("backup '%s' metadata format_version=%d is not supported, current clickhouse-backup supports format_version<=%d, use clickhouse-backup %s or newer which created this backup", backupMetadata.BackupName, backupMetadata.FormatVersion, metadata.FormatVersion, backupMetadata.ClickhouseBackupVersion)
+	}
+	return nil
+}
+
+// warnEncryptedDisks - parts on `encrypted` disks stored in backup as ciphertext and linked to detached as is, they are readable only when destination disk use the same encryption keys
+func warnEncryptedDisks(tablesForRestore ListOfTables, disks []clickhouse.Disk, log *apexLog.Entry) {
+	for _, disk := range disks {
+		if disk.Type != "encrypted" {
+			continue
+		}
+		var encryptedTables []string
+		for _, t := range tablesForRestore {
+			if len(t.Parts[disk.Name]) > 0 {
+				encryptedTables = append(encryptedTables, fmt.Sprintf("'%s.%s'", t.Database, t.Table))
+			}
+		}
+		if len(encryptedTables) > 0 {
+			log.Warnf("disk '%s' has type `encrypted`, parts for %s will restored as is without re-encryption, ATTACH PART will fail or data will unreadable when encryption keys in destination clickhouse `storage_configuration` is different with keys used during backup", disk.Name, strings.Join(encryptedTables, ", "))
+		}
+	}
+}
+
+// warnObjectDisks - backup contains only metadata files for parts on object storage disks, remote objects shall still exist in object storage during restore
+func warnObjectDisks(tablesForRestore ListOfTables, disks []clickhouse.Disk, log *apexLog.Entry) {
+	for _, disk := range disks {
+		if !filesystemhelper.IsObjectDiskType(disk.Type) {
+			continue
+		}
+		for _, t := range tablesForRestore {
+			if len(t.Parts[disk.Name]) > 0 {
+				log.Warnf("disk '%s' has type `%s`, backup contains only metadata files for parts, remote objects referenced by them shall exist in object storage", disk.Name, disk.Type)
+				break
+			}
+		}
+	}
+}
+
+// getAttachUnsupportedReason - restore data copy parts to `detached` on local filesystem and execute ATTACH PART,
+// it doesn't work for SharedMergeTree in ClickHouse Cloud and when clickhouse-backup runs on another host, ATTACH will fail or attach nothing
+// data paths are not checked with `disk_mapping`, cause clickhouse-server paths could be different from clickhouse-backup host paths
+func getAttachUnsupportedReason(table clickhouse.Table, checkDataPaths bool) string {
+	if strings.HasPrefix(table.Engine, "Shared") {
+		return fmt.Sprintf("engine %s doesn't support ATTACH PART from `detached`", table.Engine)
+	}
+	for _, dataPath := range table.DataPaths {
+		if !checkDataPaths {
+			break
+		}
+		if _, err := os.Stat(dataPath); os.IsNotExist(err) {
+			return fmt.Sprintf("data path %s doesn't exist on clickhouse-backup host", dataPath)
+		}
+	}
+	return ""
+}
+
+// checkAttachSupported - fail before copy any data with guidance instead of restore empty tables
+func (b *Backuper) checkAttachSupported(tablesForRestore ListOfTables, dstTablesMap map[metadata.TableTitle]clickhouse.Table) error {
+	var unsupportedTables []string
+	for _, table := range tablesForRestore {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		dstTable, exists := dstTablesMap[metadata.TableTitle{Database: dstDatabase, Table: dstTableName}]
+		if !exists {
+			continue
+		}
+		if reason := getAttachUnsupportedReason(dstTable, len(b.cfg.ClickHouse.DiskMapping) == 0); reason != "" {
+			unsupportedTables = append(unsupportedTables, fmt.Sprintf("'%s.%s': %s", dstDatabase, dstTableName, reason))
+		}
+	}
+	if len(unsupportedTables) > 0 {
+		return fmt.Errorf("can't restore data via `detached` folder and ATTACH PART, %s; for ClickHouse Cloud and other managed services without filesystem access use `use_embedded_backup_restore: true` or restore backup to self-managed ClickHouse server and copy data with `INSERT INTO ... SELECT * FROM remoteSecure(...)`, otherwise run clickhouse-backup on the same host with clickhouse-server", strings.Join(unsupportedTables, "; "))
+	}
+	return nil
+}
+
+// getColumnTypesCheckedTables - existing tables which were not created during restore, queries already transformed during restore schema are reused,
+// the rest queries are transformed here, for example when only data restored
+func (b *Backuper) getColumnTypesCheckedTables(tablesForRestore ListOfTables, dstTablesMap map[metadata.TableTitle]clickhouse.Table, createdTables map[metadata.TableTitle]struct{}, log *apexLog.Entry) (ListOfTables, error) {
+	var checkedTables, notTransformedTables ListOfTables
+	for _, table := range tablesForRestore {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		dstTitle := metadata.TableTitle{Database: dstDatabase, Table: dstTableName}
+		if _, isCreated := createdTables[dstTitle]; isCreated {
+			continue
+		}
+		if _, exists := dstTablesMap[dstTitle]; !exists {
+			continue
+		}
+		if query, isTransformed := b.transformedQueries[dstTitle]; isTransformed {
+			table.Query = query
+			checkedTables = append(checkedTables, table)
+		} else {
+			notTransformedTables = append(notTransformedTables, table)
+		}
+	}
+	if len(notTransformedTables) > 0 && (len(b.cfg.General.RestoreSchemaTransformRules) > 0 || b.cfg.General.RestoreSchemaTransformCommand != "") {
+		if err := b.transformSchemaQueries(notTransformedTables, log); err != nil {
+			return nil, err
+		}
+	}
+	return append(checkedTables, notTransformedTables...), nil
+}
+
+// checkColumnTypes - existing table which was not dropped could have columns with other types than in backup, ATTACH PART fails or silently misreads data in this case,
+// tables just created from backup schema are skipped, backup schema compared after `restore_schema_transform_rules` and `restore_schema_transform_command`, like it was created
+func (b *Backuper) checkColumnTypes(ctx context.Context, tablesForRestore ListOfTables, dstTablesMap map[metadata.TableTitle]clickhouse.Table, createdTables map[metadata.TableTitle]struct{}, log *apexLog.Entry) error {
+	var mismatchedTables []string
+	checkedTables, err := b.getColumnTypesCheckedTables(tablesForRestore, dstTablesMap, createdTables, log)
+	if err != nil {
+		return err
+	}
+	for _, table := range checkedTables {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		backupTypes := getColumnTypes(table.Query)
+		if len(backupTypes) == 0 {
+			continue
+		}
+		dstTypes, err := b.ch.GetColumnTypes(ctx, dstDatabase, dstTableName)
+		if err != nil {
+			return fmt.Errorf("can't get columns of '%s.%s' from system.columns: %v", dstDatabase, dstTableName, err)
+		}
+		if diff := getColumnTypeDiff(backupTypes, dstTypes); len(diff) > 0 {
+			mismatchedTables = append(mismatchedTables, fmt.Sprintf("'%s.%s': %s", dstDatabase, dstTableName, strings.Join(diff, ", ")))
+		}
+	}
+	if len(mismatchedTables) > 0 {
+		return fmt.Errorf("column types in backup are different from existing tables, use --rm to recreate tables from backup or change column types manually, %s", strings.Join(mismatchedTables, "; "))
+	}
+	return nil
+}
+
+// RestoreData - restore data for tables matched by opts.TablePattern from backupName
+func (b *Backuper) RestoreData(ctx context.Context, backupName string, opts RestoreOptions, disks []clickhouse.Disk, isEmbedded bool, commandId int) error {
+	startRestore := time.Now()
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore",
+	})
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	if isEmbedded && opts.SkipAttach {
+		return fmt.Errorf("--skip-attach is not compatible with `use_embedded_backup_restore: true`")
+	}
+	if isEmbedded && opts.LastPartitions > 0 {
+		return fmt.Errorf("--last-partitions is not compatible with `use_embedded_backup_restore: true`")
+	}
+	if opts.FreezeAfterRestore && (isEmbedded || opts.SkipAttach) {
+		return fmt.Errorf("--freeze-after-restore is not compatible with --skip-attach and `use_embedded_backup_restore: true`")
+	}
+	if opts.OnlyNewPartitions && isEmbedded {
+		return fmt.Errorf("--only-new-partitions is not compatible with `use_embedded_backup_restore: true`")
+	}
+	if opts.SyncPartsDetach && !opts.SyncParts {
+		return fmt.Errorf("--sync-parts-detach requires --sync-parts")
+	}
+	if opts.SyncParts && (isEmbedded || opts.ReplacePartitions || opts.SkipAttach) {
+		return fmt.Errorf("--sync-parts is not compatible with --replace-partitions, --skip-attach and `use_embedded_backup_restore: true`")
+	}
+	if isEmbedded {
+		for _, partitionArg := range opts.Partitions {
+			if scope, _ := filesystemhelper.ParsePartitionTableScope(partitionArg); scope != "" {
+				return fmt.Errorf("--partitions=%s with table scope is not compatible with `use_embedded_backup_restore: true`", partitionArg)
+			}
+		}
+	}
+	if opts.ReplacePartitions && (isEmbedded || opts.SkipAttach || opts.AttachIncrementally) {
+		return fmt.Errorf("--replace-partitions is not compatible with --skip-attach, --attach-incrementally and `use_embedded_backup_restore: true`")
+	}
+	if isEmbedded && len(opts.Parts) > 0 {
+		return fmt.Errorf("--part is not compatible with `use_embedded_backup_restore: true`")
+	}
+	if isEmbedded && len(b.cfg.General.RestoreTableMapping) > 0 {
+		return fmt.Errorf("`restore_table_mapping` is not compatible with `use_embedded_backup_restore: true`")
+	}
+	if b.ch.IsClickhouseShadow(path.Join(defaultDataPath, "backup", backupName, "shadow")) {
+		return fmt.Errorf("backups created in v0.0.1 is not supported now")
+	}
+	backup, _, err := b.getLocalBackup(ctx, backupName, disks)
+	if err != nil {
+		return fmt.Errorf("can't restore: %v", err)
+	}
+	if err = checkBackupFormatVersion(backup.BackupMetadata); err != nil {
+		return err
+	}
+	var requiredBackups []string
+	var brokenChainErr error
+	if backup.RequiredBackup != "" && !isEmbedded {
+		requiredBackups, brokenChainErr = b.getRequiredBackupsChain(ctx, backup.BackupMetadata, disks)
+		if len(requiredBackups) > 0 {
+			log.Infof("parts absent in backup will restore from required backups %s", strings.Join(requiredBackups, " -> "))
+		}
+	}
+
+	diskMap := map[string]string{}
+	for _, disk := range disks {
+		diskMap[disk.Name] = disk.Path
+	}
+	var tablesForRestore ListOfTables
+	if backup.Legacy {
+		tablesForRestore, err = b.ch.GetBackupTablesLegacy(backupName, disks)
+	} else {
+		metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
+		if isEmbedded {
+			metadataPath = path.Join(diskMap[b.cfg.ClickHouse.EmbeddedBackupDisk], backupName, "metadata")
+		}
+		tablesForRestore, err = getTableListByPatternLocal(b.cfg, b.ch, metadataPath, opts.TablePattern, false, opts.Partitions)
+	}
+	if err != nil {
+		return err
+	}
+	if len(tablesForRestore) == 0 {
+		return fmt.Errorf("no have found schemas by %s in %s", opts.TablePattern, backupName)
+	}
+	tableTitles := make([]metadata.TableTitle, len(tablesForRestore))
+	for i, table := range tablesForRestore {
+		tableTitles[i] = metadata.TableTitle{Database: table.Database, Table: table.Table}
+	}
+	if unmatchedScopes := filesystemhelper.GetUnmatchedPartitionTableScopes(opts.Partitions, tableTitles); len(unmatchedScopes) > 0 {
+		return fmt.Errorf("--partitions table scope %s doesn't match any table in %s", strings.Join(unmatchedScopes, ", "), backupName)
+	}
+	if opts.LastPartitions > 0 {
+		for _, table := range tablesForRestore {
+			filterPartsByLastPartitions(table, opts.LastPartitions)
+		}
+	}
+	// --part restore only named parts, for surgical recovery of specific data
+	if len(opts.Parts) > 0 {
+		if tablesForRestore, err = filterPartsByNames(tablesForRestore, opts.Parts, backupName); err != nil {
+			return err
+		}
+	}
+	if opts.OnlyNewPartitions {
+		if err = b.filterOnlyNewPartitions(ctx, tablesForRestore, log); err != nil {
+			return err
+		}
+	}
+	var extraPartsByTable map[metadata.TableTitle][]string
+	if opts.SyncParts {
+		if extraPartsByTable, err = b.syncTableParts(ctx, backupName, requiredBackups, tablesForRestore, disks, opts.SyncPartsDetach, log); err != nil {
+			return err
+		}
+	}
+	// downloaded incremental backup already contains required parts, so broken chain is an error only when some parts absent
+	if brokenChainErr != nil && !isAllPartsExists(backupName, requiredBackups, tablesForRestore, disks) {
+		return brokenChainErr
+	}
+	version, err := b.ch.GetVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if err = checkExperimentalJSONColumns(tablesForRestore, backup.ClickHouseVersion, version); err != nil {
+		return err
+	}
+	var lowCardinalityTables []lowCardinalityTable
+	if b.cfg.General.VerifyLowCardinalityOnRestore {
+		lowCardinalityTables = b.getLowCardinalityTables(tablesForRestore)
+		warnLowCardinalityVersion(lowCardinalityTables, backup.ClickHouseVersion, version, log)
+	}
+	if b.cfg.General.VerifyAggregateFunctionsOnRestore != "none" {
+		if err = b.checkAggregateFunctions(ctx, tablesForRestore, backup.ClickHouseVersion, version, log); err != nil {
+			return err
+		}
+	}
+	log.Debugf("found %d tables with data in backup", len(tablesForRestore))
+	if isEmbedded {
+		err = b.restoreDataEmbedded(ctx, backupName, tablesForRestore, opts.Partitions, commandId)
+	} else {
+		if b.cfg.General.RestoreCheckFreeSpace {
+			if err = b.checkRestoreFreeSpace(ctx, tablesForRestore, disks, log); err != nil {
+				return err
+			}
+		}
+		err = b.restoreDataRegular(ctx, backupName, requiredBackups, opts, tablesForRestore, diskMap, disks, commandId, log)
+	}
+	if err != nil {
+		return err
+	}
+	if len(lowCardinalityTables) > 0 && !opts.SkipAttach {
+		if err = b.verifyLowCardinalityColumns(ctx, lowCardinalityTables, log); err != nil {
+			return err
+		}
+	}
+	// detach after all missing parts attached, so table doesn't lose data when restore failed
+	if opts.SyncPartsDetach {
+		if err = b.detachExtraParts(ctx, extraPartsByTable, log); err != nil {
+			return err
+		}
+	} else if len(extraPartsByTable) > 0 {
+		log.Warnf("%d tables contain parts which absent in backup, use --sync-parts-detach to detach them", len(extraPartsByTable))
+	}
+	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
+	return nil
+}
+
+// getRequiredBackupsChain - resolve incremental backups chain from nearest to base, return error and resolved part of chain when required backup doesn't exist locally
+func (b *Backuper) getRequiredBackupsChain(ctx context.Context, backupMetadata metadata.BackupMetadata, disks []clickhouse.Disk) ([]string, error) {
+	localBackups, _, err := b.GetLocalBackups(ctx, disks)
+	if err != nil {
+		return nil, err
+	}
+	return resolveRequiredBackupsChain(backupMetadata, localBackups)
+}
+
+// resolveRequiredBackupsChain - follow `required_backup` from backupMetadata through localBackups until base backup
+func resolveRequiredBackupsChain(backupMetadata metadata.BackupMetadata, localBackups []LocalBackup) ([]string, error) {
+	localBackupsMap := make(map[string]metadata.BackupMetadata, len(localBackups))
+	for _, localBackup := range localBackups {
+		localBackupsMap[localBackup.BackupName] = localBackup.BackupMetadata
+	}
+	var requiredBackups []string
+	visitedBackups := common.EmptyMap{backupMetadata.BackupName: struct{}{}}
+	for requiredBackup := backupMetadata.RequiredBackup; requiredBackup != ""; {
+		if _, visited := visitedBackups[requiredBackup]; visited {
+			return requiredBackups, fmt.Errorf("broken increment chain for '%s', cyclic dependency on '%s'", backupMetadata.BackupName, requiredBackup)
+		}
+		requiredMetadata, exists := localBackupsMap[requiredBackup]
+		if !exists {
+			return requiredBackups, fmt.Errorf("broken increment chain for '%s', required backup '%s' not found locally, download it first", backupMetadata.BackupName, requiredBackup)
+		}
+		visitedBackups[requiredBackup] = struct{}{}
+		requiredBackups = append(requiredBackups, requiredBackup)
+		requiredBackup = requiredMetadata.RequiredBackup
+	}
+	return requiredBackups, nil
+}
+
+func isAllPartsExists(backupName string, requiredBackups []string, tablesForRestore ListOfTables, disks []clickhouse.Disk) bool {
+	for _, table := range tablesForRestore {
+		for _, disk := range disks {
+			for _, part := range table.Parts[disk.Name] {
+				if filesystemhelper.IsProjection(part.Name) {
+					continue
+				}
+				if _, err := os.Stat(filesystemhelper.GetBackupPartPath(backupName, requiredBackups, table, disk, part.Name)); os.IsNotExist(err) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (b *Backuper) restoreDataEmbedded(ctx context.Context, backupName string, tablesForRestore ListOfTables, partitions []string, commandId int) error {
+	return b.restoreEmbedded(ctx, backupName, false, tablesForRestore, partitions, commandId)
+}
+
+func (b *Backuper) restoreDataRegular(ctx context.Context, backupName string, requiredBackups []string, opts RestoreOptions, tablesForRestore ListOfTables, diskMap map[string]string, disks []clickhouse.Disk, commandId int, log *apexLog.Entry) error {
+	tablePattern := opts.TablePattern
+	// tables dropped and created from backup schema just now, column types can't differ
+	isTablesRecreated := opts.DropTable && !opts.DataOnly
+	if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
+		for sourceDb, targetDb := range b.cfg.General.RestoreDatabaseMapping {
+			if tablePattern != "" {
+				sourceDbRE := regexp.MustCompile(fmt.Sprintf("(^%s.*)|(,%s.*)", sourceDb, sourceDb))
+				if sourceDbRE.MatchString(tablePattern) {
+					matches := sourceDbRE.FindAllStringSubmatch(tablePattern, -1)
+					substitution := targetDb + ".*"
+					if strings.HasPrefix(matches[0][1], ",") {
+						substitution = "," + substitution
+					}
+					tablePattern = sourceDbRE.ReplaceAllString(tablePattern, substitution)
+				} else {
+					tablePattern += "," + targetDb + ".*"
+				}
+			} else {
+				tablePattern += targetDb + ".*"
+			}
+		}
+	}
+	if tablePattern != "" {
+		for sourceTable := range b.cfg.General.RestoreTableMapping {
+			sourceTableParts := strings.SplitN(sourceTable, ".", 2)
+			if len(sourceTableParts) == 2 {
+				dstDatabase, dstTable := getRestoreTableMappingTarget(sourceTableParts[0], sourceTableParts[1], b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+				tablePattern += "," + dstDatabase + "." + dstTable
+			}
+		}
+	}
+	chTables, err := b.ch.GetTables(ctx, tablePattern)
+	if err != nil {
+		return err
+	}
+	if disks, err = b.getRestoreDisks(backupName, tablesForRestore, disks, diskMap, log); err != nil {
+		return err
+	}
+	warnEncryptedDisks(tablesForRestore, disks, log)
+	warnObjectDisks(tablesForRestore, disks, log)
+	missingTables, tablesForCreate := b.getMissingTables(tablesForRestore, chTables)
+	if len(missingTables) > 0 && b.cfg.General.RestoreCreateMissingTables {
+		log.Infof("%s is not created, will restore schema from backup", strings.Join(missingTables, ", "))
+		if chTables, err = b.createMissingTables(ctx, tablesForCreate, tablePattern, opts.SchemaAsAttach, log); err != nil {
+			return err
+		}
+	} else if len(missingTables) > 0 {
+		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
+	}
+	if b.cfg.General.RestoreCheckCodecs {
+		if err = b.checkCompressionCodecs(ctx, backupName, requiredBackups, tablesForRestore, disks, log); err != nil {
+			return err
+		}
+	}
+	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{}
+	for i, chTable := range chTables {
+		dstTablesMap[metadata.TableTitle{
+			Database: chTables[i].Database,
+			Table:    chTables[i].Name,
+		}] = chTable
+	}
+	if err = b.checkAttachSupported(tablesForRestore, dstTablesMap); err != nil {
+		return err
+	}
+	if !isTablesRecreated {
+		createdTables := make(map[metadata.TableTitle]struct{}, len(tablesForCreate))
+		for _, table := range tablesForCreate {
+			dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+			createdTables[metadata.TableTitle{Database: dstDatabase, Table: dstTableName}] = struct{}{}
+		}
+		if err = b.checkColumnTypes(ctx, tablesForRestore, dstTablesMap, createdTables, log); err != nil {
+			return err
+		}
+	}
+
+	totalRestoredSize := uint64(0)
+	totalRestoredParts := 0
+	var failedTables []string
+	// attachState - parts attached before restore crash or failure, to avoid duplicated data when restore retried
+	// --replace-partitions attach parts into temporary table, so retry replace partitions again without duplicates
+	var attachState *resumable.State
+	if !opts.SkipAttach && !opts.ReplacePartitions {
+		attachState = resumable.NewStateFile(getRestoreAttachStateFile(diskMap["default"], backupName), nil)
+		defer attachState.Close()
+	}
+	currentTableName := ""
+	// pendingPostCommand - table which `pre_restore_table_command` already done, `post_restore_table_command` runs for it even when table restore failed
+	var pendingPostCommand *metadata.TableTitle
+	// skipTableOnError - return nil when `restore_continue_on_error: true` to continue with next table
+	skipTableOnError := func(tableErr error, log *apexLog.Entry) error {
+		if pendingPostCommand != nil {
+			postCommandTable := *pendingPostCommand
+			pendingPostCommand = nil
+			// table restore could fail due to canceled context, post command shall run anyway
+			if err := b.runRestoreTableCommand(context.Background(), "post_restore_table_command", b.cfg.General.PostRestoreTableCommand, postCommandTable.Database, postCommandTable.Table, tableErr, log); err != nil {
+				log.Warn(err.Error())
+			}
+		}
+		status.Current.FinishTable(commandId, currentTableName, tableErr)
+		metrics.Restore.Errors.WithLabelValues(backupName).Inc()
+		return skipRestoreTableError(ctx, b.cfg.General.RestoreContinueOnError, tableErr, &failedTables, log)
+	}
+	// stoppedMergesTables - merges will start again after all tables restored, even when restore failed
+	var stoppedMergesTables []metadata.TableTitle
+	defer func() {
+		for _, t := range stoppedMergesTables {
+			if err := b.ch.StartMerges(context.Background(), t.Database, t.Table); err != nil {
+				log.Errorf("can't start merges for '%s.%s': %v", t.Database, t.Table, err)
+				continue
+			}
+			log.Infof("merges started for '%s.%s'", t.Database, t.Table)
+		}
+	}()
+	// freezeName - one `shadow` folder for all tables of current restore
+	freezeName := getRestoreFreezeName(backupName)
+	for i, table := range tablesForRestore {
+		// need mapped database and table path and original table.Database and table.Table for CopyDataToDetached
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		tablesForRestore[i].Database = dstDatabase
+		tablesForRestore[i].Table = dstTableName
+		currentTableName = fmt.Sprintf("%s.%s", dstDatabase, dstTableName)
+		pendingPostCommand = nil
+		status.Current.StartTable(commandId, currentTableName)
+		log := log.WithField("table", currentTableName)
+		dstTable, ok := dstTablesMap[metadata.TableTitle{
+			Database: dstDatabase,
+			Table:    dstTableName}]
+		if !ok {
+			if err := skipTableOnError(fmt.Errorf("can't find '%s.%s' in current system.tables", dstDatabase, dstTableName), log); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.runRestoreTableCommand(ctx, "pre_restore_table_command", b.cfg.General.PreRestoreTableCommand, dstDatabase, dstTableName, nil, log); err != nil {
+			if err = skipTableOnError(err, log); err != nil {
+				return err
+			}
+			continue
+		}
+		pendingPostCommand = &metadata.TableTitle{Database: dstDatabase, Table: dstTableName}
+		// `restore_reinsert_on_sortkey_mismatch` attach parts into temporary table with backup schema and copy rows with INSERT SELECT
+		reinsert := b.cfg.General.RestoreReinsertOnSortkeyMismatch && !opts.SkipAttach && !opts.ReplacePartitions && isSortingKeyMismatch(table.Query, dstTable.CreateTableQuery)
+		if reinsert {
+			log.Warnf("ORDER BY of table in backup differs from current table, data will be restored with INSERT SELECT from temporary table")
+		}
+		// table UUID changed after re-create, so state of dropped table will not applied
+		attachStateKey := func(disk, part string) string {
+			return fmt.Sprintf("`%s`.`%s`.%s/%s/%s", dstDatabase, dstTableName, dstTable.UUID, disk, part)
+		}
+		if attachState != nil && !reinsert {
+			notAttachedParts, alreadyAttachedParts := getNotAttachedParts(table.Parts, attachState, attachStateKey)
+			if alreadyAttachedParts > 0 {
+				log.Warnf("%d parts already attached during previous restore, will skip them", alreadyAttachedParts)
+				table.Parts = notAttachedParts
+				tablesForRestore[i].Parts = notAttachedParts
+			}
+		}
+		// parts attached into temporary table are lost after its drop, so for reinsert restore retried for partitions which not inserted
+		if attachState != nil && reinsert {
+			var insertedPartitions []string
+			notInsertedParts := make(map[string][]metadata.Part, len(table.Parts))
+			for _, partitionParts := range splitPartsByPartition(table.Parts) {
+				partitionID := getPartsPartitionID(partitionParts)
+				if attachState.IsAlreadyProcessedBool(getReinsertStateKey(dstDatabase, dstTableName, dstTable.UUID, partitionID)) {
+					insertedPartitions = append(insertedPartitions, partitionID)
+					continue
+				}
+				for disk, parts := range partitionParts {
+					notInsertedParts[disk] = append(notInsertedParts[disk], parts...)
+				}
+			}
+			if len(insertedPartitions) > 0 {
+				log.Warnf("partitions %s already inserted during previous restore, will skip them", strings.Join(insertedPartitions, ", "))
+				table.Parts = notInsertedParts
+				tablesForRestore[i].Parts = notInsertedParts
+			}
+		}
+		// parts from backup with the same block numbers as active parts already present in table, when restore into the same table which backup created from
+		if b.cfg.General.RestoreOverlappingPartsMode != "force" && !opts.ReplacePartitions && !reinsert {
+			existingParts, err := b.ch.GetPartsState(ctx, dstDatabase, dstTableName, getRestoredPartitionIDs(table.Parts))
+			if err != nil {
+				if err = skipTableOnError(fmt.Errorf("can't get parts from system.parts for table '%s.%s': %v", dstDatabase, dstTableName, err), log); err != nil {
+					return err
+				}
+				continue
+			}
+			notOverlappingParts, overlappingParts := splitOverlappingParts(table.Parts, existingParts)
+			if len(overlappingParts) > 0 {
+				log.Warnf("parts %s overlap block numbers of existing active parts, skipped", strings.Join(overlappingParts, ", "))
+				table.Parts = notOverlappingParts
+				tablesForRestore[i].Parts = notOverlappingParts
+			}
+		}
+		// rows and parts of replaced partitions are removed, so count() before and after attach are not comparable
+		verifyRows := b.cfg.General.VerifyRowsOnRestore && !opts.SkipAttach && !opts.ReplacePartitions
+		if verifyRows && !isRowsVerificationSupported(dstTable) {
+			log.Infof("%s engine, rows verification skipped", dstTable.Engine)
+			verifyRows = false
+		}
+		rowsBeforeAttach := uint64(0)
+		if verifyRows {
+			if rowsBeforeAttach, err = b.ch.GetTableRowsCount(ctx, tablesForRestore[i].Database, tablesForRestore[i].Table); err != nil {
+				if err = skipTableOnError(fmt.Errorf("can't get rows count for table '%s.%s': %v", tablesForRestore[i].Database, tablesForRestore[i].Table, err), log); err != nil {
+					return err
+				}
+				continue
 			}
 		}
-		tablesForRestore = notRestoredTables
-		if len(tablesForRestore) == 0 {
-			break
+		if b.cfg.General.RestoreStopMerges && !opts.SkipAttach {
+			if err := b.ch.StopMerges(ctx, tablesForRestore[i].Database, tablesForRestore[i].Table); err != nil {
+				if err = skipTableOnError(fmt.Errorf("can't stop merges for table '%s.%s': %v", tablesForRestore[i].Database, tablesForRestore[i].Table, err), log); err != nil {
+					return err
+				}
+				continue
+			}
+			stoppedMergesTables = append(stoppedMergesTables, metadata.TableTitle{Database: tablesForRestore[i].Database, Table: tablesForRestore[i].Table})
+			log.Info("merges stopped")
 		}
-	}
-	return nil
-}
-
-func (b *Backuper) dropExistsTables(tablesForDrop ListOfTables, ignoreDependencies bool, version int, log *apexLog.Entry) error {
-	var dropErr error
-	dropRetries := 0
-	totalRetries := len(tablesForDrop)
-	for dropRetries < totalRetries {
-		var notDroppedTables ListOfTables
-		for i, schema := range tablesForDrop {
-			if schema.Query == "" {
-				possibleQueries := []string{
-					fmt.Sprintf("CREATE DICTIONARY `%s`.`%s`", schema.Database, schema.Table),
-					fmt.Sprintf("CREATE MATERIALIZED VIEW `%s`.`%s`", schema.Database, schema.Table),
+		verifyParts := b.cfg.General.VerifyActivePartsOnRestore != "none" && !opts.SkipAttach && !opts.ReplacePartitions && !reinsert
+		var partsBeforeAttach common.EmptyMap
+		if verifyParts {
+			if partsBeforeAttach, err = b.getPartNamesBeforeAttach(ctx, tablesForRestore[i].Database, tablesForRestore[i].Table, getRestoredPartitionIDs(table.Parts)); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
 				}
-				if len(schema.Parts) > 0 {
-					possibleQueries = append([]string{
-						fmt.Sprintf("CREATE TABLE `%s`.`%s`", schema.Database, schema.Table),
-					}, possibleQueries...)
+				continue
+			}
+		}
+		// --attach-incrementally copy and attach parts partition by partition, so restored partitions available for queries before the whole table restored
+		attachEachPartition := opts.AttachIncrementally && !opts.SkipAttach && !reinsert
+		partsBatches := []map[string][]metadata.Part{table.Parts}
+		if attachEachPartition {
+			partsBatches = splitPartsByPartition(table.Parts)
+		}
+		// --replace-partitions copy and attach parts into temporary table with the same structure, then replace partitions of destination table from it
+		copyDstTable := dstTable
+		if opts.ReplacePartitions {
+			if copyDstTable, err = b.createReplaceStagingTable(ctx, dstTable, log); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
 				}
-				for _, query := range possibleQueries {
-					dropErr = b.ch.DropTable(clickhouse.Table{
-						Database: schema.Database,
-						Name:     schema.Table,
-					}, query, b.cfg.General.RestoreSchemaOnCluster, ignoreDependencies, version)
-					if dropErr == nil {
-						tablesForDrop[i].Query = query
+				continue
+			}
+		} else if reinsert {
+			if copyDstTable, err = b.createReinsertStagingTable(ctx, table, dstTable, log); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		restoredSize := uint64(0)
+		restoredTableParts := make(map[string][]metadata.Part, len(table.Parts))
+		attachedParts := common.EmptyMap{}
+		attachPartitions := func(attachTable metadata.TableMetadata) error {
+			if err := b.ch.AttachPartitions(attachTable, disks, func(disk clickhouse.Disk, part metadata.Part) {
+				attachedParts[path.Join(disk.Name, part.Name)] = struct{}{}
+				if attachState != nil && !reinsert {
+					attachState.AppendToState(attachStateKey(disk.Name, part.Name), 0)
+				}
+			}); err != nil {
+				copiedTable := tablesForRestore[i]
+				copiedTable.Parts = restoredTableParts
+				b.cleanNotAttachedParts(copiedTable, attachedParts, disks, copyDstTable.DataPaths, log)
+				return fmt.Errorf("can't attach partitions for table '%s.%s': %v", tablesForRestore[i].Database, tablesForRestore[i].Table, err)
+			}
+			return nil
+		}
+		var restoreErr error
+		for _, parts := range partsBatches {
+			batchTable := table
+			batchTable.Parts = parts
+			batchSize, err := filesystemhelper.CopyDataToDetached(ctx, backupName, requiredBackups, batchTable, disks, copyDstTable.DataPaths, b.ch, b.cfg)
+			if err != nil {
+				restoreErr = fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
+				break
+			}
+			restoredSize += batchSize
+			for disk, diskParts := range batchTable.Parts {
+				restoredTableParts[disk] = append(restoredTableParts[disk], diskParts...)
+			}
+			if attachEachPartition {
+				attachTable := tablesForRestore[i]
+				attachTable.Parts = batchTable.Parts
+				if restoreErr = attachPartitions(attachTable); restoreErr != nil {
+					break
+				}
+				log.Debugf("partition %s attached", getPartsPartitionID(batchTable.Parts))
+			}
+		}
+		if restoreErr != nil {
+			if opts.ReplacePartitions || reinsert {
+				b.dropStagingTable(copyDstTable, log)
+			}
+			if err = skipTableOnError(restoreErr, log); err != nil {
+				return err
+			}
+			continue
+		}
+		log.Debugf("copied data to 'detached'")
+		// missing parts could be excluded during copy, when `restore_skip_missing_parts: true`
+		table.Parts = restoredTableParts
+		tablesForRestore[i].Parts = restoredTableParts
+		restoredParts := 0
+		for _, parts := range table.Parts {
+			restoredParts += len(parts)
+		}
+		totalRestoredSize += restoredSize
+		metrics.Restore.Bytes.WithLabelValues(backupName).Add(float64(restoredSize))
+		totalRestoredParts += restoredParts
+		log = log.WithFields(apexLog.Fields{
+			"parts": restoredParts,
+			"size":  utils.FormatBytes(restoredSize),
+		})
+		if opts.SkipAttach {
+			b.logAttachQueries(tablesForRestore[i], disks, log)
+			pendingPostCommand = nil
+			if err := b.runRestoreTableCommand(ctx, "post_restore_table_command", b.cfg.General.PostRestoreTableCommand, dstDatabase, dstTableName, nil, log); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Info("copied to 'detached', attach skipped")
+			status.Current.FinishTable(commandId, currentTableName, nil)
+			metrics.Restore.Tables.WithLabelValues(backupName).Inc()
+			continue
+		}
+		// expected rows scoped to restored parts, so --partitions and --last-partitions are respected
+		expectedRows := getPartsRows(table.Parts)
+		if verifyRows && expectedRows == 0 {
+			if restoredParts > 0 {
+				log.Warn("backup metadata doesn't contain rows count for parts, rows verification skipped")
+			}
+			verifyRows = false
+		}
+		if opts.ReplacePartitions {
+			attachTable := tablesForRestore[i]
+			attachTable.Database, attachTable.Table = copyDstTable.Database, copyDstTable.Name
+			err := attachPartitions(attachTable)
+			if err == nil {
+				err = b.replaceRestoredPartitions(ctx, tablesForRestore[i], copyDstTable, log)
+			}
+			b.dropStagingTable(copyDstTable, log)
+			if err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if reinsert {
+			attachTable := tablesForRestore[i]
+			attachTable.Database, attachTable.Table = copyDstTable.Database, copyDstTable.Name
+			err := attachPartitions(attachTable)
+			if err == nil {
+				err = b.reinsertRestoredData(ctx, tablesForRestore[i], copyDstTable, func(partitionID string) {
+					if attachState != nil {
+						attachState.AppendToState(getReinsertStateKey(dstDatabase, dstTableName, dstTable.UUID, partitionID), 0)
 					}
+				}, log)
+			}
+			b.dropStagingTable(copyDstTable, log)
+			if err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
 				}
-			} else {
-				dropErr = b.ch.DropTable(clickhouse.Table{
-					Database: schema.Database,
-					Name:     schema.Table,
-				}, schema.Query, b.cfg.General.RestoreSchemaOnCluster, ignoreDependencies, version)
+				continue
 			}
-
-			if dropErr != nil {
-				dropRetries++
-				if dropRetries >= totalRetries {
-					return fmt.Errorf(
-						"can't drop table `%s`.`%s`: %v after %d times, please check your schema dependencies",
-						schema.Database, schema.Table, dropErr, dropRetries,
-					)
-				} else {
-					log.Warnf(
-						"can't drop table '%s.%s': %v, will try again", schema.Database, schema.Table, dropErr,
-					)
+		} else if !attachEachPartition {
+			if err := attachPartitions(tablesForRestore[i]); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
 				}
-				notDroppedTables = append(notDroppedTables, schema)
+				continue
 			}
 		}
-		tablesForDrop = notDroppedTables
-		if len(tablesForDrop) == 0 {
-			break
+		// ATTACH PART moves part from `detached`, but empty directories could be left after partial copy
+		if removedPaths, err := filesystemhelper.RemoveEmptyDetachedDirs(filesystemhelper.GetDetachedPartPaths(table, disks, copyDstTable.DataPaths, b.cfg.General.RestoreDiskNameMapping), false); err != nil {
+			log.Warnf("can't remove empty directories from 'detached': %v", err)
+		} else if len(removedPaths) > 0 {
+			log.Debugf("empty directories removed from 'detached': %s", strings.Join(removedPaths, ", "))
+		}
+		if b.cfg.General.MaterializeIndexesAfterRestore {
+			if err := b.materializeIndexes(ctx, tablesForRestore[i], log); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if verifyRows {
+			rowsAfterAttach, err := b.ch.GetTableRowsCount(ctx, tablesForRestore[i].Database, tablesForRestore[i].Table)
+			if err == nil && (rowsAfterAttach < rowsBeforeAttach || rowsAfterAttach-rowsBeforeAttach != expectedRows) {
+				err = fmt.Errorf("rows count mismatch, expected %d restored rows, count() before attach %d, after attach %d", expectedRows, rowsBeforeAttach, rowsAfterAttach)
+			}
+			if err != nil {
+				if err = skipTableOnError(fmt.Errorf("can't verify rows for table '%s.%s': %v", tablesForRestore[i].Database, tablesForRestore[i].Table, err), log); err != nil {
+					return err
+				}
+				continue
+			}
+			log = log.WithField("rows", expectedRows)
+		}
+		if verifyParts {
+			if err := b.verifyActiveParts(ctx, tablesForRestore[i], partsBeforeAttach, log); err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if opts.FreezeAfterRestore {
+			freezePaths, err := b.freezeRestoredTable(ctx, freezeName, tablesForRestore[i], dstTable, disks)
+			if err != nil {
+				if err = skipTableOnError(err, log); err != nil {
+					return err
+				}
+				continue
+			}
+			log = log.WithField("frozen", strings.Join(freezePaths, ", "))
+		}
+		pendingPostCommand = nil
+		if err := b.runRestoreTableCommand(ctx, "post_restore_table_command", b.cfg.General.PostRestoreTableCommand, dstDatabase, dstTableName, nil, log); err != nil {
+			if err = skipTableOnError(err, log); err != nil {
+				return err
+			}
+			continue
 		}
+		log.Info("done")
+		status.Current.FinishTable(commandId, currentTableName, nil)
+		metrics.Restore.Tables.WithLabelValues(backupName).Inc()
+	}
+	log.WithFields(apexLog.Fields{
+		"tables": len(tablesForRestore),
+		"parts":  totalRestoredParts,
+		"size":   utils.FormatBytes(totalRestoredSize),
+	}).Info("data restored")
+	if err := getFailedTablesError(failedTables); err != nil {
+		return err
+	}
+	if attachState != nil {
+		attachState.Cleanup()
 	}
 	return nil
 }
 
-// RestoreData - restore data for tables matched by tablePattern from backupName
-func (b *Backuper) RestoreData(ctx context.Context, backupName string, tablePattern string, partitions []string, disks []clickhouse.Disk, isEmbedded bool) error {
-	startRestore := time.Now()
-	log := apexLog.WithFields(apexLog.Fields{
-		"backup":    backupName,
-		"operation": "restore",
-	})
-	defaultDataPath, err := b.ch.GetDefaultPath(disks)
-	if err != nil {
-		return ErrUnknownClickhouseDataPath
-	}
-	if b.ch.IsClickhouseShadow(path.Join(defaultDataPath, "backup", backupName, "shadow")) {
-		return fmt.Errorf("backups created in v0.0.1 is not supported now")
-	}
-	backup, _, err := b.getLocalBackup(ctx, backupName, disks)
-	if err != nil {
-		return fmt.Errorf("can't restore: %v", err)
+// skipRestoreTableError - collect tableErr into failedTables and return nil when continueOnError, canceled context always stops restore
+func skipRestoreTableError(ctx context.Context, continueOnError bool, tableErr error, failedTables *[]string, log *apexLog.Entry) error {
+	if !continueOnError || ctx.Err() != nil {
+		return tableErr
 	}
+	log.Errorf("%v, will continue with next table", tableErr)
+	*failedTables = append(*failedTables, tableErr.Error())
+	return nil
+}
 
-	diskMap := map[string]string{}
-	for _, disk := range disks {
-		diskMap[disk.Name] = disk.Path
-	}
-	var tablesForRestore ListOfTables
-	if backup.Legacy {
-		tablesForRestore, err = b.ch.GetBackupTablesLegacy(backupName, disks)
-	} else {
-		metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
-		if isEmbedded {
-			metadataPath = path.Join(diskMap[b.cfg.ClickHouse.EmbeddedBackupDisk], backupName, "metadata")
-		}
-		tablesForRestore, err = getTableListByPatternLocal(b.cfg, b.ch, metadataPath, tablePattern, false, partitions)
+// getFailedTablesError - summary error for tables skipped by `restore_continue_on_error`
+func getFailedTablesError(failedTables []string) error {
+	if len(failedTables) > 0 {
+		return fmt.Errorf("can't restore data for %d tables: %s", len(failedTables), strings.Join(failedTables, "; "))
 	}
+	return nil
+}
+
+// checkCompressionCodecs - codecs from table schema and `default_compression_codec.txt` of backup parts shall be supported by server, custom builds could miss some codecs
+// parts compressed with unsupported codec will attach successfully, but can't be read
+func (b *Backuper) checkCompressionCodecs(ctx context.Context, backupName string, requiredBackups []string, tablesForRestore ListOfTables, disks []clickhouse.Disk, log *apexLog.Entry) error {
+	serverCodecs, err := b.ch.GetCodecs(ctx)
 	if err != nil {
 		return err
 	}
-	if len(tablesForRestore) == 0 {
-		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, backupName)
+	if serverCodecs == nil {
+		log.Warn("system.codecs doesn't exist, compression codecs check skipped")
+		return nil
 	}
-	log.Debugf("found %d tables with data in backup", len(tablesForRestore))
-	if isEmbedded {
-		err = b.restoreDataEmbedded(backupName, tablesForRestore, partitions)
-	} else {
-		err = b.restoreDataRegular(ctx, backupName, tablePattern, tablesForRestore, diskMap, disks, log)
+	supportedCodecs := make(common.EmptyMap, len(serverCodecs))
+	for _, codec := range serverCodecs {
+		supportedCodecs[strings.ToUpper(codec)] = struct{}{}
 	}
-	if err != nil {
-		return err
+	var unsupportedTables []string
+	for _, table := range tablesForRestore {
+		codecs := getCodecNames(table.Query)
+		for _, disk := range disks {
+			for _, part := range table.Parts[disk.Name] {
+				partPath := filesystemhelper.GetBackupPartPath(backupName, requiredBackups, table, disk, part.Name)
+				if codecBody, err := os.ReadFile(path.Join(partPath, "default_compression_codec.txt")); err == nil {
+					codecs = append(codecs, getCodecNames(string(codecBody))...)
+				}
+			}
+		}
+		var unsupportedCodecs []string
+		isAdded := common.EmptyMap{}
+		for _, codec := range codecs {
+			if _, isSupported := supportedCodecs[strings.ToUpper(codec)]; isSupported {
+				continue
+			}
+			if _, exists := isAdded[codec]; !exists {
+				isAdded[codec] = struct{}{}
+				unsupportedCodecs = append(unsupportedCodecs, codec)
+			}
+		}
+		if len(unsupportedCodecs) > 0 {
+			unsupportedTables = append(unsupportedTables, fmt.Sprintf("'%s.%s': %s", table.Database, table.Table, strings.Join(unsupportedCodecs, ", ")))
+		}
+	}
+	if len(unsupportedTables) > 0 {
+		return fmt.Errorf("compression codecs are not supported by current ClickHouse server, %s", strings.Join(unsupportedTables, "; "))
 	}
-	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
 	return nil
 }
 
-func (b *Backuper) restoreDataEmbedded(backupName string, tablesForRestore ListOfTables, partitions []string) error {
-	return b.restoreEmbedded(backupName, false, tablesForRestore, partitions)
+// materializeIndexes - parts from backup created before index was added don't contain index files, so rebuild each skip index from table schema
+// mutation executed without ON CLUSTER, each host rebuilds index for its own restored table, mutation of Replicated*MergeTree table replicated to other replicas, so it skipped when already created by other replica
+func (b *Backuper) materializeIndexes(ctx context.Context, table metadata.TableMetadata, log *apexLog.Entry) error {
+	isReplicated := strings.Contains(table.Query, "Replicated")
+	for _, index := range getSkipIndexNames(table.Query) {
+		if isReplicated {
+			isInProgress, err := b.ch.IsMaterializeIndexInProgress(ctx, table.Database, table.Table, index)
+			if err != nil {
+				return fmt.Errorf("can't check mutations of index `%s` for table '%s.%s': %v", index, table.Database, table.Table, err)
+			}
+			if isInProgress {
+				log.Infof("index `%s` materialization already started by other replica", index)
+				continue
+			}
+		}
+		if err := b.ch.MaterializeIndex(ctx, table.Database, table.Table, index); err != nil {
+			return fmt.Errorf("can't materialize index `%s` for table '%s.%s': %v", index, table.Database, table.Table, err)
+		}
+		log.Infof("index `%s` materialized", index)
+	}
+	return nil
 }
 
-func (b *Backuper) restoreDataRegular(ctx context.Context, backupName string, tablePattern string, tablesForRestore ListOfTables, diskMap map[string]string, disks []clickhouse.Disk, log *apexLog.Entry) error {
-	if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
-		for sourceDb, targetDb := range b.cfg.General.RestoreDatabaseMapping {
-			if tablePattern != "" {
-				sourceDbRE := regexp.MustCompile(fmt.Sprintf("(^%s.*)|(,%s.*)", sourceDb, sourceDb))
-				if sourceDbRE.MatchString(tablePattern) {
-					matches := sourceDbRE.FindAllStringSubmatch(tablePattern, -1)
-					substitution := targetDb + ".*"
-					if strings.HasPrefix(matches[0][1], ",") {
-						substitution = "," + substitution
-					}
-					tablePattern = sourceDbRE.ReplaceAllString(tablePattern, substitution)
-				} else {
-					tablePattern += "," + targetDb + ".*"
-				}
-			} else {
-				tablePattern += targetDb + ".*"
+// splitPartsByPartition - disk to parts maps for each partition, sorted by partition ID
+func splitPartsByPartition(disksToPartsMap map[string][]metadata.Part) []map[string][]metadata.Part {
+	partitionParts := map[string]map[string][]metadata.Part{}
+	for disk, parts := range disksToPartsMap {
+		for _, part := range parts {
+			partitionID := part.PartitionID
+			if partitionID == "" {
+				partitionID = strings.Split(part.Name, "_")[0]
+			}
+			if _, exists := partitionParts[partitionID]; !exists {
+				partitionParts[partitionID] = map[string][]metadata.Part{}
 			}
+			partitionParts[partitionID][disk] = append(partitionParts[partitionID][disk], part)
 		}
 	}
-	chTables, err := b.ch.GetTables(ctx, tablePattern)
-	if err != nil {
-		return err
+	partitionIDs := make([]string, 0, len(partitionParts))
+	for partitionID := range partitionParts {
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	sort.Strings(partitionIDs)
+	result := make([]map[string][]metadata.Part, 0, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		result = append(result, partitionParts[partitionID])
 	}
+	return result
+}
+
+// getPartsPartitionID - partition ID of the first part, for logging
+func getPartsPartitionID(disksToPartsMap map[string][]metadata.Part) string {
+	for _, parts := range disksToPartsMap {
+		for _, part := range parts {
+			if part.PartitionID != "" {
+				return part.PartitionID
+			}
+			return strings.Split(part.Name, "_")[0]
+		}
+	}
+	return ""
+}
+
+// getRestoreDisks - add disks from backup which absent in system.disks, mapped by `restore_disk_name_mapping` or placed to `default` disk path, fail with `strict_disk_mapping: true`
+func (b *Backuper) getRestoreDisks(backupName string, tablesForRestore ListOfTables, disks []clickhouse.Disk, diskMap map[string]string, log *apexLog.Entry) ([]clickhouse.Disk, error) {
+	for backupDiskName, diskName := range b.cfg.General.RestoreDiskNameMapping {
+		if _, diskExists := diskMap[diskName]; !diskExists {
+			return nil, fmt.Errorf("`restore_disk_name_mapping` contains %s:%s, but disk '%s' not found in clickhouse table system.disks", backupDiskName, diskName, diskName)
+		}
+	}
+	var missingDisks []string
 	for _, t := range tablesForRestore {
 		for disk := range t.Parts {
 			if _, diskExists := diskMap[disk]; !diskExists {
+				if diskName, isMapped := b.cfg.General.RestoreDiskNameMapping[disk]; isMapped {
+					disks = addMappedBackupDisk(disks, backupName, disk, diskName, diskMap)
+					continue
+				}
+				if b.cfg.General.StrictDiskMapping {
+					missingDisks = append(missingDisks, fmt.Sprintf("'%s' required by '%s.%s'", disk, t.Database, t.Table))
+					continue
+				}
 				log.Warnf("table '%s.%s' require disk '%s' that not found in clickhouse table system.disks, you can add nonexistent disks to `disk_mapping` in  `clickhouse` config section, data will restored to %s", t.Database, t.Table, disk, diskMap["default"])
 				found := false
 				for _, d := range disks {
@@ -570,66 +2625,134 @@ func (b *Backuper) restoreDataRegular(ctx context.Context, backupName string, ta
 			}
 		}
 	}
-	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{}
-	for i, chTable := range chTables {
-		dstTablesMap[metadata.TableTitle{
-			Database: chTables[i].Database,
-			Table:    chTables[i].Name,
-		}] = chTable
+	if len(missingDisks) > 0 {
+		sort.Strings(missingDisks)
+		return nil, fmt.Errorf("disks %s not found in clickhouse table system.disks, add them to `disk_mapping` in `clickhouse` config section or set `strict_disk_mapping: false` in `general` config section to restore data to %s", strings.Join(missingDisks, ", "), diskMap["default"])
 	}
+	return disks, nil
+}
 
-	var missingTables []string
-	for _, table := range tablesForRestore {
-		dstDatabase := table.Database
-		if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
-			if targetDB, isMapped := b.cfg.General.RestoreDatabaseMapping[table.Database]; isMapped {
-				dstDatabase = targetDB
+// addMappedBackupDisk - add pseudo disk for renamed backup disk, backup files downloaded to mapped disk or to `default` disk by old versions
+func addMappedBackupDisk(disks []clickhouse.Disk, backupName, backupDiskName, diskName string, diskMap map[string]string) []clickhouse.Disk {
+	for _, d := range disks {
+		if d.Name == backupDiskName {
+			return disks
+		}
+	}
+	mappedDisk := clickhouse.Disk{Name: backupDiskName, Path: diskMap["default"], Type: "local"}
+	for _, d := range disks {
+		if d.Name == diskName {
+			mappedDisk.Type = d.Type
+			if shadowDirs, err := filepath.Glob(path.Join(d.Path, "backup", backupName, "shadow", "*", "*", backupDiskName)); err == nil && len(shadowDirs) > 0 {
+				mappedDisk.Path = d.Path
 			}
+			break
 		}
+	}
+	return append(disks, mappedDisk)
+}
+
+// getMissingTables - tables from backup which absent in ClickHouse after `restore_table_mapping` and `restore_database_mapping`, names for log and tables from backup for create
+func (b *Backuper) getMissingTables(tablesForRestore ListOfTables, chTables []clickhouse.Table) ([]string, ListOfTables) {
+	var missingTables []string
+	var tablesForCreate ListOfTables
+	for _, table := range tablesForRestore {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
 		found := false
 		for _, chTable := range chTables {
-			if (dstDatabase == chTable.Database) && (table.Table == chTable.Name) {
+			if (dstDatabase == chTable.Database) && (dstTableName == chTable.Name) {
 				found = true
 				break
 			}
 		}
 		if !found {
-			missingTables = append(missingTables, fmt.Sprintf("'%s.%s'", dstDatabase, table.Table))
+			missingTables = append(missingTables, fmt.Sprintf("'%s.%s'", dstDatabase, dstTableName))
+			tablesForCreate = append(tablesForCreate, table)
 		}
 	}
-	if len(missingTables) > 0 {
-		return fmt.Errorf("%s is not created. Restore schema first or create missing tables manually", strings.Join(missingTables, ", "))
+	return missingTables, tablesForCreate
+}
+
+// createMissingTables - restore schema only for tables which exist in backup but absent in ClickHouse, return refreshed list of tables
+func (b *Backuper) createMissingTables(ctx context.Context, tablesForCreate ListOfTables, tablePattern string, schemaAsAttach bool, log *apexLog.Entry) ([]clickhouse.Table, error) {
+	for _, table := range tablesForCreate {
+		if table.Query == "" {
+			return nil, fmt.Errorf("'%s.%s' doesn't contain schema in backup, can't create it", table.Database, table.Table)
+		}
 	}
+	if len(b.cfg.General.RestoreTableMapping) > 0 {
+		if err := changeTableQueryToAdjustTableMapping(&tablesForCreate, b.cfg.General.RestoreTableMapping); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
+		if err := changeTableQueryToAdjustDatabaseMapping(&tablesForCreate, b.cfg.General.RestoreDatabaseMapping); err != nil {
+			return nil, err
+		}
+	}
+	version, err := b.ch.GetVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = b.restoreSchemaRegular(tablesForCreate, version, schemaAsAttach, false, nil, log); err != nil {
+		return nil, err
+	}
+	return b.ch.GetTables(ctx, tablePattern)
+}
 
-	for i, table := range tablesForRestore {
-		// need mapped database path and original table.Database for CopyDataToDetached
-		dstDatabase := table.Database
-		if len(b.cfg.General.RestoreDatabaseMapping) > 0 {
-			if targetDB, isMapped := b.cfg.General.RestoreDatabaseMapping[table.Database]; isMapped {
-				dstDatabase = targetDB
-				tablesForRestore[i].Database = targetDB
+// getRestoreAttachStateFile - attach state placed outside `backup` directory, backup could be read-only mounted snapshot and restore shall never change it
+func getRestoreAttachStateFile(defaultDataPath, backupName string) string {
+	return path.Join(defaultDataPath, "restore_state", backupName, "attach.state")
+}
+
+// cleanNotAttachedParts - after ATTACH PART failure keep the rest parts copied by restore in `detached` for manual inspection, remove them only when `remove_detached_on_failure: true`
+func (b *Backuper) cleanNotAttachedParts(table metadata.TableMetadata, attachedParts common.EmptyMap, disks []clickhouse.Disk, tableDataPaths []string, log *apexLog.Entry) {
+	notAttachedTable := table
+	notAttachedTable.Parts = make(map[string][]metadata.Part, len(table.Parts))
+	for disk, parts := range table.Parts {
+		for _, part := range parts {
+			if _, isAttached := attachedParts[path.Join(disk, part.Name)]; !isAttached {
+				notAttachedTable.Parts[disk] = append(notAttachedTable.Parts[disk], part)
 			}
 		}
-		log := log.WithField("table", fmt.Sprintf("%s.%s", dstDatabase, table.Table))
-		dstTable, ok := dstTablesMap[metadata.TableTitle{
-			Database: dstDatabase,
-			Table:    table.Table}]
-		if !ok {
-			return fmt.Errorf("can't find '%s.%s' in current system.tables", dstDatabase, table.Table)
-		}
-		if err := filesystemhelper.CopyDataToDetached(backupName, table, disks, dstTable.DataPaths, b.ch); err != nil {
-			return fmt.Errorf("can't restore '%s.%s': %v", table.Database, table.Table, err)
+	}
+	detachedPaths := filesystemhelper.GetDetachedPartPaths(notAttachedTable, disks, tableDataPaths, b.cfg.General.RestoreDiskNameMapping)
+	if len(detachedPaths) == 0 {
+		return
+	}
+	if !b.cfg.General.RemoveDetachedOnFailure {
+		log.Warnf("%d not attached parts kept in 'detached' for manual ATTACH PART or inspection: %s", len(detachedPaths), strings.Join(detachedPaths, ", "))
+		return
+	}
+	for _, detachedPath := range detachedPaths {
+		if err := os.RemoveAll(detachedPath); err != nil {
+			log.Warnf("can't remove not attached part %s: %v", detachedPath, err)
 		}
-		log.Debugf("copied data to 'detached'")
-		if err := b.ch.AttachPartitions(tablesForRestore[i], disks); err != nil {
-			return fmt.Errorf("can't attach partitions for table '%s.%s': %v", tablesForRestore[i].Database, tablesForRestore[i].Table, err)
+	}
+	log.Infof("%d not attached parts removed from 'detached', cause `remove_detached_on_failure: true`", len(detachedPaths))
+}
+
+// logAttachQueries - print ATTACH PART queries which shall be executed manually when --skip-attach is used
+func (b *Backuper) logAttachQueries(table metadata.TableMetadata, disks []clickhouse.Disk, log *apexLog.Entry) {
+	for _, query := range getAttachPartQueries(table, disks) {
+		log.Info(query)
+	}
+}
+
+// getAttachPartQueries - ATTACH PART query for each part in disks order, projections attached together with parent part
+func getAttachPartQueries(table metadata.TableMetadata, disks []clickhouse.Disk) []string {
+	var queries []string
+	for _, disk := range disks {
+		for _, part := range table.Parts[disk.Name] {
+			if !filesystemhelper.IsProjection(part.Name) {
+				queries = append(queries, clickhouse.GetAttachPartQuery(table.Database, table.Table, part.Name))
+			}
 		}
-		log.Info("done")
 	}
-	return nil
+	return queries
 }
 
-func (b *Backuper) restoreEmbedded(backupName string, restoreOnlySchema bool, tablesForRestore ListOfTables, partitions []string) error {
+func (b *Backuper) restoreEmbedded(ctx context.Context, backupName string, restoreOnlySchema bool, tablesForRestore ListOfTables, partitions []string, commandId int) error {
 	restoreSQL := "Disk(?,?)"
 	tablesSQL := ""
 	l := len(tablesForRestore)
@@ -663,7 +2786,16 @@ func (b *Backuper) restoreEmbedded(backupName string, restoreOnlySchema bool, ta
 	}
 	restoreSQL = fmt.Sprintf("RESTORE %s FROM %s %s", tablesSQL, restoreSQL, settings)
 	restoreResults := make([]clickhouse.SystemBackups, 0)
-	if err := b.ch.Select(&restoreResults, restoreSQL, b.cfg.ClickHouse.EmbeddedBackupDisk, backupName); err != nil {
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		b.pollEmbeddedRestoreProgress(progressCtx, backupName, commandId)
+	}()
+	err := b.ch.Select(&restoreResults, restoreSQL, b.cfg.ClickHouse.EmbeddedBackupDisk, backupName)
+	stopProgress()
+	<-progressDone
+	if err != nil {
 		return fmt.Errorf("restore error: %v", err)
 	}
 	if len(restoreResults) == 0 || restoreResults[0].Status != "RESTORED" {
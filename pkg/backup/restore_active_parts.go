@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// getRestoredPartitionIDs - sorted partition IDs of restored parts, check of attached parts scoped to them
+func getRestoredPartitionIDs(disksToPartsMap map[string][]metadata.Part) []string {
+	isAdded := common.EmptyMap{}
+	partitionIDs := make([]string, 0)
+	for _, parts := range disksToPartsMap {
+		for _, part := range parts {
+			if strings.HasSuffix(part.Name, ".proj") {
+				continue
+			}
+			partitionID := part.PartitionID
+			if partitionID == "" {
+				partitionID = strings.Split(part.Name, "_")[0]
+			}
+			if _, exists := isAdded[partitionID]; !exists {
+				isAdded[partitionID] = struct{}{}
+				partitionIDs = append(partitionIDs, partitionID)
+			}
+		}
+	}
+	sort.Strings(partitionIDs)
+	return partitionIDs
+}
+
+// getPartNamesBeforeAttach - ATTACH PART assign new block numbers, so attached parts are parts which absent in system.parts before attach
+func (b *Backuper) getPartNamesBeforeAttach(ctx context.Context, database, table string, partitionIDs []string) (common.EmptyMap, error) {
+	partsBefore, err := b.ch.GetPartsState(ctx, database, table, partitionIDs)
+	if err != nil {
+		return nil, fmt.Errorf("can't get parts from system.parts for table '%s.%s': %v", database, table, err)
+	}
+	partNames := make(common.EmptyMap, len(partsBefore))
+	for _, part := range partsBefore {
+		partNames[part.Name] = struct{}{}
+	}
+	return partNames, nil
+}
+
+// getUnexpectedAttachedParts - inactive new part is expected only when it merged into active part which covers its block range,
+// restored partition without new parts means ATTACH PART completed but parts disappeared
+func getUnexpectedAttachedParts(partitionIDs []string, partsBefore common.EmptyMap, partsAfter []clickhouse.PartState) []string {
+	var problems []string
+	newPartsCount := make(map[string]int, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		newPartsCount[partitionID] = 0
+	}
+	for _, part := range partsAfter {
+		if _, exists := partsBefore[part.Name]; exists {
+			continue
+		}
+		if _, isRestored := newPartsCount[part.PartitionID]; !isRestored {
+			continue
+		}
+		newPartsCount[part.PartitionID]++
+		if part.Active == 1 {
+			continue
+		}
+		isCovered := false
+		for _, activePart := range partsAfter {
+			if activePart.Active == 1 && activePart.PartitionID == part.PartitionID && activePart.MinBlockNumber <= part.MinBlockNumber && activePart.MaxBlockNumber >= part.MaxBlockNumber && activePart.Level >= part.Level {
+				isCovered = true
+				break
+			}
+		}
+		if !isCovered {
+			problems = append(problems, fmt.Sprintf("part %s attached but inactive", part.Name))
+		}
+	}
+	for _, partitionID := range partitionIDs {
+		if newPartsCount[partitionID] == 0 {
+			problems = append(problems, fmt.Sprintf("partition %s has no attached parts", partitionID))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// verifyActiveParts - `verify_active_parts_on_restore`, `warn` log problems, `error` fail table restore
+func (b *Backuper) verifyActiveParts(ctx context.Context, table metadata.TableMetadata, partsBefore common.EmptyMap, log *apexLog.Entry) error {
+	partitionIDs := getRestoredPartitionIDs(table.Parts)
+	partsAfter, err := b.ch.GetPartsState(ctx, table.Database, table.Table, partitionIDs)
+	if err != nil {
+		return fmt.Errorf("can't get parts from system.parts for table '%s.%s': %v", table.Database, table.Table, err)
+	}
+	problems := getUnexpectedAttachedParts(partitionIDs, partsBefore, partsAfter)
+	if len(problems) == 0 {
+		log.Debugf("attached parts are active in %d partitions", len(partitionIDs))
+		return nil
+	}
+	if b.cfg.General.VerifyActivePartsOnRestore == "error" {
+		return fmt.Errorf("attached parts verification failed for table '%s.%s': %s", table.Database, table.Table, strings.Join(problems, ", "))
+	}
+	log.Warnf("attached parts verification failed: %s", strings.Join(problems, ", "))
+	return nil
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	apexLog "github.com/apex/log"
+)
+
+// isAggregateFunctionSupported - function name could be combined with combinators suffixes like uniqMergeIf, strip them until base function found
+func isAggregateFunctionSupported(name string, functions common.EmptyMap, combinators []string) bool {
+	if _, exists := functions[name]; exists {
+		return true
+	}
+	if _, exists := functions[strings.ToLower(name)]; exists {
+		return true
+	}
+	for _, combinator := range combinators {
+		if combinator != "" && len(name) > len(combinator) && strings.HasSuffix(name, combinator) {
+			if isAggregateFunctionSupported(strings.TrimSuffix(name, combinator), functions, combinators) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getAggregateFunctionProblems - unsupported functions for all columns, and functions of AggregateFunction states when backup created by other ClickHouse version
+// SimpleAggregateFunction columns contain plain values, so only function existence checked for them
+func getAggregateFunctionProblems(tables map[string][]aggregateFunctionColumn, functions common.EmptyMap, combinators []string, backupVersion string, targetVersion int) []string {
+	sourceVersion := parseClickHouseVersion(backupVersion)
+	isVersionChanged := sourceVersion != 0 && targetVersion != 0 && sourceVersion/1000 != targetVersion/1000
+	tableNames := make([]string, 0, len(tables))
+	for tableName := range tables {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+	var problems []string
+	for _, tableName := range tableNames {
+		var unsupported, changedStates []string
+		for _, column := range tables[tableName] {
+			if !isAggregateFunctionSupported(column.Function, functions, combinators) {
+				unsupported = append(unsupported, fmt.Sprintf("%s (%s)", column.Function, column.Column))
+			} else if isVersionChanged && !column.IsSimple {
+				changedStates = append(changedStates, fmt.Sprintf("%s (%s)", column.Function, column.Column))
+			}
+		}
+		if len(unsupported) > 0 {
+			problems = append(problems, fmt.Sprintf("'%s' aggregate functions not supported by current server: %s", tableName, strings.Join(unsupported, ", ")))
+		}
+		if len(changedStates) > 0 {
+			problems = append(problems, fmt.Sprintf("'%s' aggregate function states created by ClickHouse %s could be incompatible with current version %d: %s", tableName, backupVersion, targetVersion, strings.Join(changedStates, ", ")))
+		}
+	}
+	return problems
+}
+
+// checkAggregateFunctions - `verify_aggregate_functions_on_restore`, state of AggregateFunction columns serialized inside data parts, wrong state format corrupts read instead of fail attach
+func (b *Backuper) checkAggregateFunctions(ctx context.Context, tablesForRestore ListOfTables, backupVersion string, targetVersion int, log *apexLog.Entry) error {
+	tables := map[string][]aggregateFunctionColumn{}
+	for _, t := range tablesForRestore {
+		if columns := getAggregateFunctionColumns(t.Query); len(columns) > 0 {
+			dstDatabase, dstTable := getRestoreTableMappingTarget(t.Database, t.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+			tables[fmt.Sprintf("%s.%s", dstDatabase, dstTable)] = columns
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	serverFunctions, combinators, err := b.ch.GetAggregateFunctions(ctx)
+	if err != nil {
+		return fmt.Errorf("can't get aggregate functions from system.functions: %v", err)
+	}
+	functions := make(common.EmptyMap, len(serverFunctions))
+	for _, function := range serverFunctions {
+		functions[function] = struct{}{}
+	}
+	problems := getAggregateFunctionProblems(tables, functions, combinators, backupVersion, targetVersion)
+	if len(problems) == 0 {
+		log.Debugf("aggregate functions of %d tables supported by current server", len(tables))
+		return nil
+	}
+	if b.cfg.General.VerifyAggregateFunctionsOnRestore == "error" {
+		return fmt.Errorf("aggregate functions check failed: %s", strings.Join(problems, "; "))
+	}
+	for _, problem := range problems {
+		log.Warn(problem)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+const embeddedRestoreProgressInterval = 5 * time.Second
+
+// embeddedRestoreProgress - row from system.backups for RESTORE in progress, files_read and bytes_read grow while RESTORE running
+type embeddedRestoreProgress struct {
+	Id        string    `db:"id"`
+	NumFiles  uint64    `db:"num_files"`
+	TotalSize uint64    `db:"total_size"`
+	FilesRead uint64    `db:"files_read"`
+	BytesRead uint64    `db:"bytes_read"`
+	StartTime time.Time `db:"start_time"`
+}
+
+// getEmbeddedRestoreProgressStatus - percent by bytes, files used when backup size is unknown, ETA extrapolated linearly from elapsed time
+func getEmbeddedRestoreProgressStatus(progress embeddedRestoreProgress, elapsed time.Duration) status.ProgressStatus {
+	result := status.ProgressStatus{
+		FilesDone:  progress.FilesRead,
+		FilesTotal: progress.NumFiles,
+		BytesDone:  progress.BytesRead,
+		BytesTotal: progress.TotalSize,
+	}
+	done, total := progress.BytesRead, progress.TotalSize
+	if total == 0 {
+		done, total = progress.FilesRead, progress.NumFiles
+	}
+	if total == 0 {
+		return result
+	}
+	if done > total {
+		done = total
+	}
+	result.Percent = float64(done) * 100 / float64(total)
+	if done > 0 && elapsed > 0 {
+		eta := time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+		result.ETA = utils.HumanizeDuration(eta.Round(time.Second))
+	}
+	return result
+}
+
+// pollEmbeddedRestoreProgress - RESTORE statement blocks until finish, so progress is read from system.backups until ctx canceled
+func (b *Backuper) pollEmbeddedRestoreProgress(ctx context.Context, backupName string, commandId int) {
+	log := apexLog.WithFields(apexLog.Fields{"backup": backupName, "operation": "restore_progress"})
+	ticker := time.NewTicker(embeddedRestoreProgressInterval)
+	defer ticker.Stop()
+	progressSQL := "SELECT id, num_files, total_size, files_read, bytes_read, start_time FROM system.backups WHERE status = 'RESTORING' AND position(name, ?) > 0 ORDER BY start_time DESC LIMIT 1"
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			progress := make([]embeddedRestoreProgress, 0)
+			if err := b.ch.SelectContext(ctx, &progress, progressSQL, fmt.Sprintf("'%s'", backupName)); err != nil {
+				if ctx.Err() == nil {
+					log.Warnf("can't get RESTORE progress from system.backups, progress will not be reported: %v", err)
+				}
+				return
+			}
+			if len(progress) == 0 {
+				continue
+			}
+			progressStatus := getEmbeddedRestoreProgressStatus(progress[0], time.Since(progress[0].StartTime))
+			status.Current.SetProgress(commandId, progressStatus)
+			log.WithField("id", progress[0].Id).Infof(
+				"restored %s / %s, %d / %d files, %.1f%%, eta %s",
+				utils.FormatBytes(progressStatus.BytesDone), utils.FormatBytes(progressStatus.BytesTotal),
+				progressStatus.FilesDone, progressStatus.FilesTotal, progressStatus.Percent, progressStatus.ETA,
+			)
+		}
+	}
+}
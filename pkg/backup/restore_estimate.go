@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// DiskRestoreSize - bytes which restore will copy to `detached` folders on destination disk
+type DiskRestoreSize struct {
+	Disk     string `json:"disk"`
+	Required uint64 `json:"required"`
+	Free     uint64 `json:"free"`
+	Fits     bool   `json:"fits"`
+}
+
+// RestoreSizeEstimate - per disk breakdown, Fits is false when at least one disk has not enough free space
+type RestoreSizeEstimate struct {
+	Disks    []DiskRestoreSize `json:"disks"`
+	Required uint64            `json:"required"`
+	Fits     bool              `json:"fits"`
+}
+
+// EstimateRestoreSize - sum of parts size from backup metadata grouped by destination disk, after `restore_disk_name_mapping` and fallback to table storage policy
+// free space from system.disks, with `restore_copy_mode: hardlink` and backup on the same filesystem real disk usage is lower, so result is upper bound
+func (b *Backuper) EstimateRestoreSize(ctx context.Context, backupName, tablePattern string, partitions []string) (RestoreSizeEstimate, error) {
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	if err := b.connectRestore(); err != nil {
+		return RestoreSizeEstimate{}, err
+	}
+	defer b.ch.Close()
+	disks, err := b.ch.GetDisks(ctx)
+	if err != nil {
+		return RestoreSizeEstimate{}, err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return RestoreSizeEstimate{}, ErrUnknownClickhouseDataPath
+	}
+	tablesForRestore, err := getTableListByPatternLocal(b.cfg, b.ch, path.Join(defaultDataPath, "backup", backupName, "metadata"), tablePattern, false, partitions)
+	if err != nil {
+		return RestoreSizeEstimate{}, err
+	}
+	return b.estimateRestoreSize(ctx, tablesForRestore, disks)
+}
+
+func (b *Backuper) estimateRestoreSize(ctx context.Context, tablesForRestore ListOfTables, disks []clickhouse.Disk) (RestoreSizeEstimate, error) {
+	chTables, err := b.ch.GetTables(ctx, "")
+	if err != nil {
+		return RestoreSizeEstimate{}, err
+	}
+	dstTables := make(map[metadata.TableTitle]clickhouse.Table, len(chTables))
+	for _, t := range chTables {
+		dstTables[metadata.TableTitle{Database: t.Database, Table: t.Name}] = t
+	}
+	freeSpace, err := b.ch.GetDisksFreeSpace(ctx)
+	if err != nil {
+		return RestoreSizeEstimate{}, err
+	}
+	requiredByDisk := map[string]uint64{}
+	for _, table := range tablesForRestore {
+		dstDatabase, dstTable := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		var dataPaths []string
+		if t, exists := dstTables[metadata.TableTitle{Database: dstDatabase, Table: dstTable}]; exists {
+			dataPaths = t.DataPaths
+		}
+		for backupDisk, parts := range table.Parts {
+			if len(parts) == 0 {
+				continue
+			}
+			dstDisk := getRestoreDstDisk(backupDisk, disks, dataPaths, b.cfg.General.RestoreDiskNameMapping)
+			requiredByDisk[dstDisk] += getPartsRestoreSize(parts, table.Size[backupDisk])
+		}
+	}
+	return getRestoreSizeEstimate(requiredByDisk, freeSpace), nil
+}
+
+// getPartsRestoreSize - old backups don't contain part size, use table size on disk for them
+func getPartsRestoreSize(parts []metadata.Part, diskSize int64) uint64 {
+	size := uint64(0)
+	for _, part := range parts {
+		if part.Size == 0 {
+			return uint64(diskSize)
+		}
+		size += uint64(part.Size)
+	}
+	return size
+}
+
+// getRestoreDstDisk - the same rules as filesystemhelper.CopyDataToDetached, for tables which will created during restore current storage policy is unknown,
+// so parts placed to mapped disk or to disk with the same name or to default disk
+func getRestoreDstDisk(backupDisk string, disks []clickhouse.Disk, dataPaths []string, diskNameMapping map[string]string) string {
+	dstDisk := backupDisk
+	if mappedDisk, isMapped := diskNameMapping[backupDisk]; isMapped {
+		dstDisk = mappedDisk
+	}
+	if len(dataPaths) > 0 {
+		tableDisks := clickhouse.GetDisksByPaths(disks, dataPaths)
+		if _, isTableDisk := tableDisks[dstDisk]; isTableDisk {
+			return dstDisk
+		}
+		if _, isTableDisk := tableDisks[backupDisk]; isTableDisk {
+			return backupDisk
+		}
+		firstPathDisks := make([]string, 0)
+		for disk := range clickhouse.GetDisksByPaths(disks, dataPaths[:1]) {
+			firstPathDisks = append(firstPathDisks, disk)
+		}
+		if len(firstPathDisks) > 0 {
+			sort.Strings(firstPathDisks)
+			return firstPathDisks[0]
+		}
+	}
+	for _, disk := range disks {
+		if disk.Name == dstDisk {
+			return dstDisk
+		}
+	}
+	return "default"
+}
+
+// getRestoreSizeEstimate - disk which absent in freeSpace is not checked
+func getRestoreSizeEstimate(requiredByDisk map[string]uint64, freeSpace map[string]uint64) RestoreSizeEstimate {
+	estimate := RestoreSizeEstimate{Fits: true}
+	for disk, required := range requiredByDisk {
+		diskSize := DiskRestoreSize{Disk: disk, Required: required, Fits: true}
+		if free, exists := freeSpace[disk]; exists {
+			diskSize.Free = free
+			diskSize.Fits = required <= free
+		}
+		estimate.Required += required
+		estimate.Fits = estimate.Fits && diskSize.Fits
+		estimate.Disks = append(estimate.Disks, diskSize)
+	}
+	sort.Slice(estimate.Disks, func(i, j int) bool {
+		return estimate.Disks[i].Disk < estimate.Disks[j].Disk
+	})
+	return estimate
+}
+
+// checkRestoreFreeSpace - fail before copy any data when estimated size greater than free space, `general->restore_check_free_space`
+func (b *Backuper) checkRestoreFreeSpace(ctx context.Context, tablesForRestore ListOfTables, disks []clickhouse.Disk, log *apexLog.Entry) error {
+	estimate, err := b.estimateRestoreSize(ctx, tablesForRestore, disks)
+	if err != nil {
+		return err
+	}
+	for _, disk := range estimate.Disks {
+		log.WithFields(apexLog.Fields{"disk": disk.Disk, "required": utils.FormatBytes(disk.Required), "free": utils.FormatBytes(disk.Free)}).Debug("restore size estimate")
+		if !disk.Fits {
+			return fmt.Errorf("not enough free space on disk '%s', restore requires %s, free %s", disk.Disk, utils.FormatBytes(disk.Required), utils.FormatBytes(disk.Free))
+		}
+	}
+	return nil
+}
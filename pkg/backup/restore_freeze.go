@@ -0,0 +1,40 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/google/uuid"
+)
+
+// getRestoreFreezeName - `shadow` folder name for --freeze-after-restore, random suffix to avoid conflicts between concurrent restores of the same backup, `create` uses random UUID names, so they don't conflict
+func getRestoreFreezeName(backupName string) string {
+	return "restored_" + backupName + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+}
+
+// getRestoreFreezePaths - FREEZE creates hardlinks in `shadow/<name>` folder on each disk which contains table data
+func getRestoreFreezePaths(disks []clickhouse.Disk, dataPaths []string, freezeName string) []string {
+	tableDisks := clickhouse.GetDisksByPaths(disks, dataPaths)
+	var freezePaths []string
+	for _, disk := range disks {
+		if _, isTableDisk := tableDisks[disk.Name]; isTableDisk {
+			freezePaths = append(freezePaths, path.Join(disk.Path, "shadow", freezeName))
+		}
+	}
+	sort.Strings(freezePaths)
+	return freezePaths
+}
+
+// freezeRestoredTable - --freeze-after-restore, snapshot restored partitions right after attach, so migrated data ready for first backup on new cluster
+func (b *Backuper) freezeRestoredTable(ctx context.Context, freezeName string, table metadata.TableMetadata, dstTable clickhouse.Table, disks []clickhouse.Disk) ([]string, error) {
+	partitionIDs := getRestoredPartitionIDs(table.Parts)
+	if err := b.ch.FreezePartitions(ctx, table.Database, table.Table, partitionIDs, freezeName); err != nil {
+		return nil, fmt.Errorf("can't freeze restored partitions for table '%s.%s': %v", table.Database, table.Table, err)
+	}
+	return getRestoreFreezePaths(disks, dstTable.DataPaths, freezeName), nil
+}
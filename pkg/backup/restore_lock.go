@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+const restoreGlobalLockName = "restore.lock"
+
+// restoreLock - flock based advisory locks inside `backup` directory, prevent concurrent restore into the same databases, `general->restore_lock_mode`
+type restoreLock struct {
+	files       []*os.File
+	isExclusive []bool
+}
+
+// getRestoreLockNames - `global` mode use one exclusive lock, `database` mode use shared global lock and exclusive lock for each target database,
+// so `global` and `database` restores also exclude each other, RBAC and configs restore replace files which shared for all databases
+func getRestoreLockNames(mode string, tables []metadata.TableTitle, tablePattern string, tableMapping, databaseMapping map[string]string, rbacOnly, configsOnly bool) ([]string, []string) {
+	if mode == "none" {
+		return nil, nil
+	}
+	if mode == "global" || (len(tables) == 0 && !rbacOnly && !configsOnly) {
+		return []string{restoreGlobalLockName}, nil
+	}
+	var exclusiveNames []string
+	if rbacOnly {
+		exclusiveNames = append(exclusiveNames, "restore.access.lock")
+	}
+	if configsOnly {
+		exclusiveNames = append(exclusiveNames, "restore.configs.lock")
+	}
+	if !rbacOnly && !configsOnly {
+		isAdded := map[string]struct{}{}
+		for _, t := range parseTablePatternForDownload(tables, tablePattern) {
+			dstDatabase, _ := getRestoreTableMappingTarget(t.Database, t.Table, tableMapping, databaseMapping)
+			if _, exists := isAdded[dstDatabase]; !exists {
+				isAdded[dstDatabase] = struct{}{}
+				exclusiveNames = append(exclusiveNames, "restore.db."+common.TablePathEncode(dstDatabase)+".lock")
+			}
+		}
+	}
+	// the same order for all processes to avoid deadlock
+	sort.Strings(exclusiveNames)
+	return exclusiveNames, []string{restoreGlobalLockName}
+}
+
+// acquireRestoreLock - wait `restore_lock_timeout` when lock held by another restore, 0 means fail immediately
+func (b *Backuper) acquireRestoreLock(ctx context.Context, lockPath string, exclusiveNames, sharedNames []string, log *apexLog.Entry) (*restoreLock, error) {
+	lock := &restoreLock{}
+	if len(exclusiveNames) == 0 && len(sharedNames) == 0 {
+		return lock, nil
+	}
+	// backup directory could be read-only snapshot, all restores from it will use the same fallback directory
+	err := os.MkdirAll(lockPath, 0750)
+	if err == nil {
+		err = unix.Access(lockPath, unix.W_OK)
+	}
+	if errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EACCES) {
+		fallbackPath := path.Join(os.TempDir(), "clickhouse-backup")
+		log.Debugf("%s is not writable: %v, will use %s for restore lock", lockPath, err, fallbackPath)
+		lockPath = fallbackPath
+		err = os.MkdirAll(lockPath, 0750)
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(b.cfg.General.RestoreLockTimeoutDuration)
+	acquire := func(name string, how int) error {
+		f, err := os.OpenFile(path.Join(lockPath, name), os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		isWaitLogged := false
+		for {
+			if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err == nil {
+				break
+			}
+			if err != syscall.EWOULDBLOCK {
+				_ = f.Close()
+				return fmt.Errorf("can't lock %s: %v", f.Name(), err)
+			}
+			if !time.Now().Before(deadline) {
+				_ = f.Close()
+				return fmt.Errorf("another restore is running and holds %s%s, use `restore_lock_timeout` to wait", f.Name(), getRestoreLockOwner(f.Name()))
+			}
+			if !isWaitLogged {
+				log.Infof("wait for another restore release %s%s", f.Name(), getRestoreLockOwner(f.Name()))
+				isWaitLogged = true
+			}
+			select {
+			case <-ctx.Done():
+				_ = f.Close()
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
+		}
+		if how == syscall.LOCK_EX {
+			if err = f.Truncate(0); err == nil {
+				_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			}
+			if err != nil {
+				log.Warnf("can't write pid to %s: %v", f.Name(), err)
+			}
+		}
+		lock.files = append(lock.files, f)
+		lock.isExclusive = append(lock.isExclusive, how == syscall.LOCK_EX)
+		return nil
+	}
+	for _, name := range sharedNames {
+		if err := acquire(name, syscall.LOCK_SH); err != nil {
+			lock.Release(log)
+			return nil, err
+		}
+	}
+	for _, name := range exclusiveNames {
+		if err := acquire(name, syscall.LOCK_EX); err != nil {
+			lock.Release(log)
+			return nil, err
+		}
+	}
+	log.Debugf("restore lock acquired %s", strings.Join(exclusiveNames, ", "))
+	return lock, nil
+}
+
+// getRestoreLockOwner - pid written by process which holds exclusive lock
+func getRestoreLockOwner(lockFile string) string {
+	pid, err := os.ReadFile(lockFile)
+	if err != nil || len(strings.TrimSpace(string(pid))) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (pid %s)", strings.TrimSpace(string(pid)))
+}
+
+// Release - unlock and close lock files, lock files are not removed to avoid unlock race with process which already opened them
+func (l *restoreLock) Release(log *apexLog.Entry) {
+	if l == nil {
+		return
+	}
+	for i := len(l.files) - 1; i >= 0; i-- {
+		if l.isExclusive[i] {
+			_ = l.files[i].Truncate(0)
+		}
+		if err := syscall.Flock(int(l.files[i].Fd()), syscall.LOCK_UN); err != nil {
+			log.Warnf("can't unlock %s: %v", l.files[i].Name(), err)
+		}
+		if err := l.files[i].Close(); err != nil {
+			log.Warnf("can't close %s: %v", l.files[i].Name(), err)
+		}
+	}
+	l.files, l.isExclusive = nil, nil
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apexLog "github.com/apex/log"
+)
+
+// lowCardinalitySampleRows - how much rows read from each restored table to check LowCardinality dictionaries are readable
+const lowCardinalitySampleRows = 10000
+
+// lowCardinalityTable - destination table after `restore_table_mapping` and `restore_database_mapping` with LowCardinality columns
+type lowCardinalityTable struct {
+	Database string
+	Table    string
+	Columns  []string
+}
+
+func (b *Backuper) getLowCardinalityTables(tablesForRestore ListOfTables) []lowCardinalityTable {
+	var tables []lowCardinalityTable
+	for _, t := range tablesForRestore {
+		columns := getLowCardinalityColumns(t.Query)
+		if len(columns) == 0 {
+			continue
+		}
+		dstDatabase, dstTable := getRestoreTableMappingTarget(t.Database, t.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		tables = append(tables, lowCardinalityTable{Database: dstDatabase, Table: dstTable, Columns: columns})
+	}
+	return tables
+}
+
+// warnLowCardinalityVersion - LowCardinality dictionaries serialized inside data parts, format could be different between ClickHouse major versions
+func warnLowCardinalityVersion(tables []lowCardinalityTable, backupVersion string, targetVersion int, log *apexLog.Entry) {
+	sourceVersion := parseClickHouseVersion(backupVersion)
+	if len(tables) == 0 || sourceVersion == 0 || targetVersion == 0 || sourceVersion/1000 == targetVersion/1000 {
+		return
+	}
+	log.Warnf("backup created by ClickHouse %s, current version %d, %d tables contain LowCardinality columns which serialization could differ between versions", backupVersion, targetVersion, len(tables))
+}
+
+// getLowCardinalitySampleQuery - NOT ignore(...) force read and deserialize columns, without it ClickHouse could skip read unused columns
+func getLowCardinalitySampleQuery(table lowCardinalityTable) string {
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = "`" + strings.ReplaceAll(column, "`", "\\`") + "`"
+	}
+	columnsList := strings.Join(columns, ", ")
+	return fmt.Sprintf("SELECT count() FROM (SELECT %s FROM `%s`.`%s` LIMIT %d) WHERE NOT ignore(%s)", columnsList, table.Database, table.Table, lowCardinalitySampleRows, columnsList)
+}
+
+// verifyLowCardinalityColumns - `verify_low_cardinality_on_restore`, read sample of restored rows for each table with LowCardinality columns
+func (b *Backuper) verifyLowCardinalityColumns(ctx context.Context, tables []lowCardinalityTable, log *apexLog.Entry) error {
+	var unreadableTables []string
+	for _, table := range tables {
+		rows := make([]uint64, 0)
+		if err := b.ch.SelectContext(ctx, &rows, getLowCardinalitySampleQuery(table)); err != nil {
+			unreadableTables = append(unreadableTables, fmt.Sprintf("'%s.%s': %v", table.Database, table.Table, err))
+			continue
+		}
+		sampleRows := uint64(0)
+		if len(rows) > 0 {
+			sampleRows = rows[0]
+		}
+		log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Debugf("LowCardinality columns %s readable, %d rows checked", strings.Join(table.Columns, ", "), sampleRows)
+	}
+	if len(unreadableTables) > 0 {
+		return fmt.Errorf("can't read LowCardinality columns after restore: %s", strings.Join(unreadableTables, "; "))
+	}
+	return nil
+}
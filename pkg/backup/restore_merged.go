@@ -0,0 +1,247 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/server/metrics"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+var createQueryUUIDRE = regexp.MustCompile(`\s+UUID\s+'[^']+'`)
+
+// RestoreMerged - restore union of parts from several local backups into one set of tables, for example independent daily and hourly backups
+// schema of tables which present in several backups shall be the same, schema created from the first backup which contains table
+func (b *Backuper) RestoreMerged(backupNames []string, tablePattern string, partitions []string, dataOnly, dropTable, skipAttach bool, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	startRestore := time.Now()
+	for i := range backupNames {
+		backupNames[i] = utils.CleanBackupNameRE.ReplaceAllString(backupNames[i], "")
+	}
+	if len(backupNames) < 2 {
+		return fmt.Errorf("at least two backup names required for merged restore")
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    strings.Join(backupNames, "+"),
+		"operation": "restore_merged",
+	})
+	if err = b.connectRestore(); err != nil {
+		return err
+	}
+	defer b.ch.Close()
+	disks, err := b.ch.GetDisks(ctx)
+	if err != nil {
+		return err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return ErrUnknownClickhouseDataPath
+	}
+	if tablePattern == "" {
+		tablePattern = "*"
+	}
+	var requiredBackups []string
+	isRequiredBackupAdded := map[string]struct{}{backupNames[0]: {}}
+	tablesByBackup := make([]ListOfTables, len(backupNames))
+	for i, backupName := range backupNames {
+		backup, _, err := b.getLocalBackup(ctx, backupName, disks)
+		if err != nil {
+			return fmt.Errorf("can't restore: %v", err)
+		}
+		if backup.Legacy || strings.Contains(backup.Tags, "embedded") {
+			return fmt.Errorf("'%s' is legacy or embedded backup, merged restore is not supported for it", backupName)
+		}
+		if err = checkBackupFormatVersion(backup.BackupMetadata); err != nil {
+			return err
+		}
+		// parts which absent in first backup will search in other backups and their incremental chains
+		searchBackups := []string{backupName}
+		if backup.RequiredBackup != "" {
+			chain, err := b.getRequiredBackupsChain(ctx, backup.BackupMetadata, disks)
+			if err != nil {
+				return err
+			}
+			searchBackups = append(searchBackups, chain...)
+		}
+		for _, name := range searchBackups {
+			if _, exists := isRequiredBackupAdded[name]; !exists {
+				isRequiredBackupAdded[name] = struct{}{}
+				requiredBackups = append(requiredBackups, name)
+			}
+		}
+		if tablesByBackup[i], err = getTableListByPatternLocal(b.cfg, b.ch, path.Join(defaultDataPath, "backup", backupName, "metadata"), tablePattern, dropTable, partitions); err != nil {
+			return err
+		}
+	}
+	tablesForRestore, err := mergeTablesForRestore(backupNames, tablesByBackup, log)
+	if err != nil {
+		return err
+	}
+	if len(tablesForRestore) == 0 {
+		return fmt.Errorf("no have found schemas by %s in %s", tablePattern, strings.Join(backupNames, ", "))
+	}
+	tableTitles := make([]metadata.TableTitle, len(tablesForRestore))
+	for i, t := range tablesForRestore {
+		tableTitles[i] = metadata.TableTitle{Database: t.Database, Table: t.Table}
+	}
+	exclusiveLocks, sharedLocks := getRestoreLockNames(b.cfg.General.RestoreLockMode, tableTitles, tablePattern, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping, false, false)
+	lock, err := b.acquireRestoreLock(ctx, path.Join(defaultDataPath, "backup"), exclusiveLocks, sharedLocks, log)
+	if err != nil {
+		return err
+	}
+	defer lock.Release(log)
+	if !dataOnly {
+		// tables which absent in previous backups created from next backup which contains them
+		isCreated := map[metadata.TableTitle]struct{}{}
+		for i, backupName := range backupNames {
+			var tablesForCreate []string
+			for _, t := range tablesByBackup[i] {
+				title := metadata.TableTitle{Database: t.Database, Table: t.Table}
+				if _, exists := isCreated[title]; !exists {
+					isCreated[title] = struct{}{}
+					tablesForCreate = append(tablesForCreate, fmt.Sprintf("%s.%s", t.Database, t.Table))
+				}
+			}
+			if len(tablesForCreate) == 0 {
+				continue
+			}
+			if err = b.RestoreSchema(ctx, backupName, RestoreOptions{TablePattern: strings.Join(tablesForCreate, ","), DropTable: dropTable}, disks, false, nil); err != nil {
+				metrics.Restore.Errors.WithLabelValues(backupName).Inc()
+				return err
+			}
+		}
+	}
+	diskMap := map[string]string{}
+	for _, disk := range disks {
+		diskMap[disk.Name] = disk.Path
+	}
+	log.Infof("parts absent in '%s' will restore from %s", backupNames[0], strings.Join(requiredBackups, ", "))
+	if err = b.restoreDataRegular(ctx, backupNames[0], requiredBackups, RestoreOptions{TablePattern: tablePattern, DataOnly: dataOnly, DropTable: dropTable, SkipAttach: skipAttach}, tablesForRestore, diskMap, disks, commandId, log); err != nil {
+		return err
+	}
+	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
+	return nil
+}
+
+// mergeTablesForRestore - union of tables and parts from several backups, part with the same name on the same disk restored once
+// return error when the same table has different schema in different backups, UUID is ignored during comparison
+func mergeTablesForRestore(backupNames []string, tablesByBackup []ListOfTables, log *apexLog.Entry) (ListOfTables, error) {
+	var merged ListOfTables
+	indexByTitle := map[metadata.TableTitle]int{}
+	queryBackup := map[metadata.TableTitle]string{}
+	for i, tables := range tablesByBackup {
+		for _, t := range tables {
+			title := metadata.TableTitle{Database: t.Database, Table: t.Table}
+			backupParts := t.Parts
+			j, exists := indexByTitle[title]
+			if !exists {
+				t.Parts = make(map[string][]metadata.Part, len(t.Parts))
+				indexByTitle[title] = len(merged)
+				queryBackup[title] = backupNames[i]
+				j = len(merged)
+				merged = append(merged, t)
+			} else if t.Query != "" {
+				if merged[j].Query == "" {
+					merged[j].Query = t.Query
+					queryBackup[title] = backupNames[i]
+				} else if normalizeCreateQueryForCompare(merged[j].Query) != normalizeCreateQueryForCompare(t.Query) {
+					return nil, fmt.Errorf("schema of '%s.%s' is different in backups '%s' and '%s', merged restore is not possible", t.Database, t.Table, queryBackup[title], backupNames[i])
+				}
+			}
+			mergedParts, duplicatedParts, err := mergeBackupParts(merged[j].Parts, backupParts)
+			if err != nil {
+				return nil, fmt.Errorf("'%s.%s' part from '%s' can't be merged with previous backups: %v", t.Database, t.Table, backupNames[i], err)
+			}
+			merged[j].Parts = mergedParts
+			if duplicatedParts > 0 {
+				log.Warnf("'%s.%s' %d parts from '%s' and previous backups contain the same blocks, will restore them once", t.Database, t.Table, duplicatedParts, backupNames[i])
+			}
+		}
+	}
+	return merged, nil
+}
+
+// mergeBackupParts - add parts to mergedParts, parts compared by block ranges in partition, because the same rows could be in parts with different names after merge, like all_1_1_0 + all_2_2_0 and all_1_2_1
+// part which blocks covered by already merged part is skipped, already merged parts covered by new part are replaced by it, partially intersected block ranges means data can't be merged without duplicates
+// parts which names can't be parsed compared by names, return merged parts and count of skipped or replaced parts
+func mergeBackupParts(mergedParts, parts map[string][]metadata.Part) (map[string][]metadata.Part, int, error) {
+	type diskPart struct {
+		disk string
+		part metadata.Part
+	}
+	var allParts []diskPart
+	for _, disk := range getSortedDisks(mergedParts) {
+		for _, part := range mergedParts[disk] {
+			allParts = append(allParts, diskPart{disk: disk, part: part})
+		}
+	}
+	duplicatedParts := 0
+	for _, disk := range getSortedDisks(parts) {
+		for _, part := range parts[disk] {
+			partitionID, minBlock, maxBlock, isParsed := parsePartBlockRange(part)
+			isCovered := false
+			isCoveredParts := make([]bool, len(allParts))
+			for k, existing := range allParts {
+				existingPartitionID, existingMinBlock, existingMaxBlock, isExistingParsed := parsePartBlockRange(existing.part)
+				switch {
+				case !isParsed || !isExistingParsed:
+					isCovered = isCovered || existing.part.Name == part.Name
+				case existingPartitionID != partitionID || existingMaxBlock < minBlock || existingMinBlock > maxBlock:
+				case existingMinBlock <= minBlock && maxBlock <= existingMaxBlock:
+					isCovered = true
+				case minBlock <= existingMinBlock && existingMaxBlock <= maxBlock:
+					isCoveredParts[k] = true
+				default:
+					return nil, 0, fmt.Errorf("blocks of %s/%s partially intersect with %s/%s", disk, part.Name, existing.disk, existing.part.Name)
+				}
+			}
+			if isCovered {
+				duplicatedParts++
+				continue
+			}
+			notCoveredParts := make([]diskPart, 0, len(allParts)+1)
+			for k, existing := range allParts {
+				if isCoveredParts[k] {
+					duplicatedParts++
+					continue
+				}
+				notCoveredParts = append(notCoveredParts, existing)
+			}
+			allParts = append(notCoveredParts, diskPart{disk: disk, part: part})
+		}
+	}
+	result := make(map[string][]metadata.Part, len(mergedParts))
+	for _, p := range allParts {
+		result[p.disk] = append(result[p.disk], p.part)
+	}
+	return result, duplicatedParts, nil
+}
+
+func getSortedDisks(disksToPartsMap map[string][]metadata.Part) []string {
+	disks := make([]string, 0, len(disksToPartsMap))
+	for disk := range disksToPartsMap {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	return disks
+}
+
+// normalizeCreateQueryForCompare - remove UUID and collapse whitespaces, the same table in independent backups could be re-created with new UUID
+func normalizeCreateQueryForCompare(query string) string {
+	query = createQueryUUIDRE.ReplaceAllString(query, "")
+	query = strings.Replace(query, "ATTACH ", "CREATE ", 1)
+	return strings.Join(strings.Fields(query), " ")
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/server/metrics"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// restoreSummary - result of one Restore call for --metrics-file
+type restoreSummary struct {
+	Tables   uint64
+	Bytes    uint64
+	Errors   uint64
+	Duration time.Duration
+	Err      error
+}
+
+var openMetricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// getRestoreMetricsFileBody - OpenMetrics text format, human-readable duration and size added as labels of info metric
+func getRestoreMetricsFileBody(backupName string, summary restoreSummary) string {
+	label := fmt.Sprintf(`backup="%s"`, openMetricsLabelReplacer.Replace(backupName))
+	success, restoreStatus := 1, "success"
+	if summary.Err != nil {
+		success, restoreStatus = 0, "error"
+	}
+	var body strings.Builder
+	writeMetric := func(name, metricType, help string, value interface{}) {
+		body.WriteString(fmt.Sprintf("# TYPE clickhouse_backup_%s %s\n", name, metricType))
+		body.WriteString(fmt.Sprintf("# HELP clickhouse_backup_%s %s\n", name, help))
+		if metricType == "counter" {
+			name += "_total"
+		}
+		body.WriteString(fmt.Sprintf("clickhouse_backup_%s{%s} %v\n", name, label, value))
+	}
+	writeMetric("restore_success", "gauge", "1 when restore finished successfully, 0 when failed", success)
+	writeMetric("restore_tables", "counter", "Tables which data successfully restored", summary.Tables)
+	writeMetric("restore_bytes", "counter", "Bytes of data parts copied to detached during restore", summary.Bytes)
+	writeMetric("restore_errors", "counter", "Errors during restore schema and data", summary.Errors)
+	writeMetric("restore_duration_seconds", "gauge", "Restore duration in seconds", fmt.Sprintf("%.3f", summary.Duration.Seconds()))
+	body.WriteString("# TYPE clickhouse_backup_restore info\n")
+	body.WriteString("# HELP clickhouse_backup_restore Restore summary\n")
+	body.WriteString(fmt.Sprintf(
+		"clickhouse_backup_restore_info{%s,status=\"%s\",duration=\"%s\",size=\"%s\"} 1\n",
+		label, restoreStatus, utils.HumanizeDuration(summary.Duration), utils.FormatBytes(summary.Bytes),
+	))
+	body.WriteString("# EOF\n")
+	return body.String()
+}
+
+// writeRestoreMetricsFile - --metrics-file, counters are global for API server, so restore values calculated as difference with values before restore
+func writeRestoreMetricsFile(metricsFile, backupName string, before restoreSummary, startRestore time.Time, restoreErr error, log *apexLog.Entry) error {
+	tables, bytes, errors, err := metrics.Restore.GetCounters(backupName)
+	if err != nil {
+		return fmt.Errorf("can't get restore metrics: %v", err)
+	}
+	summary := restoreSummary{
+		Tables:   tables - before.Tables,
+		Bytes:    bytes - before.Bytes,
+		Errors:   errors - before.Errors,
+		Duration: time.Since(startRestore),
+		Err:      restoreErr,
+	}
+	if err = os.WriteFile(metricsFile, []byte(getRestoreMetricsFileBody(backupName, summary)), 0640); err != nil {
+		return fmt.Errorf("can't write restore metrics to %s: %v", metricsFile, err)
+	}
+	log.Infof("restore metrics saved to %s", metricsFile)
+	return nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// getNewPartitionsFilter - backup partitions which don't have active parts in destination table, return filter and count of skipped partitions
+func getNewPartitionsFilter(backupPartitionIDs, existingPartitionIDs []string) (common.EmptyMap, int) {
+	isExists := make(common.EmptyMap, len(existingPartitionIDs))
+	for _, partitionID := range existingPartitionIDs {
+		isExists[partitionID] = struct{}{}
+	}
+	newPartitions := common.EmptyMap{}
+	skipped := 0
+	for _, partitionID := range backupPartitionIDs {
+		if _, exists := isExists[partitionID]; exists {
+			skipped++
+			continue
+		}
+		newPartitions[partitionID] = struct{}{}
+	}
+	return newPartitions, skipped
+}
+
+// filterOnlyNewPartitions - --only-new-partitions, keep only parts of partitions which absent in destination table
+func (b *Backuper) filterOnlyNewPartitions(ctx context.Context, tablesForRestore ListOfTables, log *apexLog.Entry) error {
+	totalSkipped := 0
+	for _, table := range tablesForRestore {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		existingPartitionIDs, err := b.ch.GetActivePartitionIDs(ctx, dstDatabase, dstTableName)
+		if err != nil {
+			return fmt.Errorf("can't get partitions from system.parts for table '%s.%s': %v", dstDatabase, dstTableName, err)
+		}
+		newPartitions, skipped := getNewPartitionsFilter(getRestoredPartitionIDs(table.Parts), existingPartitionIDs)
+		if skipped == 0 {
+			continue
+		}
+		totalSkipped += skipped
+		log.WithField("table", fmt.Sprintf("%s.%s", dstDatabase, dstTableName)).Infof("%d partitions already exist, skipped, %d new partitions will be restored", skipped, len(newPartitions))
+		if len(newPartitions) > 0 {
+			filterPartsAndFilesByPartitionsFilter(table, newPartitions)
+			continue
+		}
+		// empty filter means no filter
+		for disk := range table.Parts {
+			table.Parts[disk] = make([]metadata.Part, 0)
+		}
+		for disk := range table.Files {
+			table.Files[disk] = make([]string, 0)
+		}
+	}
+	log.Infof("--only-new-partitions skipped %d partitions", totalSkipped)
+	return nil
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// parsePartBlockRange - part name format is `<partition_id>_<min_block>_<max_block>_<level>[_<mutation>]`, partition_id could contain `_` only when it stored in metadata
+func parsePartBlockRange(part metadata.Part) (string, int64, int64, bool) {
+	partitionID := part.PartitionID
+	var blocks []string
+	if partitionID != "" {
+		if !strings.HasPrefix(part.Name, partitionID+"_") {
+			return "", 0, 0, false
+		}
+		blocks = strings.Split(strings.TrimPrefix(part.Name, partitionID+"_"), "_")
+	} else {
+		fields := strings.Split(part.Name, "_")
+		if len(fields) < 4 {
+			return "", 0, 0, false
+		}
+		partitionID, blocks = fields[0], fields[1:]
+	}
+	if len(blocks) != 3 && len(blocks) != 4 {
+		return "", 0, 0, false
+	}
+	minBlock, err := strconv.ParseInt(blocks[0], 10, 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+	maxBlock, err := strconv.ParseInt(blocks[1], 10, 64)
+	if err != nil || maxBlock < minBlock {
+		return "", 0, 0, false
+	}
+	return partitionID, minBlock, maxBlock, true
+}
+
+// splitOverlappingParts - backup parts which block range intersects with active part in the same partition of destination table,
+// when restore into the same table which backup created from, it means part data already present in table
+func splitOverlappingParts(disksToPartsMap map[string][]metadata.Part, existingParts []clickhouse.PartState) (map[string][]metadata.Part, []string) {
+	notOverlappingParts := make(map[string][]metadata.Part, len(disksToPartsMap))
+	var overlappingParts []string
+	for disk, parts := range disksToPartsMap {
+		for _, part := range parts {
+			partitionID, minBlock, maxBlock, ok := parsePartBlockRange(part)
+			isOverlapped := false
+			for _, existingPart := range existingParts {
+				if ok && existingPart.Active == 1 && existingPart.PartitionID == partitionID && existingPart.MinBlockNumber <= maxBlock && existingPart.MaxBlockNumber >= minBlock {
+					isOverlapped = true
+					break
+				}
+			}
+			if isOverlapped {
+				overlappingParts = append(overlappingParts, path.Join(disk, part.Name))
+				continue
+			}
+			notOverlappingParts[disk] = append(notOverlappingParts[disk], part)
+		}
+	}
+	sort.Strings(overlappingParts)
+	return notOverlappingParts, overlappingParts
+}
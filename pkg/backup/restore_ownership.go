@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	apexLog "github.com/apex/log"
+)
+
+// FixRestoreOwnership - repair step after interrupted restore, chown data paths of tables restored from backupName including `detached` to clickhouse user,
+// `restore_table_mapping` and `restore_database_mapping` applied to find destination tables
+func (b *Backuper) FixRestoreOwnership(backupName string, databaseMapping []string, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	if err = b.prepareRestoreDatabaseMapping(databaseMapping); err != nil {
+		return err
+	}
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "fix_restore_ownership",
+	})
+	if err = b.connectRestore(); err != nil {
+		return err
+	}
+	defer b.ch.Close()
+	restorableTables, err := b.ListRestorableTables(ctx, backupName, "", nil)
+	if err != nil {
+		return err
+	}
+	disks, err := b.ch.GetDisks(ctx)
+	if err != nil {
+		return err
+	}
+	tables, err := b.ch.GetTables(ctx, "")
+	if err != nil {
+		return fmt.Errorf("can't get tables from clickhouse: %v", err)
+	}
+	isRestored := make(map[metadata.TableTitle]struct{}, len(restorableTables))
+	for _, table := range restorableTables {
+		dstDatabase, dstTable := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		isRestored[metadata.TableTitle{Database: dstDatabase, Table: dstTable}] = struct{}{}
+	}
+	totalFixed := 0
+	for _, table := range tables {
+		if _, ok := isRestored[metadata.TableTitle{Database: table.Database, Table: table.Name}]; !ok || table.Skip {
+			continue
+		}
+		tableFixed := 0
+		for _, dataPath := range table.DataPaths {
+			fixed, err := filesystemhelper.FixOwnership(dataPath, b.ch, disks)
+			if err != nil {
+				return fmt.Errorf("can't fix ownership for '%s.%s' in %s: %v", table.Database, table.Name, dataPath, err)
+			}
+			tableFixed += fixed
+		}
+		if tableFixed > 0 {
+			log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Name)).Infof("ownership fixed for %d files and directories", tableFixed)
+		}
+		totalFixed += tableFixed
+	}
+	log.Infof("ownership fixed for %d files and directories", totalFixed)
+	return nil
+}
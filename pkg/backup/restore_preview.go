@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+)
+
+type RestorableTable struct {
+	SourceDatabase string `json:"source_database"`
+	SourceTable    string `json:"source_table"`
+	Database       string `json:"database"`
+	Table          string `json:"table"`
+	Parts          int    `json:"parts"`
+	MetadataOnly   bool   `json:"metadata_only"`
+}
+
+// ListRestorableTables - resolve tables which will restored from local backup by tablePattern and databaseMapping, doesn't execute any DDL
+func (b *Backuper) ListRestorableTables(ctx context.Context, backupName, tablePattern string, databaseMapping []string) ([]RestorableTable, error) {
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	if err := b.prepareRestoreDatabaseMapping(databaseMapping); err != nil {
+		return nil, err
+	}
+	if !b.ch.IsOpen {
+		if err := b.connectRestore(); err != nil {
+			return nil, err
+		}
+		defer b.ch.Close()
+	}
+	_, disks, err := b.getLocalBackup(ctx, backupName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	metadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata")
+	if _, err = os.Stat(metadataPath); os.IsNotExist(err) {
+		if embeddedBackupPath, embeddedErr := b.ch.GetEmbeddedBackupPath(disks); embeddedErr == nil && embeddedBackupPath != "" {
+			metadataPath = path.Join(embeddedBackupPath, backupName, "metadata")
+		}
+	}
+	tablesForRestore, err := getTableListByPatternLocal(b.cfg, b.ch, metadataPath, tablePattern, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return getRestorableTables(tablesForRestore, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+}
+
+// getRestorableTables - apply table and database mapping to tablesForRestore and keep source names for each table
+func getRestorableTables(tablesForRestore ListOfTables, tableMapping, databaseMapping map[string]string) ([]RestorableTable, error) {
+	sourceDatabases := make([]string, len(tablesForRestore))
+	sourceTables := make([]string, len(tablesForRestore))
+	for i, table := range tablesForRestore {
+		sourceDatabases[i] = table.Database
+		sourceTables[i] = table.Table
+	}
+	if len(tableMapping) > 0 {
+		if err := changeTableQueryToAdjustTableMapping(&tablesForRestore, tableMapping); err != nil {
+			return nil, err
+		}
+	}
+	if len(databaseMapping) > 0 {
+		if err := changeTableQueryToAdjustDatabaseMapping(&tablesForRestore, databaseMapping); err != nil {
+			return nil, err
+		}
+	}
+	restorableTables := make([]RestorableTable, len(tablesForRestore))
+	for i, table := range tablesForRestore {
+		parts := 0
+		for _, diskParts := range table.Parts {
+			parts += len(diskParts)
+		}
+		restorableTables[i] = RestorableTable{
+			SourceDatabase: sourceDatabases[i],
+			SourceTable:    sourceTables[i],
+			Database:       table.Database,
+			Table:          table.Table,
+			Parts:          parts,
+			MetadataOnly:   table.MetadataOnly,
+		}
+	}
+	return restorableTables, nil
+}
+
+// PrintRestorableTables - print result of ListRestorableTables for `restore --preview`
+func (b *Backuper) PrintRestorableTables(backupName, tablePattern string, databaseMapping []string) error {
+	ctx, cancel, _ := status.Current.GetContextWithCancel(status.NotFromAPI)
+	defer cancel()
+	restorableTables, err := b.ListRestorableTables(ctx, backupName, tablePattern, databaseMapping)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.DiscardEmptyColumns)
+	for _, table := range restorableTables {
+		if bytes, err := fmt.Fprintf(w, "%s.%s\t->\t%s.%s\t%d parts\n", table.SourceDatabase, table.SourceTable, table.Database, table.Table, table.Parts); err != nil {
+			b.log.Errorf("fmt.Fprintf write %d bytes return error: %v", bytes, err)
+		}
+	}
+	return w.Flush()
+}
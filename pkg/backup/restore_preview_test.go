@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRestorableTables(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db1", Table: "events", Query: "CREATE TABLE db1.events (`id` UInt64) ENGINE = MergeTree ORDER BY id", Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+			"hdd":     {{Name: "all_3_3_0"}},
+		}},
+		{Database: "db1", Table: "other", Query: "CREATE TABLE db1.other (`id` UInt64) ENGINE = MergeTree ORDER BY id", MetadataOnly: true},
+		{Database: "db2", Table: "view", Query: "CREATE VIEW db2.view AS SELECT 1"},
+	}
+	restorableTables, err := getRestorableTables(tables, map[string]string{"db1.events": "db1.new_events"}, map[string]string{"db1": "db3"})
+	assert.NoError(t, err)
+	assert.Equal(t, []RestorableTable{
+		{SourceDatabase: "db1", SourceTable: "events", Database: "db3", Table: "new_events", Parts: 3},
+		{SourceDatabase: "db1", SourceTable: "other", Database: "db3", Table: "other", MetadataOnly: true},
+		{SourceDatabase: "db2", SourceTable: "view", Database: "db2", Table: "view"},
+	}, restorableTables)
+
+	restorableTables, err = getRestorableTables(ListOfTables{{Database: "db2", Table: "t", Query: "CREATE TABLE db2.t (`id` UInt64) ENGINE = Log"}}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []RestorableTable{{SourceDatabase: "db2", SourceTable: "t", Database: "db2", Table: "t"}}, restorableTables)
+
+	_, err = getRestorableTables(ListOfTables{{Database: "db1", Table: "t", Query: "CREATE TABLE db1.t (`id` UInt64) ENGINE = Log"}}, map[string]string{"db1.t": "new_t"}, nil)
+	assert.Error(t, err)
+}
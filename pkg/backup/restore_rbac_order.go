@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rbacIDRE - access/<uuid>.sql files refer to other entities by UUID, like `ATTACH GRANT ID('...') TO ...` or `SETTINGS PROFILE ID('...')`
+var rbacIDRE = regexp.MustCompile(`ID\('([0-9a-fA-F-]{36})'\)`)
+
+// rbacEntityTypePriority - used when dependencies don't define order, for example profile assigned to user and user assigned to profile
+var rbacEntityTypePriority = map[string]int{"ROLE": 0, "SETTINGS PROFILE": 1, "QUOTA": 2, "USER": 3, "ROW POLICY": 4}
+
+type rbacEntityFile struct {
+	rbacEntity
+	File      string
+	ID        string
+	DependsOn []string
+}
+
+// getRBACEntityFiles - parse access/*.sql entity files from dir, entity UUID is file name
+func getRBACEntityFiles(dir string) ([]rbacEntityFile, error) {
+	files, err := filepath.Glob(path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	entityFiles := make([]rbacEntityFile, 0, len(files))
+	for _, f := range files {
+		body, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		entity, ok := parseRBACEntity(string(body))
+		if !ok {
+			continue
+		}
+		entityFile := rbacEntityFile{rbacEntity: entity, File: filepath.Base(f), ID: strings.TrimSuffix(filepath.Base(f), ".sql")}
+		for _, matches := range rbacIDRE.FindAllStringSubmatch(string(body), -1) {
+			if matches[1] != entityFile.ID {
+				entityFile.DependsOn = append(entityFile.DependsOn, matches[1])
+			}
+		}
+		entityFiles = append(entityFiles, entityFile)
+	}
+	return entityFiles, nil
+}
+
+// getRBACCopyFiles - all files from backup access directory, entity files in orderedFiles order go first,
+// *.sql files which entity can't be parsed and other files copied as is after them, *.list files removed during rebuild
+func getRBACCopyFiles(dir string, orderedFiles []rbacEntityFile) ([]string, error) {
+	copyFiles := make([]string, 0, len(orderedFiles))
+	orderedNames := make(map[string]struct{}, len(orderedFiles))
+	for _, entityFile := range orderedFiles {
+		copyFiles = append(copyFiles, entityFile.File)
+		orderedNames[entityFile.File] = struct{}{}
+	}
+	files, err := filepath.Glob(path.Join(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		name := filepath.Base(f)
+		if _, isOrdered := orderedNames[name]; isOrdered || strings.HasSuffix(name, ".list") {
+			continue
+		}
+		copyFiles = append(copyFiles, name)
+	}
+	return copyFiles, nil
+}
+
+// sortRBACEntityFiles - referenced entities go before entities which refer to them, cycles resolved by entity type priority and name
+func sortRBACEntityFiles(entityFiles []rbacEntityFile) []rbacEntityFile {
+	sorted := append([]rbacEntityFile(nil), entityFiles...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if rbacEntityTypePriority[sorted[i].Type] != rbacEntityTypePriority[sorted[j].Type] {
+			return rbacEntityTypePriority[sorted[i].Type] < rbacEntityTypePriority[sorted[j].Type]
+		}
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].File < sorted[j].File
+	})
+	isPresent := make(map[string]struct{}, len(sorted))
+	for _, entityFile := range sorted {
+		isPresent[entityFile.ID] = struct{}{}
+	}
+	isAdded := make(map[string]struct{}, len(sorted))
+	ordered := make([]rbacEntityFile, 0, len(sorted))
+	for len(ordered) < len(sorted) {
+		addedOnPass := 0
+		for _, entityFile := range sorted {
+			if _, added := isAdded[entityFile.ID]; added {
+				continue
+			}
+			isReady := true
+			for _, id := range entityFile.DependsOn {
+				_, present := isPresent[id]
+				_, added := isAdded[id]
+				if present && !added {
+					isReady = false
+					break
+				}
+			}
+			if isReady {
+				isAdded[entityFile.ID] = struct{}{}
+				ordered = append(ordered, entityFile)
+				addedOnPass++
+			}
+		}
+		// cycle, take first not added entity in priority order
+		if addedOnPass == 0 {
+			for _, entityFile := range sorted {
+				if _, added := isAdded[entityFile.ID]; !added {
+					isAdded[entityFile.ID] = struct{}{}
+					ordered = append(ordered, entityFile)
+					break
+				}
+			}
+		}
+	}
+	return ordered
+}
+
+// getDanglingRBACReferences - references to entities which neither restored nor exist in ClickHouse, ClickHouse ignores them after restart
+func getDanglingRBACReferences(restored []rbacEntityFile, existingIDs map[string]struct{}) []string {
+	restoredIDs := make(map[string]struct{}, len(restored))
+	for _, entityFile := range restored {
+		restoredIDs[entityFile.ID] = struct{}{}
+	}
+	var dangling []string
+	for _, entityFile := range restored {
+		for _, id := range entityFile.DependsOn {
+			_, isRestored := restoredIDs[id]
+			_, isExists := existingIDs[id]
+			if !isRestored && !isExists {
+				dangling = append(dangling, fmt.Sprintf("%s %s refers to absent entity %s", entityFile.Type, entityFile.Name, id))
+			}
+		}
+	}
+	return dangling
+}
+
+// getRBACOrderDescription - restore order for log
+func getRBACOrderDescription(ordered []rbacEntityFile) string {
+	order := make([]string, len(ordered))
+	for i, entityFile := range ordered {
+		order[i] = fmt.Sprintf("%s %s", entityFile.Type, entityFile.Name)
+	}
+	return strings.Join(order, ", ")
+}
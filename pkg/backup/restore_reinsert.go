@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// getReinsertStagingTableName - temporary table for `restore_reinsert_on_sortkey_mismatch`, created in the same database as destination table
+func getReinsertStagingTableName(table string) string {
+	return "__restore_reinsert_" + table
+}
+
+// isSortingKeyMismatch - parts sorted by backup table ORDER BY can't be attached to table with other ORDER BY
+func isSortingKeyMismatch(backupQuery, dstQuery string) bool {
+	backupKey := getTableSortingKey(backupQuery)
+	dstKey := getTableSortingKey(dstQuery)
+	return backupKey != "" && dstKey != "" && backupKey != dstKey
+}
+
+// createReinsertStagingTable - temporary table with schema from backup, so parts from backup could be attached to it
+func (b *Backuper) createReinsertStagingTable(ctx context.Context, table metadata.TableMetadata, dstTable clickhouse.Table, log *apexLog.Entry) (clickhouse.Table, error) {
+	return b.createStagingTable(ctx, dstTable.Database, getReinsertStagingTableName(dstTable.Name), table.Query, "restore_reinsert_on_sortkey_mismatch", log)
+}
+
+// getReinsertColumns - columns of destination table which exist in backup table, in destination table order, so INSERT SELECT matches columns by names instead of position
+// destination columns absent in backup will filled with default values
+func getReinsertColumns(dstColumns []string, srcColumnTypes map[string]string) ([]string, []string) {
+	columns := make([]string, 0, len(dstColumns))
+	var missingColumns []string
+	for _, column := range dstColumns {
+		if _, exists := srcColumnTypes[column]; exists {
+			columns = append(columns, column)
+		} else {
+			missingColumns = append(missingColumns, column)
+		}
+	}
+	return columns, missingColumns
+}
+
+// getReinsertStateKey - partitions inserted into destination table are stored in restore state, so restore retry will not insert them again
+func getReinsertStateKey(database, table, uuid, partitionID string) string {
+	return fmt.Sprintf("`%s`.`%s`.%s/reinsert/%s", database, table, uuid, partitionID)
+}
+
+// reinsertRestoredData - parts already attached to stagingTable, rows copied into destination table with INSERT SELECT partition by partition
+// INSERT SELECT is not atomic, when it fails, part of rows of current partition could be already inserted
+func (b *Backuper) reinsertRestoredData(ctx context.Context, table metadata.TableMetadata, stagingTable clickhouse.Table, onInserted func(partitionID string), log *apexLog.Entry) error {
+	dstColumns, err := b.ch.GetInsertableColumns(ctx, table.Database, table.Table)
+	if err != nil {
+		return fmt.Errorf("can't get columns of '%s.%s': %v", table.Database, table.Table, err)
+	}
+	srcColumnTypes, err := b.ch.GetColumnTypes(ctx, stagingTable.Database, stagingTable.Name)
+	if err != nil {
+		return fmt.Errorf("can't get columns of temporary table '%s.%s': %v", stagingTable.Database, stagingTable.Name, err)
+	}
+	columns, missingColumns := getReinsertColumns(dstColumns, srcColumnTypes)
+	if len(columns) == 0 {
+		return fmt.Errorf("'%s.%s' and temporary table '%s.%s' have no common columns", table.Database, table.Table, stagingTable.Database, stagingTable.Name)
+	}
+	if len(missingColumns) > 0 {
+		log.Warnf("columns %s absent in backup, will filled with default values", strings.Join(missingColumns, ", "))
+	}
+	for _, partitionID := range getRestoredPartitionIDs(table.Parts) {
+		if err = b.ch.InsertFromTable(ctx, table.Database, table.Table, stagingTable.Database, stagingTable.Name, columns, partitionID); err != nil {
+			return fmt.Errorf("can't insert partition %s into '%s.%s' from temporary table '%s.%s', rows of this partition could be partially inserted: %v", partitionID, table.Database, table.Table, stagingTable.Database, stagingTable.Name, err)
+		}
+		onInserted(partitionID)
+		log.Debugf("partition %s inserted from temporary table %s.%s", partitionID, stagingTable.Database, stagingTable.Name)
+	}
+	return nil
+}
@@ -1,11 +1,223 @@
 package backup
 
-func (b *Backuper) RestoreFromRemote(backupName, tablePattern string, databaseMapping, partitions []string, schemaOnly, dataOnly, dropTable, ignoreDependencies, rbacOnly, configsOnly, resume bool, commandId int) error {
-	if err := b.Download(backupName, tablePattern, partitions, schemaOnly, resume, commandId); err != nil {
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/storage"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// RestoreFromRemote - download backupName with tables matched by opts.TablePattern and restore it, resume continue interrupted download
+func (b *Backuper) RestoreFromRemote(backupName string, opts RestoreOptions, resume bool, commandId int) error {
+	if err := b.Download(backupName, opts.TablePattern, opts.Partitions, opts.SchemaOnly, resume, commandId); err != nil {
 		// https://github.com/AlexAkulov/clickhouse-backup/issues/625
 		if err != ErrBackupIsAlreadyExists {
 			return err
 		}
 	}
-	return b.Restore(backupName, tablePattern, databaseMapping, partitions, schemaOnly, dataOnly, dropTable, ignoreDependencies, rbacOnly, configsOnly, commandId)
+	return b.Restore(backupName, opts, commandId)
+}
+
+// RestoreFromRemoteByTable - download and restore data table by table, local copy removed after each table, so local disk usage bounded by the biggest table
+// schema restored for all tables at once before data to resolve dependencies between tables and views
+func (b *Backuper) RestoreFromRemoteByTable(backupName string, opts RestoreOptions, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	startRestore := time.Now()
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	log := b.log.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore_remote_by_table",
+	})
+	if b.cfg.ClickHouse.UseEmbeddedBackupRestore {
+		return fmt.Errorf("restore table by table is not compatible with `use_embedded_backup_restore: true`")
+	}
+	existsBackups, err := b.getLocalBackupNames(ctx)
+	if err != nil {
+		return err
+	}
+	if _, exists := existsBackups[backupName]; exists {
+		return fmt.Errorf("'%s' already exists locally, use `restore` command instead", backupName)
+	}
+	remoteBackups, err := b.GetRemoteBackups(ctx, true)
+	if err != nil {
+		return err
+	}
+	downloadBackups := getRemoteBackupsChain(backupName, remoteBackups)
+	// remove local backups downloaded during restore, incremental backup could download required backups too
+	// backups created or downloaded by other commands during restore are kept
+	cleanDownloaded := func() error {
+		localBackups, err := b.getLocalBackupNames(ctx)
+		if err != nil {
+			return err
+		}
+		for _, localBackupName := range getDownloadedBackupNames(downloadBackups, existsBackups, localBackups) {
+			if err = b.RemoveBackupLocal(ctx, localBackupName, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer func() {
+		if err := cleanDownloaded(); err != nil {
+			log.Warnf("can't clean downloaded backups: %v", err)
+		}
+	}()
+
+	if err = b.Download(backupName, opts.TablePattern, opts.Partitions, true, false, commandId); err != nil {
+		return err
+	}
+	if !opts.DataOnly {
+		if err = b.Restore(backupName, RestoreOptions{
+			TablePattern:       opts.TablePattern,
+			FunctionsPattern:   opts.FunctionsPattern,
+			DatabaseMapping:    opts.DatabaseMapping,
+			Partitions:         opts.Partitions,
+			SchemaOnly:         true,
+			DropTable:          opts.DropTable,
+			IgnoreDependencies: opts.IgnoreDependencies,
+			SchemaAsAttach:     opts.SchemaAsAttach,
+		}, commandId); err != nil {
+			return err
+		}
+	}
+	localBackup, _, err := b.getLocalBackup(ctx, backupName, nil)
+	if err != nil {
+		return err
+	}
+	tablesForRestore := localBackup.Tables
+	if err = cleanDownloaded(); err != nil {
+		return err
+	}
+	for i, tableTitle := range tablesForRestore {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		tableName := fmt.Sprintf("%s.%s", tableTitle.Database, tableTitle.Table)
+		tableLog := log.WithField("table", tableName)
+		tableLog.Infof("download and restore table %d/%d", i+1, len(tablesForRestore))
+		tableRestorePattern := getByTableRestorePattern(tableTitle)
+		if err = b.Download(backupName, tableRestorePattern, opts.Partitions, false, false, commandId); err != nil {
+			return err
+		}
+		hasData, err := b.isLocalBackupTableWithData(ctx, backupName, tableTitle)
+		if err != nil {
+			return err
+		}
+		if hasData {
+			if err = b.Restore(backupName, RestoreOptions{
+				TablePattern:       tableRestorePattern,
+				FunctionsPattern:   opts.FunctionsPattern,
+				DatabaseMapping:    opts.DatabaseMapping,
+				Partitions:         opts.Partitions,
+				LastPartitions:     opts.LastPartitions,
+				DataOnly:           true,
+				IgnoreDependencies: opts.IgnoreDependencies,
+				SkipAttach:         opts.SkipAttach,
+				SchemaAsAttach:     opts.SchemaAsAttach,
+			}, commandId); err != nil {
+				return err
+			}
+		} else {
+			tableLog.Info("table doesn't contain data, skipping")
+		}
+		if err = cleanDownloaded(); err != nil {
+			return err
+		}
+	}
+	log.WithField("duration", utils.HumanizeDuration(time.Since(startRestore))).Info("done")
+	return nil
+}
+
+func (b *Backuper) getLocalBackupNames(ctx context.Context) (common.EmptyMap, error) {
+	localBackups, _, err := b.GetLocalBackups(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	backupNames := common.EmptyMap{}
+	for _, localBackup := range localBackups {
+		backupNames[localBackup.BackupName] = struct{}{}
+	}
+	return backupNames, nil
+}
+
+// isLocalBackupTableWithData - check local backup table metadata contains data parts
+func (b *Backuper) isLocalBackupTableWithData(ctx context.Context, backupName string, tableTitle metadata.TableTitle) (bool, error) {
+	_, disks, err := b.getLocalBackup(ctx, backupName, nil)
+	if err != nil {
+		return false, err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return false, ErrUnknownClickhouseDataPath
+	}
+	var tableMetadata metadata.TableMetadata
+	tableMetadataPath := path.Join(defaultDataPath, "backup", backupName, "metadata", common.TablePathEncode(tableTitle.Database), common.TablePathEncode(tableTitle.Table)+".json")
+	if _, err = tableMetadata.Load(tableMetadataPath); err != nil {
+		return false, err
+	}
+	return isTableMetadataWithData(tableMetadata), nil
+}
+
+func isTableMetadataWithData(tableMetadata metadata.TableMetadata) bool {
+	if tableMetadata.MetadataOnly {
+		return false
+	}
+	for _, parts := range tableMetadata.Parts {
+		if len(parts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getByTableRestorePattern - table names could contain pattern related chars, `,` separates patterns, so replaced with `?`
+func getByTableRestorePattern(tableTitle metadata.TableTitle) string {
+	return strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", ",", "?").Replace(fmt.Sprintf("%s.%s", tableTitle.Database, tableTitle.Table))
+}
+
+// getRemoteBackupsChain - backupName and its `required_backup` chain, local metadata.json doesn't contain required_backup after download
+func getRemoteBackupsChain(backupName string, remoteBackups []storage.Backup) []string {
+	requiredBackups := make(map[string]string, len(remoteBackups))
+	for _, remoteBackup := range remoteBackups {
+		requiredBackups[remoteBackup.BackupName] = remoteBackup.RequiredBackup
+	}
+	chain := []string{backupName}
+	visitedBackups := common.EmptyMap{backupName: struct{}{}}
+	for requiredBackup := requiredBackups[backupName]; requiredBackup != ""; requiredBackup = requiredBackups[requiredBackup] {
+		if _, visited := visitedBackups[requiredBackup]; visited {
+			break
+		}
+		visitedBackups[requiredBackup] = struct{}{}
+		chain = append(chain, requiredBackup)
+	}
+	return chain
+}
+
+// getDownloadedBackupNames - backups from downloadBackups which absent before restore and exist locally now
+func getDownloadedBackupNames(downloadBackups []string, existsBackups, localBackups common.EmptyMap) []string {
+	var downloaded []string
+	for _, backupName := range downloadBackups {
+		if _, exists := existsBackups[backupName]; exists {
+			continue
+		}
+		if _, exists := localBackups[backupName]; exists {
+			downloaded = append(downloaded, backupName)
+		}
+	}
+	return downloaded
 }
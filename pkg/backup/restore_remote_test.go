@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/storage"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetByTableRestorePattern(t *testing.T) {
+	testCases := []struct {
+		table    metadata.TableTitle
+		expected string
+		other    string
+	}{
+		{metadata.TableTitle{Database: "db", Table: "t"}, "db.t", "db.t2"},
+		{metadata.TableTitle{Database: "db", Table: "t*"}, "db.t\\*", "db.t2"},
+		{metadata.TableTitle{Database: "db", Table: "t?[1]"}, "db.t\\?\\[1]", "db.tx1"},
+		{metadata.TableTitle{Database: "db", Table: "a,b"}, "db.a?b", "db.a"},
+	}
+	for _, tc := range testCases {
+		tableName := tc.table.Database + "." + tc.table.Table
+		pattern := getByTableRestorePattern(tc.table)
+		assert.Equal(t, tc.expected, pattern)
+		matched, err := filepath.Match(pattern, tableName)
+		assert.NoError(t, err)
+		assert.True(t, matched, tableName)
+		matched, _ = filepath.Match(pattern, tc.other)
+		assert.False(t, matched, tc.other)
+	}
+}
+
+func TestGetRemoteBackupsChain(t *testing.T) {
+	remoteBackups := []storage.Backup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "full"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "increment1", RequiredBackup: "full"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "increment2", RequiredBackup: "increment1"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "cycle", RequiredBackup: "cycle"}},
+	}
+	assert.Equal(t, []string{"increment2", "increment1", "full"}, getRemoteBackupsChain("increment2", remoteBackups))
+	assert.Equal(t, []string{"full"}, getRemoteBackupsChain("full", remoteBackups))
+	assert.Equal(t, []string{"cycle"}, getRemoteBackupsChain("cycle", remoteBackups))
+	assert.Equal(t, []string{"absent"}, getRemoteBackupsChain("absent", remoteBackups))
+}
+
+func TestGetDownloadedBackupNames(t *testing.T) {
+	downloadBackups := []string{"increment", "full"}
+	existsBackups := common.EmptyMap{"local1": {}}
+	assert.Empty(t, getDownloadedBackupNames(downloadBackups, existsBackups, common.EmptyMap{"local1": {}}))
+	assert.Equal(t, []string{"increment", "full"}, getDownloadedBackupNames(downloadBackups, existsBackups, common.EmptyMap{"local1": {}, "increment": {}, "full": {}}))
+	// backups created by other commands during restore are kept
+	assert.Equal(t, []string{"increment"}, getDownloadedBackupNames(downloadBackups, existsBackups, common.EmptyMap{"local1": {}, "increment": {}, "cron_backup": {}}))
+	// required backup which exists before restore is kept
+	assert.Equal(t, []string{"increment"}, getDownloadedBackupNames(downloadBackups, common.EmptyMap{"full": {}}, common.EmptyMap{"increment": {}, "full": {}}))
+}
+
+func TestIsTableMetadataWithData(t *testing.T) {
+	assert.True(t, isTableMetadataWithData(metadata.TableMetadata{Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}))
+	assert.False(t, isTableMetadataWithData(metadata.TableMetadata{Parts: map[string][]metadata.Part{"default": {}}}))
+	assert.False(t, isTableMetadataWithData(metadata.TableMetadata{}))
+	assert.False(t, isTableMetadataWithData(metadata.TableMetadata{MetadataOnly: true, Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}))
+}
+
+func TestRestoreFromRemoteByTableEmbedded(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.ClickHouse.UseEmbeddedBackupRestore = true
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{Config: &cfg.ClickHouse}, log: apexLog.WithField("logger", "test")}
+	err := b.RestoreFromRemoteByTable("backup1", RestoreOptions{}, status.NotFromAPI)
+	assert.EqualError(t, err, "restore table by table is not compatible with `use_embedded_backup_restore: true`")
+}
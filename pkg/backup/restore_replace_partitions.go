@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/google/uuid"
+)
+
+var createTableNameRE = regexp.MustCompile("^(CREATE TABLE\\s+)(?:`[^`]+`|[^\\s.`]+)\\.(?:`[^`]+`|[^\\s(`]+)(\\s+UUID\\s+'[^']+')?")
+var replicatedEngineWithArgsRE = regexp.MustCompile(`(ENGINE\s*=\s*)Replicated(\w*MergeTree)\(\s*'[^']*'\s*,\s*'[^']*'\s*(?:,\s*)?`)
+var replicatedEngineRE = regexp.MustCompile(`(ENGINE\s*=\s*)Replicated(\w*MergeTree)`)
+
+// stagingDatabase - temporary tables for destination tables in Replicated database engine created here, DDL inside Replicated database executed on all replicas,
+// database is not dropped after restore, concurrent restore of other tables could create temporary tables in it, empty database could be dropped manually
+const stagingDatabase = "_clickhouse_backup_staging"
+
+// getReplaceStagingTableName - temporary table for --replace-partitions, created in database of destination table, or in stagingDatabase when destination database has Replicated engine
+func getReplaceStagingTableName(table string) string {
+	return "__restore_replace_" + table
+}
+
+// getUniqueStagingTableName - random suffix allows concurrent restore of the same table, for example from several replicas of Replicated database
+func getUniqueStagingTableName(stagingTableName string) string {
+	return stagingTableName + "_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+}
+
+// getReplaceStagingTableQuery - the same structure as destination table, Replicated engine replaced by not replicated, to avoid register temporary table in ZooKeeper
+func getReplaceStagingTableQuery(createTableQuery, database, stagingTable string) (string, error) {
+	if !createTableNameRE.MatchString(createTableQuery) {
+		return "", fmt.Errorf("can't parse table name in '%s'", createTableQuery)
+	}
+	query := createTableNameRE.ReplaceAllString(createTableQuery, fmt.Sprintf("${1}`%s`.`%s`", database, stagingTable))
+	query = replicatedEngineWithArgsRE.ReplaceAllString(query, "${1}${2}(")
+	return replicatedEngineRE.ReplaceAllString(query, "${1}${2}"), nil
+}
+
+// createReplaceStagingTable - temporary table from current destination table structure
+func (b *Backuper) createReplaceStagingTable(ctx context.Context, dstTable clickhouse.Table, log *apexLog.Entry) (clickhouse.Table, error) {
+	return b.createStagingTable(ctx, dstTable.Database, getReplaceStagingTableName(dstTable.Name), dstTable.CreateTableQuery, "--replace-partitions", log)
+}
+
+// createStagingTable - temporary table in database of destination table from createTableQuery, used for attach parts before move data into destination table,
+// for Replicated database engine temporary table created in separate local database, REPLACE PARTITION and INSERT SELECT work between databases
+func (b *Backuper) createStagingTable(ctx context.Context, database, stagingTableName, createTableQuery, purpose string, log *apexLog.Entry) (clickhouse.Table, error) {
+	stagingTable := clickhouse.Table{Database: database, Name: getUniqueStagingTableName(stagingTableName)}
+	if b.isReplicatedDatabase(database, map[string]bool{}, log) {
+		stagingTable.Database = stagingDatabase
+		if err := b.ch.CreateDatabaseWithEngine(stagingDatabase, "Atomic", ""); err != nil {
+			return stagingTable, fmt.Errorf("can't create database '%s' for %s temporary tables: %v", stagingDatabase, purpose, err)
+		}
+	}
+	query, err := getReplaceStagingTableQuery(createTableQuery, stagingTable.Database, stagingTable.Name)
+	if err != nil {
+		return stagingTable, err
+	}
+	if _, err = b.ch.QueryContext(ctx, query); err != nil {
+		return stagingTable, fmt.Errorf("can't create temporary table '%s.%s' for %s: %v", stagingTable.Database, stagingTable.Name, purpose, err)
+	}
+	tables, err := b.ch.GetTables(ctx, fmt.Sprintf("%s.%s", stagingTable.Database, stagingTable.Name))
+	if err != nil || len(tables) == 0 {
+		b.dropStagingTable(stagingTable, log)
+		return stagingTable, fmt.Errorf("can't find temporary table '%s.%s' in system.tables: %v", stagingTable.Database, stagingTable.Name, err)
+	}
+	log.Debugf("temporary table %s.%s created", stagingTable.Database, stagingTable.Name)
+	return tables[0], nil
+}
+
+func (b *Backuper) dropStagingTable(stagingTable clickhouse.Table, log *apexLog.Entry) {
+	if err := b.ch.DropTable(stagingTable, "", "", false, 0); err != nil {
+		log.Warnf("can't drop temporary table '%s.%s': %v", stagingTable.Database, stagingTable.Name, err)
+	}
+}
+
+// replaceRestoredPartitions - parts already attached to stagingTable, partitions of destination table replaced one by one
+func (b *Backuper) replaceRestoredPartitions(ctx context.Context, table metadata.TableMetadata, stagingTable clickhouse.Table, log *apexLog.Entry) error {
+	partitionIDs := getRestoredPartitionIDs(table.Parts)
+	if err := b.ch.ReplacePartitions(ctx, table.Database, table.Table, stagingTable.Database, stagingTable.Name, partitionIDs); err != nil {
+		return fmt.Errorf("can't replace partitions for table '%s.%s': %v", table.Database, table.Table, err)
+	}
+	log.Debugf("%d partitions replaced", len(partitionIDs))
+	return nil
+}
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/filesystemhelper"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+)
+
+// splitSyncParts - compare backup parts and active parts of destination table by data checksum, ATTACH PART assign new block numbers, so part names and block ranges can't be compared
+// backupChecksums key is `disk/part_name`, existingChecksums key is part name, parts merged after previous restore have other checksum and will not match any backup part
+// return backup parts which absent in table, backup parts which already present and active table parts which absent in backup
+func splitSyncParts(disksToPartsMap map[string][]metadata.Part, backupChecksums map[string]string, existingParts []clickhouse.PartState, existingChecksums map[string]string) (map[string][]metadata.Part, []string, []string) {
+	existingByChecksum := map[string][]string{}
+	for _, existingPart := range existingParts {
+		if existingPart.Active != 1 {
+			continue
+		}
+		checksum := existingChecksums[existingPart.Name]
+		existingByChecksum[checksum] = append(existingByChecksum[checksum], existingPart.Name)
+	}
+	missingParts := make(map[string][]metadata.Part, len(disksToPartsMap))
+	var presentParts []string
+	disks := make([]string, 0, len(disksToPartsMap))
+	for disk := range disksToPartsMap {
+		disks = append(disks, disk)
+	}
+	sort.Strings(disks)
+	for _, disk := range disks {
+		for _, part := range disksToPartsMap[disk] {
+			// old backups could contain projections in parts list, they copied inside parent part directory
+			if filesystemhelper.IsProjection(part.Name) {
+				continue
+			}
+			checksum, exists := backupChecksums[path.Join(disk, part.Name)]
+			// each existing part matches only one backup part
+			if exists && checksum != "" && len(existingByChecksum[checksum]) > 0 {
+				existingByChecksum[checksum] = existingByChecksum[checksum][1:]
+				presentParts = append(presentParts, path.Join(disk, part.Name))
+				continue
+			}
+			missingParts[disk] = append(missingParts[disk], part)
+		}
+	}
+	var extraParts []string
+	for _, partNames := range existingByChecksum {
+		extraParts = append(extraParts, partNames...)
+	}
+	sort.Strings(presentParts)
+	sort.Strings(extraParts)
+	return missingParts, presentParts, extraParts
+}
+
+// syncTableParts - --sync-parts, keep only backup parts which absent in destination table, return active parts of destination table which absent in backup
+// only partitions which contain restored parts are compared, so --partitions and --last-partitions don't lead to detach other partitions
+func (b *Backuper) syncTableParts(ctx context.Context, backupName string, requiredBackups []string, tablesForRestore ListOfTables, disks []clickhouse.Disk, syncPartsDetach bool, log *apexLog.Entry) (map[metadata.TableTitle][]string, error) {
+	extraPartsByTable := map[metadata.TableTitle][]string{}
+	for i, table := range tablesForRestore {
+		dstDatabase, dstTableName := getRestoreTableMappingTarget(table.Database, table.Table, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping)
+		// DETACH PART is replicated, part would disappear on all replicas, not only on restored one
+		if syncPartsDetach && strings.Contains(table.Query, "Replicated") {
+			return nil, fmt.Errorf("--sync-parts-detach is not supported for replicated table '%s.%s', DETACH PART will applied on all replicas", dstDatabase, dstTableName)
+		}
+		existingParts, err := b.ch.GetPartsState(ctx, dstDatabase, dstTableName, getRestoredPartitionIDs(table.Parts))
+		if err != nil {
+			return nil, fmt.Errorf("can't get parts from system.parts for table '%s.%s': %v", dstDatabase, dstTableName, err)
+		}
+		existingChecksums := make(map[string]string, len(existingParts))
+		for _, existingPart := range existingParts {
+			if existingPart.Active != 1 {
+				continue
+			}
+			if existingChecksums[existingPart.Name], err = filesystemhelper.GetPartDataChecksum(existingPart.Path); err != nil {
+				return nil, fmt.Errorf("can't read checksums of part %s in '%s.%s', --sync-parts requires local access to part files: %v", existingPart.Name, dstDatabase, dstTableName, err)
+			}
+		}
+		backupChecksums := map[string]string{}
+		for _, disk := range disks {
+			for _, part := range table.Parts[disk.Name] {
+				if filesystemhelper.IsProjection(part.Name) {
+					continue
+				}
+				if backupChecksums[path.Join(disk.Name, part.Name)], err = filesystemhelper.GetPartDataChecksum(filesystemhelper.GetBackupPartPath(backupName, requiredBackups, table, disk, part.Name)); err != nil {
+					return nil, fmt.Errorf("can't read checksums of backup part %s/%s for '%s.%s': %v", disk.Name, part.Name, table.Database, table.Table, err)
+				}
+			}
+		}
+		missingParts, presentParts, extraParts := splitSyncParts(table.Parts, backupChecksums, existingParts, existingChecksums)
+		tablesForRestore[i].Parts = missingParts
+		if len(extraParts) > 0 {
+			extraPartsByTable[metadata.TableTitle{Database: dstDatabase, Table: dstTableName}] = extraParts
+		}
+		missingCount := 0
+		for _, parts := range missingParts {
+			missingCount += len(parts)
+		}
+		log.WithField("table", fmt.Sprintf("%s.%s", dstDatabase, dstTableName)).Infof("%d parts already present, %d parts will be restored, %d parts absent in backup", len(presentParts), missingCount, len(extraParts))
+	}
+	return extraPartsByTable, nil
+}
+
+// detachExtraParts - --sync-parts-detach, parts moved to `detached` and could be attached back manually
+func (b *Backuper) detachExtraParts(ctx context.Context, extraPartsByTable map[metadata.TableTitle][]string, log *apexLog.Entry) error {
+	for table, extraParts := range extraPartsByTable {
+		for _, partName := range extraParts {
+			if err := b.ch.DetachPart(ctx, table.Database, table.Table, partName); err != nil {
+				return fmt.Errorf("can't detach part %s from '%s.%s': %v", partName, table.Database, table.Table, err)
+			}
+		}
+		log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).Infof("parts absent in backup moved to 'detached': %s", strings.Join(extraParts, ", "))
+	}
+	return nil
+}
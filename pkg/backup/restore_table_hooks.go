@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/mattn/go-shellwords"
+)
+
+// getRestoreTableCommandArgs - placeholders replaced after parse, so database and table names can't break command arguments
+func getRestoreTableCommandArgs(command, database, table string) ([]string, error) {
+	args, err := shellwords.Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	replacer := strings.NewReplacer("{database}", database, "{table}", table)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+	return args, nil
+}
+
+// runRestoreTableCommand - run `pre_restore_table_command` or `post_restore_table_command`, output logged line by line
+// tableErr passed to command in CLICKHOUSE_BACKUP_RESTORE_ERROR environment variable, when post command runs after failed table restore
+// error returned only when `restore_table_command_abort_on_error: true`
+func (b *Backuper) runRestoreTableCommand(ctx context.Context, name, command, database, table string, tableErr error, log *apexLog.Entry) error {
+	if command == "" {
+		return nil
+	}
+	args, err := getRestoreTableCommandArgs(command, database, table)
+	if err == nil && len(args) == 0 {
+		err = fmt.Errorf("empty command")
+	}
+	var out []byte
+	if err == nil {
+		log.Debugf("run %s: %s", name, strings.Join(args, " "))
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = getRestoreTableCommandEnv(os.Environ(), database, table, tableErr)
+		out, err = cmd.CombinedOutput()
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		log.Infof("%s: %s", name, scanner.Text())
+	}
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%s failed for '%s.%s': %v", name, database, table, err)
+	if b.cfg.General.RestoreTableCommandAbortOnError {
+		return err
+	}
+	log.Warn(err.Error())
+	return nil
+}
+
+// getRestoreTableCommandEnv - restored table and result of table restore for hook commands, empty CLICKHOUSE_BACKUP_RESTORE_ERROR means table restored successfully
+func getRestoreTableCommandEnv(env []string, database, table string, tableErr error) []string {
+	restoreErr := ""
+	if tableErr != nil {
+		restoreErr = tableErr.Error()
+	}
+	return append(env, "CLICKHOUSE_BACKUP_DATABASE="+database, "CLICKHOUSE_BACKUP_TABLE="+table, "CLICKHOUSE_BACKUP_RESTORE_ERROR="+restoreErr)
+}
@@ -0,0 +1,947 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/resumable"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRestoreDatabaseMapping(t *testing.T) {
+	mapping, err := parseRestoreDatabaseMapping("mapping.yaml", []byte("db1: new_db1\ndb2: new_db2\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db1:new_db1", "db2:new_db2"}, mapping)
+
+	mapping, err = parseRestoreDatabaseMapping("mapping.json", []byte(`{"db1": "new_db1", "db2": "new_db2"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db1:new_db1", "db2:new_db2"}, mapping)
+
+	_, err = parseRestoreDatabaseMapping("mapping.yaml", []byte("- db1\n- db2\n"))
+	assert.EqualError(t, err, "mapping.yaml line 1: shall contain srcDatabase: destinationDatabase object")
+
+	_, err = parseRestoreDatabaseMapping("mapping.yaml", []byte("db1: new_db1\ndb2:\n  nested: value\n"))
+	assert.EqualError(t, err, "mapping.yaml line 2: srcDatabase and destinationDatabase shall be strings")
+
+	_, err = parseRestoreDatabaseMapping("mapping.yaml", []byte("db1: new_db1\ndb2: \"new:db2\"\n"))
+	assert.EqualError(t, err, "mapping.yaml line 2: invalid database name, shall be not empty and doesn't contain ':' or ','")
+
+	_, err = parseRestoreDatabaseMapping("mapping.yaml", []byte("db1: new_db1\ndb1: other_db1\n"))
+	assert.EqualError(t, err, "mapping.yaml line 2: duplicated srcDatabase, already defined at line 1")
+
+	// file content is not returned in errors
+	_, err = parseRestoreDatabaseMapping("mapping.yaml", []byte("db1: new_db1\nsecret_value: [unclosed\n"))
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret_value")
+	assert.NotContains(t, err.Error(), "unclosed")
+	assert.Contains(t, err.Error(), "mapping.yaml line ")
+}
+
+func TestGetUnmatchedDatabaseMappingRules(t *testing.T) {
+	backupMetadata := metadata.BackupMetadata{
+		Databases: []metadata.DatabasesMeta{{Name: "db1"}},
+		Tables:    []metadata.TableTitle{{Database: "db2", Table: "t"}},
+	}
+	assert.Empty(t, getUnmatchedDatabaseMappingRules(map[string]string{"db1": "new_db1", "db2": "new_db2"}, backupMetadata))
+	assert.Equal(t, []string{"absent1", "absent2"}, getUnmatchedDatabaseMappingRules(map[string]string{"db1": "new_db1", "absent2": "x", "absent1": "y"}, backupMetadata))
+}
+
+func TestParseRBACEntity(t *testing.T) {
+	entity, ok := parseRBACEntity("ATTACH USER `test-user` IDENTIFIED WITH sha256_hash BY '...';\nATTACH GRANT SELECT ON default.* TO `test-user`;\n")
+	assert.True(t, ok)
+	assert.Equal(t, rbacEntity{Type: "USER", Name: "test-user"}, entity)
+
+	entity, ok = parseRBACEntity("ATTACH ROW POLICY policy1 ON default.test USING 1 TO ALL;\n")
+	assert.True(t, ok)
+	assert.Equal(t, rbacEntity{Type: "ROW POLICY", Name: "policy1", Table: "default.test"}, entity)
+
+	entity, ok = parseRBACEntity("ATTACH ROW POLICY policy1 ON `db-1`.`test 2` USING 1 TO ALL;\n")
+	assert.True(t, ok)
+	assert.Equal(t, rbacEntity{Type: "ROW POLICY", Name: "policy1", Table: "db-1.test 2"}, entity)
+
+	_, ok = parseRBACEntity("SELECT 1")
+	assert.False(t, ok)
+
+	assert.True(t, isRBACEntityMatched(rbacEntity{Type: "SETTINGS PROFILE", Name: "readonly"}, []string{"settings_profile"}, nil))
+	assert.True(t, isRBACEntityMatched(rbacEntity{Type: "USER", Name: "test-user"}, []string{"user", "role"}, []string{"admin", "test-*"}))
+	assert.False(t, isRBACEntityMatched(rbacEntity{Type: "USER", Name: "test-user"}, []string{"ROLE"}, nil))
+	assert.False(t, isRBACEntityMatched(rbacEntity{Type: "USER", Name: "test-user"}, nil, []string{"admin"}))
+}
+
+func TestGetRBACEntities(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"1.sql": "ATTACH ROW POLICY policy1 ON default.t1 USING 1 TO ALL;\n",
+		"2.sql": "ATTACH ROW POLICY policy1 ON default.t2 USING 1 TO ALL;\n",
+		"3.sql": "ATTACH USER user1;\n",
+	}
+	for name, body := range files {
+		assert.NoError(t, os.WriteFile(path.Join(dir, name), []byte(body), 0644))
+	}
+	entities, err := getRBACEntities(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[rbacEntity][]string{
+		{Type: "ROW POLICY", Name: "policy1", Table: "default.t1"}: {"1.sql"},
+		{Type: "ROW POLICY", Name: "policy1", Table: "default.t2"}: {"2.sql"},
+		{Type: "USER", Name: "user1"}:                              {"3.sql"},
+	}, entities)
+}
+
+func TestWriteSchemaOutput(t *testing.T) {
+	schemaOutput := path.Join(t.TempDir(), "schema.sql")
+	assert.NoError(t, writeSchemaOutput(schemaOutput, []string{
+		"CREATE TABLE db.src (`id` UInt64) ENGINE = MergeTree ORDER BY id",
+		"ATTACH MATERIALIZED VIEW db.mv TO db.src (`id` UInt64) AS SELECT id FROM db.queue;",
+	}, apexLog.WithField("logger", "test")))
+	body, err := os.ReadFile(schemaOutput)
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE db.src (`id` UInt64) ENGINE = MergeTree ORDER BY id;\n\nATTACH MATERIALIZED VIEW db.mv TO db.src (`id` UInt64) AS SELECT id FROM db.queue;\n\n", string(body))
+}
+
+func TestGetSchemaOutputDatabaseQueries(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreDatabaseMapping = map[string]string{"db1": "new_db1"}
+	b := &Backuper{cfg: cfg}
+	databaseQueries := b.getSchemaOutputDatabaseQueries([]metadata.DatabasesMeta{
+		{Name: "db1", Engine: "Atomic", Query: "CREATE DATABASE db1 ENGINE = Atomic"},
+		{Name: "db2", Engine: "Ordinary", Query: "CREATE DATABASE db2 ENGINE = Ordinary"},
+		{Name: "system", Engine: "Atomic", Query: "CREATE DATABASE system ENGINE = Atomic"},
+	})
+	assert.Equal(t, map[string]string{
+		"new_db1": "CREATE DATABASE IF NOT EXISTS `new_db1` ENGINE = Atomic",
+		"db2":     "CREATE DATABASE IF NOT EXISTS `db2` ENGINE = Ordinary",
+	}, databaseQueries)
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `new_db1` ENGINE = Atomic", getSchemaOutputDatabaseQuery("new_db1", databaseQueries))
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `db3`", getSchemaOutputDatabaseQuery("db3", databaseQueries))
+}
+
+func TestMergeTablesForRestore(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	daily := ListOfTables{
+		{Database: "db", Table: "t", Query: "CREATE TABLE db.t UUID '00000000-0000-4000-8000-000000000001' (`id` UInt64) ENGINE = MergeTree ORDER BY id", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}}},
+	}
+	hourly := ListOfTables{
+		{Database: "db", Table: "t", Query: "CREATE TABLE db.t UUID '00000000-0000-4000-8000-000000000002' (`id` UInt64) ENGINE = MergeTree ORDER BY id", Parts: map[string][]metadata.Part{"default": {{Name: "all_2_2_0"}, {Name: "all_3_3_0"}}}},
+		{Database: "db", Table: "new", Query: "CREATE TABLE db.new (`id` UInt64) ENGINE = MergeTree ORDER BY id", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}},
+	}
+	merged, err := mergeTablesForRestore([]string{"daily", "hourly"}, []ListOfTables{daily, hourly}, log)
+	assert.NoError(t, err)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, []metadata.Part{{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_3_3_0"}}, merged[0].Parts["default"])
+	assert.Equal(t, []metadata.Part{{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}, daily[0].Parts["default"])
+	assert.Equal(t, "new", merged[1].Table)
+
+	// merged part in later backup replaces parts with the same blocks, parts covered by already merged part are skipped
+	merged, err = mergeTablesForRestore([]string{"daily", "hourly", "merged"}, []ListOfTables{daily, hourly, {
+		{Database: "db", Table: "t", Query: hourly[0].Query, Parts: map[string][]metadata.Part{"default": {{Name: "all_1_2_1"}}, "hdd": {{Name: "all_3_3_0_5"}}}},
+	}}, log)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_3_3_0"}, {Name: "all_1_2_1"}}}, merged[0].Parts)
+	parts, duplicatedParts, err := mergeBackupParts(map[string][]metadata.Part{"default": {{Name: "202301_1_4_1", PartitionID: "202301"}, {Name: "202302_1_1_0"}}}, map[string][]metadata.Part{"default": {{Name: "202301_2_3_1"}, {Name: "202302_1_1_0_3"}, {Name: "202302_2_2_0"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, duplicatedParts)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "202301_1_4_1", PartitionID: "202301"}, {Name: "202302_1_1_0"}, {Name: "202302_2_2_0"}}}, parts)
+	_, _, err = mergeBackupParts(map[string][]metadata.Part{"default": {{Name: "all_1_2_1"}}}, map[string][]metadata.Part{"default": {{Name: "all_2_3_1"}}})
+	assert.EqualError(t, err, "blocks of default/all_2_3_1 partially intersect with default/all_1_2_1")
+
+	hourly[0].Query = "CREATE TABLE db.t (`id` UInt64, `name` String) ENGINE = MergeTree ORDER BY id"
+	_, err = mergeTablesForRestore([]string{"daily", "hourly"}, []ListOfTables{daily, hourly}, log)
+	assert.EqualError(t, err, "schema of 'db.t' is different in backups 'daily' and 'hourly', merged restore is not possible")
+}
+
+func TestSplitPartsByPartition(t *testing.T) {
+	batches := splitPartsByPartition(map[string][]metadata.Part{
+		"default": {{Name: "202302_3_3_0"}, {Name: "202301_1_1_0"}},
+		"hdd":     {{Name: "202301_2_2_0"}, {Name: "4a1b_1_1_0", PartitionID: "4a1b"}},
+	})
+	assert.Equal(t, []map[string][]metadata.Part{
+		{"default": {{Name: "202301_1_1_0"}}, "hdd": {{Name: "202301_2_2_0"}}},
+		{"default": {{Name: "202302_3_3_0"}}},
+		{"hdd": {{Name: "4a1b_1_1_0", PartitionID: "4a1b"}}},
+	}, batches)
+}
+
+func TestGetUnexpectedAttachedParts(t *testing.T) {
+	partitionIDs := getRestoredPartitionIDs(map[string][]metadata.Part{
+		"default": {{Name: "202301_1_1_0"}, {Name: "202302_2_2_0"}, {Name: "202302_2_2_0.proj"}},
+		"hdd":     {{Name: "202303_3_3_0"}},
+	})
+	assert.Equal(t, []string{"202301", "202302", "202303"}, partitionIDs)
+	partsBefore := common.EmptyMap{"202301_1_1_0": {}}
+	partsAfter := []clickhouse.PartState{
+		{Name: "202301_1_1_0", PartitionID: "202301", MinBlockNumber: 1, MaxBlockNumber: 1, Active: 1},
+		// merged into 202301_5_6_1
+		{Name: "202301_5_5_0", PartitionID: "202301", MinBlockNumber: 5, MaxBlockNumber: 5},
+		{Name: "202301_6_6_0", PartitionID: "202301", MinBlockNumber: 6, MaxBlockNumber: 6},
+		{Name: "202301_5_6_1", PartitionID: "202301", MinBlockNumber: 5, MaxBlockNumber: 6, Level: 1, Active: 1},
+		{Name: "202302_7_7_0", PartitionID: "202302", MinBlockNumber: 7, MaxBlockNumber: 7},
+	}
+	assert.Equal(t, []string{"part 202302_7_7_0 attached but inactive", "partition 202303 has no attached parts"}, getUnexpectedAttachedParts(partitionIDs, partsBefore, partsAfter))
+	assert.Empty(t, getUnexpectedAttachedParts(partitionIDs[:1], partsBefore, partsAfter))
+}
+
+func TestGetAttachUnsupportedReason(t *testing.T) {
+	dataPath := t.TempDir()
+	assert.Equal(t, "", getAttachUnsupportedReason(clickhouse.Table{Engine: "ReplicatedMergeTree", DataPaths: []string{dataPath}}, true))
+	assert.Equal(t, "engine SharedMergeTree doesn't support ATTACH PART from `detached`", getAttachUnsupportedReason(clickhouse.Table{Engine: "SharedMergeTree", DataPaths: []string{dataPath}}, true))
+	missingPath := path.Join(dataPath, "missing")
+	assert.Equal(t, "data path "+missingPath+" doesn't exist on clickhouse-backup host", getAttachUnsupportedReason(clickhouse.Table{Engine: "MergeTree", DataPaths: []string{missingPath}}, true))
+	assert.Equal(t, "", getAttachUnsupportedReason(clickhouse.Table{Engine: "MergeTree", DataPaths: []string{missingPath}}, false))
+}
+
+func TestSplitOverlappingParts(t *testing.T) {
+	partitionID, minBlock, maxBlock, ok := parsePartBlockRange(metadata.Part{Name: "202301_3_7_1_9"})
+	assert.True(t, ok)
+	assert.Equal(t, "202301", partitionID)
+	assert.Equal(t, []int64{3, 7}, []int64{minBlock, maxBlock})
+	partitionID, _, _, ok = parsePartBlockRange(metadata.Part{Name: "1-a_5_5_0", PartitionID: "1-a"})
+	assert.True(t, ok)
+	assert.Equal(t, "1-a", partitionID)
+	_, _, _, ok = parsePartBlockRange(metadata.Part{Name: "p1.proj"})
+	assert.False(t, ok)
+
+	existingParts := []clickhouse.PartState{
+		{Name: "202301_1_5_1", PartitionID: "202301", MinBlockNumber: 1, MaxBlockNumber: 5, Active: 1},
+		{Name: "202301_6_6_0", PartitionID: "202301", MinBlockNumber: 6, MaxBlockNumber: 6},
+	}
+	notOverlappingParts, overlappingParts := splitOverlappingParts(map[string][]metadata.Part{
+		"default": {{Name: "202301_4_4_0"}, {Name: "202301_6_6_0"}, {Name: "202302_1_1_0"}},
+	}, existingParts)
+	assert.Equal(t, []string{"default/202301_4_4_0"}, overlappingParts)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "202301_6_6_0"}, {Name: "202302_1_1_0"}}}, notOverlappingParts)
+}
+
+func TestGetRestoreFreezePaths(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse", Type: "local"},
+		{Name: "hdd", Path: "/hdd", Type: "local"},
+		{Name: "unused", Path: "/unused", Type: "local"},
+	}
+	dataPaths := []string{"/var/lib/clickhouse/store/abc/abcdef/", "/hdd/store/abc/abcdef/"}
+	assert.Equal(t, []string{"/hdd/shadow/restored_backup1", "/var/lib/clickhouse/shadow/restored_backup1"}, getRestoreFreezePaths(disks, dataPaths, "restored_backup1"))
+}
+
+func TestGetRestoreFreezeName(t *testing.T) {
+	freezeName := getRestoreFreezeName("backup1")
+	assert.Regexp(t, `^restored_backup1_[0-9a-f]{8}$`, freezeName)
+	assert.NotEqual(t, freezeName, getRestoreFreezeName("backup1"))
+}
+
+func TestRestartClickHouse(t *testing.T) {
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{Config: &cfg.ClickHouse}}
+	log := apexLog.WithField("logger", "test")
+	workDir := t.TempDir()
+	b.ch.Config.RestartCommand = `sh -c 'test "$RESTART_TEST" = "ok" && test "$(pwd)" = "` + workDir + `" && echo restarted'`
+	b.ch.Config.RestartCommandEnv = []string{"RESTART_TEST=ok"}
+	b.ch.Config.RestartCommandDir = workDir
+	assert.NoError(t, b.restartClickHouse(context.Background(), log))
+	b.ch.Config.RestartCommandEnv = nil
+	assert.ErrorContains(t, b.restartClickHouse(context.Background(), log), "failed")
+	b.ch.Config.RestartCommand = "sleep 5"
+	b.ch.Config.RestartCommandTimeout, b.ch.Config.RestartCommandTimeoutDuration = "100ms", 100*time.Millisecond
+	assert.ErrorContains(t, b.restartClickHouse(context.Background(), log), "restart_command_timeout: 100ms")
+	b.ch.Config.RestartCommand = "clickhouse-backup-nonexistent-restart-command"
+	assert.ErrorContains(t, b.restartClickHouse(context.Background(), log), "not found")
+}
+
+func TestRestoreLock(t *testing.T) {
+	tables := []metadata.TableTitle{{Database: "db1", Table: "t1"}, {Database: "db2", Table: "t2"}, {Database: "db1", Table: "t3"}}
+	exclusiveLocks, sharedLocks := getRestoreLockNames("database", tables, "db2.*,db1.t1", nil, map[string]string{"db2": "new.db2"}, false, false)
+	assert.Equal(t, []string{"restore.db.db1.lock", "restore.db.new%2Edb2.lock"}, exclusiveLocks)
+	assert.Equal(t, []string{"restore.lock"}, sharedLocks)
+	exclusiveLocks, sharedLocks = getRestoreLockNames("database", tables, "*", nil, nil, true, false)
+	assert.Equal(t, []string{"restore.access.lock"}, exclusiveLocks)
+	assert.Equal(t, []string{"restore.lock"}, sharedLocks)
+	// restore_rbac doesn't read backup tables
+	exclusiveLocks, sharedLocks = getRestoreLockNames("database", nil, "", nil, nil, true, false)
+	assert.Equal(t, []string{"restore.access.lock"}, exclusiveLocks)
+	assert.Equal(t, []string{"restore.lock"}, sharedLocks)
+	exclusiveLocks, sharedLocks = getRestoreLockNames("global", tables, "*", nil, nil, false, false)
+	assert.Equal(t, []string{"restore.lock"}, exclusiveLocks)
+	assert.Empty(t, sharedLocks)
+	exclusiveLocks, sharedLocks = getRestoreLockNames("none", tables, "*", nil, nil, false, false)
+	assert.Empty(t, exclusiveLocks)
+	assert.Empty(t, sharedLocks)
+
+	b := &Backuper{cfg: config.DefaultConfig()}
+	log := apexLog.WithField("operation", "restore")
+	lockPath := t.TempDir()
+	lock1, err := b.acquireRestoreLock(context.Background(), lockPath, []string{"restore.db.db1.lock"}, []string{"restore.lock"}, log)
+	assert.NoError(t, err)
+	lock2, err := b.acquireRestoreLock(context.Background(), lockPath, []string{"restore.db.db2.lock"}, []string{"restore.lock"}, log)
+	assert.NoError(t, err)
+	_, err = b.acquireRestoreLock(context.Background(), lockPath, []string{"restore.db.db1.lock"}, []string{"restore.lock"}, log)
+	assert.ErrorContains(t, err, "another restore is running")
+	_, err = b.acquireRestoreLock(context.Background(), lockPath, []string{"restore.lock"}, nil, log)
+	assert.Error(t, err)
+	lock1.Release(log)
+	lock2.Release(log)
+	lock3, err := b.acquireRestoreLock(context.Background(), lockPath, []string{"restore.lock"}, nil, log)
+	assert.NoError(t, err)
+	lock3.Release(log)
+}
+
+func TestEstimateRestoreSize(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "default", Path: "/var/lib/clickhouse"}, {Name: "hdd", Path: "/hdd"}, {Name: "ssd", Path: "/ssd"}}
+	// table created during restore, parts placed to mapped disk or disk with the same name or default disk
+	assert.Equal(t, "hdd", getRestoreDstDisk("hdd", disks, nil, nil))
+	assert.Equal(t, "ssd", getRestoreDstDisk("hdd", disks, nil, map[string]string{"hdd": "ssd"}))
+	assert.Equal(t, "default", getRestoreDstDisk("absent", disks, nil, nil))
+	// existing table, parts from disk which is not used by storage policy placed to the first table disk
+	assert.Equal(t, "ssd", getRestoreDstDisk("hdd", disks, []string{"/ssd/store/abc/abcdef/"}, nil))
+	assert.Equal(t, "hdd", getRestoreDstDisk("hdd", disks, []string{"/ssd/store/abc/abcdef/", "/hdd/store/abc/abcdef/"}, nil))
+
+	assert.Equal(t, uint64(300), getPartsRestoreSize([]metadata.Part{{Name: "all_1_1_0", Size: 100}, {Name: "all_2_2_0", Size: 200}}, 1000))
+	assert.Equal(t, uint64(1000), getPartsRestoreSize([]metadata.Part{{Name: "all_1_1_0", Size: 100}, {Name: "all_2_2_0"}}, 1000))
+
+	estimate := getRestoreSizeEstimate(map[string]uint64{"default": 100, "hdd": 500, "s3": 1000}, map[string]uint64{"default": 1000, "hdd": 400})
+	assert.Equal(t, RestoreSizeEstimate{
+		Disks: []DiskRestoreSize{
+			{Disk: "default", Required: 100, Free: 1000, Fits: true},
+			{Disk: "hdd", Required: 500, Free: 400, Fits: false},
+			{Disk: "s3", Required: 1000, Fits: true},
+		},
+		Required: 1600,
+		Fits:     false,
+	}, estimate)
+}
+
+func TestGetEmbeddedRestoreProgressStatus(t *testing.T) {
+	progress := getEmbeddedRestoreProgressStatus(embeddedRestoreProgress{NumFiles: 10, TotalSize: 1000, FilesRead: 2, BytesRead: 250}, time.Minute)
+	assert.Equal(t, 25.0, progress.Percent)
+	assert.Equal(t, "3m0s", progress.ETA)
+	assert.Equal(t, uint64(2), progress.FilesDone)
+
+	progress = getEmbeddedRestoreProgressStatus(embeddedRestoreProgress{NumFiles: 4, FilesRead: 1}, 10*time.Second)
+	assert.Equal(t, 25.0, progress.Percent)
+	assert.Equal(t, "30s", progress.ETA)
+
+	progress = getEmbeddedRestoreProgressStatus(embeddedRestoreProgress{NumFiles: 4, TotalSize: 1000}, 10*time.Second)
+	assert.Equal(t, 0.0, progress.Percent)
+	assert.Empty(t, progress.ETA)
+}
+
+func TestSortRBACEntityFiles(t *testing.T) {
+	accessDir := t.TempDir()
+	const roleID, profileID, userID, quotaID = "00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002", "00000000-0000-0000-0000-000000000003", "00000000-0000-0000-0000-000000000004"
+	files := map[string]string{
+		userID:    "ATTACH USER app SETTINGS PROFILE ID('" + profileID + "');\nATTACH GRANT ID('" + roleID + "') TO app;\n",
+		quotaID:   "ATTACH QUOTA q1 FOR INTERVAL 1 hour MAX queries = 10 TO ID('" + userID + "');\n",
+		profileID: "ATTACH SETTINGS PROFILE p1 SETTINGS max_threads = 1;\n",
+		roleID:    "ATTACH ROLE reader;\nATTACH GRANT SELECT ON db.* TO reader;\n",
+	}
+	for id, body := range files {
+		assert.NoError(t, os.WriteFile(path.Join(accessDir, id+".sql"), []byte(body), 0644))
+	}
+	entityFiles, err := getRBACEntityFiles(accessDir)
+	assert.NoError(t, err)
+	ordered := sortRBACEntityFiles(entityFiles)
+	assert.Equal(t, "ROLE reader, SETTINGS PROFILE p1, USER app, QUOTA q1", getRBACOrderDescription(ordered))
+	assert.Empty(t, getDanglingRBACReferences(ordered, nil))
+
+	// quota restored without user
+	assert.Equal(t, []string{"QUOTA q1 refers to absent entity " + userID}, getDanglingRBACReferences(ordered[3:], nil))
+	assert.Empty(t, getDanglingRBACReferences(ordered[3:], map[string]struct{}{userID: {}}))
+
+	// files which entity can't be parsed are copied after ordered entities, *.list files are rebuilt
+	const unparsedID = "00000000-0000-0000-0000-000000000005"
+	assert.NoError(t, os.WriteFile(path.Join(accessDir, unparsedID+".sql"), []byte("ATTACH MASKING POLICY m1 ON db.t;\n"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(accessDir, "users.list"), []byte("list"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(accessDir, "need_rebuild_lists.mark"), []byte(""), 0644))
+	copyFiles, err := getRBACCopyFiles(accessDir, ordered)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{roleID + ".sql", profileID + ".sql", userID + ".sql", quotaID + ".sql", unparsedID + ".sql", "need_rebuild_lists.mark"}, copyFiles)
+}
+
+func TestGetReplaceStagingTableQuery(t *testing.T) {
+	query, err := getReplaceStagingTableQuery("CREATE TABLE db.t (`id` UInt64, `v` UInt32) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/db/t', '{replica}', v) PARTITION BY id % 10 ORDER BY id SETTINGS index_granularity = 8192", "db", getReplaceStagingTableName("t"))
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE `db`.`__restore_replace_t` (`id` UInt64, `v` UInt32) ENGINE = ReplacingMergeTree(v) PARTITION BY id % 10 ORDER BY id SETTINGS index_granularity = 8192", query)
+
+	query, err = getReplaceStagingTableQuery("CREATE TABLE `my-db`.`my table` UUID 'c6e5a0a8-0000-4000-8000-000000000001' (`id` UInt64) ENGINE = ReplicatedMergeTree ORDER BY id", "my-db", getReplaceStagingTableName("my table"))
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE `my-db`.`__restore_replace_my table` (`id` UInt64) ENGINE = MergeTree ORDER BY id", query)
+
+	_, err = getReplaceStagingTableQuery("CREATE VIEW db.v AS SELECT 1", "db", "__restore_replace_v")
+	assert.Error(t, err)
+}
+
+func TestGetUniqueStagingTableName(t *testing.T) {
+	name1 := getUniqueStagingTableName(getReplaceStagingTableName("t"))
+	name2 := getUniqueStagingTableName(getReplaceStagingTableName("t"))
+	assert.Regexp(t, "^__restore_replace_t_[0-9a-f]{8}$", name1)
+	assert.Regexp(t, "^__restore_reinsert_t_[0-9a-f]{8}$", getUniqueStagingTableName(getReinsertStagingTableName("t")))
+	assert.NotEqual(t, name1, name2)
+}
+
+func TestParseRestoreTablesFile(t *testing.T) {
+	patterns, err := parseRestoreTablesFile("tables.txt", "# curated tables\ndb1.t1\n\n  db2.* # all tables\r\ndb3.t?\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db1.t1", "db2.*", "db3.t?"}, patterns)
+	_, err = parseRestoreTablesFile("tables.txt", "db1.t1,db1.t2\n")
+	assert.EqualError(t, err, "tables.txt line 1 shall contain one table name or pattern without spaces and commas")
+	_, err = parseRestoreTablesFile("tables.txt", "db1.[t\n")
+	assert.EqualError(t, err, "tables.txt line 1 contains invalid pattern: syntax error in pattern")
+	_, err = parseRestoreTablesFile("tables.txt", "# empty\n")
+	assert.Error(t, err)
+
+	backupTables := []metadata.TableTitle{{Database: "db1", Table: "t1"}, {Database: "db2", Table: "t2"}}
+	assert.Equal(t, []string{"db3.t?", "db1.absent"}, getUnmatchedTablePatterns("db1.t1,db2.*,db3.t?,db1.absent", backupTables))
+	assert.Empty(t, getUnmatchedTablePatterns("", backupTables))
+}
+
+func TestGetRestoreDatabaseActions(t *testing.T) {
+	// fresh server always contains `default` database, restore `default.*` tables keeps it
+	isDrop, isCreate := getRestoreDatabaseActions("default", true, true, true, true)
+	assert.False(t, isDrop)
+	assert.False(t, isCreate)
+	isDrop, isCreate = getRestoreDatabaseActions("default", false, true, false, true)
+	assert.False(t, isDrop)
+	assert.True(t, isCreate)
+	isDrop, isCreate = getRestoreDatabaseActions("db1", true, true, false, true)
+	assert.True(t, isDrop)
+	assert.True(t, isCreate)
+	isDrop, isCreate = getRestoreDatabaseActions("db1", true, true, false, false)
+	assert.False(t, isDrop)
+	assert.True(t, isCreate)
+	// --force-drop drops database even without --rm and for full restore
+	isDrop, isCreate = getRestoreDatabaseActions("db1", true, false, true, false)
+	assert.True(t, isDrop)
+	assert.True(t, isCreate)
+	isDrop, isCreate = getRestoreDatabaseActions("db1", false, false, true, true)
+	assert.True(t, isDrop)
+	assert.True(t, isCreate)
+	// --force-drop never drops `default` database
+	isDrop, isCreate = getRestoreDatabaseActions("default", false, false, true, false)
+	assert.False(t, isDrop)
+	assert.True(t, isCreate)
+}
+
+func TestGetNewPartitionsFilter(t *testing.T) {
+	newPartitions, skipped := getNewPartitionsFilter([]string{"202301", "202302", "202303"}, []string{"202301", "202302", "202312"})
+	assert.Equal(t, common.EmptyMap{"202303": struct{}{}}, newPartitions)
+	assert.Equal(t, 2, skipped)
+	newPartitions, skipped = getNewPartitionsFilter([]string{"202301"}, []string{})
+	assert.Equal(t, common.EmptyMap{"202301": struct{}{}}, newPartitions)
+	assert.Equal(t, 0, skipped)
+}
+
+func TestGetRestoreTableCommandArgs(t *testing.T) {
+	args, err := getRestoreTableCommandArgs(`notify.sh --table "{database}.{table}" --stage pre`, "db 1", "t1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notify.sh", "--table", "db 1.t1", "--stage", "pre"}, args)
+	_, err = getRestoreTableCommandArgs(`notify.sh "{table}`, "db1", "t1")
+	assert.Error(t, err)
+}
+
+func TestRunRestoreTableCommand(t *testing.T) {
+	outFile := path.Join(t.TempDir(), "hook.out")
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	log := apexLog.WithField("test", t.Name())
+	command := `sh -c 'echo "{database}.{table} $CLICKHOUSE_BACKUP_DATABASE.$CLICKHOUSE_BACKUP_TABLE error=$CLICKHOUSE_BACKUP_RESTORE_ERROR" >> ` + outFile + `'`
+	assert.NoError(t, b.runRestoreTableCommand(context.Background(), "post_restore_table_command", command, "db", "t1", nil, log))
+	assert.NoError(t, b.runRestoreTableCommand(context.Background(), "post_restore_table_command", command, "db", "t2", fmt.Errorf("can't attach partitions"), log))
+	body, err := os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "db.t1 db.t1 error=\ndb.t2 db.t2 error=can't attach partitions\n", string(body))
+
+	// failed command only logged, unless `restore_table_command_abort_on_error: true`
+	assert.NoError(t, b.runRestoreTableCommand(context.Background(), "pre_restore_table_command", "false", "db", "t1", nil, log))
+	cfg.General.RestoreTableCommandAbortOnError = true
+	assert.EqualError(t, b.runRestoreTableCommand(context.Background(), "pre_restore_table_command", "false", "db", "t1", nil, log), "pre_restore_table_command failed for 'db.t1': exit status 1")
+
+	// command is not started with canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, b.runRestoreTableCommand(ctx, "post_restore_table_command", command, "db", "t3", nil, log))
+	body, err = os.ReadFile(outFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "db.t3")
+}
+
+func TestGetAggregateFunctionProblems(t *testing.T) {
+	functions := common.EmptyMap{"uniq": {}, "sum": {}, "any": {}}
+	combinators := []string{"OrDefault", "Merge", "State", "If"}
+	assert.True(t, isAggregateFunctionSupported("uniqMergeIf", functions, combinators))
+	assert.False(t, isAggregateFunctionSupported("uniqExact", functions, combinators))
+	tables := map[string][]aggregateFunctionColumn{
+		"db.t": {{Column: "u", Function: "uniqIf"}, {Column: "e", Function: "uniqExact"}, {Column: "s", Function: "sum", IsSimple: true}},
+	}
+	assert.Equal(t, []string{"'db.t' aggregate functions not supported by current server: uniqExact (e)"}, getAggregateFunctionProblems(tables, functions, combinators, "23.3.1.1", 23003002))
+	assert.Equal(t, []string{
+		"'db.t' aggregate functions not supported by current server: uniqExact (e)",
+		"'db.t' aggregate function states created by ClickHouse 22.8.1.1 could be incompatible with current version 23003002: uniqIf (u)",
+	}, getAggregateFunctionProblems(tables, functions, combinators, "22.8.1.1", 23003002))
+}
+
+func TestIsSortingKeyMismatch(t *testing.T) {
+	backupQuery := "CREATE TABLE db.t (`id` UInt64, `ts` DateTime) ENGINE = MergeTree ORDER BY (id, ts)"
+	assert.False(t, isSortingKeyMismatch(backupQuery, "CREATE TABLE db.t (`id` UInt64, `ts` DateTime) ENGINE = MergeTree ORDER BY (id,  ts) SETTINGS index_granularity = 8192"))
+	assert.True(t, isSortingKeyMismatch(backupQuery, "CREATE TABLE db.t (`id` UInt64, `ts` DateTime) ENGINE = MergeTree ORDER BY (ts, id)"))
+	assert.False(t, isSortingKeyMismatch(backupQuery, "CREATE TABLE db.t (`id` UInt64, `ts` DateTime) ENGINE = Log"))
+}
+
+func TestGetReinsertColumns(t *testing.T) {
+	columns, missingColumns := getReinsertColumns([]string{"ts", "id", "name"}, map[string]string{"id": "UInt64", "ts": "DateTime", "removed": "String"})
+	assert.Equal(t, []string{"ts", "id"}, columns)
+	assert.Equal(t, []string{"name"}, missingColumns)
+	assert.Equal(t, "`db`.`t`.uuid/reinsert/202401", getReinsertStateKey("db", "t", "uuid", "202401"))
+}
+
+func TestCheckColumnTypesSkipCreatedTables(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreSchemaTransformRules = []string{"String->LowCardinality(String)"}
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{}}
+	query := "CREATE TABLE db.t (`id` UInt64, `name` String) ENGINE = MergeTree ORDER BY id"
+	tables := ListOfTables{{Database: "db", Table: "t", Query: query}}
+	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{{Database: "db", Table: "t"}: {Database: "db", Name: "t"}}
+	// created table is not compared, so system.columns is not queried
+	assert.NoError(t, b.checkColumnTypes(context.Background(), tables, dstTablesMap, map[metadata.TableTitle]struct{}{{Database: "db", Table: "t"}: {}}, apexLog.WithField("test", t.Name())))
+	assert.Equal(t, query, tables[0].Query)
+}
+
+func TestGetColumnTypesCheckedTables(t *testing.T) {
+	log := apexLog.WithField("test", t.Name())
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreDatabaseMapping = map[string]string{"db1": "db2"}
+	// failed command shows transform is not executed again for queries transformed during restore schema
+	cfg.General.RestoreSchemaTransformCommand = "false"
+	b := &Backuper{cfg: cfg, transformedQueries: map[metadata.TableTitle]string{
+		{Database: "db2", Table: "t1"}: "CREATE TABLE db2.t1 (`id` UInt32) ENGINE = MergeTree ORDER BY id",
+	}}
+	tables := ListOfTables{
+		{Database: "db1", Table: "t1", Query: "CREATE TABLE db1.t1 (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db1", Table: "created", Query: "CREATE TABLE db1.created (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db1", Table: "absent", Query: "CREATE TABLE db1.absent (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+	dstTablesMap := map[metadata.TableTitle]clickhouse.Table{
+		{Database: "db2", Table: "t1"}:      {Database: "db2", Name: "t1"},
+		{Database: "db2", Table: "created"}: {Database: "db2", Name: "created"},
+	}
+	createdTables := map[metadata.TableTitle]struct{}{{Database: "db2", Table: "created"}: {}}
+	checkedTables, err := b.getColumnTypesCheckedTables(tables, dstTablesMap, createdTables, log)
+	assert.NoError(t, err)
+	assert.Equal(t, ListOfTables{{Database: "db1", Table: "t1", Query: "CREATE TABLE db2.t1 (`id` UInt32) ENGINE = MergeTree ORDER BY id"}}, checkedTables)
+	assert.Equal(t, "CREATE TABLE db1.t1 (`id` UInt64) ENGINE = MergeTree ORDER BY id", tables[0].Query)
+
+	// data only restore, queries are not transformed yet
+	b.transformedQueries = nil
+	_, err = b.getColumnTypesCheckedTables(tables, dstTablesMap, createdTables, log)
+	assert.ErrorContains(t, err, "restore_schema_transform_command failed for db1.t1")
+
+	cfg.General.RestoreSchemaTransformCommand = ""
+	cfg.General.RestoreSchemaTransformRules = []string{"UInt64->UInt32"}
+	checkedTables, err = b.getColumnTypesCheckedTables(tables, dstTablesMap, createdTables, log)
+	assert.NoError(t, err)
+	assert.Equal(t, ListOfTables{{Database: "db1", Table: "t1", Query: "CREATE TABLE db1.t1 (`id` UInt32) ENGINE = MergeTree ORDER BY id"}}, checkedTables)
+}
+
+func TestGetRestoreMetricsFileBody(t *testing.T) {
+	body := getRestoreMetricsFileBody("backup\"1", restoreSummary{Tables: 2, Bytes: 2048, Duration: 1500 * time.Millisecond})
+	assert.Contains(t, body, "clickhouse_backup_restore_success{backup=\"backup\\\"1\"} 1\n")
+	assert.Contains(t, body, "clickhouse_backup_restore_tables_total{backup=\"backup\\\"1\"} 2\n")
+	assert.Contains(t, body, "clickhouse_backup_restore_duration_seconds{backup=\"backup\\\"1\"} 1.500\n")
+	assert.Contains(t, body, "clickhouse_backup_restore_info{backup=\"backup\\\"1\",status=\"success\",duration=\"1.5s\",size=\"2.00KiB\"} 1\n")
+	assert.True(t, strings.HasSuffix(body, "# EOF\n"))
+	body = getRestoreMetricsFileBody("backup1", restoreSummary{Errors: 1, Err: fmt.Errorf("can't restore")})
+	assert.Contains(t, body, "clickhouse_backup_restore_success{backup=\"backup1\"} 0\n")
+	assert.Contains(t, body, "status=\"error\"")
+}
+
+func TestIsEmptyBackup(t *testing.T) {
+	assert.True(t, isEmptyBackup(metadata.BackupMetadata{}))
+	assert.False(t, isEmptyBackup(metadata.BackupMetadata{RBACSize: 1024}))
+	assert.False(t, isEmptyBackup(metadata.BackupMetadata{Functions: []metadata.FunctionsMeta{{Name: "f1"}}}))
+}
+
+func TestGetDDLPreamble(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreDDLPreamble = []string{" SET allow_experimental_object_type = 1; ", "SET allow_experimental_window_view = 1"}
+	b := &Backuper{cfg: cfg}
+	assert.Equal(t, []string{"SET allow_experimental_object_type = 1", "SET allow_experimental_window_view = 1"}, b.getDDLPreamble())
+}
+
+func TestRestoreSessionSettingsWithDDLPreamble(t *testing.T) {
+	preambleSettings := map[string]string{"allow_experimental_object_type": "1", "max_partitions_per_insert_block": "0"}
+	assert.Equal(t,
+		map[string]string{"allow_experimental_object_type": "1", "max_partitions_per_insert_block": "0", "max_threads": "4"},
+		getRestoreSessionSettings(map[string]string{"max_partitions_per_insert_block": "100", "max_threads": "4"}, preambleSettings),
+	)
+	assert.NoError(t, checkDDLPreambleApplied([]string{"max_threads"}, preambleSettings))
+	assert.ErrorContains(t, checkDDLPreambleApplied([]string{"allow_experimental_object_type", "max_threads"}, preambleSettings), "settings allow_experimental_object_type are not applied")
+}
+
+func TestConnectRestoreRejectsReservedSettings(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreSessionSettings = map[string]string{"password": "x"}
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{Config: &cfg.ClickHouse, Log: apexLog.WithField("logger", "test")}}
+	assert.ErrorContains(t, b.connectRestore(), "contains reserved connection parameters: password")
+	assert.False(t, b.ch.IsOpen)
+}
+
+func TestGetAttachPartQueries(t *testing.T) {
+	disks := []clickhouse.Disk{{Name: "default"}, {Name: "hdd"}}
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts: map[string][]metadata.Part{
+			"hdd":     {{Name: "202301_2_2_0"}, {Name: "202301_4_4_0'"}},
+			"default": {{Name: "202301_1_1_0"}, {Name: "p1.proj"}},
+			"absent":  {{Name: "202301_3_3_0"}},
+		},
+	}
+	assert.Equal(t, []string{
+		"ALTER TABLE `db`.`t` ATTACH PART '202301_1_1_0'",
+		"ALTER TABLE `db`.`t` ATTACH PART '202301_2_2_0'",
+		`ALTER TABLE ` + "`db`.`t`" + ` ATTACH PART '202301_4_4_0\''`,
+	}, getAttachPartQueries(table, disks))
+	assert.Empty(t, getAttachPartQueries(metadata.TableMetadata{Database: "db", Table: "empty"}, disks))
+}
+
+func TestGetRestoreDisks(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	disks := []clickhouse.Disk{{Name: "default", Path: "/var/lib/clickhouse", Type: "local"}}
+	diskMap := map[string]string{"default": "/var/lib/clickhouse"}
+	tables := ListOfTables{
+		{Database: "db", Table: "t1", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}, "hdd": {{Name: "all_2_2_0"}}}},
+		{Database: "db", Table: "t2", Parts: map[string][]metadata.Part{"ssd": {{Name: "all_1_1_0"}}}},
+	}
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	restoreDisks, err := b.getRestoreDisks("backup1", tables, disks, diskMap, log)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse", Type: "local"},
+		{Name: "hdd", Path: "/var/lib/clickhouse", Type: "local"},
+		{Name: "ssd", Path: "/var/lib/clickhouse", Type: "local"},
+	}, restoreDisks)
+
+	cfg.General.StrictDiskMapping = true
+	_, err = b.getRestoreDisks("backup1", tables, disks, diskMap, log)
+	assert.EqualError(t, err, "disks 'hdd' required by 'db.t1', 'ssd' required by 'db.t2' not found in clickhouse table system.disks, add them to `disk_mapping` in `clickhouse` config section or set `strict_disk_mapping: false` in `general` config section to restore data to /var/lib/clickhouse")
+
+	// mapped disks are not missing
+	cfg.General.RestoreDiskNameMapping = map[string]string{"hdd": "default", "ssd": "default"}
+	restoreDisks, err = b.getRestoreDisks("backup1", tables, disks, diskMap, log)
+	assert.NoError(t, err)
+	assert.Len(t, restoreDisks, 3)
+}
+
+func TestGetFunctionsForRestore(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	functions := []metadata.FunctionsMeta{
+		{Name: "f_new", CreateQuery: "CREATE FUNCTION f_new AS (x) -> x + 1"},
+		{Name: "f_same", CreateQuery: "CREATE FUNCTION f_same AS (x) -> x * 2"},
+		{Name: "f_changed", CreateQuery: "CREATE FUNCTION f_changed AS (x) -> x * 3"},
+		{Name: "other", CreateQuery: "CREATE FUNCTION other AS (x) -> x"},
+	}
+	existsFunctions := map[string]string{
+		"f_same":    normalizeFunctionQuery("CREATE OR REPLACE FUNCTION f_same ON CLUSTER 'cluster' AS (x) ->  x * 2"),
+		"f_changed": normalizeFunctionQuery("CREATE FUNCTION f_changed AS (x) -> x"),
+	}
+	getNames := func(functions []metadata.FunctionsMeta) []string {
+		var names []string
+		for _, function := range functions {
+			names = append(names, function.Name)
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"f_new", "f_changed", "other"}, getNames(getFunctionsForRestore(functions, "", existsFunctions, "replace", log)))
+	assert.ElementsMatch(t, []string{"f_new", "other"}, getNames(getFunctionsForRestore(functions, "", existsFunctions, "skip", log)))
+	assert.ElementsMatch(t, []string{"f_new", "f_changed"}, getNames(getFunctionsForRestore(functions, "f_*", existsFunctions, "replace", log)))
+	assert.ElementsMatch(t, []string{"other"}, getNames(getFunctionsForRestore(functions, "absent, other", existsFunctions, "replace", log)))
+	assert.Empty(t, getFunctionsForRestore(functions, "absent", existsFunctions, "replace", log))
+}
+
+func TestGetMissingTables(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.General.RestoreDatabaseMapping = map[string]string{"db": "new_db"}
+	cfg.General.RestoreTableMapping = map[string]string{"db.renamed": "db.t3"}
+	b := &Backuper{cfg: cfg}
+	tablesForRestore := ListOfTables{
+		{Database: "db", Table: "t1", Query: "CREATE TABLE db.t1 (id UInt64) ENGINE=MergeTree ORDER BY id"},
+		{Database: "db", Table: "t2", Query: "CREATE TABLE db.t2 (id UInt64) ENGINE=MergeTree ORDER BY id"},
+		{Database: "db", Table: "renamed", Query: "CREATE TABLE db.renamed (id UInt64) ENGINE=MergeTree ORDER BY id"},
+	}
+	chTables := []clickhouse.Table{{Database: "new_db", Name: "t1"}, {Database: "db", Name: "t2"}, {Database: "new_db", Name: "t3"}}
+	missingTables, tablesForCreate := b.getMissingTables(tablesForRestore, chTables)
+	assert.Equal(t, []string{"'new_db.t2'"}, missingTables)
+	assert.Equal(t, ListOfTables{tablesForRestore[1]}, tablesForCreate)
+
+	missingTables, tablesForCreate = b.getMissingTables(tablesForRestore, append(chTables, clickhouse.Table{Database: "new_db", Name: "t2"}))
+	assert.Empty(t, missingTables)
+	assert.Empty(t, tablesForCreate)
+}
+
+func TestCreateMissingTablesWithoutSchema(t *testing.T) {
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{Config: &cfg.ClickHouse}}
+	_, err := b.createMissingTables(context.Background(), ListOfTables{{Database: "db", Table: "t1"}}, "*", false, apexLog.WithField("logger", "test"))
+	assert.EqualError(t, err, "'db.t1' doesn't contain schema in backup, can't create it")
+}
+
+func TestWriteRestoreSchemaReport(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	report := RestoreSchemaReport{AttemptsOrder: [][]string{{"db.mv", "db.src"}, {"db.mv"}}}
+	tableAttempts := map[metadata.TableTitle]int{{Database: "db", Table: "mv"}: 2, {Database: "a", Table: "dict"}: 1}
+	tableErrors := map[metadata.TableTitle]error{{Database: "db", Table: "mv"}: fmt.Errorf("UNKNOWN_TABLE"), {Database: "a", Table: "dict"}: fmt.Errorf("BAD_ARGUMENTS")}
+
+	// nothing written without restore_schema_report_path
+	b.writeRestoreSchemaReport(report, tableAttempts, tableErrors, log)
+
+	cfg.General.RestoreSchemaReportPath = path.Join(t.TempDir(), "report.json")
+	b.writeRestoreSchemaReport(report, tableAttempts, tableErrors, log)
+	body, err := os.ReadFile(cfg.General.RestoreSchemaReportPath)
+	assert.NoError(t, err)
+	var savedReport RestoreSchemaReport
+	assert.NoError(t, json.Unmarshal(body, &savedReport))
+	assert.Equal(t, RestoreSchemaReport{
+		AttemptsOrder: [][]string{{"db.mv", "db.src"}, {"db.mv"}},
+		FailedTables: []RestoreSchemaFailedTable{
+			{Database: "a", Table: "dict", Attempts: 1, LastError: "BAD_ARGUMENTS"},
+			{Database: "db", Table: "mv", Attempts: 2, LastError: "UNKNOWN_TABLE"},
+		},
+	}, savedReport)
+
+	// write errors don't replace original restore error
+	cfg.General.RestoreSchemaReportPath = path.Join(t.TempDir(), "absent", "report.json")
+	b.writeRestoreSchemaReport(report, tableAttempts, tableErrors, log)
+	_, err = os.Stat(cfg.General.RestoreSchemaReportPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrepareRestoreDatabaseMappingExcludeSystem(t *testing.T) {
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	assert.NoError(t, b.prepareRestoreDatabaseMapping([]string{"db1:new_db1,system:db2", "information_schema:db3", "db4:INFORMATION_SCHEMA"}))
+	assert.Equal(t, map[string]string{"db1": "new_db1"}, cfg.General.RestoreDatabaseMapping)
+
+	cfg = config.DefaultConfig()
+	cfg.General.RestoreDatabaseMappingAllowSystem = true
+	b = &Backuper{cfg: cfg}
+	assert.NoError(t, b.prepareRestoreDatabaseMapping([]string{"db1:new_db1,system:db2"}))
+	assert.Equal(t, map[string]string{"db1": "new_db1", "system": "db2"}, cfg.General.RestoreDatabaseMapping)
+
+	assert.Error(t, b.prepareRestoreDatabaseMapping([]string{"db1"}))
+	assert.True(t, IsSystemDatabase("system"))
+	assert.True(t, IsSystemDatabase("information_schema"))
+	assert.False(t, IsSystemDatabase("default"))
+}
+
+func TestSkipRestoreTableError(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	tableErr := fmt.Errorf("can't restore 'db.t1': broken part")
+	var failedTables []string
+	assert.Equal(t, tableErr, skipRestoreTableError(context.Background(), false, tableErr, &failedTables, log))
+	assert.Empty(t, failedTables)
+	assert.NoError(t, skipRestoreTableError(context.Background(), true, tableErr, &failedTables, log))
+	assert.NoError(t, skipRestoreTableError(context.Background(), true, fmt.Errorf("can't restore 'db.t2': no space"), &failedTables, log))
+	assert.Equal(t, []string{"can't restore 'db.t1': broken part", "can't restore 'db.t2': no space"}, failedTables)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, tableErr, skipRestoreTableError(ctx, true, tableErr, &failedTables, log))
+	assert.Len(t, failedTables, 2)
+
+	assert.NoError(t, getFailedTablesError(nil))
+	assert.EqualError(t, getFailedTablesError(failedTables), "can't restore data for 2 tables: can't restore 'db.t1': broken part; can't restore 'db.t2': no space")
+}
+
+func TestCheckBackupFormatVersion(t *testing.T) {
+	// backups created before format_version was introduced
+	assert.NoError(t, checkBackupFormatVersion(metadata.BackupMetadata{BackupName: "old"}))
+	assert.NoError(t, checkBackupFormatVersion(metadata.BackupMetadata{BackupName: "current", FormatVersion: metadata.FormatVersion}))
+	err := checkBackupFormatVersion(metadata.BackupMetadata{BackupName: "future", FormatVersion: metadata.FormatVersion + 1, ClickhouseBackupVersion: "9.9.9"})
+	assert.EqualError(t, err, fmt.Sprintf("backup 'future' metadata format_version=%d is not supported, current clickhouse-backup supports format_version<=%d, use clickhouse-backup 9.9.9 or newer which created this backup", metadata.FormatVersion+1, metadata.FormatVersion))
+
+	var backupMetadata metadata.BackupMetadata
+	assert.NoError(t, json.Unmarshal([]byte(`{"backup_name":"old"}`), &backupMetadata))
+	assert.Equal(t, 0, backupMetadata.FormatVersion)
+	assert.NoError(t, checkBackupFormatVersion(backupMetadata))
+}
+
+func TestResolveRequiredBackupsChain(t *testing.T) {
+	localBackups := []LocalBackup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "full"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "inc1", RequiredBackup: "full"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "inc2", RequiredBackup: "inc1"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "cycle1", RequiredBackup: "cycle2"}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "cycle2", RequiredBackup: "cycle1"}},
+	}
+	chain, err := resolveRequiredBackupsChain(metadata.BackupMetadata{BackupName: "inc3", RequiredBackup: "inc2"}, localBackups)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"inc2", "inc1", "full"}, chain)
+
+	chain, err = resolveRequiredBackupsChain(metadata.BackupMetadata{BackupName: "full"}, localBackups)
+	assert.NoError(t, err)
+	assert.Empty(t, chain)
+
+	chain, err = resolveRequiredBackupsChain(metadata.BackupMetadata{BackupName: "inc5", RequiredBackup: "inc4"}, localBackups)
+	assert.EqualError(t, err, "broken increment chain for 'inc5', required backup 'inc4' not found locally, download it first")
+	assert.Empty(t, chain)
+
+	chain, err = resolveRequiredBackupsChain(metadata.BackupMetadata{BackupName: "cycle1", RequiredBackup: "cycle2"}, localBackups)
+	assert.EqualError(t, err, "broken increment chain for 'cycle1', cyclic dependency on 'cycle1'")
+	assert.Equal(t, []string{"cycle2"}, chain)
+}
+
+func TestIsAllPartsExists(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir}}
+	tables := ListOfTables{{Database: "db", Table: "t", Parts: map[string][]metadata.Part{
+		"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_2_2_0/p.proj"}},
+	}}}
+	for backupName, partName := range map[string]string{"inc": "all_2_2_0", "full": "all_1_1_0"} {
+		assert.NoError(t, os.MkdirAll(path.Join(tmpDir, "backup", backupName, "shadow", "db", "t", "default", partName), 0755))
+	}
+	assert.False(t, isAllPartsExists("inc", nil, tables, disks))
+	assert.True(t, isAllPartsExists("inc", []string{"full"}, tables, disks))
+}
+
+func TestGetRestoreSchemaOnCluster(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg, ch: &clickhouse.ClickHouse{Config: &cfg.ClickHouse}, log: log}
+	// engines already checked, no queries to ClickHouse
+	replicatedDatabases := map[string]bool{"replicated_db": true, "atomic_db": false}
+	assert.Equal(t, "", b.getRestoreSchemaOnCluster("atomic_db", replicatedDatabases, log))
+	assert.Equal(t, "", b.getRestoreSchemaOnCluster("replicated_db", replicatedDatabases, log))
+
+	cfg.General.RestoreSchemaOnCluster = "{cluster}"
+	assert.Equal(t, "{cluster}", b.getRestoreSchemaOnCluster("atomic_db", replicatedDatabases, log))
+	assert.Equal(t, "", b.getRestoreSchemaOnCluster("replicated_db", replicatedDatabases, log))
+	assert.True(t, b.isReplicatedDatabase("replicated_db", replicatedDatabases, log))
+	assert.False(t, b.isReplicatedDatabase("atomic_db", replicatedDatabases, log))
+}
+
+func TestSplitSyncParts(t *testing.T) {
+	backupParts := map[string][]metadata.Part{"default": {{Name: "202301_1_5_1"}, {Name: "202301_6_6_0"}, {Name: "202301_10_10_0"}, {Name: "202302_1_1_0"}}}
+	backupChecksums := map[string]string{"default/202301_1_5_1": "a", "default/202301_6_6_0": "b", "default/202301_10_10_0": "c", "default/202302_1_1_0": "d"}
+	// block numbers of attached parts doesn't related to backup part names, so only checksums matter
+	existingParts := []clickhouse.PartState{
+		{Name: "202301_11_11_0", PartitionID: "202301", MinBlockNumber: 11, MaxBlockNumber: 11, Active: 1},
+		{Name: "202301_12_12_0", PartitionID: "202301", MinBlockNumber: 12, MaxBlockNumber: 12, Active: 1},
+		{Name: "202301_6_6_0", PartitionID: "202301", MinBlockNumber: 6, MaxBlockNumber: 6, Active: 1},
+		{Name: "202301_13_13_0", PartitionID: "202301", MinBlockNumber: 13, MaxBlockNumber: 13, Active: 0},
+		{Name: "202302_1_1_0", PartitionID: "202302", MinBlockNumber: 1, MaxBlockNumber: 1, Active: 1},
+	}
+	existingChecksums := map[string]string{"202301_11_11_0": "a", "202301_12_12_0": "c", "202301_6_6_0": "x", "202302_1_1_0": "y"}
+	missingParts, presentParts, extraParts := splitSyncParts(backupParts, backupChecksums, existingParts, existingChecksums)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "202301_6_6_0"}, {Name: "202302_1_1_0"}}}, missingParts)
+	assert.Equal(t, []string{"default/202301_10_10_0", "default/202301_1_5_1"}, presentParts)
+	assert.Equal(t, []string{"202301_6_6_0", "202302_1_1_0"}, extraParts)
+	// two backup parts with the same data match only one existing part
+	missingParts, presentParts, extraParts = splitSyncParts(
+		map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}},
+		map[string]string{"default/all_1_1_0": "a", "default/all_2_2_0": "a"},
+		[]clickhouse.PartState{{Name: "all_5_5_0", Active: 1}},
+		map[string]string{"all_5_5_0": "a"},
+	)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_2_2_0"}}}, missingParts)
+	assert.Equal(t, []string{"default/all_1_1_0"}, presentParts)
+	assert.Empty(t, extraParts)
+}
+
+func TestCleanNotAttachedParts(t *testing.T) {
+	diskPath := t.TempDir()
+	tableDataPath := path.Join(diskPath, "store", "abc", "abcdef")
+	disks := []clickhouse.Disk{{Name: "default", Path: diskPath}}
+	table := metadata.TableMetadata{Database: "db", Table: "t", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}}}
+	createDetachedParts := func() {
+		for _, partName := range []string{"all_1_1_0", "all_2_2_0"} {
+			assert.NoError(t, os.MkdirAll(path.Join(tableDataPath, "detached", partName), 0750))
+		}
+	}
+	attachedParts := common.EmptyMap{"default/all_1_1_0": {}}
+	log := apexLog.WithField("logger", "test")
+
+	createDetachedParts()
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+	b.cleanNotAttachedParts(table, attachedParts, disks, []string{tableDataPath}, log)
+	assert.DirExists(t, path.Join(tableDataPath, "detached", "all_2_2_0"), "not attached parts shall be kept by default")
+
+	cfg.General.RemoveDetachedOnFailure = true
+	b.cleanNotAttachedParts(table, attachedParts, disks, []string{tableDataPath}, log)
+	assert.NoDirExists(t, path.Join(tableDataPath, "detached", "all_2_2_0"))
+	assert.DirExists(t, path.Join(tableDataPath, "detached", "all_1_1_0"), "attached part path shall not be touched")
+}
+
+func TestGetRestoreAttachStateFile(t *testing.T) {
+	stateFile := getRestoreAttachStateFile("/var/lib/clickhouse", "test_backup")
+	assert.Equal(t, "/var/lib/clickhouse/restore_state/test_backup/attach.state", stateFile)
+	assert.False(t, strings.HasPrefix(stateFile, "/var/lib/clickhouse/backup/"), "restore shall not write into backup directory")
+}
+
+func TestFilterStreamingTables(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "queue", Query: "CREATE TABLE db.queue (`id` UInt64) ENGINE = Kafka SETTINGS kafka_broker_list = 'kafka:9092', kafka_topic_list = 'events', kafka_group_name = 'g', kafka_format = 'JSONEachRow'"},
+		{Database: "db", Table: "events", Query: "CREATE TABLE db.events (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "mv", Query: "CREATE MATERIALIZED VIEW db.mv TO db.events (`id` UInt64) AS SELECT id FROM db.queue"},
+	}
+	log := apexLog.WithField("logger", "test")
+	cfg := config.DefaultConfig()
+	b := &Backuper{cfg: cfg}
+
+	cfg.General.RestoreStreamingTablesMode = "skip"
+	filtered, streamingTables, consumerViews := b.filterStreamingTables(tables, log)
+	assert.Equal(t, ListOfTables{tables[1]}, filtered)
+	assert.Nil(t, streamingTables)
+	assert.Nil(t, consumerViews)
+
+	cfg.General.RestoreStreamingTablesMode = "detach"
+	filtered, streamingTables, consumerViews = b.filterStreamingTables(tables, log)
+	assert.Equal(t, tables, filtered)
+	assert.Equal(t, map[metadata.TableTitle]struct{}{{Database: "db", Table: "queue"}: {}}, streamingTables)
+	assert.Equal(t, map[metadata.TableTitle]struct{}{{Database: "db", Table: "mv"}: {}}, consumerViews)
+
+	cfg.General.RestoreStreamingTablesMode = "detach"
+	filtered, streamingTables, consumerViews = b.filterStreamingTables(ListOfTables{tables[1]}, log)
+	assert.Equal(t, ListOfTables{tables[1]}, filtered)
+	assert.Nil(t, streamingTables)
+	assert.Nil(t, consumerViews)
+}
+
+func TestIsRowsVerificationSupported(t *testing.T) {
+	assert.True(t, isRowsVerificationSupported(clickhouse.Table{Engine: "MergeTree"}))
+	assert.True(t, isRowsVerificationSupported(clickhouse.Table{Engine: "ReplacingMergeTree"}))
+	assert.False(t, isRowsVerificationSupported(clickhouse.Table{Engine: "ReplicatedMergeTree"}))
+	assert.False(t, isRowsVerificationSupported(clickhouse.Table{Engine: "ReplicatedReplacingMergeTree"}))
+}
+
+func TestGetNotAttachedParts(t *testing.T) {
+	attachState := resumable.NewStateFile(path.Join(t.TempDir(), "attach.state"), nil)
+	defer attachState.Close()
+	attachStateKey := func(disk, part string) string {
+		return fmt.Sprintf("`db`.`t`.uuid/%s/%s", disk, part)
+	}
+	attachState.AppendToState(attachStateKey("default", "all_1_1_0"), 0)
+	attachState.AppendToState(attachStateKey("s3", "all_3_3_0"), 0)
+	// the same part name on other table is not skipped
+	attachState.AppendToState("`db`.`t2`.uuid/default/all_2_2_0", 0)
+	parts := map[string][]metadata.Part{
+		"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+		"s3":      {{Name: "all_3_3_0"}},
+	}
+	notAttachedParts, alreadyAttachedParts := getNotAttachedParts(parts, attachState, attachStateKey)
+	assert.Equal(t, 2, alreadyAttachedParts)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_2_2_0"}}}, notAttachedParts)
+
+	notAttachedParts, alreadyAttachedParts = getNotAttachedParts(map[string][]metadata.Part{"default": {{Name: "all_4_4_0"}}}, attachState, attachStateKey)
+	assert.Equal(t, 0, alreadyAttachedParts)
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_4_4_0"}}}, notAttachedParts)
+}
@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+type RestoreValidationResult struct {
+	Database string                   `json:"database"`
+	Table    string                   `json:"table"`
+	Query    string                   `json:"query"`
+	Rows     []map[string]interface{} `json:"rows,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+type RestoreValidationReport struct {
+	BackupName string                    `json:"backup_name"`
+	Results    []RestoreValidationResult `json:"results"`
+}
+
+// RestoreAndValidate - restore backup, then execute validationQueries for each restored table and save results as JSON into reportPath, or print to stdout when reportPath is empty
+// {database} and {table} placeholders in validation queries replaced with restored table database and name
+func (b *Backuper) RestoreAndValidate(backupName, tablePattern, functionsPattern string, databaseMapping, partitions []string, dropTable, ignoreDependencies, schemaAsAttach bool, lastPartitions int, validationQueries []string, reportPath string, commandId int) error {
+	if err := b.Restore(backupName, RestoreOptions{
+		TablePattern:       tablePattern,
+		FunctionsPattern:   functionsPattern,
+		DatabaseMapping:    databaseMapping,
+		Partitions:         partitions,
+		LastPartitions:     lastPartitions,
+		DropTable:          dropTable,
+		IgnoreDependencies: ignoreDependencies,
+		SchemaAsAttach:     schemaAsAttach,
+	}, commandId); err != nil {
+		return err
+	}
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	log := apexLog.WithFields(apexLog.Fields{
+		"backup":    backupName,
+		"operation": "restore_validate",
+	})
+	backup, _, err := b.getLocalBackup(ctx, backupName, nil)
+	if err != nil {
+		return err
+	}
+	if err = b.connectRestore(); err != nil {
+		return err
+	}
+	defer b.ch.Close()
+
+	report := RestoreValidationReport{
+		BackupName: backupName,
+		Results:    make([]RestoreValidationResult, 0),
+	}
+	failedQueries := 0
+	for _, result := range getRestoreValidationResults(backup.Tables, tablePattern, validationQueries, b.cfg.General.RestoreTableMapping, b.cfg.General.RestoreDatabaseMapping) {
+		rows, err := b.runValidationQuery(ctx, result.Query)
+		result.Rows = rows
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warnf("validation query `%s` failed: %v", result.Query, err)
+			result.Error = err.Error()
+			failedQueries += 1
+		}
+		report.Results = append(report.Results, result)
+	}
+	if err = writeRestoreValidationReport(report, reportPath, log); err != nil {
+		return err
+	}
+	if failedQueries > 0 {
+		return fmt.Errorf("%d validation queries failed, look to restore validation report for details", failedQueries)
+	}
+	return nil
+}
+
+// getRestoreValidationResults - validation queries for each restored table with mapped {database} and {table} placeholders, rows and error filled after query execution
+func getRestoreValidationResults(tables []metadata.TableTitle, tablePattern string, validationQueries []string, tableMapping, databaseMapping map[string]string) []RestoreValidationResult {
+	results := make([]RestoreValidationResult, 0)
+	for _, tableTitle := range parseTablePatternForDownload(tables, tablePattern) {
+		tableTitle.Database, tableTitle.Table = getRestoreTableMappingTarget(tableTitle.Database, tableTitle.Table, tableMapping, databaseMapping)
+		for _, validationQuery := range validationQueries {
+			results = append(results, RestoreValidationResult{
+				Database: tableTitle.Database,
+				Table:    tableTitle.Table,
+				Query:    strings.NewReplacer("{database}", tableTitle.Database, "{table}", tableTitle.Table).Replace(validationQuery),
+			})
+		}
+	}
+	return results
+}
+
+// writeRestoreValidationReport - save report as JSON into reportPath, or print to stdout when reportPath is empty
+func writeRestoreValidationReport(report RestoreValidationReport, reportPath string, log *apexLog.Entry) error {
+	body, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return fmt.Errorf("can't marshal restore validation report: %v", err)
+	}
+	if reportPath == "" {
+		fmt.Println(string(body))
+	} else if err = os.WriteFile(reportPath, body, 0640); err != nil {
+		return fmt.Errorf("can't write restore validation report to %s: %v", reportPath, err)
+	} else {
+		log.Infof("restore validation report saved to %s", reportPath)
+	}
+	return nil
+}
+
+func (b *Backuper) runValidationQuery(ctx context.Context, query string) ([]map[string]interface{}, error) {
+	rows, err := b.ch.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			apexLog.Warnf("can't close validation query rows: %v", err)
+		}
+	}()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		row := map[string]interface{}{}
+		if err = rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRestoreValidationResults(t *testing.T) {
+	tables := []metadata.TableTitle{{Database: "db1", Table: "t1"}, {Database: "db1", Table: "t2"}, {Database: "db2", Table: "t3"}}
+	validationQueries := []string{"SELECT count() FROM `{database}`.`{table}`", "CHECK TABLE {database}.{table}"}
+	results := getRestoreValidationResults(tables, "db1.*", validationQueries, map[string]string{"db1.t2": "db1.renamed"}, map[string]string{"db1": "db3"})
+	assert.Equal(t, []RestoreValidationResult{
+		{Database: "db3", Table: "t1", Query: "SELECT count() FROM `db3`.`t1`"},
+		{Database: "db3", Table: "t1", Query: "CHECK TABLE db3.t1"},
+		{Database: "db3", Table: "renamed", Query: "SELECT count() FROM `db3`.`renamed`"},
+		{Database: "db3", Table: "renamed", Query: "CHECK TABLE db3.renamed"},
+	}, results)
+
+	assert.Empty(t, getRestoreValidationResults(tables, "", nil, nil, nil))
+	assert.Len(t, getRestoreValidationResults(tables, "", validationQueries, nil, nil), 6)
+}
+
+func TestWriteRestoreValidationReport(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	report := RestoreValidationReport{
+		BackupName: "backup1",
+		Results: []RestoreValidationResult{
+			{Database: "db", Table: "t1", Query: "SELECT 1", Rows: []map[string]interface{}{{"1": float64(1)}}},
+			{Database: "db", Table: "t2", Query: "SELECT broken", Error: "Missing columns: 'broken'"},
+		},
+	}
+	reportPath := path.Join(t.TempDir(), "report.json")
+	assert.NoError(t, writeRestoreValidationReport(report, reportPath, log))
+	body, err := os.ReadFile(reportPath)
+	assert.NoError(t, err)
+	var savedReport RestoreValidationReport
+	assert.NoError(t, json.Unmarshal(body, &savedReport))
+	assert.Equal(t, report, savedReport)
+
+	assert.Error(t, writeRestoreValidationReport(report, path.Join(t.TempDir(), "missing", "report.json"), log))
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+)
+
+// table references which shall be created before the table itself, database is optional
+var tableReferenceRE = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|TO)\s+\x60?([^\s\x60.(),']+)\x60?(?:\.\x60?([^\s\x60.(),']+)\x60?)?`)
+var dictGetReferenceRE = regexp.MustCompile(`(?i)\bdict\w*\(\s*'([^'.]+)(?:\.([^']+))?'`)
+var distributedReferenceRE = regexp.MustCompile(`Distributed\(\s*'[^']*'\s*,\s*'?([^',\s]+)'?\s*,\s*'?([^',\s)]+)'?`)
+var dictionarySourceRE = regexp.MustCompile(`(?is)SOURCE\(\s*CLICKHOUSE\((.*?)\)\)`)
+var dictionarySourceDbRE = regexp.MustCompile(`(?i)\bDB\s+'([^']+)'`)
+var dictionarySourceTableRE = regexp.MustCompile(`(?i)\bTABLE\s+'([^']+)'`)
+var createQueryHeaderRE = regexp.MustCompile(`^(?:CREATE|ATTACH) (?:TABLE|VIEW|LIVE VIEW|WINDOW VIEW|MATERIALIZED VIEW|DICTIONARY) \S+`)
+var materializedViewUUIDRE = regexp.MustCompile(`(?m)^(?:CREATE|ATTACH) MATERIALIZED VIEW \S+ UUID '([^']+)'`)
+var materializedViewTargetRE = regexp.MustCompile("^(?:CREATE|ATTACH) MATERIALIZED VIEW \\S+(?:\\s+UUID\\s+'[^']+')?\\s+TO\\s+(`[^`]+`|[^\\s`.(]+)(?:\\.(`[^`]+`|[^\\s`.(]+))?")
+
+var functionCallRE = regexp.MustCompile(`\b(\w+)\s*\(`)
+var streamingEngineRE = regexp.MustCompile(`ENGINE\s*=\s*(?:Kafka|RabbitMQ|NATS|FileLog|S3Queue|AzureQueue)\b`)
+
+// getStreamingTables - tables with message queue engines and materialized views which read from them, consuming starts when such view created
+func getStreamingTables(tables ListOfTables) (map[metadata.TableTitle]struct{}, map[metadata.TableTitle]struct{}) {
+	streamingTables := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		if !strings.HasPrefix(t.Query, "CREATE MATERIALIZED VIEW") && !strings.HasPrefix(t.Query, "ATTACH MATERIALIZED VIEW") && streamingEngineRE.MatchString(t.Query) {
+			streamingTables[metadata.TableTitle{Database: t.Database, Table: t.Table}] = struct{}{}
+		}
+	}
+	consumerViews := map[metadata.TableTitle]struct{}{}
+	for _, t := range tables {
+		if !strings.HasPrefix(t.Query, "CREATE MATERIALIZED VIEW") && !strings.HasPrefix(t.Query, "ATTACH MATERIALIZED VIEW") {
+			continue
+		}
+		for _, dependency := range getQueryDependencies(t) {
+			if _, isStreaming := streamingTables[dependency]; isStreaming {
+				consumerViews[metadata.TableTitle{Database: t.Database, Table: t.Table}] = struct{}{}
+				break
+			}
+		}
+	}
+	return streamingTables, consumerViews
+}
+
+// getMaterializedViewTarget - table from `TO db.table` clause, `TO INNER UUID` means inner table and returns false
+func getMaterializedViewTarget(table metadata.TableMetadata) (metadata.TableTitle, bool) {
+	matches := materializedViewTargetRE.FindStringSubmatch(table.Query)
+	if len(matches) == 0 || (matches[1] == "INNER" && matches[2] == "") {
+		return metadata.TableTitle{}, false
+	}
+	database, name := strings.Trim(matches[1], "`"), strings.Trim(matches[2], "`")
+	if name == "" {
+		database, name = table.Database, database
+	}
+	return metadata.TableTitle{Database: database, Table: name}, true
+}
+
+// getQueryDependencies - tables, dictionaries and inner tables which shall exist before execute CREATE query for table
+func getQueryDependencies(table metadata.TableMetadata) []metadata.TableTitle {
+	var dependencies []metadata.TableTitle
+	addDependency := func(database, name string) {
+		if name == "" {
+			database, name = table.Database, database
+		}
+		if database == table.Database && name == table.Table {
+			return
+		}
+		dependency := metadata.TableTitle{Database: database, Table: name}
+		for _, exists := range dependencies {
+			if exists == dependency {
+				return
+			}
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	// skip CREATE ... db.table prefix, it matches as reference
+	query := createQueryHeaderRE.ReplaceAllString(table.Query, "")
+	for _, matches := range tableReferenceRE.FindAllStringSubmatch(query, -1) {
+		// `TO INNER UUID` clause for materialized view inner table
+		if matches[1] == "INNER" && matches[2] == "" {
+			continue
+		}
+		addDependency(matches[1], matches[2])
+	}
+	for _, matches := range dictGetReferenceRE.FindAllStringSubmatch(query, -1) {
+		addDependency(matches[1], matches[2])
+	}
+	for _, matches := range distributedReferenceRE.FindAllStringSubmatch(query, -1) {
+		addDependency(matches[1], matches[2])
+	}
+	for _, matches := range dictionarySourceRE.FindAllStringSubmatch(query, -1) {
+		dbMatches := dictionarySourceDbRE.FindStringSubmatch(matches[1])
+		tableMatches := dictionarySourceTableRE.FindStringSubmatch(matches[1])
+		if len(tableMatches) == 2 {
+			if len(dbMatches) == 2 {
+				addDependency(dbMatches[1], tableMatches[1])
+			} else {
+				addDependency(tableMatches[1], "")
+			}
+		}
+	}
+	if strings.HasPrefix(table.Query, "CREATE MATERIALIZED VIEW") || strings.HasPrefix(table.Query, "ATTACH MATERIALIZED VIEW") {
+		// ATTACH doesn't check TO table existence, so target shall be explicit dependency
+		if target, isTargetDefined := getMaterializedViewTarget(table); isTargetDefined {
+			addDependency(target.Database, target.Table)
+			return dependencies
+		}
+		addDependency(table.Database, ".inner."+table.Table)
+		if matches := materializedViewUUIDRE.FindStringSubmatch(table.Query); len(matches) == 2 {
+			addDependency(table.Database, ".inner_id."+matches[1])
+		}
+	}
+	return dependencies
+}
+
+// SortByDependencies - topological sort, tables referenced in queries will create before dependent tables, order of independent tables is kept
+// tables inside dependency cycles are placed to the end in original order and returned as second value
+func (lt ListOfTables) SortByDependencies() (ListOfTables, []string) {
+	indexByTitle := make(map[metadata.TableTitle]int, len(lt))
+	for i, t := range lt {
+		indexByTitle[metadata.TableTitle{Database: t.Database, Table: t.Table}] = i
+	}
+	dependents := make([][]int, len(lt))
+	inDegree := make([]int, len(lt))
+	for i, t := range lt {
+		isAdded := map[int]struct{}{}
+		for _, dependency := range getQueryDependencies(t) {
+			j, exists := indexByTitle[dependency]
+			if !exists || j == i {
+				continue
+			}
+			if _, exists = isAdded[j]; exists {
+				continue
+			}
+			isAdded[j] = struct{}{}
+			dependents[j] = append(dependents[j], i)
+			inDegree[i]++
+		}
+	}
+	var ready []int
+	for i := range lt {
+		if inDegree[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	result := make(ListOfTables, 0, len(lt))
+	isSorted := make([]bool, len(lt))
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		result = append(result, lt[i])
+		isSorted[i] = true
+		for _, j := range dependents[i] {
+			inDegree[j]--
+			if inDegree[j] == 0 {
+				// keep original order for tables which became ready
+				pos := sort.SearchInts(ready, j)
+				ready = append(ready, 0)
+				copy(ready[pos+1:], ready[pos:])
+				ready[pos] = j
+			}
+		}
+	}
+	var cyclicTables []string
+	for i, t := range lt {
+		if !isSorted[i] {
+			result = append(result, t)
+			cyclicTables = append(cyclicTables, fmt.Sprintf("%s.%s", t.Database, t.Table))
+		}
+	}
+	return result, cyclicTables
+}
+
+// sortFunctionsByDependencies - functions sorted by name, functions called inside other function body will create before it
+func sortFunctionsByDependencies(functions []metadata.FunctionsMeta) []metadata.FunctionsMeta {
+	sorted := make([]metadata.FunctionsMeta, len(functions))
+	copy(sorted, functions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	dependencies := make([][]string, len(sorted))
+	for i, f := range sorted {
+		body := f.CreateQuery
+		if asIndex := strings.Index(body, " AS "); asIndex >= 0 {
+			body = body[asIndex:]
+		}
+		calledFunctions := map[string]struct{}{}
+		for _, matches := range functionCallRE.FindAllStringSubmatch(body, -1) {
+			calledFunctions[matches[1]] = struct{}{}
+		}
+		for _, dependency := range sorted {
+			if _, isCalled := calledFunctions[dependency.Name]; isCalled && dependency.Name != f.Name {
+				dependencies[i] = append(dependencies[i], dependency.Name)
+			}
+		}
+	}
+	result := make([]metadata.FunctionsMeta, 0, len(sorted))
+	isCreated := make(map[string]bool, len(sorted))
+	isAdded := make([]bool, len(sorted))
+	for len(result) < len(sorted) {
+		next := -1
+		for i := range sorted {
+			if isAdded[i] {
+				continue
+			}
+			isReady := true
+			for _, dependency := range dependencies[i] {
+				if !isCreated[dependency] {
+					isReady = false
+					break
+				}
+			}
+			if isReady {
+				next = i
+				break
+			}
+		}
+		// dependency cycle, ClickHouse will fail on it anyway, keep name order
+		if next == -1 {
+			for i := range sorted {
+				if !isAdded[i] {
+					next = i
+					break
+				}
+			}
+		}
+		isAdded[next] = true
+		isCreated[sorted[next].Name] = true
+		result = append(result, sorted[next])
+	}
+	return result
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortByDependencies(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "mv", Query: "CREATE MATERIALIZED VIEW db.mv TO db.dst (`id` UInt64) AS SELECT id FROM db.src"},
+		{Database: "db", Table: "dict", Query: "CREATE DICTIONARY db.dict (`id` UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(DB 'db' TABLE 'src')) LIFETIME(0) LAYOUT(FLAT())"},
+		{Database: "db", Table: "view", Query: "CREATE VIEW db.view (`id` UInt64) AS SELECT dictGet('db.dict', 'id', id) AS id FROM db.distr"},
+		{Database: "db", Table: "distr", Query: "CREATE TABLE db.distr (`id` UInt64) ENGINE = Distributed('cluster', 'db', 'dst', rand())"},
+		{Database: "db", Table: "dst", Query: "CREATE TABLE db.dst (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "src", Query: "CREATE TABLE db.src (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "cycle1", Query: "CREATE VIEW db.cycle1 (`id` UInt64) AS SELECT id FROM cycle2"},
+		{Database: "db", Table: "cycle2", Query: "CREATE VIEW db.cycle2 (`id` UInt64) AS SELECT id FROM cycle1"},
+	}
+	sorted, cyclicTables := tables.SortByDependencies()
+	var sortedNames []string
+	for _, table := range sorted {
+		sortedNames = append(sortedNames, table.Table)
+	}
+	assert.Equal(t, []string{"dst", "distr", "src", "mv", "dict", "view", "cycle1", "cycle2"}, sortedNames)
+	assert.Equal(t, []string{"db.cycle1", "db.cycle2"}, cyclicTables)
+}
+
+func TestGetQueryDependenciesInnerTable(t *testing.T) {
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "mv",
+		Query:    "ATTACH MATERIALIZED VIEW db.mv UUID '5b2d3c7e-0000-4000-8000-000000000001' (`id` UInt64) ENGINE = MergeTree ORDER BY id AS SELECT id FROM src",
+	}
+	assert.ElementsMatch(t, []metadata.TableTitle{
+		{Database: "db", Table: "src"},
+		{Database: "db", Table: ".inner.mv"},
+		{Database: "db", Table: ".inner_id.5b2d3c7e-0000-4000-8000-000000000001"},
+	}, getQueryDependencies(table))
+}
+
+func TestGetQueryDependenciesMaterializedViewTo(t *testing.T) {
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "mv",
+		Query:    "ATTACH MATERIALIZED VIEW db.mv UUID '5b2d3c7e-0000-4000-8000-000000000001' TO `other_db`.`dst` (`id` UInt64) AS SELECT id FROM src",
+	}
+	target, isTargetDefined := getMaterializedViewTarget(table)
+	assert.True(t, isTargetDefined)
+	assert.Equal(t, metadata.TableTitle{Database: "other_db", Table: "dst"}, target)
+	assert.ElementsMatch(t, []metadata.TableTitle{
+		{Database: "db", Table: "src"},
+		{Database: "other_db", Table: "dst"},
+	}, getQueryDependencies(table))
+
+	table.Query = "CREATE MATERIALIZED VIEW db.mv TO dst (`id` UInt64) AS SELECT id FROM src"
+	target, isTargetDefined = getMaterializedViewTarget(table)
+	assert.True(t, isTargetDefined)
+	assert.Equal(t, metadata.TableTitle{Database: "db", Table: "dst"}, target)
+
+	tables := ListOfTables{
+		{Database: "db", Table: "mv", Query: "ATTACH MATERIALIZED VIEW db.mv TO db.dst (`id` UInt64) AS SELECT id FROM db.src"},
+		{Database: "db", Table: "src", Query: "CREATE TABLE db.src (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "dst", Query: "CREATE TABLE db.dst (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+	sorted, cyclicTables := tables.SortByDependencies()
+	assert.Empty(t, cyclicTables)
+	assert.Equal(t, "mv", sorted[2].Table)
+}
+
+func TestGetQueryDependenciesMaterializedViewToInner(t *testing.T) {
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "mv",
+		Query:    "ATTACH MATERIALIZED VIEW db.mv UUID '5b2d3c7e-0000-4000-8000-000000000001' TO INNER UUID '5b2d3c7e-0000-4000-8000-000000000002' (`id` UInt64) ENGINE = MergeTree ORDER BY id AS SELECT id FROM src",
+	}
+	_, isTargetDefined := getMaterializedViewTarget(table)
+	assert.False(t, isTargetDefined)
+	assert.ElementsMatch(t, []metadata.TableTitle{
+		{Database: "db", Table: "src"},
+		{Database: "db", Table: ".inner.mv"},
+		{Database: "db", Table: ".inner_id.5b2d3c7e-0000-4000-8000-000000000001"},
+	}, getQueryDependencies(table))
+}
+
+func TestSortFunctionsByDependencies(t *testing.T) {
+	functions := sortFunctionsByDependencies([]metadata.FunctionsMeta{
+		{Name: "a_total", CreateQuery: "CREATE FUNCTION a_total AS (x, k, b) -> (z_linear(x, k, b) + b_shift(x))"},
+		{Name: "z_linear", CreateQuery: "CREATE FUNCTION z_linear AS (x, k, b) -> ((k * x) + b)"},
+		{Name: "b_shift", CreateQuery: "CREATE FUNCTION b_shift AS x -> (x + 1)"},
+		{Name: "c_plain", CreateQuery: "CREATE FUNCTION c_plain AS x -> (x * 2)"},
+	})
+	names := make([]string, 0, len(functions))
+	for _, f := range functions {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"b_shift", "c_plain", "z_linear", "a_total"}, names)
+
+	// name which is suffix of called function is not dependency
+	functions = sortFunctionsByDependencies([]metadata.FunctionsMeta{
+		{Name: "a_calls", CreateQuery: "CREATE FUNCTION a_calls AS x -> xb_shift(x)"},
+		{Name: "b_shift", CreateQuery: "CREATE FUNCTION b_shift AS x -> (x + 1)"},
+	})
+	assert.Equal(t, "a_calls", functions[0].Name)
+}
+
+func TestGetStreamingTables(t *testing.T) {
+	streamingTables, consumerViews := getStreamingTables(ListOfTables{
+		{Database: "db", Table: "queue", Query: "CREATE TABLE db.queue (`id` UInt64) ENGINE = Kafka SETTINGS kafka_broker_list = 'kafka:9092', kafka_topic_list = 'events', kafka_group_name = 'g', kafka_format = 'JSONEachRow'"},
+		{Database: "db", Table: "rabbit", Query: "CREATE TABLE db.rabbit (`id` UInt64) ENGINE = RabbitMQ SETTINGS rabbitmq_host_port = 'rabbit:5672', rabbitmq_exchange_name = 'e', rabbitmq_format = 'JSONEachRow'"},
+		{Database: "db", Table: "events", Query: "CREATE TABLE db.events (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "mv", Query: "CREATE MATERIALIZED VIEW db.mv TO db.events (`id` UInt64) AS SELECT id FROM db.queue"},
+		{Database: "db", Table: "mv_events", Query: "CREATE MATERIALIZED VIEW db.mv_events TO db.other (`id` UInt64) AS SELECT id FROM db.events"},
+	})
+	assert.Equal(t, map[metadata.TableTitle]struct{}{{Database: "db", Table: "queue"}: {}, {Database: "db", Table: "rabbit"}: {}}, streamingTables)
+	assert.Equal(t, map[metadata.TableTitle]struct{}{{Database: "db", Table: "mv"}: {}}, consumerViews)
+}
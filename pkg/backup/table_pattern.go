@@ -9,12 +9,12 @@ import (
 	apexLog "github.com/apex/log"
 	"github.com/google/uuid"
 	"io"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
@@ -76,11 +76,11 @@ func getTableListByPatternLocal(cfg *config.Config, ch *clickhouse.ClickHouse, m
 		if len(names) != 2 {
 			return nil
 		}
-		database, _ := url.PathUnescape(names[0])
+		database := common.TablePathDecode(names[0])
 		if IsInformationSchema(database) {
 			return nil
 		}
-		table, _ := url.PathUnescape(names[1])
+		table := common.TablePathDecode(names[1])
 		tableName := fmt.Sprintf("%s.%s", database, table)
 		shallSkipped := false
 		for _, skipPattern := range cfg.ClickHouse.SkipTables {
@@ -126,8 +126,11 @@ func getTableListByPatternLocal(cfg *config.Config, ch *clickhouse.ClickHouse, m
 					Query:    query,
 					Parts:    parts,
 				}
-				partitionsFilter, _ := filesystemhelper.CreatePartitionsToBackupMap(ch, nil, []metadata.TableMetadata{t}, partitions)
-				filterPartsAndFilesByPartitionsFilter(t, partitionsFilter)
+				partitionsFilter, err := filesystemhelper.CreatePartitionsToBackupMap(ch, nil, []metadata.TableMetadata{t}, partitions)
+				if err != nil {
+					return err
+				}
+				filterPartsAndFilesByPartitionsFilter(t, partitionsFilter[metadata.TableTitle{Database: t.Database, Table: t.Table}])
 				result = addTableToListIfNotExistsOrEnrichQueryAndParts(result, t)
 
 				return nil
@@ -136,8 +139,11 @@ func getTableListByPatternLocal(cfg *config.Config, ch *clickhouse.ClickHouse, m
 			if err := json.Unmarshal(data, &t); err != nil {
 				return err
 			}
-			partitionsFilter, _ := filesystemhelper.CreatePartitionsToBackupMap(ch, nil, []metadata.TableMetadata{t}, partitions)
-			filterPartsAndFilesByPartitionsFilter(t, partitionsFilter)
+			partitionsFilter, err := filesystemhelper.CreatePartitionsToBackupMap(ch, nil, []metadata.TableMetadata{t}, partitions)
+			if err != nil {
+				return err
+			}
+			filterPartsAndFilesByPartitionsFilter(t, partitionsFilter[metadata.TableTitle{Database: t.Database, Table: t.Table}])
 			result = addTableToListIfNotExistsOrEnrichQueryAndParts(result, t)
 			return nil
 		}
@@ -156,6 +162,153 @@ var uuidRE = regexp.MustCompile(`UUID '[a-f\d\-]+'`)
 var replicatedRE = regexp.MustCompile(`(Replicated[a-zA-Z]*MergeTree)\('([^']+)'([^)]+)\)`)
 var distributedRE = regexp.MustCompile(`(Distributed)\(([^,]+),([^,]+),([^)]+)\)`)
 
+// findDictionarySource - return source type and position of parameters inside SOURCE(TYPE(...)) clause, respect quotes and nested parentheses
+func findDictionarySource(query string) (string, int, int) {
+	sourceIdx := strings.Index(strings.ToUpper(query), "SOURCE(")
+	if sourceIdx < 0 {
+		return "", -1, -1
+	}
+	typeStart := sourceIdx + len("SOURCE(")
+	typeEnd := strings.Index(query[typeStart:], "(")
+	if typeEnd < 0 {
+		return "", -1, -1
+	}
+	sourceType := strings.ToLower(strings.TrimSpace(query[typeStart : typeStart+typeEnd]))
+	paramsStart := typeStart + typeEnd + 1
+	depth := 1
+	inQuote := false
+	for i := paramsStart; i < len(query); i++ {
+		switch {
+		case inQuote && query[i] == '\\':
+			i++
+		case query[i] == '\'':
+			inQuote = !inQuote
+		case !inQuote && query[i] == '(':
+			depth++
+		case !inQuote && query[i] == ')':
+			depth--
+			if depth == 0 {
+				return sourceType, paramsStart, i
+			}
+		}
+	}
+	return "", -1, -1
+}
+
+// changeDictionaryQueryToAdjustSourceMapping - rewrite SOURCE parameters of dictionaries according to `dictionary_source_mapping`
+// keys could be `param` for any source type or `source_type.param` for specific source, like `clickhouse.host`, `mysql.password`, `http.url`
+func changeDictionaryQueryToAdjustSourceMapping(tables ListOfTables, sourceMapping map[string]string) {
+	log := apexLog.WithField("logger", "changeDictionaryQueryToAdjustSourceMapping")
+	for i := range tables {
+		if !strings.HasPrefix(tables[i].Query, "CREATE DICTIONARY") && !strings.HasPrefix(tables[i].Query, "ATTACH DICTIONARY") {
+			continue
+		}
+		sourceType, paramsStart, paramsEnd := findDictionarySource(tables[i].Query)
+		if paramsStart < 0 {
+			log.Warnf("can't find SOURCE clause in %s.%s", tables[i].Database, tables[i].Table)
+			continue
+		}
+		params := tables[i].Query[paramsStart:paramsEnd]
+		rules := map[string]string{}
+		for key, value := range sourceMapping {
+			if !strings.Contains(key, ".") {
+				if _, exists := rules[strings.ToLower(key)]; !exists {
+					rules[strings.ToLower(key)] = value
+				}
+			} else if keyParts := strings.SplitN(key, ".", 2); strings.ToLower(keyParts[0]) == sourceType {
+				// source specific rule has priority
+				rules[strings.ToLower(keyParts[1])] = value
+			}
+		}
+		for param, value := range rules {
+			paramRE := regexp.MustCompile(`(?i)\b(` + regexp.QuoteMeta(param) + `)\s+('(?:[^'\\]|\\.)*'|[^\s)']+)`)
+			params = paramRE.ReplaceAllStringFunc(params, func(match string) string {
+				matches := paramRE.FindStringSubmatch(match)
+				if strings.HasPrefix(matches[2], "'") {
+					return fmt.Sprintf("%s '%s'", matches[1], strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value))
+				}
+				return fmt.Sprintf("%s %s", matches[1], value)
+			})
+		}
+		tables[i].Query = tables[i].Query[:paramsStart] + params + tables[i].Query[paramsEnd:]
+		log.Debugf("%s.%s %s source adjusted", tables[i].Database, tables[i].Table, sourceType)
+	}
+}
+
+// replaceDictionarySourceWithNull - replace SOURCE(TYPE(...)) clause with SOURCE(NULL()), return false when SOURCE clause not found
+func replaceDictionarySourceWithNull(query string) (string, bool) {
+	sourceIdx := strings.Index(strings.ToUpper(query), "SOURCE(")
+	_, paramsStart, paramsEnd := findDictionarySource(query)
+	if sourceIdx < 0 || paramsStart < 0 {
+		return query, false
+	}
+	sourceEnd := strings.Index(query[paramsEnd+1:], ")")
+	if sourceEnd < 0 {
+		return query, false
+	}
+	sourceEnd += paramsEnd + 2
+	return query[:sourceIdx] + "SOURCE(NULL())" + query[sourceEnd:], true
+}
+
+var tableNameInCreateQueryRE = regexp.MustCompile(`^((?:CREATE|ATTACH)\s+(?:TABLE|DICTIONARY|VIEW|MATERIALIZED\s+VIEW|LIVE\s+VIEW|WINDOW\s+VIEW)\s+(?:IF\s+NOT\s+EXISTS\s+)?)(\x60[^\x60]+\x60|[^\s\x60.]+)\.(\x60[^\x60]+\x60|[^\s\x60.(]+)`)
+
+// getRestoreTableMappingTarget - destination database and table for table from backup, `restore_table_mapping` applied first, then `restore_database_mapping` applied to result database
+func getRestoreTableMappingTarget(database, table string, tableMapRule, dbMapRule map[string]string) (string, string) {
+	if target, isMapped := tableMapRule[database+"."+table]; isMapped {
+		if targetParts := strings.SplitN(target, ".", 2); len(targetParts) == 2 {
+			database, table = targetParts[0], targetParts[1]
+		}
+	}
+	if targetDB, isMapped := dbMapRule[database]; isMapped {
+		database = targetDB
+	}
+	return database, table
+}
+
+// changeTableQueryToAdjustTableMapping - rename tables according to `restore_table_mapping`, shall be called before changeTableQueryToAdjustDatabaseMapping
+func changeTableQueryToAdjustTableMapping(originTables *ListOfTables, tableMapRule map[string]string) error {
+	for i := 0; i < len(*originTables); i++ {
+		originTable := (*originTables)[i]
+		target, isMapped := tableMapRule[originTable.Database+"."+originTable.Table]
+		if !isMapped {
+			continue
+		}
+		targetParts := strings.SplitN(target, ".", 2)
+		if len(targetParts) != 2 || targetParts[0] == "" || targetParts[1] == "" {
+			return fmt.Errorf("restore-table-mapping %s.%s:%s should only have src_db.src_table:dst_db.dst_table format", originTable.Database, originTable.Table, target)
+		}
+		targetDB, targetTable := targetParts[0], targetParts[1]
+		if originTable.Query != "" {
+			loc := tableNameInCreateQueryRE.FindStringSubmatchIndex(originTable.Query)
+			if loc == nil {
+				return fmt.Errorf("error when try to replace table `%s`.`%s` to `%s`.`%s` in query: %s", originTable.Database, originTable.Table, targetDB, targetTable, originTable.Query)
+			}
+			originTable.Query = originTable.Query[:loc[3]] + fmt.Sprintf("`%s`.`%s`", targetDB, targetTable) + originTable.Query[loc[1]:]
+			// original table could exist near to restored table
+			if len(uuidRE.FindAllString(originTable.Query, -1)) > 0 {
+				newUUID, _ := uuid.NewUUID()
+				originTable.Query = uuidRE.ReplaceAllString(originTable.Query, fmt.Sprintf("UUID '%s'", newUUID.String()))
+			}
+			if replicatedRE.MatchString(originTable.Query) {
+				matches := replicatedRE.FindAllStringSubmatch(originTable.Query, -1)
+				replicatedPath := matches[0][2]
+				if strings.Contains(replicatedPath, "/"+originTable.Table+"/") || strings.HasSuffix(replicatedPath, "/"+originTable.Table) {
+					replicatedPath = strings.Replace(replicatedPath+"/", "/"+originTable.Table+"/", "/"+targetTable+"/", 1)
+					replicatedPath = strings.TrimSuffix(replicatedPath, "/")
+				}
+				if targetDB != originTable.Database {
+					replicatedPath = strings.Replace(replicatedPath, "/"+originTable.Database+"/", "/"+targetDB+"/", 1)
+				}
+				originTable.Query = replicatedRE.ReplaceAllString(originTable.Query, fmt.Sprintf("${1}('%s'${3})", replicatedPath))
+			}
+		}
+		originTable.Database = targetDB
+		originTable.Table = targetTable
+		(*originTables)[i] = originTable
+	}
+	return nil
+}
+
 func changeTableQueryToAdjustDatabaseMapping(originTables *ListOfTables, dbMapRule map[string]string) error {
 	for i := 0; i < len(*originTables); i++ {
 		originTable := (*originTables)[i]
@@ -217,6 +370,653 @@ func changeTableQueryToAdjustDatabaseMapping(originTables *ListOfTables, dbMapRu
 	return nil
 }
 
+// changeTableQueryToAdjustDistributedClusterMapping - replace cluster name in ENGINE = Distributed(cluster, database, table), underlying database which wasn't replaced by changeTableQueryToAdjustDatabaseMapping replaced according to dbMapRule
+func changeTableQueryToAdjustDistributedClusterMapping(tables ListOfTables, clusterMapping, dbMapRule map[string]string, log *apexLog.Entry) {
+	for i, table := range tables {
+		if !strings.HasPrefix(table.Query, "CREATE TABLE") && !strings.HasPrefix(table.Query, "ATTACH TABLE") {
+			continue
+		}
+		matches := distributedRE.FindStringSubmatch(table.Query)
+		if len(matches) == 0 {
+			continue
+		}
+		cluster, underlyingDB := matches[2], matches[3]
+		clusterClean := strings.Trim(cluster, "'\" ")
+		underlyingDBClean := strings.Trim(underlyingDB, "'\"` ")
+		targetCluster, isClusterMapped := clusterMapping[clusterClean]
+		targetDB, isDBMapped := dbMapRule[underlyingDBClean]
+		if !isClusterMapped && !isDBMapped {
+			continue
+		}
+		if isClusterMapped {
+			cluster = strings.Replace(cluster, clusterClean, targetCluster, 1)
+		}
+		if isDBMapped {
+			underlyingDB = strings.Replace(underlyingDB, underlyingDBClean, targetDB, 1)
+		}
+		tables[i].Query = strings.Replace(table.Query, matches[0], fmt.Sprintf("%s(%s,%s,%s)", matches[1], cluster, underlyingDB, matches[4]), 1)
+		log.Debugf("%s.%s Distributed engine adjusted to %s(%s,%s,...)", table.Database, table.Table, matches[1], cluster, underlyingDB)
+	}
+}
+
+type schemaTransformRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// compileRegexpReplaceRules - parse `regexp->replacement` items of `option`, rules applied in config order
+func compileRegexpReplaceRules(option string, items []string) ([]schemaTransformRule, error) {
+	parsedRules, err := config.ParseRegexpReplaceRules(option, items)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]schemaTransformRule, len(parsedRules))
+	for i, rule := range parsedRules {
+		rules[i] = schemaTransformRule{re: rule.Regexp, replacement: rule.Replacement}
+	}
+	return rules, nil
+}
+
+func applySchemaTransformRules(query string, rules []schemaTransformRule) string {
+	for _, rule := range rules {
+		query = rule.re.ReplaceAllString(query, rule.replacement)
+	}
+	return query
+}
+
+var unknownSettingErrorRE = regexp.MustCompile(`Unknown setting '?([A-Za-z0-9_]+)'?`)
+var lastSettingsClauseRE = regexp.MustCompile(`(?i)\s+SETTINGS\s+`)
+
+// getUnknownSettingFromError - parse setting name from ClickHouse UNKNOWN_SETTING error, empty string when error has another reason
+func getUnknownSettingFromError(err error) string {
+	if matches := unknownSettingErrorRE.FindStringSubmatch(err.Error()); len(matches) > 1 {
+		return matches[1]
+	}
+	return ""
+}
+
+// removeSettingFromCreateQuery - remove `name = value` from the last SETTINGS clause, remove whole clause when it becomes empty
+func removeSettingFromCreateQuery(query, name string) (string, bool) {
+	clauses := lastSettingsClauseRE.FindAllStringIndex(query, -1)
+	if len(clauses) == 0 {
+		return query, false
+	}
+	clauseStart, settingsStart := clauses[len(clauses)-1][0], clauses[len(clauses)-1][1]
+	var settings []string
+	inQuote := false
+	depth := 0
+	last := settingsStart
+	for i := settingsStart; i < len(query); i++ {
+		switch {
+		case inQuote && query[i] == '\\':
+			i++
+		case query[i] == '\'':
+			inQuote = !inQuote
+		case !inQuote && query[i] == '(':
+			depth++
+		case !inQuote && query[i] == ')':
+			depth--
+		case !inQuote && depth == 0 && query[i] == ',':
+			settings = append(settings, strings.TrimSpace(query[last:i]))
+			last = i + 1
+		}
+	}
+	settings = append(settings, strings.TrimSpace(query[last:]))
+	keptSettings := make([]string, 0, len(settings))
+	isRemoved := false
+	for _, setting := range settings {
+		if strings.TrimSpace(strings.SplitN(setting, "=", 2)[0]) == name {
+			isRemoved = true
+			continue
+		}
+		keptSettings = append(keptSettings, setting)
+	}
+	if !isRemoved {
+		return query, false
+	}
+	if len(keptSettings) == 0 {
+		return query[:clauseStart], true
+	}
+	return query[:settingsStart] + strings.Join(keptSettings, ", "), true
+}
+
+// removeTTLFromCreateQuery - remove table level TTL clause after ENGINE and column level TTL expressions, to avoid delete TTL expired rows in attached parts
+func removeTTLFromCreateQuery(query string) (string, bool) {
+	var result strings.Builder
+	var quote byte
+	depth, ttlDepth, last := 0, -1, 0
+	isEngine := false
+	endTTL := func(i int) {
+		last = i
+		ttlDepth = -1
+	}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '`' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if ttlDepth == depth {
+				endTTL(i)
+			}
+			depth--
+		case c == ',' && ttlDepth == 1 && depth == 1:
+			endTTL(i)
+		case c == ' ' && ttlDepth == 0 && depth == 0 && (strings.HasPrefix(query[i:], " SETTINGS ") || strings.HasPrefix(query[i:], " AS ") || strings.HasPrefix(query[i:], " COMMENT ")):
+			endTTL(i)
+		case c == ' ' && ttlDepth == -1 && strings.HasPrefix(query[i:], " TTL ") && ((depth == 1 && !isEngine) || (depth == 0 && isEngine)):
+			result.WriteString(query[last:i])
+			ttlDepth = depth
+		case c == ' ' && depth == 0 && strings.HasPrefix(query[i:], " ENGINE = "):
+			isEngine = true
+		}
+	}
+	if ttlDepth == -1 {
+		result.WriteString(query[last:])
+	}
+	if result.Len() == len(query) {
+		return query, false
+	}
+	return result.String(), true
+}
+
+// changeTableQueryToExcludeColumns - remove columns from CREATE TABLE queries according to `restore_column_exclude`, rules use database and table names from backup
+func changeTableQueryToExcludeColumns(tables ListOfTables, cfg *config.Config, log *apexLog.Entry) error {
+	for i, table := range tables {
+		columns := cfg.GetRestoreColumnExclude(table.Database, table.Table)
+		if len(columns) == 0 || (!strings.HasPrefix(table.Query, "CREATE TABLE") && !strings.HasPrefix(table.Query, "ATTACH TABLE")) {
+			continue
+		}
+		query, removedColumns, err := removeColumnsFromCreateQuery(table.Query, columns)
+		if err != nil {
+			return fmt.Errorf("can't exclude columns from '%s.%s': %v", table.Database, table.Table, err)
+		}
+		tables[i].Query = query
+		if len(removedColumns) > 0 {
+			log.Warnf("%s.%s columns %s excluded from schema due `restore_column_exclude`", table.Database, table.Table, strings.Join(removedColumns, ","))
+		}
+		if len(removedColumns) < len(columns) {
+			log.Warnf("%s.%s not all columns from %s found in schema", table.Database, table.Table, strings.Join(columns, ","))
+		}
+	}
+	return nil
+}
+
+// getCreateQueryElements - column, index, projection and constraint definitions from columns list of CREATE query, end is position of closing bracket, -1 when query doesn't contain columns list
+func getCreateQueryElements(query string) ([]string, int) {
+	var quote byte
+	var elements []string
+	depth, start, end := 0, -1, -1
+	for i := 0; i < len(query) && end == -1; i++ {
+		c := query[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '`' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+			if depth == 1 && start == -1 {
+				// CREATE TABLE ... AS other_table or without columns list
+				if strings.Contains(query[:i], " ENGINE") || strings.Contains(query[:i], " AS ") {
+					return nil, -1
+				}
+				start = i + 1
+			}
+		case c == ')':
+			depth--
+			if depth == 0 && start != -1 {
+				elements = append(elements, query[start:i])
+				end = i
+			}
+		case c == ',' && depth == 1 && start != -1:
+			elements = append(elements, query[start:i])
+			start = i + 1
+		}
+	}
+	return elements, end
+}
+
+var lowCardinalityRE = regexp.MustCompile(`\bLowCardinality\(`)
+
+// getLowCardinalityColumns - names of columns which type contains LowCardinality, including nested types like Array(LowCardinality(String))
+func getLowCardinalityColumns(query string) []string {
+	elements, _ := getCreateQueryElements(query)
+	var columns []string
+	for _, element := range elements {
+		element = strings.TrimSpace(element)
+		if strings.HasPrefix(element, "INDEX ") || strings.HasPrefix(element, "PROJECTION ") || strings.HasPrefix(element, "CONSTRAINT ") {
+			continue
+		}
+		name, columnType, err := common.ParseBackQuotedName(element)
+		if err != nil {
+			continue
+		}
+		if lowCardinalityRE.MatchString(quotedStringRE.ReplaceAllString(columnType, "''")) {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+var orderByRE = regexp.MustCompile(`\sORDER BY\s+`)
+var orderByEndRE = regexp.MustCompile(`^\s+(PRIMARY KEY|SAMPLE BY|TTL|SETTINGS|COMMENT)\b`)
+
+// getTableSortingKey - ORDER BY expression of MergeTree engine from CREATE TABLE query, spaces and outer brackets removed to compare keys, empty when engine doesn't have ORDER BY
+func getTableSortingKey(query string) string {
+	_, columnsEnd := getCreateQueryElements(query)
+	if columnsEnd == -1 {
+		return ""
+	}
+	loc := orderByRE.FindStringIndex(query[columnsEnd:])
+	if loc == nil {
+		return ""
+	}
+	expr := query[columnsEnd+loc[1]:]
+	var quote byte
+	depth, end := 0, len(expr)
+	for i := 0; i < len(expr) && end == len(expr); i++ {
+		c := expr[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '\'' || c == '`' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && orderByEndRE.MatchString(expr[i:]):
+			end = i
+		}
+	}
+	key := strings.Join(strings.Fields(expr[:end]), "")
+	if strings.HasPrefix(key, "(") && strings.HasSuffix(key, ")") {
+		if elements, elementsEnd := getCreateQueryElements(key); elementsEnd == len(key)-1 && len(elements) == 1 {
+			key = key[1 : len(key)-1]
+		}
+	}
+	return key
+}
+
+// aggregateFunctionRE - AggregateFunction could contain optional state version before function name, like AggregateFunction(1, sumMap, ...)
+var aggregateFunctionRE = regexp.MustCompile(`\b(Simple)?AggregateFunction\(\s*(?:\d+\s*,\s*)?([A-Za-z_][A-Za-z0-9_]*)`)
+
+type aggregateFunctionColumn struct {
+	Column   string
+	Function string
+	IsSimple bool
+}
+
+// getAggregateFunctionColumns - aggregate functions used in AggregateFunction and SimpleAggregateFunction column types, including nested types like Array(AggregateFunction(...))
+func getAggregateFunctionColumns(query string) []aggregateFunctionColumn {
+	columnTypes := getColumnTypes(query)
+	names := make([]string, 0, len(columnTypes))
+	for name := range columnTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var columns []aggregateFunctionColumn
+	for _, name := range names {
+		for _, matches := range aggregateFunctionRE.FindAllStringSubmatch(quotedStringRE.ReplaceAllString(columnTypes[name], "''"), -1) {
+			columns = append(columns, aggregateFunctionColumn{Column: name, Function: matches[2], IsSimple: matches[1] != ""})
+		}
+	}
+	return columns
+}
+
+var columnTypeEndRE = regexp.MustCompile(`^\s+(DEFAULT|MATERIALIZED|ALIAS|EPHEMERAL|CODEC|COMMENT|TTL|NULL|NOT|STATISTICS|SETTINGS|PRIMARY)\b`)
+
+// getColumnTypes - column name to type map from columns list of CREATE TABLE query, type ends on first column modifier outside of parentheses
+func getColumnTypes(query string) map[string]string {
+	elements, _ := getCreateQueryElements(query)
+	columnTypes := make(map[string]string, len(elements))
+	for _, element := range elements {
+		element = strings.TrimSpace(element)
+		if strings.HasPrefix(element, "INDEX ") || strings.HasPrefix(element, "PROJECTION ") || strings.HasPrefix(element, "CONSTRAINT ") {
+			continue
+		}
+		name, definition, err := common.ParseBackQuotedName(element)
+		if err != nil {
+			continue
+		}
+		var quote byte
+		depth, end := 0, len(definition)
+		for i := 0; i < len(definition) && end == len(definition); i++ {
+			c := definition[i]
+			if quote != 0 {
+				if c == '\\' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+				continue
+			}
+			switch {
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+			case depth == 0 && columnTypeEndRE.MatchString(definition[i:]):
+				end = i
+			}
+		}
+		if columnType := strings.TrimSpace(definition[:end]); columnType != "" {
+			columnTypes[name] = columnType
+		}
+	}
+	return columnTypes
+}
+
+// getColumnTypeDiff - columns which exist in both tables with different types, whitespace in types is ignored, sorted by column name
+func getColumnTypeDiff(backupTypes, dstTypes map[string]string) []string {
+	normalize := func(columnType string) string {
+		return strings.Join(strings.Fields(columnType), "")
+	}
+	var diff []string
+	for name, backupType := range backupTypes {
+		dstType, exists := dstTypes[name]
+		if !exists || normalize(dstType) == normalize(backupType) {
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("`%s` %s in backup, %s in destination table", name, backupType, dstType))
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// removeColumnsFromCreateQuery - remove column definitions from columns list of CREATE TABLE query, return error when column still used in other parts of query,
+// like ORDER BY, PARTITION BY, skip index, projection or DEFAULT expression of other column
+func removeColumnsFromCreateQuery(query string, columns []string) (string, []string, error) {
+	isExcluded := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		isExcluded[column] = struct{}{}
+	}
+	elements, end := getCreateQueryElements(query)
+	if end == -1 {
+		return query, nil, nil
+	}
+	var keptElements, removedColumns []string
+	for _, element := range elements {
+		element = strings.TrimSpace(element)
+		name, _, err := common.ParseBackQuotedName(element)
+		if err != nil {
+			return query, nil, err
+		}
+		if _, exists := isExcluded[name]; exists {
+			removedColumns = append(removedColumns, name)
+			continue
+		}
+		keptElements = append(keptElements, element)
+	}
+	if len(removedColumns) == 0 {
+		return query, nil, nil
+	}
+	if len(removedColumns) == len(elements) {
+		return query, nil, fmt.Errorf("all columns excluded")
+	}
+	columnsStart := end - len(strings.Join(elements, ","))
+	keptColumns := strings.Join(keptElements, ", ")
+	// table name before columns list could be the same as column name
+	unquotedRest := quotedStringRE.ReplaceAllString(keptColumns+query[end:], "")
+	for _, column := range removedColumns {
+		if regexp.MustCompile(`(^|[^\w])` + regexp.QuoteMeta(column) + `([^\w]|$)`).MatchString(unquotedRest) {
+			return query, nil, fmt.Errorf("column `%s` still used in schema after exclusion", column)
+		}
+	}
+	return query[:columnsStart] + keptColumns + query[end:], removedColumns, nil
+}
+
+var functionOnClusterRE = regexp.MustCompile(`(?i)\s+ON\s+CLUSTER\s+('[^']*'|\x60[^\x60]*\x60|\S+)`)
+var createOrReplaceFunctionRE = regexp.MustCompile(`^(?i)CREATE\s+(OR\s+REPLACE\s+)?FUNCTION\s+`)
+
+// normalizeFunctionQuery - remove ON CLUSTER and OR REPLACE clauses, collapse whitespaces to compare create_query from system.functions and backup
+func normalizeFunctionQuery(query string) string {
+	query = functionOnClusterRE.ReplaceAllString(query, "")
+	query = createOrReplaceFunctionRE.ReplaceAllString(query, "CREATE FUNCTION ")
+	return strings.Join(strings.Fields(query), " ")
+}
+
+var objectJSONColumnRE = regexp.MustCompile(`\bObject\(\s*'json'\s*\)`)
+var jsonColumnRE = regexp.MustCompile(`[\s(,]JSON(?:\(|[\s,)]|$)`)
+var quotedStringRE = regexp.MustCompile(`'(?:[^'\\]|\\.)*'`)
+
+// parseClickHouseVersion - convert VERSION_DESCRIBE like `v22.8.5.29-lts` to VERSION_INTEGER format like 22008005, 0 when version can't parse
+func parseClickHouseVersion(version string) int {
+	version = strings.SplitN(strings.TrimPrefix(version, "v"), "-", 2)[0]
+	parts := strings.SplitN(version, ".", 4)
+	if len(parts) < 3 {
+		return 0
+	}
+	result := 0
+	for _, part := range parts[:3] {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		result = result*1000 + n
+	}
+	return result
+}
+
+// checkExperimentalJSONColumns - experimental Object('json') and JSON columns store serialization version inside data parts,
+// so restore into ClickHouse which doesn't support this type or older than backup source could produce unreadable columns
+func checkExperimentalJSONColumns(tables ListOfTables, backupVersion string, targetVersion int) error {
+	if targetVersion == 0 {
+		return nil
+	}
+	sourceVersion := parseClickHouseVersion(backupVersion)
+	var incompatibleTables []string
+	for _, t := range tables {
+		columns := t.Query
+		if engineIndex := strings.Index(columns, " ENGINE"); engineIndex > 0 {
+			columns = columns[:engineIndex]
+		}
+		isObjectJSON := objectJSONColumnRE.MatchString(columns)
+		isJSON := jsonColumnRE.MatchString(quotedStringRE.ReplaceAllString(columns, "''"))
+		switch {
+		case isObjectJSON && targetVersion < 22003000:
+			incompatibleTables = append(incompatibleTables, fmt.Sprintf("'%s.%s' contains Object('json') column which requires ClickHouse 22.3+", t.Database, t.Table))
+		case isJSON && targetVersion < 24008000:
+			incompatibleTables = append(incompatibleTables, fmt.Sprintf("'%s.%s' contains JSON column which requires ClickHouse 24.8+", t.Database, t.Table))
+		case (isObjectJSON || isJSON) && sourceVersion > targetVersion:
+			incompatibleTables = append(incompatibleTables, fmt.Sprintf("'%s.%s' contains experimental JSON column created by ClickHouse %s, serialization format could be unreadable for older version", t.Database, t.Table, backupVersion))
+		}
+	}
+	if len(incompatibleTables) > 0 {
+		return fmt.Errorf("can't restore into ClickHouse version %d: %s, upgrade ClickHouse server or exclude these tables via --tables", targetVersion, strings.Join(incompatibleTables, "; "))
+	}
+	return nil
+}
+
+var codecClauseRE = regexp.MustCompile(`\bCODEC\(`)
+
+// getCodecNames - names of compression codecs from all CODEC(...) clauses, `CODEC(Delta(4), ZSTD(3))` returns Delta and ZSTD
+func getCodecNames(s string) []string {
+	var codecs []string
+	for _, loc := range codecClauseRE.FindAllStringIndex(s, -1) {
+		depth := 0
+		name := strings.Builder{}
+		for i := loc[1]; i < len(s) && depth >= 0; i++ {
+			switch c := s[i]; {
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+			case c == ',' && depth == 0:
+				codecs = append(codecs, name.String())
+				name.Reset()
+			case depth == 0 && c != ' ':
+				name.WriteByte(c)
+			}
+			if depth < 0 {
+				codecs = append(codecs, name.String())
+			}
+		}
+	}
+	return codecs
+}
+
+var skipIndexRE = regexp.MustCompile("[(,]\\s*INDEX\\s+(`[^`]+`|[^\\s`]+)\\s+")
+
+// getSkipIndexNames - names of data skipping indexes from `INDEX name expr TYPE type GRANULARITY n` clauses of CREATE query
+func getSkipIndexNames(query string) []string {
+	var indexes []string
+	for _, matches := range skipIndexRE.FindAllStringSubmatch(query, -1) {
+		indexes = append(indexes, strings.Trim(matches[1], "`"))
+	}
+	return indexes
+}
+
+var replicatedEngineArgsRE = regexp.MustCompile(`ENGINE\s*=\s*Replicated\w*MergeTree\(\s*'([^']+)'\s*,\s*'([^']+)'`)
+var tableUUIDRE = regexp.MustCompile(`^(?:CREATE|ATTACH)\s+TABLE\s+\S+\s+UUID\s+'([^']+)'`)
+var macroRE = regexp.MustCompile(`\{[^{}]+\}`)
+
+// compileZookeeperPathMapping - `restore_zookeeper_path_mapping` items have `regexp->replacement` format, applied in config order
+func compileZookeeperPathMapping(mapping []string) ([]schemaTransformRule, error) {
+	return compileRegexpReplaceRules("restore_zookeeper_path_mapping", mapping)
+}
+
+// changeTableQueryToAdjustZookeeperPathMapping - rewrite ZooKeeper path argument of Replicated*MergeTree engine, replica name is not changed,
+// return tables with changed path, and error when different tables get the same ZooKeeper path after rewrite, they would become replicas of each other
+func changeTableQueryToAdjustZookeeperPathMapping(tables ListOfTables, rules []schemaTransformRule, log *apexLog.Entry) (ListOfTables, error) {
+	var changedTables ListOfTables
+	zkPathOwners := map[string]string{}
+	for i := range tables {
+		loc := replicatedEngineArgsRE.FindStringSubmatchIndex(tables[i].Query)
+		if len(loc) == 0 {
+			continue
+		}
+		query := tables[i].Query
+		zkPath := applySchemaTransformRules(query[loc[2]:loc[3]], rules)
+		if zkPath != query[loc[2]:loc[3]] {
+			log.Infof("%s.%s ZooKeeper path '%s' changed to '%s'", tables[i].Database, tables[i].Table, query[loc[2]:loc[3]], zkPath)
+			tables[i].Query = query[:loc[2]] + zkPath + query[loc[3]:]
+			changedTables = append(changedTables, tables[i])
+		}
+		expandedPath, replica, _ := getReplicatedZookeeperPath(tables[i].Query, tables[i].Database, tables[i].Table)
+		tableName := fmt.Sprintf("%s.%s", tables[i].Database, tables[i].Table)
+		if owner, exists := zkPathOwners[expandedPath+"/"+replica]; exists && owner != tableName {
+			return nil, fmt.Errorf("%s and %s have the same ZooKeeper path '%s' and replica '%s' after `restore_zookeeper_path_mapping`", owner, tableName, expandedPath, replica)
+		}
+		zkPathOwners[expandedPath+"/"+replica] = tableName
+	}
+	return changedTables, nil
+}
+
+// getReplicatedZookeeperPath - ZooKeeper path and replica name from Replicated*MergeTree engine arguments,
+// {database}, {table} and {uuid} are expanded by ClickHouse itself, so they replaced here, other macros shall be applied by ch.ApplyMacros
+func getReplicatedZookeeperPath(query, database, table string) (string, string, bool) {
+	matches := replicatedEngineArgsRE.FindStringSubmatch(query)
+	if len(matches) == 0 {
+		return "", "", false
+	}
+	replacements := []string{"{database}", database, "{table}", table}
+	if uuidMatches := tableUUIDRE.FindStringSubmatch(query); len(uuidMatches) == 2 {
+		replacements = append(replacements, "{uuid}", uuidMatches[1])
+	}
+	replacer := strings.NewReplacer(replacements...)
+	return replacer.Replace(matches[1]), replacer.Replace(matches[2]), true
+}
+
+// getUndefinedMacros - macros which are still present after ch.ApplyMacros
+func getUndefinedMacros(s string) []string {
+	return macroRE.FindAllString(s, -1)
+}
+
+var storagePolicyRE = regexp.MustCompile(`(\bstorage_policy\s*=\s*')([^']+)(')`)
+var diskSettingRE = regexp.MustCompile(`\bdisk\s*=`)
+var tableSettingsRE = regexp.MustCompile(`\sSETTINGS\s`)
+var ttlToDiskRE = regexp.MustCompile(`(?i)\bTO\s+(DISK|VOLUME)\s+'`)
+
+// changeTableQueryToAdjustStoragePolicyMapping - replace `storage_policy` for MergeTree tables, `default` mapping key applied to tables without `storage_policy` setting
+func changeTableQueryToAdjustStoragePolicyMapping(tables ListOfTables, storagePolicyMapping map[string]string, log *apexLog.Entry) {
+	for i, table := range tables {
+		if (!strings.HasPrefix(table.Query, "CREATE TABLE") && !strings.HasPrefix(table.Query, "ATTACH TABLE")) || !strings.Contains(table.Query, "MergeTree") {
+			continue
+		}
+		query := table.Query
+		if matches := storagePolicyRE.FindStringSubmatch(query); len(matches) > 0 {
+			newPolicy, isMapped := storagePolicyMapping[matches[2]]
+			if !isMapped {
+				continue
+			}
+			query = storagePolicyRE.ReplaceAllString(query, "${1}"+newPolicy+"${3}")
+		} else if newPolicy, isMapped := storagePolicyMapping["default"]; !isMapped {
+			continue
+		} else if diskSettingRE.MatchString(query) {
+			log.Warnf("%s.%s has explicit `disk` setting, `restore_storage_policy_mapping` will not applied", table.Database, table.Table)
+			continue
+		} else if settingsIndex := tableSettingsRE.FindAllStringIndex(query, -1); len(settingsIndex) > 0 {
+			insertPosition := settingsIndex[len(settingsIndex)-1][1]
+			query = query[:insertPosition] + fmt.Sprintf("storage_policy = '%s', ", newPolicy) + query[insertPosition:]
+		} else {
+			query = strings.TrimRight(query, "; \t\r\n") + fmt.Sprintf(" SETTINGS storage_policy = '%s'", newPolicy)
+		}
+		if ttlToDiskRE.MatchString(query) {
+			log.Warnf("%s.%s TTL contains TO DISK or TO VOLUME, they shall exist in new storage policy", table.Database, table.Table)
+		}
+		tables[i].Query = query
+	}
+}
+
+var createObjectRE = regexp.MustCompile(`^(CREATE|ATTACH)\s+(TABLE|DICTIONARY|VIEW|MATERIALIZED\s+VIEW|LIVE\s+VIEW|WINDOW\s+VIEW)\s+`)
+var ifNotExistsRE = regexp.MustCompile(`^IF\s+NOT\s+EXISTS\s`)
+
+// addIfNotExistsToCreateQuery - add IF NOT EXISTS after object type keyword, CREATE OR REPLACE queries are not changed
+func addIfNotExistsToCreateQuery(query string) string {
+	matches := createObjectRE.FindStringSubmatchIndex(query)
+	if matches == nil || ifNotExistsRE.MatchString(query[matches[1]:]) {
+		return query
+	}
+	return query[:matches[1]] + "IF NOT EXISTS " + query[matches[1]:]
+}
+
+var replicatedDatabaseZkPathRE = regexp.MustCompile(`(ENGINE\s*=\s*Replicated\s*\(\s*')([^']+)(')`)
+
+// changeDatabaseQueryToAdjustDatabaseMapping - rename database in CREATE DATABASE query, for Replicated database engine also rename path segments in ZooKeeper path which equal to source database name
+// to avoid new database join to replication of source database, parameters of other engines like MySQL and PostgreSQL refer remote database and kept as is
+func changeDatabaseQueryToAdjustDatabaseMapping(query, sourceDB, targetDB string) string {
+	query = CreateDatabaseRE.ReplaceAllString(query, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS ${1}`%s`${3}", targetDB))
+	if sourceDB == targetDB {
+		return query
+	}
+	return replicatedDatabaseZkPathRE.ReplaceAllStringFunc(query, func(engine string) string {
+		matches := replicatedDatabaseZkPathRE.FindStringSubmatch(engine)
+		zkPathSegments := strings.Split(matches[2], "/")
+		for i, segment := range zkPathSegments {
+			if segment == sourceDB {
+				zkPathSegments[i] = targetDB
+			}
+		}
+		return matches[1] + strings.Join(zkPathSegments, "/") + matches[3]
+	})
+}
+
 func filterPartsAndFilesByPartitionsFilter(tableMetadata metadata.TableMetadata, partitionsFilter common.EmptyMap) {
 	if len(partitionsFilter) > 0 {
 		for disk, parts := range tableMetadata.Parts {
@@ -240,6 +1040,68 @@ func filterPartsAndFilesByPartitionsFilter(tableMetadata metadata.TableMetadata,
 	}
 }
 
+// filterPartsByLastPartitions - keep only parts from lastPartitions lexicographically highest partition ids, for date based partitioning it means the most recent partitions
+func filterPartsByLastPartitions(tableMetadata metadata.TableMetadata, lastPartitions int) {
+	if lastPartitions <= 0 {
+		return
+	}
+	partitionIds := common.EmptyMap{}
+	for _, parts := range tableMetadata.Parts {
+		for _, part := range parts {
+			partitionIds[strings.Split(part.Name, "_")[0]] = struct{}{}
+		}
+	}
+	if len(partitionIds) <= lastPartitions {
+		return
+	}
+	sortedPartitionIds := make([]string, 0, len(partitionIds))
+	for partitionId := range partitionIds {
+		sortedPartitionIds = append(sortedPartitionIds, partitionId)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sortedPartitionIds)))
+	partitionsFilter := common.EmptyMap{}
+	for _, partitionId := range sortedPartitionIds[:lastPartitions] {
+		partitionsFilter[partitionId] = struct{}{}
+	}
+	filterPartsAndFilesByPartitionsFilter(tableMetadata, partitionsFilter)
+}
+
+// filterPartsByNames - keep only parts with names from partNames, tables without such parts excluded, return error when some part absent in all tables
+func filterPartsByNames(tables ListOfTables, partNames []string, backupName string) (ListOfTables, error) {
+	isFound := make(map[string]bool, len(partNames))
+	for _, name := range partNames {
+		isFound[strings.TrimSpace(name)] = false
+	}
+	var result ListOfTables
+	for _, table := range tables {
+		filteredParts := map[string][]metadata.Part{}
+		for disk, parts := range table.Parts {
+			for _, part := range parts {
+				if _, exists := isFound[part.Name]; exists {
+					isFound[part.Name] = true
+					filteredParts[disk] = append(filteredParts[disk], part)
+				}
+			}
+		}
+		if len(filteredParts) == 0 {
+			continue
+		}
+		table.Parts = filteredParts
+		result = append(result, table)
+	}
+	var notFoundParts []string
+	for name, found := range isFound {
+		if !found {
+			notFoundParts = append(notFoundParts, name)
+		}
+	}
+	if len(notFoundParts) > 0 {
+		sort.Strings(notFoundParts)
+		return nil, fmt.Errorf("parts %s not found in backup '%s' metadata for matched tables", strings.Join(notFoundParts, ", "), backupName)
+	}
+	return result, nil
+}
+
 func getTableListByPatternRemote(ctx context.Context, b *Backuper, remoteBackupMetadata *metadata.BackupMetadata, tablePattern string, dropTable bool) (ListOfTables, error) {
 	result := ListOfTables{}
 	tablePatterns := []string{"*"}
@@ -351,6 +1213,11 @@ func IsInformationSchema(database string) bool {
 	return false
 }
 
+// IsSystemDatabase - virtual and system databases which shall be excluded from `restore_database_mapping`
+func IsSystemDatabase(database string) bool {
+	return database == "system" || IsInformationSchema(database)
+}
+
 func ShallSkipDatabase(cfg *config.Config, targetDB, tablePattern string) bool {
 	if tablePattern != "" {
 		var bypassTablePatterns []string
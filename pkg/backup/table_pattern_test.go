@@ -0,0 +1,358 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeDictionaryQueryToAdjustSourceMapping(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "ch_dict", Query: "CREATE DICTIONARY db.ch_dict (`id` UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(HOST 'old-host' PORT 9000 USER 'default' TABLE 'src' PASSWORD '[HIDDEN]' DB 'db')) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())"},
+		{Database: "db", Table: "mysql_dict", Query: "CREATE DICTIONARY db.mysql_dict (`id` UInt64) PRIMARY KEY id SOURCE(MYSQL(PORT 3306 USER 'root' PASSWORD '' REPLICA(HOST 'mysql' PRIORITY 1) DB 'db' TABLE 'src')) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())"},
+		{Database: "db", Table: "http_dict", Query: "CREATE DICTIONARY db.http_dict (`id` UInt64) PRIMARY KEY id SOURCE(HTTP(URL 'http://old:8080/dict.tsv' FORMAT 'TabSeparated' CREDENTIALS(USER 'u' PASSWORD 'p'))) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())"},
+		{Database: "db", Table: "table", Query: "CREATE TABLE db.table (`host` String) ENGINE = MergeTree ORDER BY host"},
+	}
+	changeDictionaryQueryToAdjustSourceMapping(tables, map[string]string{
+		"host":                "new-host",
+		"password":            "it's secret",
+		"clickhouse.port":     "9440",
+		"mysql.host":          "new-mysql",
+		"http.url":            "https://new:8443/dict.tsv",
+		"http.password":       "http-secret",
+		"postgresql.password": "unused",
+	})
+	assert.Equal(t, "CREATE DICTIONARY db.ch_dict (`id` UInt64) PRIMARY KEY id SOURCE(CLICKHOUSE(HOST 'new-host' PORT 9440 USER 'default' TABLE 'src' PASSWORD 'it\\'s secret' DB 'db')) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())", tables[0].Query)
+	assert.Equal(t, "CREATE DICTIONARY db.mysql_dict (`id` UInt64) PRIMARY KEY id SOURCE(MYSQL(PORT 3306 USER 'root' PASSWORD 'it\\'s secret' REPLICA(HOST 'new-mysql' PRIORITY 1) DB 'db' TABLE 'src')) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())", tables[1].Query)
+	assert.Equal(t, "CREATE DICTIONARY db.http_dict (`id` UInt64) PRIMARY KEY id SOURCE(HTTP(URL 'https://new:8443/dict.tsv' FORMAT 'TabSeparated' CREDENTIALS(USER 'u' PASSWORD 'http-secret'))) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())", tables[2].Query)
+	assert.Equal(t, "CREATE TABLE db.table (`host` String) ENGINE = MergeTree ORDER BY host", tables[3].Query)
+}
+
+func TestReplaceDictionarySourceWithNull(t *testing.T) {
+	query, isReplaced := replaceDictionarySourceWithNull("CREATE DICTIONARY db.mysql_dict (`id` UInt64) PRIMARY KEY id SOURCE(MYSQL(PORT 3306 USER 'root' PASSWORD ')' REPLICA(HOST 'mysql' PRIORITY 1) DB 'db' TABLE 'src')) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())")
+	assert.True(t, isReplaced)
+	assert.Equal(t, "CREATE DICTIONARY db.mysql_dict (`id` UInt64) PRIMARY KEY id SOURCE(NULL()) LIFETIME(MIN 0 MAX 1000) LAYOUT(FLAT())", query)
+	query, isReplaced = replaceDictionarySourceWithNull("CREATE TABLE db.table (`source` String) ENGINE = MergeTree ORDER BY source")
+	assert.False(t, isReplaced)
+	assert.Equal(t, "CREATE TABLE db.table (`source` String) ENGINE = MergeTree ORDER BY source", query)
+}
+
+func TestFilterPartsByLastPartitions(t *testing.T) {
+	tableMetadata := metadata.TableMetadata{
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "20230101_1_1_0"}, {Name: "20230103_3_3_0"}},
+			"hdd":     {{Name: "20230102_2_2_0"}, {Name: "20230103_4_4_0"}},
+		},
+	}
+	filterPartsByLastPartitions(tableMetadata, 2)
+	assert.Equal(t, []metadata.Part{{Name: "20230103_3_3_0"}}, tableMetadata.Parts["default"])
+	assert.Equal(t, []metadata.Part{{Name: "20230102_2_2_0"}, {Name: "20230103_4_4_0"}}, tableMetadata.Parts["hdd"])
+}
+
+func TestFilterPartsByNames(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "t1", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}}, "hdd": {{Name: "all_3_3_0"}}}},
+		{Database: "db", Table: "t2", Parts: map[string][]metadata.Part{"default": {{Name: "all_4_4_0"}}}},
+	}
+	filtered, err := filterPartsByNames(tables, []string{"all_2_2_0"}, "backup")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(filtered))
+	assert.Equal(t, map[string][]metadata.Part{"default": {{Name: "all_2_2_0"}}}, filtered[0].Parts)
+	_, err = filterPartsByNames(tables, []string{"all_2_2_0", "all_9_9_0"}, "backup")
+	assert.EqualError(t, err, "parts all_9_9_0 not found in backup 'backup' metadata for matched tables")
+}
+
+func TestChangeDatabaseQueryToAdjustDatabaseMapping(t *testing.T) {
+	testCases := []struct {
+		query    string
+		targetDB string
+		expected string
+	}{
+		{
+			query:    "CREATE DATABASE db ENGINE = Replicated('/clickhouse/databases/db', '{shard}', '{replica}')",
+			targetDB: "db_copy",
+			expected: "CREATE DATABASE IF NOT EXISTS `db_copy` ENGINE = Replicated('/clickhouse/databases/db_copy', '{shard}', '{replica}')",
+		},
+		{
+			query:    "CREATE DATABASE db ENGINE = Replicated('/clickhouse/databases/db', '{shard}', '{replica}')",
+			targetDB: "db",
+			expected: "CREATE DATABASE IF NOT EXISTS `db` ENGINE = Replicated('/clickhouse/databases/db', '{shard}', '{replica}')",
+		},
+		{
+			query:    "CREATE DATABASE db ENGINE = Replicated('/clickhouse/db_path/{uuid}', '{shard}', '{replica}')",
+			targetDB: "db_copy",
+			expected: "CREATE DATABASE IF NOT EXISTS `db_copy` ENGINE = Replicated('/clickhouse/db_path/{uuid}', '{shard}', '{replica}')",
+		},
+		{
+			query:    "CREATE DATABASE db ENGINE = MySQL('mysql:3306', 'db', 'root', 'root')",
+			targetDB: "db_copy",
+			expected: "CREATE DATABASE IF NOT EXISTS `db_copy` ENGINE = MySQL('mysql:3306', 'db', 'root', 'root')",
+		},
+		{
+			query:    "CREATE DATABASE db ENGINE = PostgreSQL('pgsql:5432', 'db', 'root', 'root', 'public')",
+			targetDB: "db_copy",
+			expected: "CREATE DATABASE IF NOT EXISTS `db_copy` ENGINE = PostgreSQL('pgsql:5432', 'db', 'root', 'root', 'public')",
+		},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, changeDatabaseQueryToAdjustDatabaseMapping(tc.query, "db", tc.targetDB))
+	}
+}
+
+func TestChangeTableQueryToAdjustStoragePolicyMapping(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "with_policy", Query: "CREATE TABLE db.with_policy (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'single', index_granularity = 8192"},
+		{Database: "db", Table: "with_settings", Query: "CREATE TABLE db.with_settings (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192"},
+		{Database: "db", Table: "without_settings", Query: "CREATE TABLE db.without_settings (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db", Table: "with_disk", Query: "CREATE TABLE db.with_disk (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS disk = 'hdd', index_granularity = 8192"},
+		{Database: "db", Table: "log", Query: "CREATE TABLE db.log (`id` UInt64) ENGINE = Log"},
+	}
+	changeTableQueryToAdjustStoragePolicyMapping(tables, map[string]string{"single": "tiered", "default": "tiered"}, apexLog.WithField("logger", "test"))
+	assert.Equal(t, "CREATE TABLE db.with_policy (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'tiered', index_granularity = 8192", tables[0].Query)
+	assert.Equal(t, "CREATE TABLE db.with_settings (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'tiered', index_granularity = 8192", tables[1].Query)
+	assert.Equal(t, "CREATE TABLE db.without_settings (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS storage_policy = 'tiered'", tables[2].Query)
+	assert.Equal(t, "CREATE TABLE db.with_disk (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS disk = 'hdd', index_granularity = 8192", tables[3].Query)
+	assert.Equal(t, "CREATE TABLE db.log (`id` UInt64) ENGINE = Log", tables[4].Query)
+}
+
+func TestAddIfNotExistsToCreateQuery(t *testing.T) {
+	testCases := map[string]string{
+		"CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id":                    "CREATE TABLE IF NOT EXISTS db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id",
+		"CREATE TABLE IF NOT EXISTS db.t (`id` UInt64) ENGINE = Log":                        "CREATE TABLE IF NOT EXISTS db.t (`id` UInt64) ENGINE = Log",
+		"CREATE DICTIONARY db.d (`id` UInt64) PRIMARY KEY id SOURCE(NULL()) LAYOUT(FLAT())": "CREATE DICTIONARY IF NOT EXISTS db.d (`id` UInt64) PRIMARY KEY id SOURCE(NULL()) LAYOUT(FLAT())",
+		"CREATE VIEW db.v AS SELECT 1":                                                      "CREATE VIEW IF NOT EXISTS db.v AS SELECT 1",
+		"CREATE MATERIALIZED VIEW db.mv TO db.t AS SELECT 1 AS id":                          "CREATE MATERIALIZED VIEW IF NOT EXISTS db.mv TO db.t AS SELECT 1 AS id",
+		"ATTACH MATERIALIZED VIEW db.mv TO db.t AS SELECT 1 AS id":                          "ATTACH MATERIALIZED VIEW IF NOT EXISTS db.mv TO db.t AS SELECT 1 AS id",
+		"CREATE OR REPLACE VIEW db.v AS SELECT 1":                                           "CREATE OR REPLACE VIEW db.v AS SELECT 1",
+	}
+	for query, expected := range testCases {
+		assert.Equal(t, expected, addIfNotExistsToCreateQuery(query))
+	}
+}
+
+func TestChangeTableQueryToAdjustDistributedClusterMapping(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db", Table: "dist", Query: "CREATE TABLE db.dist (`id` UInt64) ENGINE = Distributed('old_cluster', 'db', 'local', rand())"},
+		{Database: "new_db", Table: "dist_mapped", Query: "CREATE TABLE new_db.dist_mapped (`id` UInt64) ENGINE = Distributed(old_cluster, new_db, local)"},
+		{Database: "db", Table: "dist_other", Query: "CREATE TABLE db.dist_other (`id` UInt64) ENGINE = Distributed('other_cluster', 'other_db', 'local')"},
+		{Database: "db", Table: "local", Query: "CREATE TABLE db.local (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+	changeTableQueryToAdjustDistributedClusterMapping(tables, map[string]string{"old_cluster": "new_cluster"}, map[string]string{"db": "new_db"}, apexLog.WithField("logger", "test"))
+	assert.Equal(t, "CREATE TABLE db.dist (`id` UInt64) ENGINE = Distributed('new_cluster', 'new_db', 'local', rand())", tables[0].Query)
+	assert.Equal(t, "CREATE TABLE new_db.dist_mapped (`id` UInt64) ENGINE = Distributed(new_cluster, new_db, local)", tables[1].Query)
+	assert.Equal(t, "CREATE TABLE db.dist_other (`id` UInt64) ENGINE = Distributed('other_cluster', 'other_db', 'local')", tables[2].Query)
+	assert.Equal(t, "CREATE TABLE db.local (`id` UInt64) ENGINE = MergeTree ORDER BY id", tables[3].Query)
+}
+
+func TestApplySchemaTransformRules(t *testing.T) {
+	rules, err := compileRegexpReplaceRules("restore_schema_transform_rules", []string{
+		`(ENGINE = MergeTree ORDER BY \S+)$->${1} TTL event_date + INTERVAL 30 DAY`,
+		`CODEC\(LZ4\)->CODEC(ZSTD(3))`,
+	})
+	assert.NoError(t, err)
+	query := "CREATE TABLE db.t (`event_date` Date CODEC(LZ4), `id` UInt64) ENGINE = MergeTree ORDER BY id"
+	assert.Equal(t, "CREATE TABLE db.t (`event_date` Date CODEC(ZSTD(3)), `id` UInt64) ENGINE = MergeTree ORDER BY id TTL event_date + INTERVAL 30 DAY", applySchemaTransformRules(query, rules))
+	// rules applied in config order, second rule see result of first
+	rules, err = compileRegexpReplaceRules("restore_schema_transform_rules", []string{"String->LowCardinality(String)", `LowCardinality\(LowCardinality\(String\)\)->LowCardinality(String)`, "LowCardinality->LC"})
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE db.t (`s` LC(String)) ENGINE = Log", applySchemaTransformRules("CREATE TABLE db.t (`s` String) ENGINE = Log", rules))
+	_, err = compileRegexpReplaceRules("restore_schema_transform_rules", []string{"(->"})
+	assert.Error(t, err)
+}
+
+func TestChangeTableQueryToAdjustTableMapping(t *testing.T) {
+	tables := ListOfTables{
+		{Database: "db1", Table: "old_events", Query: "CREATE TABLE db1.old_events UUID 'a6b0e1f2-0000-4000-8000-000000000001' (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/db1/old_events', '{replica}') ORDER BY id"},
+		{Database: "db1", Table: "other", Query: "CREATE TABLE db1.other (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+		{Database: "db1", Table: "dict", Query: "CREATE DICTIONARY `db1`.`dict` (`id` UInt64) PRIMARY KEY id SOURCE(NULL()) LIFETIME(0) LAYOUT(FLAT())"},
+	}
+	tableMapping := map[string]string{"db1.old_events": "db1.new_events", "db1.dict": "db3.new_dict"}
+	dbMapping := map[string]string{"db1": "db2"}
+	assert.NoError(t, changeTableQueryToAdjustTableMapping(&tables, tableMapping))
+	assert.Equal(t, "db1", tables[0].Database)
+	assert.Equal(t, "new_events", tables[0].Table)
+	assert.NotContains(t, tables[0].Query, "a6b0e1f2-0000-4000-8000-000000000001")
+	assert.Contains(t, tables[0].Query, "CREATE TABLE `db1`.`new_events` UUID '")
+	assert.Contains(t, tables[0].Query, "ReplicatedMergeTree('/clickhouse/tables/{shard}/db1/new_events', '{replica}')")
+	assert.Equal(t, "CREATE TABLE db1.other (`id` UInt64) ENGINE = MergeTree ORDER BY id", tables[1].Query)
+	assert.Equal(t, "CREATE DICTIONARY `db3`.`new_dict` (`id` UInt64) PRIMARY KEY id SOURCE(NULL()) LIFETIME(0) LAYOUT(FLAT())", tables[2].Query)
+
+	assert.NoError(t, changeTableQueryToAdjustDatabaseMapping(&tables, dbMapping))
+	assert.Equal(t, "db2", tables[0].Database)
+	assert.Contains(t, tables[0].Query, "CREATE TABLE `db2`.`new_events` UUID '")
+	assert.Equal(t, "db3", tables[2].Database)
+
+	dstDatabase, dstTable := getRestoreTableMappingTarget("db1", "old_events", tableMapping, dbMapping)
+	assert.Equal(t, "db2.new_events", dstDatabase+"."+dstTable)
+	dstDatabase, dstTable = getRestoreTableMappingTarget("db1", "other", tableMapping, dbMapping)
+	assert.Equal(t, "db2.other", dstDatabase+"."+dstTable)
+
+	invalid := ListOfTables{{Database: "db1", Table: "t", Query: "CREATE TABLE db1.t (`id` UInt64) ENGINE = Log"}}
+	assert.Error(t, changeTableQueryToAdjustTableMapping(&invalid, map[string]string{"db1.t": "new_t"}))
+}
+
+func TestRemoveTTLFromCreateQuery(t *testing.T) {
+	query, ok := removeTTLFromCreateQuery("CREATE TABLE db.t (`d` Date, `x` UInt64 TTL d + toIntervalDay(1), `s` String) ENGINE = MergeTree PARTITION BY d ORDER BY x TTL d + toIntervalDay(7), d + toIntervalDay(1) TO VOLUME 'cold' SETTINGS index_granularity = 8192")
+	assert.True(t, ok)
+	assert.Equal(t, "CREATE TABLE db.t (`d` Date, `x` UInt64, `s` String) ENGINE = MergeTree PARTITION BY d ORDER BY x SETTINGS index_granularity = 8192", query)
+
+	query, ok = removeTTLFromCreateQuery("CREATE TABLE db.t (`d` Date, `x` UInt64 TTL d + toIntervalDay(1)) ENGINE = MergeTree ORDER BY x TTL d + INTERVAL 1 MONTH DELETE WHERE x = 0")
+	assert.True(t, ok)
+	assert.Equal(t, "CREATE TABLE db.t (`d` Date, `x` UInt64) ENGINE = MergeTree ORDER BY x", query)
+
+	query, ok = removeTTLFromCreateQuery("CREATE MATERIALIZED VIEW db.mv (`d` Date) ENGINE = MergeTree ORDER BY d TTL d + toIntervalDay(1) AS SELECT d FROM db.t")
+	assert.True(t, ok)
+	assert.Equal(t, "CREATE MATERIALIZED VIEW db.mv (`d` Date) ENGINE = MergeTree ORDER BY d AS SELECT d FROM db.t", query)
+
+	_, ok = removeTTLFromCreateQuery("CREATE TABLE db.t (`TTL ` String COMMENT ' TTL ') ENGINE = MergeTree ORDER BY `TTL `")
+	assert.False(t, ok)
+}
+
+func TestRemoveColumnsFromCreateQuery(t *testing.T) {
+	query, removed, err := removeColumnsFromCreateQuery("CREATE TABLE db.t (`id` UInt64, `email` String, `phone` Nullable(String) COMMENT 'a, b', `name` String DEFAULT 'email') ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192", []string{"email", "phone", "absent"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"email", "phone"}, removed)
+	assert.Equal(t, "CREATE TABLE db.t (`id` UInt64, `name` String DEFAULT 'email') ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192", query)
+
+	query, removed, err = removeColumnsFromCreateQuery("CREATE TABLE db.email (`id` UInt64, `email` String, INDEX idx_id id TYPE minmax GRANULARITY 1) ENGINE = MergeTree ORDER BY id", []string{"email"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"email"}, removed)
+	assert.Equal(t, "CREATE TABLE db.email (`id` UInt64, INDEX idx_id id TYPE minmax GRANULARITY 1) ENGINE = MergeTree ORDER BY id", query)
+
+	_, _, err = removeColumnsFromCreateQuery("CREATE TABLE db.t (`id` UInt64, `email` String) ENGINE = MergeTree ORDER BY (id, email)", []string{"email"})
+	assert.Error(t, err)
+	_, _, err = removeColumnsFromCreateQuery("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id", []string{"id"})
+	assert.Error(t, err)
+
+	query, removed, err = removeColumnsFromCreateQuery("CREATE TABLE db.t AS db.src ENGINE = Distributed('cluster', 'db', 'src')", []string{"email"})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, "CREATE TABLE db.t AS db.src ENGINE = Distributed('cluster', 'db', 'src')", query)
+}
+
+func TestGetLowCardinalityColumns(t *testing.T) {
+	query := "CREATE TABLE db.t (`id` UInt64, `name` LowCardinality(String), `tags` Array(LowCardinality(Nullable(String))), `comment` String DEFAULT 'LowCardinality(', INDEX idx name TYPE set(100) GRANULARITY 1) ENGINE = MergeTree ORDER BY id"
+	assert.Equal(t, []string{"name", "tags"}, getLowCardinalityColumns(query))
+	assert.Empty(t, getLowCardinalityColumns("CREATE TABLE db.t AS db.src ENGINE = MergeTree ORDER BY id"))
+	assert.Equal(t, "SELECT count() FROM (SELECT `name`, `tags` FROM `db`.`t` LIMIT 10000) WHERE NOT ignore(`name`, `tags`)", getLowCardinalitySampleQuery(lowCardinalityTable{Database: "db", Table: "t", Columns: []string{"name", "tags"}}))
+}
+
+func TestRemoveSettingFromCreateQuery(t *testing.T) {
+	assert.Equal(t, "allow_experimental_foo", getUnknownSettingFromError(fmt.Errorf("code: 115, message: Unknown setting allow_experimental_foo: for storage MergeTree")))
+	assert.Equal(t, "allow_experimental_foo", getUnknownSettingFromError(fmt.Errorf("code: 115, message: Unknown setting 'allow_experimental_foo'")))
+	assert.Equal(t, "", getUnknownSettingFromError(fmt.Errorf("code: 57, message: Table db.t already exists")))
+
+	query := "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, allow_experimental_foo = 1, storage_policy = 'a,b'"
+	stripped, isStripped := removeSettingFromCreateQuery(query, "allow_experimental_foo")
+	assert.True(t, isStripped)
+	assert.Equal(t, "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS index_granularity = 8192, storage_policy = 'a,b'", stripped)
+
+	stripped, isStripped = removeSettingFromCreateQuery("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id SETTINGS allow_experimental_foo = 1", "allow_experimental_foo")
+	assert.True(t, isStripped)
+	assert.Equal(t, "CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id", stripped)
+
+	_, isStripped = removeSettingFromCreateQuery(query, "unknown")
+	assert.False(t, isStripped)
+}
+
+func TestNormalizeFunctionQuery(t *testing.T) {
+	expected := "CREATE FUNCTION linear_equation AS (x, k, b) -> ((k * x) + b)"
+	assert.Equal(t, expected, normalizeFunctionQuery("CREATE FUNCTION linear_equation AS (x, k, b) -> ((k * x) + b)"))
+	assert.Equal(t, expected, normalizeFunctionQuery("CREATE OR REPLACE FUNCTION linear_equation ON CLUSTER 'cluster' AS (x, k, b) ->  ((k * x) + b)"))
+	assert.NotEqual(t, expected, normalizeFunctionQuery("CREATE FUNCTION linear_equation AS (x, k, b) -> ((k * x) - b)"))
+}
+
+func TestCheckExperimentalJSONColumns(t *testing.T) {
+	assert.Equal(t, 22008005, parseClickHouseVersion("v22.8.5.29-lts"))
+	assert.Equal(t, 0, parseClickHouseVersion("unknown"))
+	tables := ListOfTables{
+		{Database: "db", Table: "plain", Query: "CREATE TABLE db.plain (`s` String DEFAULT ' JSON ') ENGINE = MergeTree ORDER BY s"},
+		{Database: "db", Table: "object", Query: "CREATE TABLE db.object (`data` Object('json')) ENGINE = MergeTree ORDER BY tuple()"},
+	}
+	assert.NoError(t, checkExperimentalJSONColumns(tables, "22.8.5.29", 22008005))
+	assert.NoError(t, checkExperimentalJSONColumns(tables, "22.8.5.29", 0))
+	assert.EqualError(t, checkExperimentalJSONColumns(tables, "22.8.5.29", 21008001), "can't restore into ClickHouse version 21008001: 'db.object' contains Object('json') column which requires ClickHouse 22.3+, upgrade ClickHouse server or exclude these tables via --tables")
+	assert.EqualError(t, checkExperimentalJSONColumns(tables, "v23.3.1.1-lts", 22008005), "can't restore into ClickHouse version 22008005: 'db.object' contains experimental JSON column created by ClickHouse v23.3.1.1-lts, serialization format could be unreadable for older version, upgrade ClickHouse server or exclude these tables via --tables")
+
+	tables = ListOfTables{{Database: "db", Table: "json", Query: "CREATE TABLE db.json (`id` UInt64, `data` JSON(max_dynamic_paths = 16)) ENGINE = MergeTree ORDER BY id"}}
+	assert.Error(t, checkExperimentalJSONColumns(tables, "24.8.1.1", 24003001))
+	assert.NoError(t, checkExperimentalJSONColumns(tables, "24.8.1.1", 24008001))
+}
+
+func TestGetCodecNames(t *testing.T) {
+	assert.Equal(t, []string{"Delta", "ZSTD", "LZ4HC"}, getCodecNames("CREATE TABLE db.t (`id` UInt64 CODEC(Delta(8), ZSTD(3)), `s` String CODEC(LZ4HC(9))) ENGINE = MergeTree ORDER BY id"))
+	assert.Equal(t, []string{"ZSTD"}, getCodecNames("CODEC(ZSTD(1))\n"))
+	assert.Empty(t, getCodecNames("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id"))
+}
+
+func TestGetSkipIndexNames(t *testing.T) {
+	assert.Equal(t, []string{"idx_s", "idx with space"}, getSkipIndexNames("CREATE TABLE db.t (`id` UInt64, `s` String, INDEX idx_s s TYPE bloom_filter GRANULARITY 1, INDEX `idx with space` id * 2 TYPE minmax GRANULARITY 4) ENGINE = MergeTree ORDER BY id"))
+	assert.Empty(t, getSkipIndexNames("CREATE TABLE db.t (`INDEX` UInt64) ENGINE = MergeTree ORDER BY `INDEX`"))
+}
+
+func TestGetReplicatedZookeeperPath(t *testing.T) {
+	zkPath, replica, ok := getReplicatedZookeeperPath("CREATE TABLE db.t UUID '5b2d3c7e-0000-4000-8000-000000000001' (`id` UInt64) ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/{database}/{table}/{uuid}', '{replica}') ORDER BY id", "db", "t")
+	assert.True(t, ok)
+	assert.Equal(t, "/clickhouse/tables/{shard}/db/t/5b2d3c7e-0000-4000-8000-000000000001", zkPath)
+	assert.Equal(t, "{replica}", replica)
+	assert.Equal(t, []string{"{shard}", "{replica}"}, getUndefinedMacros(zkPath+replica))
+
+	_, _, ok = getReplicatedZookeeperPath("CREATE TABLE db.t (`id` UInt64) ENGINE = ReplicatedMergeTree ORDER BY id", "db", "t")
+	assert.False(t, ok)
+	_, _, ok = getReplicatedZookeeperPath("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id", "db", "t")
+	assert.False(t, ok)
+}
+
+func TestChangeTableQueryToAdjustZookeeperPathMapping(t *testing.T) {
+	rules, err := compileZookeeperPathMapping([]string{"^/clickhouse/tables/old/->/clickhouse/tables/new/"})
+	assert.NoError(t, err)
+	tables := ListOfTables{
+		{Database: "db", Table: "t1", Query: "CREATE TABLE db.t1 (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/old/{database}/{table}', '{replica}') ORDER BY id"},
+		{Database: "db", Table: "t2", Query: "CREATE TABLE db.t2 (`id` UInt64) ENGINE = MergeTree ORDER BY id"},
+	}
+	changedTables, err := changeTableQueryToAdjustZookeeperPathMapping(tables, rules, apexLog.WithField("logger", "test"))
+	assert.NoError(t, err)
+	assert.Equal(t, ListOfTables{tables[0]}, changedTables)
+	assert.Equal(t, "CREATE TABLE db.t1 (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/new/{database}/{table}', '{replica}') ORDER BY id", tables[0].Query)
+	assert.Equal(t, "CREATE TABLE db.t2 (`id` UInt64) ENGINE = MergeTree ORDER BY id", tables[1].Query)
+
+	rules, err = compileZookeeperPathMapping([]string{"/(a|b)$->/shared"})
+	assert.NoError(t, err)
+	tables = ListOfTables{
+		{Database: "db", Table: "a", Query: "CREATE TABLE db.a (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/a', 'r1') ORDER BY id"},
+		{Database: "db", Table: "b", Query: "CREATE TABLE db.b (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/b', 'r1') ORDER BY id"},
+	}
+	_, err = changeTableQueryToAdjustZookeeperPathMapping(tables, rules, apexLog.WithField("logger", "test"))
+	assert.Error(t, err)
+
+	_, err = compileZookeeperPathMapping([]string{"/clickhouse/tables/old"})
+	assert.Error(t, err)
+}
+
+func TestGetColumnTypeDiff(t *testing.T) {
+	backupTypes := getColumnTypes("CREATE TABLE db.t (`id` Int32 CODEC(Delta(4), ZSTD(1)), `dt` DateTime64(3, 'UTC') DEFAULT now64(), `s` Nullable(String) COMMENT 'not null', `m` Map(String, UInt64), INDEX idx id TYPE minmax GRANULARITY 1) ENGINE = MergeTree ORDER BY id")
+	assert.Equal(t, map[string]string{"id": "Int32", "dt": "DateTime64(3, 'UTC')", "s": "Nullable(String)", "m": "Map(String, UInt64)"}, backupTypes)
+	assert.Equal(t, []string{"`id` Int32 in backup, Int64 in destination table"}, getColumnTypeDiff(backupTypes, map[string]string{"id": "Int64", "dt": "DateTime64(3,'UTC')", "m": "Map(String, UInt64)"}))
+	assert.Empty(t, getColumnTypes("CREATE TABLE db.t AS db.src ENGINE = MergeTree ORDER BY id"))
+}
+
+func TestGetAggregateFunctionColumns(t *testing.T) {
+	query := "CREATE TABLE db.t (`id` UInt64, `u` AggregateFunction(uniqIf, String, UInt8), `q` AggregateFunction(quantiles(0.5, 0.9), Float64), `s` SimpleAggregateFunction(sum, UInt64), `m` AggregateFunction(1, sumMap, Array(UInt8), Array(UInt64)), `c` String DEFAULT 'AggregateFunction(fake)') ENGINE = AggregatingMergeTree ORDER BY id"
+	assert.Equal(t, []aggregateFunctionColumn{
+		{Column: "m", Function: "sumMap"},
+		{Column: "q", Function: "quantiles"},
+		{Column: "s", Function: "sum", IsSimple: true},
+		{Column: "u", Function: "uniqIf"},
+	}, getAggregateFunctionColumns(query))
+}
+
+func TestGetTableSortingKey(t *testing.T) {
+	assert.Equal(t, "(id,toDate(ts))", getTableSortingKey("CREATE TABLE db.t (`id` UInt64, `ts` DateTime, INDEX idx id TYPE minmax GRANULARITY 1) ENGINE = ReplicatedMergeTree('/clickhouse/{shard}/t', '{replica}') PARTITION BY toYYYYMM(ts) ORDER BY (id, toDate(ts)) SETTINGS index_granularity = 8192"))
+	assert.Equal(t, "id", getTableSortingKey("CREATE TABLE db.t (`id` UInt64, `ts` DateTime) ENGINE = MergeTree ORDER BY (id) TTL ts + INTERVAL 1 DAY"))
+	assert.Equal(t, "id", getTableSortingKey("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY id"))
+	assert.Equal(t, "(id)+(1)", getTableSortingKey("CREATE TABLE db.t (`id` UInt64) ENGINE = MergeTree ORDER BY (id) + (1)"))
+	assert.Equal(t, "", getTableSortingKey("CREATE TABLE db.t (`id` UInt64) ENGINE = Log"))
+}
@@ -89,6 +89,13 @@ func (b *Backuper) Upload(backupName, diffFrom, diffFromRemote, tablePattern str
 	if err != nil {
 		return err
 	}
+	// backup created with `create_local_incremental` doesn't contain parts required from base backup
+	if backupMetadata.RequiredBackup != "" {
+		if (diffFrom != "" && diffFrom != backupMetadata.RequiredBackup) || (diffFromRemote != "" && diffFromRemote != backupMetadata.RequiredBackup) {
+			return fmt.Errorf("'%s' is local increment for '%s', can't upload it with another diff-from backup", backupName, backupMetadata.RequiredBackup)
+		}
+		log.Infof("'%s' is local increment, '%s' shall be uploaded before restore from remote storage", backupName, backupMetadata.RequiredBackup)
+	}
 	var tablesForUpload ListOfTables
 	b.isEmbedded = strings.Contains(backupMetadata.Tags, "embedded")
 
@@ -644,7 +651,7 @@ func (b *Backuper) markDuplicatedParts(backup *metadata.BackupMetadata, existsTa
 					existsPath := path.Join(b.DiskToPathMap[disk], "backup", backup.RequiredBackup, "shadow", dbAndTablePath, disk, newParts[i].Name)
 					newPath := path.Join(b.DiskToPathMap[disk], "backup", backup.BackupName, "shadow", dbAndTablePath, disk, newParts[i].Name)
 
-					if err := filesystemhelper.IsDuplicatedParts(existsPath, newPath); err != nil {
+					if err := filesystemhelper.IsDuplicatedParts(existsPath, newPath, b.cfg.General.ComparePartsByContent); err != nil {
 						log.Debugf("part '%s' and '%s' must be the same: %v", existsPath, newPath, err)
 						continue
 					}
@@ -9,7 +9,24 @@ func GetBackupsToDelete(backups []LocalBackup, keep int) []LocalBackup {
 		sort.SliceStable(backups, func(i, j int) bool {
 			return backups[i].CreationDate.After(backups[j].CreationDate)
 		})
-		return backups[keep:]
+		// local incremental backups created with `create_local_incremental` require parts from base backups
+		deletedBackups := append([]LocalBackup{}, backups[keep:]...)
+		var findRequiredBackup func(b LocalBackup)
+		findRequiredBackup = func(b LocalBackup) {
+			if b.RequiredBackup != "" {
+				for i, deletedBackup := range deletedBackups {
+					if b.RequiredBackup == deletedBackup.BackupName {
+						deletedBackups = append(deletedBackups[:i], deletedBackups[i+1:]...)
+						findRequiredBackup(deletedBackup)
+						break
+					}
+				}
+			}
+		}
+		for _, b := range backups[:keep] {
+			findRequiredBackup(b)
+		}
+		return deletedBackups
 	}
 	return []LocalBackup{}
 }
@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBackupsToDeleteWithRequiredBackup(t *testing.T) {
+	creationDate := time.Date(2019, 3, 28, 19, 50, 0, 0, time.UTC)
+	testData := []LocalBackup{
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "3", RequiredBackup: "2", CreationDate: creationDate.Add(3 * time.Second)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "1", CreationDate: creationDate.Add(1 * time.Second)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "4", CreationDate: creationDate.Add(4 * time.Second)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "2", RequiredBackup: "1", CreationDate: creationDate.Add(2 * time.Second)}},
+		{BackupMetadata: metadata.BackupMetadata{BackupName: "0", CreationDate: creationDate}},
+	}
+	var deletedNames []string
+	for _, b := range GetBackupsToDelete(testData, 2) {
+		deletedNames = append(deletedNames, b.BackupName)
+	}
+	assert.Equal(t, []string{"0"}, deletedNames)
+	assert.Equal(t, []LocalBackup{}, GetBackupsToDelete(testData[:1], 2))
+}
@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/status"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	apexLog "github.com/apex/log"
+)
+
+// ValidateBackupPart - data part which is absent in `shadow` folder or absent in table metadata
+type ValidateBackupPart struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Disk     string `json:"disk"`
+	Part     string `json:"part"`
+	Path     string `json:"path"`
+}
+
+// ValidateBackupReport - result of local backup consistency check
+type ValidateBackupReport struct {
+	BackupName      string                `json:"backup_name"`
+	MissingMetadata []metadata.TableTitle `json:"missing_metadata,omitempty"`
+	MissingDisks    []string              `json:"missing_disks,omitempty"`
+	MissingParts    []ValidateBackupPart  `json:"missing_parts,omitempty"`
+	ExtraParts      []ValidateBackupPart  `json:"extra_parts,omitempty"`
+}
+
+// IsValid - true when backup has no missing metadata, disks and parts, extra parts don't break restore
+func (r *ValidateBackupReport) IsValid() bool {
+	return len(r.MissingMetadata) == 0 && len(r.MissingDisks) == 0 && len(r.MissingParts) == 0
+}
+
+// Validate - check local backup consistency from command line, print report to stdout
+func (b *Backuper) Validate(backupName string, commandId int) error {
+	ctx, cancel, err := status.Current.GetContextWithCancel(commandId)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	report, err := b.ValidateBackup(ctx, backupName)
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	if !report.IsValid() {
+		return fmt.Errorf("backup '%s' is broken, can't restore it", report.BackupName)
+	}
+	return nil
+}
+
+// ValidateBackup - check metadata.json, table metadata and `shadow` data parts of local backup are consistent with each other
+func (b *Backuper) ValidateBackup(ctx context.Context, backupName string) (*ValidateBackupReport, error) {
+	backupName = utils.CleanBackupNameRE.ReplaceAllString(backupName, "")
+	log := b.log.WithField("logger", "ValidateBackup").WithField("backup", backupName)
+	if !b.ch.IsOpen {
+		if err := b.ch.Connect(); err != nil {
+			return nil, fmt.Errorf("can't connect to clickhouse: %v", err)
+		}
+		defer b.ch.Close()
+	}
+	disks, err := b.ch.GetDisks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defaultDataPath, err := b.ch.GetDefaultPath(disks)
+	if err != nil {
+		return nil, ErrUnknownClickhouseDataPath
+	}
+	diskMap := map[string]string{}
+	for _, disk := range disks {
+		diskMap[disk.Name] = disk.Path
+	}
+	return validateBackupFiles(ctx, backupName, path.Join(defaultDataPath, "backup", backupName), diskMap, log)
+}
+
+// validateBackupFiles - compare table metadata parts with `shadow` folders on each disk, diskMap contains disk paths by disk names
+func validateBackupFiles(ctx context.Context, backupName, backupPath string, diskMap map[string]string, log *apexLog.Entry) (*ValidateBackupReport, error) {
+	backupMetadataBody, err := os.ReadFile(path.Join(backupPath, "metadata.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s doesn't contain metadata.json, legacy and embedded backups can't be validated", backupPath)
+		}
+		return nil, err
+	}
+	backupMetadata := metadata.BackupMetadata{}
+	if err := json.Unmarshal(backupMetadataBody, &backupMetadata); err != nil {
+		return nil, err
+	}
+	report := &ValidateBackupReport{BackupName: backupName}
+	missingDisks := common.EmptyMap{}
+	for _, tableTitle := range backupMetadata.Tables {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		dbAndTablePath := path.Join(common.TablePathEncode(tableTitle.Database), common.TablePathEncode(tableTitle.Table))
+		tableMetadataPath := path.Join(backupPath, "metadata", dbAndTablePath+".json")
+		var tableMetadata metadata.TableMetadata
+		if _, err := tableMetadata.Load(tableMetadataPath); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			log.Warnf("%s not found", tableMetadataPath)
+			report.MissingMetadata = append(report.MissingMetadata, tableTitle)
+			continue
+		}
+		if tableMetadata.MetadataOnly {
+			continue
+		}
+		for disk, parts := range tableMetadata.Parts {
+			diskPath, diskExists := diskMap[disk]
+			if !diskExists {
+				if _, isReported := missingDisks[disk]; !isReported {
+					log.Warnf("disk '%s' not found in system.disks and `disk_mapping`", disk)
+					missingDisks[disk] = struct{}{}
+					report.MissingDisks = append(report.MissingDisks, disk)
+				}
+				continue
+			}
+			partsPath := path.Join(diskPath, "backup", backupName, "shadow", dbAndTablePath, disk)
+			// Legacy backup support
+			if _, err := os.Stat(partsPath); os.IsNotExist(err) {
+				partsPath = path.Join(diskPath, "backup", backupName, "shadow", dbAndTablePath)
+			}
+			metadataParts := common.EmptyMap{}
+			for _, part := range parts {
+				metadataParts[part.Name] = struct{}{}
+				partPath := path.Join(partsPath, part.Name)
+				if info, err := os.Stat(partPath); err != nil || !info.IsDir() {
+					if err != nil && !os.IsNotExist(err) {
+						return nil, err
+					}
+					log.Warnf("part %s not found", partPath)
+					report.MissingParts = append(report.MissingParts, ValidateBackupPart{
+						Database: tableMetadata.Database,
+						Table:    tableMetadata.Table,
+						Disk:     disk,
+						Part:     part.Name,
+						Path:     partPath,
+					})
+				}
+			}
+			entries, err := os.ReadDir(partsPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, entry := range entries {
+				if _, isMetadataPart := metadataParts[entry.Name()]; isMetadataPart || !entry.IsDir() || entry.Name() == disk {
+					continue
+				}
+				log.Warnf("part %s not found in %s", path.Join(partsPath, entry.Name()), tableMetadataPath)
+				report.ExtraParts = append(report.ExtraParts, ValidateBackupPart{
+					Database: tableMetadata.Database,
+					Table:    tableMetadata.Table,
+					Disk:     disk,
+					Part:     entry.Name(),
+					Path:     path.Join(partsPath, entry.Name()),
+				})
+			}
+		}
+	}
+	return report, nil
+}
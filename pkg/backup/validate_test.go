@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBackupFiles(t *testing.T) {
+	log := apexLog.WithField("logger", "test")
+	dataPath := t.TempDir()
+	backupPath := path.Join(dataPath, "backup", "backup1")
+	writeJSON := func(filePath string, v interface{}) {
+		assert.NoError(t, os.MkdirAll(path.Dir(filePath), 0755))
+		body, err := json.Marshal(v)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filePath, body, 0644))
+	}
+	writeJSON(path.Join(backupPath, "metadata.json"), metadata.BackupMetadata{
+		BackupName: "backup1",
+		Tables: []metadata.TableTitle{
+			{Database: "db", Table: "t1"},
+			{Database: "db", Table: "absent"},
+			{Database: "db", Table: "view"},
+		},
+	})
+	writeJSON(path.Join(backupPath, "metadata", "db", "t1.json"), metadata.TableMetadata{
+		Database: "db",
+		Table:    "t1",
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}},
+			"s3":      {{Name: "all_3_3_0"}},
+		},
+	})
+	writeJSON(path.Join(backupPath, "metadata", "db", "view.json"), metadata.TableMetadata{Database: "db", Table: "view", MetadataOnly: true})
+	shadowPath := path.Join(backupPath, "shadow", "db", "t1", "default")
+	for _, part := range []string{"all_1_1_0", "all_4_4_0"} {
+		assert.NoError(t, os.MkdirAll(path.Join(shadowPath, part), 0755))
+	}
+
+	report, err := validateBackupFiles(context.Background(), "backup1", backupPath, map[string]string{"default": dataPath}, log)
+	assert.NoError(t, err)
+	assert.False(t, report.IsValid())
+	assert.Equal(t, []metadata.TableTitle{{Database: "db", Table: "absent"}}, report.MissingMetadata)
+	assert.Equal(t, []string{"s3"}, report.MissingDisks)
+	assert.Equal(t, []ValidateBackupPart{{Database: "db", Table: "t1", Disk: "default", Part: "all_2_2_0", Path: path.Join(shadowPath, "all_2_2_0")}}, report.MissingParts)
+	assert.Equal(t, []ValidateBackupPart{{Database: "db", Table: "t1", Disk: "default", Part: "all_4_4_0", Path: path.Join(shadowPath, "all_4_4_0")}}, report.ExtraParts)
+
+	// extra parts don't break restore
+	assert.True(t, (&ValidateBackupReport{ExtraParts: report.ExtraParts}).IsValid())
+
+	_, err = validateBackupFiles(context.Background(), "absent", path.Join(dataPath, "backup", "absent"), map[string]string{"default": dataPath}, log)
+	assert.ErrorContains(t, err, "doesn't contain metadata.json")
+}
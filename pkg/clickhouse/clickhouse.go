@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -33,6 +34,8 @@ type ClickHouse struct {
 	disks   []Disk
 	version int
 	IsOpen  bool
+	// SessionSettings - settings sent with each query, connection pool doesn't keep SET between queries
+	SessionSettings map[string]string
 }
 
 // Connect - establish connection to ClickHouse
@@ -105,6 +108,12 @@ func (ch *ClickHouse) Connect() error {
 	if !ch.Config.LogSQLQueries {
 		params.Add("log_queries", "0")
 	}
+	if err = config.CheckSessionSettings("session settings", ch.SessionSettings); err != nil {
+		return err
+	}
+	for name, value := range ch.SessionSettings {
+		params.Set(name, value)
+	}
 	connectionString := fmt.Sprintf("tcp://%v:%v?%s", ch.Config.Host, ch.Config.Port, params.Encode())
 	if ch.conn, err = sqlx.Open("clickhouse", connectionString); err != nil {
 		ch.Log.Errorf("clickhouse connection: %s, sql.Open return error: %v", fmt.Sprintf("tcp://%v:%v", ch.Config.Host, ch.Config.Port), err)
@@ -126,9 +135,51 @@ func (ch *ClickHouse) Connect() error {
 		ch.IsOpen = true
 	}
 	logFunc("clickhouse connection open: %s", fmt.Sprintf("tcp://%v:%v", ch.Config.Host, ch.Config.Port))
+	if len(ch.SessionSettings) > 0 {
+		for _, name := range ch.GetNotAppliedSessionSettings() {
+			ch.Log.Warnf("session setting %s=%s is not applied, clickhouse-go driver doesn't support it or server doesn't know it", name, ch.SessionSettings[name])
+		}
+	}
 	return err
 }
 
+// GetNotAppliedSessionSettings - clickhouse-go pass only known settings from connection string to server, other settings silently ignored
+func (ch *ClickHouse) GetNotAppliedSessionSettings() []string {
+	settings := make([]struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}, 0)
+	if err := ch.conn.Select(&settings, "SELECT name, value FROM system.settings WHERE changed"); err != nil {
+		ch.Log.Warnf("can't check session settings: %v", err)
+		return nil
+	}
+	appliedSettings := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		appliedSettings[setting.Name] = setting.Value
+	}
+	var notApplied []string
+	for name, value := range ch.SessionSettings {
+		if appliedValue, isApplied := appliedSettings[name]; isApplied {
+			ch.Log.Debugf("session setting %s=%s", name, appliedValue)
+			continue
+		}
+		if defaultValue := ch.getSettingValue(name); defaultValue == value || (defaultValue == "0" && value == "false") || (defaultValue == "1" && value == "true") {
+			continue
+		}
+		notApplied = append(notApplied, name)
+	}
+	sort.Strings(notApplied)
+	return notApplied
+}
+
+func (ch *ClickHouse) getSettingValue(name string) string {
+	values := make([]string, 0)
+	if err := ch.conn.Select(&values, "SELECT value FROM system.settings WHERE name=?", name); err != nil || len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
 // GetDisks - return data from system.disks table
 func (ch *ClickHouse) GetDisks(ctx context.Context) ([]Disk, error) {
 	version, err := ch.GetVersion(ctx)
@@ -552,8 +603,80 @@ func (ch *ClickHouse) FreezeTable(ctx context.Context, table *Table, name string
 	return nil
 }
 
-// AttachPartitions - execute ATTACH command for specific table
-func (ch *ClickHouse) AttachPartitions(table metadata.TableMetadata, disks []Disk) error {
+// quoteString - single quoted string literal, partition ids and part names come from backup metadata and command line
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
+
+// getFreezePartitionQuery - partition ID and name quoted as string literals, they come from backup metadata
+func getFreezePartitionQuery(database, table, partitionID, name string) string {
+	return fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE PARTITION ID %s WITH NAME %s", database, table, quoteString(partitionID), quoteString(name))
+}
+
+// GetAttachPartQuery - part name quoted as string literal, it comes from backup metadata
+func GetAttachPartQuery(database, table, partName string) string {
+	return fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PART %s", database, table, quoteString(partName))
+}
+
+// FreezePartitions - execute FREEZE PARTITION ID for each partition, data hardlinked to `shadow/<name>` folder on each table disk
+func (ch *ClickHouse) FreezePartitions(ctx context.Context, database, table string, partitionIDs []string, name string) error {
+	for _, partitionID := range partitionIDs {
+		if _, err := ch.QueryContext(ctx, getFreezePartitionQuery(database, table, partitionID, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetActivePartitionIDs - partitions which contain active parts, empty when table doesn't exist
+func (ch *ClickHouse) GetActivePartitionIDs(ctx context.Context, database, table string) ([]string, error) {
+	partitionIDs := make([]string, 0)
+	if err := ch.SelectContext(ctx, &partitionIDs, "SELECT DISTINCT partition_id FROM system.parts WHERE database=? AND table=? AND active", database, table); err != nil {
+		return nil, err
+	}
+	return partitionIDs, nil
+}
+
+// InsertFromTable - copy rows of one partition with INSERT SELECT, columns matched by names, rows will re-sorted and re-compressed by destination table
+func (ch *ClickHouse) InsertFromTable(ctx context.Context, database, table, srcDatabase, srcTable string, columns []string, partitionID string) error {
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = "`" + strings.ReplaceAll(column, "`", "\\`") + "`"
+	}
+	columnList := strings.Join(quotedColumns, ", ")
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` (%s) SELECT %s FROM `%s`.`%s` WHERE _partition_id = ?", database, table, columnList, columnList, srcDatabase, srcTable)
+	_, err := ch.QueryContext(ctx, query, partitionID)
+	return err
+}
+
+// GetInsertableColumns - names of table columns in table order, MATERIALIZED, ALIAS and EPHEMERAL columns can't be inserted
+func (ch *ClickHouse) GetInsertableColumns(ctx context.Context, database, table string) ([]string, error) {
+	columns := make([]string, 0)
+	if err := ch.SelectContext(ctx, &columns, "SELECT name FROM system.columns WHERE database=? AND table=? AND default_kind NOT IN ('MATERIALIZED', 'ALIAS', 'EPHEMERAL') ORDER BY position", database, table); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// DetachPart - move active part to `detached` folder of table, for Replicated*MergeTree part will detached on all replicas
+func (ch *ClickHouse) DetachPart(ctx context.Context, database, table, partName string) error {
+	_, err := ch.QueryContext(ctx, fmt.Sprintf("ALTER TABLE `%s`.`%s` DETACH PART %s", database, table, quoteString(partName)))
+	return err
+}
+
+// ReplacePartitions - execute ALTER TABLE ... REPLACE PARTITION ... FROM for each partition, old data of partition in table replaced atomically by data from srcTable
+func (ch *ClickHouse) ReplacePartitions(ctx context.Context, database, table, srcDatabase, srcTable string, partitionIDs []string) error {
+	for _, partitionID := range partitionIDs {
+		query := fmt.Sprintf("ALTER TABLE `%s`.`%s` REPLACE PARTITION ID %s FROM `%s`.`%s`", database, table, quoteString(partitionID), srcDatabase, srcTable)
+		if _, err := ch.QueryContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AttachPartitions - execute ATTACH command for specific table, onAttached called after each successfully attached part to allow skip it when restore will retried
+func (ch *ClickHouse) AttachPartitions(table metadata.TableMetadata, disks []Disk, onAttached func(disk Disk, part metadata.Part)) error {
 	// https://github.com/AlexAkulov/clickhouse-backup/issues/474
 	if ch.Config.CheckReplicasBeforeAttach && strings.Contains(table.Query, "Replicated") {
 		existsReplicas := make([]int, 0)
@@ -570,12 +693,24 @@ func (ch *ClickHouse) AttachPartitions(table metadata.TableMetadata, disks []Dis
 			ch.Log.Infof("replication_in_progress status = %+v", existsReplicas)
 		}
 	}
+	totalParts := 0
 	for _, disk := range disks {
 		for _, partition := range table.Parts[disk.Name] {
 			if !strings.HasSuffix(partition.Name, ".proj") {
-				query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PART '%s'", table.Database, table.Table, partition.Name)
-				if _, err := ch.Query(query); err != nil {
-					return err
+				totalParts++
+			}
+		}
+	}
+	attachedParts := 0
+	for _, disk := range disks {
+		for _, partition := range table.Parts[disk.Name] {
+			if !strings.HasSuffix(partition.Name, ".proj") {
+				if _, err := ch.Query(GetAttachPartQuery(table.Database, table.Table, partition.Name)); err != nil {
+					return fmt.Errorf("attached %d of %d parts, can't attach part '%s' from disk '%s': %v", attachedParts, totalParts, partition.Name, disk.Name, err)
+				}
+				attachedParts++
+				if onAttached != nil {
+					onAttached(disk, partition)
 				}
 				ch.Log.WithField("table", fmt.Sprintf("%s.%s", table.Database, table.Table)).WithField("disk", disk.Name).WithField("part", partition.Name).Debug("attached")
 			}
@@ -931,17 +1066,28 @@ func (ch *ClickHouse) GetUserDefinedFunctions(ctx context.Context) ([]Function,
 	return allFunctions, nil
 }
 
-func (ch *ClickHouse) CreateUserDefinedFunction(name string, query string, cluster string) error {
-	dropQuery := fmt.Sprintf("DROP FUNCTION IF EXISTS `%s`", name)
+// CreateUserDefinedFunction - CREATE OR REPLACE FUNCTION, doesn't drop function before, so concurrent restore on other replicas will not see it missing,
+// CREATE OR REPLACE FUNCTION available since 21.12, for older versions function dropped before create
+func (ch *ClickHouse) CreateUserDefinedFunction(ctx context.Context, name string, query string, cluster string) error {
+	version, err := ch.GetVersion(ctx)
+	if err != nil {
+		return err
+	}
 	if cluster != "" {
-		dropQuery += fmt.Sprintf(" ON CLUSTER '%s'", cluster)
 		query = strings.Replace(query, " AS ", fmt.Sprintf(" ON CLUSTER '%s' AS ", cluster), 1)
 	}
-	_, err := ch.Query(dropQuery)
-	if err != nil {
-		return err
+	if version >= 21012000 {
+		query = strings.Replace(query, "CREATE FUNCTION", "CREATE OR REPLACE FUNCTION", 1)
+	} else {
+		dropQuery := fmt.Sprintf("DROP FUNCTION IF EXISTS `%s`", name)
+		if cluster != "" {
+			dropQuery += fmt.Sprintf(" ON CLUSTER '%s'", cluster)
+		}
+		if _, err = ch.QueryContext(ctx, dropQuery); err != nil {
+			return err
+		}
 	}
-	_, err = ch.Query(query)
+	_, err = ch.QueryContext(ctx, query)
 	return err
 }
 
@@ -961,6 +1107,138 @@ func (ch *ClickHouse) CalculateMaxFileSize(ctx context.Context, cfg *config.Conf
 	return 0, nil
 }
 
+// GetTableRowsCount - return count() for table
+func (ch *ClickHouse) GetTableRowsCount(ctx context.Context, database, table string) (uint64, error) {
+	rowsCount := make([]uint64, 0)
+	if err := ch.SelectContext(ctx, &rowsCount, fmt.Sprintf("SELECT count() FROM `%s`.`%s`", database, table)); err != nil {
+		return 0, err
+	}
+	if len(rowsCount) == 0 {
+		return 0, nil
+	}
+	return rowsCount[0], nil
+}
+
+// GetAggregateFunctions - aggregate functions from system.functions, case-insensitive names in lower case, and combinators from system.aggregate_function_combinators, nil combinators when table doesn't exist in current version
+func (ch *ClickHouse) GetAggregateFunctions(ctx context.Context) ([]string, []string, error) {
+	functions := make([]string, 0)
+	if err := ch.SelectContext(ctx, &functions, "SELECT if(case_insensitive, lower(name), name) FROM system.functions WHERE is_aggregate"); err != nil {
+		return nil, nil, err
+	}
+	isCombinatorsExists := make([]uint8, 0)
+	if err := ch.SelectContext(ctx, &isCombinatorsExists, "SELECT toUInt8(count()) FROM system.tables WHERE database='system' AND name='aggregate_function_combinators'"); err != nil {
+		return nil, nil, err
+	}
+	if len(isCombinatorsExists) == 0 || isCombinatorsExists[0] == 0 {
+		return functions, nil, nil
+	}
+	combinators := make([]string, 0)
+	if err := ch.SelectContext(ctx, &combinators, "SELECT name FROM system.aggregate_function_combinators"); err != nil {
+		return nil, nil, err
+	}
+	return functions, combinators, nil
+}
+
+// GetCodecs - names of compression codecs supported by server from system.codecs, nil when system.codecs doesn't exist in current version
+func (ch *ClickHouse) GetCodecs(ctx context.Context) ([]string, error) {
+	isCodecsExists := make([]uint8, 0)
+	if err := ch.SelectContext(ctx, &isCodecsExists, "SELECT toUInt8(count()) FROM system.tables WHERE database='system' AND name='codecs'"); err != nil {
+		return nil, err
+	}
+	if len(isCodecsExists) == 0 || isCodecsExists[0] == 0 {
+		return nil, nil
+	}
+	codecs := make([]string, 0)
+	if err := ch.SelectContext(ctx, &codecs, "SELECT name FROM system.codecs"); err != nil {
+		return nil, err
+	}
+	return codecs, nil
+}
+
+// GetDisksFreeSpace - free_space from system.disks, empty for versions without system.disks
+func (ch *ClickHouse) GetDisksFreeSpace(ctx context.Context) (map[string]uint64, error) {
+	version, err := ch.GetVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	freeSpace := map[string]uint64{}
+	if version < 19015000 {
+		return freeSpace, nil
+	}
+	disks := make([]struct {
+		Name      string `db:"name"`
+		FreeSpace uint64 `db:"free_space"`
+	}, 0)
+	if err = ch.SelectContext(ctx, &disks, "SELECT name, free_space FROM system.disks"); err != nil {
+		return nil, err
+	}
+	for _, disk := range disks {
+		freeSpace[disk.Name] = disk.FreeSpace
+	}
+	return freeSpace, nil
+}
+
+// GetPartsState - active and inactive parts from system.parts for specified partitions
+func (ch *ClickHouse) GetPartsState(ctx context.Context, database, table string, partitionIDs []string) ([]PartState, error) {
+	parts := make([]PartState, 0)
+	if len(partitionIDs) == 0 {
+		return parts, nil
+	}
+	quotedIDs := make([]string, len(partitionIDs))
+	for i, partitionID := range partitionIDs {
+		quotedIDs[i] = quoteString(partitionID)
+	}
+	query := fmt.Sprintf("SELECT name, partition_id, min_block_number, max_block_number, level, active, path FROM system.parts WHERE database=? AND table=? AND partition_id IN (%s)", strings.Join(quotedIDs, ","))
+	if err := ch.SelectContext(ctx, &parts, query, database, table); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// GetColumnTypes - column name to type map from system.columns
+func (ch *ClickHouse) GetColumnTypes(ctx context.Context, database, table string) (map[string]string, error) {
+	columns := make([]struct {
+		Name string `db:"name"`
+		Type string `db:"type"`
+	}, 0)
+	if err := ch.SelectContext(ctx, &columns, "SELECT name, type FROM system.columns WHERE database=? AND table=?", database, table); err != nil {
+		return nil, err
+	}
+	columnTypes := make(map[string]string, len(columns))
+	for _, column := range columns {
+		columnTypes[column.Name] = column.Type
+	}
+	return columnTypes, nil
+}
+
+// MaterializeIndex - rebuild data skipping index for all parts, executed as mutation, for Replicated*MergeTree mutation applied on all replicas
+func (ch *ClickHouse) MaterializeIndex(ctx context.Context, database, table, index string) error {
+	_, err := ch.QueryContext(ctx, fmt.Sprintf("ALTER TABLE `%s`.`%s` MATERIALIZE INDEX `%s`", database, table, index))
+	return err
+}
+
+// IsMaterializeIndexInProgress - not finished MATERIALIZE INDEX mutation for index, for Replicated*MergeTree it could be created by other replica
+func (ch *ClickHouse) IsMaterializeIndexInProgress(ctx context.Context, database, table, index string) (bool, error) {
+	mutationsCount := make([]uint64, 0)
+	commandRE := "MATERIALIZE INDEX\\s+`?" + regexp.QuoteMeta(index) + "`?(\\s|$)"
+	if err := ch.SelectContext(ctx, &mutationsCount, "SELECT count() FROM system.mutations WHERE database=? AND table=? AND NOT is_done AND match(command, ?)", database, table, commandRE); err != nil {
+		return false, err
+	}
+	return len(mutationsCount) > 0 && mutationsCount[0] > 0, nil
+}
+
+// StopMerges - SYSTEM STOP MERGES only for specific table, background merges for other tables are not affected
+func (ch *ClickHouse) StopMerges(ctx context.Context, database, table string) error {
+	_, err := ch.QueryContext(ctx, fmt.Sprintf("SYSTEM STOP MERGES `%s`.`%s`", database, table))
+	return err
+}
+
+// StartMerges - SYSTEM START MERGES for specific table
+func (ch *ClickHouse) StartMerges(ctx context.Context, database, table string) error {
+	_, err := ch.QueryContext(ctx, fmt.Sprintf("SYSTEM START MERGES `%s`.`%s`", database, table))
+	return err
+}
+
 func (ch *ClickHouse) ApplyMacros(ctx context.Context, s string) (string, error) {
 	macrosExists := make([]int, 0)
 	err := ch.SelectContext(ctx, &macrosExists, "SELECT count() AS is_macros_exists FROM system.tables WHERE database='system' AND name='macros'")
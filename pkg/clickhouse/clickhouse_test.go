@@ -0,0 +1,26 @@
+package clickhouse
+
+import (
+	"testing"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectRejectsReservedSessionSettings(t *testing.T) {
+	cfg := config.DefaultConfig()
+	ch := &ClickHouse{Config: &cfg.ClickHouse, Log: apexLog.WithField("logger", "test"), SessionSettings: map[string]string{"max_threads": "4", "username": "admin"}}
+	assert.EqualError(t, ch.Connect(), "`session settings` contains reserved connection parameters: username")
+	assert.False(t, ch.IsOpen)
+}
+
+func TestGetFreezePartitionQuery(t *testing.T) {
+	assert.Equal(t, "ALTER TABLE `db`.`t` FREEZE PARTITION ID '202301' WITH NAME 'restored_b_0a1b2c3d'", getFreezePartitionQuery("db", "t", "202301", "restored_b_0a1b2c3d"))
+	assert.Equal(t, `ALTER TABLE `+"`db`.`t`"+` FREEZE PARTITION ID 'x\' OR 1=1 --\\' WITH NAME 'n'`, getFreezePartitionQuery("db", "t", `x' OR 1=1 --\`, "n"))
+}
+
+func TestGetAttachPartQuery(t *testing.T) {
+	assert.Equal(t, "ALTER TABLE `db`.`t` ATTACH PART 'all_1_1_0'", GetAttachPartQuery("db", "t", "all_1_1_0"))
+	assert.Equal(t, `ALTER TABLE `+"`db`.`t`"+` ATTACH PART 'x\' OR 1=1 --'`, GetAttachPartQuery("db", "t", "x' OR 1=1 --"))
+}
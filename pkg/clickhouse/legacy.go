@@ -2,11 +2,11 @@ package clickhouse
 
 import (
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 )
 
@@ -50,8 +50,8 @@ func (ch *ClickHouse) GetBackupTablesLegacy(backupName string, disks []Disk) ([]
 				return nil
 			}
 
-			tDB, _ := url.PathUnescape(parts[dbNum])
-			tName, _ := url.PathUnescape(parts[tableNum])
+			tDB := common.TablePathDecode(parts[dbNum])
+			tName := common.TablePathDecode(parts[tableNum])
 			fullTableName := fmt.Sprintf("%s.%s", tDB, tName)
 
 			allPartsHashes := allpartsBackup[fullTableName]
@@ -35,6 +35,17 @@ type Disk struct {
 	IsBackup bool
 }
 
+// PartState - info from system.parts, used to check attached parts
+type PartState struct {
+	Name           string `db:"name"`
+	PartitionID    string `db:"partition_id"`
+	MinBlockNumber int64  `db:"min_block_number"`
+	MaxBlockNumber int64  `db:"max_block_number"`
+	Level          uint32 `db:"level"`
+	Active         uint8  `db:"active"`
+	Path           string `db:"path"`
+}
+
 // Database - Clickhouse system.databases struct
 type Database struct {
 	Name   string `db:"name"`
@@ -1,15 +1,67 @@
 package common
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
 )
 
+// TablePathEncode - database or table name to directory name inside backup, `.` and `-` escaped additionally to url.PathEscape
 func TablePathEncode(str string) string {
 	return strings.NewReplacer(".", "%2E", "-", "%2D").Replace(url.PathEscape(str))
 
 }
 
+// TablePathDecode - reverse TablePathEncode, also decode names escaped by ClickHouse escapeForFileName, return str as is when it contains invalid escape sequence
+func TablePathDecode(str string) string {
+	decoded, err := url.PathUnescape(str)
+	if err != nil {
+		return str
+	}
+	return decoded
+}
+
+// ClickHouseFileNameEncode - the same as ClickHouse escapeForFileName, all bytes except [a-zA-Z0-9_] escaped as %XX
+// need for paths created by ClickHouse itself, like `data` directory in embedded backups
+func ClickHouseFileNameEncode(str string) string {
+	result := strings.Builder{}
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+			result.WriteByte(c)
+		} else {
+			result.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return result.String()
+}
+
+// ParseBackQuotedName - name at the beginning of column definition, ClickHouse quote names with back quotes and backslash escapes, return name and rest of definition
+func ParseBackQuotedName(element string) (string, string, error) {
+	if !strings.HasPrefix(element, "`") {
+		fields := strings.Fields(element)
+		if len(fields) == 0 {
+			return "", element, fmt.Errorf("empty column definition")
+		}
+		return fields[0], strings.TrimPrefix(element, fields[0]), nil
+	}
+	name := strings.Builder{}
+	for i := 1; i < len(element); i++ {
+		switch element[i] {
+		case '\\':
+			if i+1 < len(element) {
+				i++
+				name.WriteByte(element[i])
+			}
+		case '`':
+			return name.String(), element[i+1:], nil
+		default:
+			name.WriteByte(element[i])
+		}
+	}
+	return "", element, fmt.Errorf("closing back quote not found in '%s'", element)
+}
+
 func SumMapValuesInt(m map[string]int) int {
 	s := 0
 	for _, v := range m {
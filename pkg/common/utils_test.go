@@ -0,0 +1,34 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTablePathEncode(t *testing.T) {
+	for _, name := range []string{"db.with.dots", "table with spaces", "таблица", "数据库-1", "a/b%c", "plain_name"} {
+		encoded := TablePathEncode(name)
+		assert.NotContains(t, encoded, "/")
+		assert.NotContains(t, encoded, ".")
+		assert.Equal(t, name, TablePathDecode(encoded))
+		assert.Equal(t, name, TablePathDecode(ClickHouseFileNameEncode(name)))
+	}
+	assert.Equal(t, "db%2Ewith%2Edots", TablePathEncode("db.with.dots"))
+	assert.Equal(t, "table%20with%20spaces", TablePathEncode("table with spaces"))
+	assert.Equal(t, "%D1%82%D0%B1", TablePathEncode("тб"))
+	assert.Equal(t, "t%28x%29%21", ClickHouseFileNameEncode("t(x)!"))
+	assert.Equal(t, "bad%zz", TablePathDecode("bad%zz"))
+}
+
+func TestParseBackQuotedName(t *testing.T) {
+	name, rest, err := ParseBackQuotedName("`col\\`name` Nullable(String)")
+	assert.NoError(t, err)
+	assert.Equal(t, "col`name", name)
+	assert.Equal(t, " Nullable(String)", rest)
+	name, _, err = ParseBackQuotedName("INDEX idx id TYPE minmax GRANULARITY 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "INDEX", name)
+	_, _, err = ParseBackQuotedName("`unclosed String")
+	assert.Error(t, err)
+}
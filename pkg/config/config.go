@@ -6,6 +6,8 @@ import (
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"math"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -24,6 +26,7 @@ const (
 type Config struct {
 	General    GeneralConfig    `yaml:"general" envconfig:"_"`
 	ClickHouse ClickHouseConfig `yaml:"clickhouse" envconfig:"_"`
+	Filesystem FilesystemConfig `yaml:"filesystem" envconfig:"_"`
 	S3         S3Config         `yaml:"s3" envconfig:"_"`
 	GCS        GCSConfig        `yaml:"gcs" envconfig:"_"`
 	COS        COSConfig        `yaml:"cos" envconfig:"_"`
@@ -36,28 +39,74 @@ type Config struct {
 
 // GeneralConfig - general setting section
 type GeneralConfig struct {
-	RemoteStorage           string            `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
-	MaxFileSize             int64             `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
-	DisableProgressBar      bool              `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
-	BackupsToKeepLocal      int               `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
-	BackupsToKeepRemote     int               `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
-	LogLevel                string            `yaml:"log_level" envconfig:"LOG_LEVEL"`
-	AllowEmptyBackups       bool              `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
-	DownloadConcurrency     uint8             `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
-	UploadConcurrency       uint8             `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
-	UseResumableState       bool              `yaml:"use_resumable_state" envconfig:"USE_RESUMABLE_STATE"`
-	RestoreSchemaOnCluster  string            `yaml:"restore_schema_on_cluster" envconfig:"RESTORE_SCHEMA_ON_CLUSTER"`
-	UploadByPart            bool              `yaml:"upload_by_part" envconfig:"UPLOAD_BY_PART"`
-	DownloadByPart          bool              `yaml:"download_by_part" envconfig:"DOWNLOAD_BY_PART"`
-	RestoreDatabaseMapping  map[string]string `yaml:"restore_database_mapping" envconfig:"RESTORE_DATABASE_MAPPING"`
-	RetriesOnFailure        int               `yaml:"retries_on_failure" envconfig:"RETRIES_ON_FAILURE"`
-	RetriesPause            string            `yaml:"upload_retries_pause" envconfig:"RETRIES_PAUSE"`
-	WatchInterval           string            `yaml:"watch_interval" envconfig:"WATCH_INTERVAL"`
-	FullInterval            string            `yaml:"full_interval" envconfig:"FULL_INTERVAL"`
-	WatchBackupNameTemplate string            `yaml:"watch_backup_name_template" envconfig:"WATCH_BACKUP_NAME_TEMPLATE"`
-	RetriesDuration         time.Duration
-	WatchDuration           time.Duration
-	FullDuration            time.Duration
+	RemoteStorage                     string            `yaml:"remote_storage" envconfig:"REMOTE_STORAGE"`
+	MaxFileSize                       int64             `yaml:"max_file_size" envconfig:"MAX_FILE_SIZE"`
+	DisableProgressBar                bool              `yaml:"disable_progress_bar" envconfig:"DISABLE_PROGRESS_BAR"`
+	BackupsToKeepLocal                int               `yaml:"backups_to_keep_local" envconfig:"BACKUPS_TO_KEEP_LOCAL"`
+	BackupsToKeepRemote               int               `yaml:"backups_to_keep_remote" envconfig:"BACKUPS_TO_KEEP_REMOTE"`
+	LogLevel                          string            `yaml:"log_level" envconfig:"LOG_LEVEL"`
+	AllowEmptyBackups                 bool              `yaml:"allow_empty_backups" envconfig:"ALLOW_EMPTY_BACKUPS"`
+	FailOnEmptyBackup                 bool              `yaml:"fail_on_empty_backup" envconfig:"FAIL_ON_EMPTY_BACKUP"`
+	DownloadConcurrency               uint8             `yaml:"download_concurrency" envconfig:"DOWNLOAD_CONCURRENCY"`
+	UploadConcurrency                 uint8             `yaml:"upload_concurrency" envconfig:"UPLOAD_CONCURRENCY"`
+	UseResumableState                 bool              `yaml:"use_resumable_state" envconfig:"USE_RESUMABLE_STATE"`
+	RestoreSchemaOnCluster            string            `yaml:"restore_schema_on_cluster" envconfig:"RESTORE_SCHEMA_ON_CLUSTER"`
+	UploadByPart                      bool              `yaml:"upload_by_part" envconfig:"UPLOAD_BY_PART"`
+	DownloadByPart                    bool              `yaml:"download_by_part" envconfig:"DOWNLOAD_BY_PART"`
+	ComparePartsByContent             bool              `yaml:"compare_parts_by_content" envconfig:"COMPARE_PARTS_BY_CONTENT"`
+	CreateLocalIncremental            bool              `yaml:"create_local_incremental" envconfig:"CREATE_LOCAL_INCREMENTAL"`
+	RestoreDatabaseMapping            map[string]string `yaml:"restore_database_mapping" envconfig:"RESTORE_DATABASE_MAPPING"`
+	RestoreDatabaseMappingAllowSystem bool              `yaml:"restore_database_mapping_allow_system" envconfig:"RESTORE_DATABASE_MAPPING_ALLOW_SYSTEM"`
+	RestoreDatabaseMappingStrict      bool              `yaml:"restore_database_mapping_strict" envconfig:"RESTORE_DATABASE_MAPPING_STRICT"`
+	RestoreTableMapping               map[string]string `yaml:"restore_table_mapping" envconfig:"RESTORE_TABLE_MAPPING"`
+	DictionarySourceMapping           map[string]string `yaml:"dictionary_source_mapping" envconfig:"DICTIONARY_SOURCE_MAPPING"`
+	RestoreStoragePolicyMapping       map[string]string `yaml:"restore_storage_policy_mapping" envconfig:"RESTORE_STORAGE_POLICY_MAPPING"`
+	RestoreDictionariesDeferSource    bool              `yaml:"restore_dictionaries_defer_source" envconfig:"RESTORE_DICTIONARIES_DEFER_SOURCE"`
+	RestoreDistributedClusterMapping  map[string]string `yaml:"restore_distributed_cluster_mapping" envconfig:"RESTORE_DISTRIBUTED_CLUSTER_MAPPING"`
+	RestoreZookeeperPathMapping       []string          `yaml:"restore_zookeeper_path_mapping" envconfig:"RESTORE_ZOOKEEPER_PATH_MAPPING"`
+	RestoreSchemaTransformRules       []string          `yaml:"restore_schema_transform_rules" envconfig:"RESTORE_SCHEMA_TRANSFORM_RULES"`
+	RestoreSchemaTransformCommand     string            `yaml:"restore_schema_transform_command" envconfig:"RESTORE_SCHEMA_TRANSFORM_COMMAND"`
+	PreRestoreTableCommand            string            `yaml:"pre_restore_table_command" envconfig:"PRE_RESTORE_TABLE_COMMAND"`
+	PostRestoreTableCommand           string            `yaml:"post_restore_table_command" envconfig:"POST_RESTORE_TABLE_COMMAND"`
+	RestoreTableCommandAbortOnError   bool              `yaml:"restore_table_command_abort_on_error" envconfig:"RESTORE_TABLE_COMMAND_ABORT_ON_ERROR"`
+	StrictDiskMapping                 bool              `yaml:"strict_disk_mapping" envconfig:"STRICT_DISK_MAPPING"`
+	RestoreDiskNameMapping            map[string]string `yaml:"restore_disk_name_mapping" envconfig:"RESTORE_DISK_NAME_MAPPING"`
+	RestoreS3PathMapping              map[string]string `yaml:"restore_s3_path_mapping" envconfig:"RESTORE_S3_PATH_MAPPING"`
+	RestoreSessionSettings            map[string]string `yaml:"restore_session_settings" envconfig:"RESTORE_SESSION_SETTINGS"`
+	RestoreDDLPreamble                []string          `yaml:"restore_ddl_preamble" envconfig:"RESTORE_DDL_PREAMBLE"`
+	RestoreFunctionsMode              string            `yaml:"restore_functions_mode" envconfig:"RESTORE_FUNCTIONS_MODE"`
+	RestoreStreamingTablesMode        string            `yaml:"restore_streaming_tables_mode" envconfig:"RESTORE_STREAMING_TABLES_MODE"`
+	RestoreLockMode                   string            `yaml:"restore_lock_mode" envconfig:"RESTORE_LOCK_MODE"`
+	RestoreLockTimeout                string            `yaml:"restore_lock_timeout" envconfig:"RESTORE_LOCK_TIMEOUT"`
+	RestoreCopyMode                   string            `yaml:"restore_copy_mode" envconfig:"RESTORE_COPY_MODE"`
+	RestoreCreateMissingTables        bool              `yaml:"restore_create_missing_tables" envconfig:"RESTORE_CREATE_MISSING_TABLES"`
+	RestoreSchemaReportPath           string            `yaml:"restore_schema_report_path" envconfig:"RESTORE_SCHEMA_REPORT_PATH"`
+	RestoreContinueOnError            bool              `yaml:"restore_continue_on_error" envconfig:"RESTORE_CONTINUE_ON_ERROR"`
+	RestoreIfNotExists                bool              `yaml:"restore_if_not_exists" envconfig:"RESTORE_IF_NOT_EXISTS"`
+	RestoreStripUnknownSettings       bool              `yaml:"restore_strip_unknown_settings" envconfig:"RESTORE_STRIP_UNKNOWN_SETTINGS"`
+	MaterializeIndexesAfterRestore    bool              `yaml:"materialize_indexes_after_restore" envconfig:"MATERIALIZE_INDEXES_AFTER_RESTORE"`
+	RestoreCheckCodecs                bool              `yaml:"restore_check_codecs" envconfig:"RESTORE_CHECK_CODECS"`
+	RestoreStopMerges                 bool              `yaml:"restore_stop_merges" envconfig:"RESTORE_STOP_MERGES"`
+	RestoreDropTTL                    bool              `yaml:"restore_drop_ttl" envconfig:"RESTORE_DROP_TTL"`
+	RestoreCheckFreeSpace             bool              `yaml:"restore_check_free_space" envconfig:"RESTORE_CHECK_FREE_SPACE"`
+	RestoreColumnExclude              []string          `yaml:"restore_column_exclude" envconfig:"RESTORE_COLUMN_EXCLUDE"`
+	RestoreReinsertOnSortkeyMismatch  bool              `yaml:"restore_reinsert_on_sortkey_mismatch" envconfig:"RESTORE_REINSERT_ON_SORTKEY_MISMATCH"`
+	RestoreOverlappingPartsMode       string            `yaml:"restore_overlapping_parts_mode" envconfig:"RESTORE_OVERLAPPING_PARTS_MODE"`
+	RestoreSkipMissingParts           bool              `yaml:"restore_skip_missing_parts" envconfig:"RESTORE_SKIP_MISSING_PARTS"`
+	RemoveDetachedOnFailure           bool              `yaml:"remove_detached_on_failure" envconfig:"REMOVE_DETACHED_ON_FAILURE"`
+	VerifyRowsOnRestore               bool              `yaml:"verify_rows_on_restore" envconfig:"VERIFY_ROWS_ON_RESTORE"`
+	VerifyLowCardinalityOnRestore     bool              `yaml:"verify_low_cardinality_on_restore" envconfig:"VERIFY_LOW_CARDINALITY_ON_RESTORE"`
+	VerifyActivePartsOnRestore        string            `yaml:"verify_active_parts_on_restore" envconfig:"VERIFY_ACTIVE_PARTS_ON_RESTORE"`
+	VerifyAggregateFunctionsOnRestore string            `yaml:"verify_aggregate_functions_on_restore" envconfig:"VERIFY_AGGREGATE_FUNCTIONS_ON_RESTORE"`
+	RetriesOnFailure                  int               `yaml:"retries_on_failure" envconfig:"RETRIES_ON_FAILURE"`
+	RetriesPause                      string            `yaml:"upload_retries_pause" envconfig:"RETRIES_PAUSE"`
+	WatchInterval                     string            `yaml:"watch_interval" envconfig:"WATCH_INTERVAL"`
+	FullInterval                      string            `yaml:"full_interval" envconfig:"FULL_INTERVAL"`
+	WatchBackupNameTemplate           string            `yaml:"watch_backup_name_template" envconfig:"WATCH_BACKUP_NAME_TEMPLATE"`
+	RetriesDuration                   time.Duration
+	WatchDuration                     time.Duration
+	FullDuration                      time.Duration
+	RestoreLockTimeoutDuration        time.Duration
 }
 
 // GCSConfig - GCS settings section
@@ -189,6 +238,7 @@ type ClickHouseConfig struct {
 	FreezeByPart                     bool              `yaml:"freeze_by_part" envconfig:"CLICKHOUSE_FREEZE_BY_PART"`
 	FreezeByPartWhere                string            `yaml:"freeze_by_part_where" envconfig:"CLICKHOUSE_FREEZE_BY_PART_WHERE"`
 	UseEmbeddedBackupRestore         bool              `yaml:"use_embedded_backup_restore" envconfig:"CLICKHOUSE_USE_EMBEDDED_BACKUP_RESTORE"`
+	UseReflink                       bool              `yaml:"use_reflink" envconfig:"CLICKHOUSE_USE_REFLINK"`
 	EmbeddedBackupDisk               string            `yaml:"embedded_backup_disk" envconfig:"CLICKHOUSE_EMBEDDED_BACKUP_DISK"`
 	Secure                           bool              `yaml:"secure" envconfig:"CLICKHOUSE_SECURE"`
 	SkipVerify                       bool              `yaml:"skip_verify" envconfig:"CLICKHOUSE_SKIP_VERIFY"`
@@ -196,12 +246,25 @@ type ClickHouseConfig struct {
 	LogSQLQueries                    bool              `yaml:"log_sql_queries" envconfig:"CLICKHOUSE_LOG_SQL_QUERIES"`
 	ConfigDir                        string            `yaml:"config_dir" envconfig:"CLICKHOUSE_CONFIG_DIR"`
 	RestartCommand                   string            `yaml:"restart_command" envconfig:"CLICKHOUSE_RESTART_COMMAND"`
-	IgnoreNotExistsErrorDuringFreeze bool              `yaml:"ignore_not_exists_error_during_freeze" envconfig:"CLICKHOUSE_IGNORE_NOT_EXISTS_ERROR_DURING_FREEZE"`
-	CheckReplicasBeforeAttach        bool              `yaml:"check_replicas_before_attach" envconfig:"CLICKHOUSE_CHECK_REPLICAS_BEFORE_ATTACH"`
-	TLSKey                           string            `yaml:"tls_key" envconfig:"CLICKHOUSE_TLS_KEY"`
-	TLSCert                          string            `yaml:"tls_cert" envconfig:"CLICKHOUSE_TLS_CERT"`
-	TLSCa                            string            `yaml:"tls_ca" envconfig:"CLICKHOUSE_TLS_CA"`
-	Debug                            bool              `yaml:"debug" envconfig:"CLICKHOUSE_DEBUG"`
+	RestartCommandTimeout            string            `yaml:"restart_command_timeout" envconfig:"CLICKHOUSE_RESTART_COMMAND_TIMEOUT"`
+	RestartCommandTimeoutDuration    time.Duration
+	RestartCommandEnv                []string `yaml:"restart_command_env" envconfig:"CLICKHOUSE_RESTART_COMMAND_ENV"`
+	RestartCommandDir                string   `yaml:"restart_command_dir" envconfig:"CLICKHOUSE_RESTART_COMMAND_DIR"`
+	IgnoreNotExistsErrorDuringFreeze bool     `yaml:"ignore_not_exists_error_during_freeze" envconfig:"CLICKHOUSE_IGNORE_NOT_EXISTS_ERROR_DURING_FREEZE"`
+	CheckReplicasBeforeAttach        bool     `yaml:"check_replicas_before_attach" envconfig:"CLICKHOUSE_CHECK_REPLICAS_BEFORE_ATTACH"`
+	TLSKey                           string   `yaml:"tls_key" envconfig:"CLICKHOUSE_TLS_KEY"`
+	TLSCert                          string   `yaml:"tls_cert" envconfig:"CLICKHOUSE_TLS_CERT"`
+	TLSCa                            string   `yaml:"tls_ca" envconfig:"CLICKHOUSE_TLS_CA"`
+	Debug                            bool     `yaml:"debug" envconfig:"CLICKHOUSE_DEBUG"`
+}
+
+// FilesystemConfig - local filesystem operations settings section
+type FilesystemConfig struct {
+	CopyConcurrency         uint8  `yaml:"copy_concurrency" envconfig:"FILESYSTEM_COPY_CONCURRENCY"`
+	FsyncOnRestore          bool   `yaml:"fsync_on_restore" envconfig:"FILESYSTEM_FSYNC_ON_RESTORE"`
+	RestoreIORateLimit      uint64 `yaml:"restore_io_rate_limit" envconfig:"FILESYSTEM_RESTORE_IO_RATE_LIMIT"`
+	ClearImmutableOnRestore bool   `yaml:"clear_immutable_on_restore" envconfig:"FILESYSTEM_CLEAR_IMMUTABLE_ON_RESTORE"`
+	DetachedStagingPath     string `yaml:"detached_staging_path" envconfig:"FILESYSTEM_DETACHED_STAGING_PATH"`
 }
 
 type APIConfig struct {
@@ -217,6 +280,7 @@ type APIConfig struct {
 	IntegrationTablesHost         string `yaml:"integration_tables_host" envconfig:"API_INTEGRATION_TABLES_HOST"`
 	AllowParallel                 bool   `yaml:"allow_parallel" envconfig:"API_ALLOW_PARALLEL"`
 	CompleteResumableAfterRestart bool   `yaml:"complete_resumable_after_restart" envconfig:"API_COMPLETE_RESUMABLE_AFTER_RESTART"`
+	RestoreFilesPath              string `yaml:"restore_files_path" envconfig:"API_RESTORE_FILES_PATH"`
 }
 
 // ArchiveExtensions - list of available compression formats and associated file extensions
@@ -251,6 +315,28 @@ func (cfg *Config) GetArchiveExtension() string {
 	}
 }
 
+// GetRestoreColumnExclude - columns which shall not restore for table, `general->restore_column_exclude` rules in `db.table:col1,col2` format, db.table could be pattern
+// RESTORE_COLUMN_EXCLUDE split by comma, so item without `:` means next column of previous rule
+func (cfg *Config) GetRestoreColumnExclude(database, table string) []string {
+	var columns []string
+	isMatched := false
+	for _, rule := range cfg.General.RestoreColumnExclude {
+		if tableColumns := strings.SplitN(rule, ":", 2); len(tableColumns) == 2 {
+			isMatched, _ = filepath.Match(strings.TrimSpace(tableColumns[0]), database+"."+table)
+			rule = tableColumns[1]
+		}
+		if !isMatched {
+			continue
+		}
+		for _, column := range strings.Split(rule, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
 func (cfg *Config) GetCompressionFormat() string {
 	switch cfg.General.RemoteStorage {
 	case "s3":
@@ -272,6 +358,97 @@ func (cfg *Config) GetCompressionFormat() string {
 	}
 }
 
+var settingNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var settingPlainValueRE = regexp.MustCompile(`^[a-zA-Z0-9_.+\-]+$`)
+var settingQuotedValueRE = regexp.MustCompile(`^'(?:[^'\\]|\\.|'')*'$`)
+
+// ParseDDLPreamble - `restore_ddl_preamble` SET statements as settings, `SET name1 = value1, name2 = 'value2'` syntax,
+// settings applied via connection string, so they are not lost when connection reopened between queries
+func ParseDDLPreamble(statements []string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, statement := range statements {
+		trimmed := strings.TrimRight(strings.TrimSpace(statement), "; \t")
+		if len(trimmed) < 4 || !strings.EqualFold(trimmed[:4], "SET ") {
+			return nil, fmt.Errorf("`restore_ddl_preamble` item '%s' should be SET statement", statement)
+		}
+		for _, item := range splitSetItems(trimmed[4:]) {
+			name, value, isFound := strings.Cut(item, "=")
+			name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+			if !isFound || !settingNameRE.MatchString(name) || (!settingPlainValueRE.MatchString(value) && !settingQuotedValueRE.MatchString(value)) {
+				return nil, fmt.Errorf("`restore_ddl_preamble` item '%s' contains invalid setting '%s', should be `name = value`", statement, item)
+			}
+			if settingQuotedValueRE.MatchString(value) {
+				value = strings.NewReplacer(`\\`, `\`, `\'`, `'`, `''`, `'`).Replace(value[1 : len(value)-1])
+			}
+			settings[name] = value
+		}
+	}
+	return settings, nil
+}
+
+// connectionParams - clickhouse-go connection string parameters, settings with these names would change connection instead of send to server
+var connectionParams = []string{"username", "password", "database", "tls_config", "secure", "skip_verify", "no_delay", "timeout", "read_timeout", "write_timeout", "block_size", "alt_hosts", "connection_open_strategy", "compress", "check_connection_liveness", "debug"}
+
+// CheckSessionSettings - settings passed via connection string shall not overwrite connection parameters
+func CheckSessionSettings(option string, settings map[string]string) error {
+	var reserved []string
+	for _, param := range connectionParams {
+		if _, exists := settings[param]; exists {
+			reserved = append(reserved, param)
+		}
+	}
+	if len(reserved) > 0 {
+		return fmt.Errorf("`%s` contains reserved connection parameters: %s", option, strings.Join(reserved, ", "))
+	}
+	return nil
+}
+
+// RegexpReplaceRule - compiled `regexp->replacement` item of ordered rules list
+type RegexpReplaceRule struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// ParseRegexpReplaceRules - items of `option` list have `regexp->replacement` format, rules keep config order
+func ParseRegexpReplaceRules(option string, items []string) ([]RegexpReplaceRule, error) {
+	rules := make([]RegexpReplaceRule, len(items))
+	for i, item := range items {
+		expr, replacement, isFound := strings.Cut(item, "->")
+		if !isFound {
+			return nil, fmt.Errorf("`%s` item '%s' should have `regexp->replacement` format", option, item)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("`%s` item '%s' contains invalid regexp: %v", option, item, err)
+		}
+		rules[i] = RegexpReplaceRule{Regexp: re, Replacement: replacement}
+	}
+	return rules, nil
+}
+
+// splitSetItems - split SET statement body by commas outside of single quotes
+func splitSetItems(body string) []string {
+	var items []string
+	isQuoted := false
+	start := 0
+	for i := 0; i < len(body); i++ {
+		switch body[i] {
+		case '\\':
+			if isQuoted {
+				i++
+			}
+		case '\'':
+			isQuoted = !isQuoted
+		case ',':
+			if !isQuoted {
+				items = append(items, body[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, body[start:])
+}
+
 // LoadConfig - load config from file + environment variables
 func LoadConfig(configLocation string) (*Config, error) {
 	cfg := DefaultConfig()
@@ -296,6 +473,9 @@ func ValidateConfig(cfg *Config) error {
 	if cfg.GetCompressionFormat() == "unknown" {
 		return fmt.Errorf("'%s' is unknown remote storage", cfg.General.RemoteStorage)
 	}
+	if cfg.Filesystem.CopyConcurrency == 0 {
+		return fmt.Errorf("`filesystem->copy_concurrency` shall be greater than 0")
+	}
 	if cfg.General.RemoteStorage == "ftp" && (cfg.FTP.Concurrency < cfg.General.DownloadConcurrency || cfg.FTP.Concurrency < cfg.General.UploadConcurrency) {
 		return fmt.Errorf(
 			"FTP_CONCURRENCY=%d should be great or equal than DOWNLOAD_CONCURRENCY=%d and UPLOAD_CONCURRENCY=%d",
@@ -373,6 +553,37 @@ func ValidateConfig(cfg *Config) error {
 	} else {
 		return fmt.Errorf("empty custom command timeout")
 	}
+	if cfg.Filesystem.DetachedStagingPath != "" && !filepath.IsAbs(cfg.Filesystem.DetachedStagingPath) {
+		return fmt.Errorf("`detached_staging_path` should be absolute path, got '%s'", cfg.Filesystem.DetachedStagingPath)
+	}
+	if preambleSettings, err := ParseDDLPreamble(cfg.General.RestoreDDLPreamble); err != nil {
+		return err
+	} else if err = CheckSessionSettings("restore_ddl_preamble", preambleSettings); err != nil {
+		return err
+	}
+	if err := CheckSessionSettings("restore_session_settings", cfg.General.RestoreSessionSettings); err != nil {
+		return err
+	}
+	if _, err := ParseRegexpReplaceRules("restore_zookeeper_path_mapping", cfg.General.RestoreZookeeperPathMapping); err != nil {
+		return err
+	}
+	if _, err := ParseRegexpReplaceRules("restore_schema_transform_rules", cfg.General.RestoreSchemaTransformRules); err != nil {
+		return err
+	}
+	if cfg.ClickHouse.RestartCommandTimeout != "" {
+		if duration, err := time.ParseDuration(cfg.ClickHouse.RestartCommandTimeout); err != nil {
+			return fmt.Errorf("invalid restart command timeout: %v", err)
+		} else {
+			cfg.ClickHouse.RestartCommandTimeoutDuration = duration
+		}
+	} else {
+		return fmt.Errorf("empty restart command timeout")
+	}
+	for _, env := range cfg.ClickHouse.RestartCommandEnv {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("`restart_command_env` item '%s' should have `NAME=value` format", env)
+		}
+	}
 	if cfg.General.RetriesPause != "" {
 		if duration, err := time.ParseDuration(cfg.General.RetriesPause); err != nil {
 			return fmt.Errorf("invalid retries pause: %v", err)
@@ -382,6 +593,40 @@ func ValidateConfig(cfg *Config) error {
 	} else {
 		return fmt.Errorf("empty retries pause")
 	}
+	if cfg.General.RestoreLockMode != "none" && cfg.General.RestoreLockMode != "global" && cfg.General.RestoreLockMode != "database" {
+		return fmt.Errorf("`restore_lock_mode: %s` should be `none`, `global` or `database`", cfg.General.RestoreLockMode)
+	}
+	if cfg.General.RestoreLockTimeout != "" {
+		if duration, err := time.ParseDuration(cfg.General.RestoreLockTimeout); err != nil {
+			return fmt.Errorf("invalid restore lock timeout: %v", err)
+		} else {
+			cfg.General.RestoreLockTimeoutDuration = duration
+		}
+	}
+	if cfg.General.RestoreFunctionsMode != "replace" && cfg.General.RestoreFunctionsMode != "skip" {
+		return fmt.Errorf("`restore_functions_mode: %s` should be `replace` or `skip`", cfg.General.RestoreFunctionsMode)
+	}
+	if cfg.General.RestoreOverlappingPartsMode != "force" && cfg.General.RestoreOverlappingPartsMode != "skip" {
+		return fmt.Errorf("`restore_overlapping_parts_mode: %s` should be `force` or `skip`", cfg.General.RestoreOverlappingPartsMode)
+	}
+	if cfg.General.VerifyActivePartsOnRestore != "none" && cfg.General.VerifyActivePartsOnRestore != "warn" && cfg.General.VerifyActivePartsOnRestore != "error" {
+		return fmt.Errorf("`verify_active_parts_on_restore: %s` should be `none`, `warn` or `error`", cfg.General.VerifyActivePartsOnRestore)
+	}
+	if cfg.General.VerifyAggregateFunctionsOnRestore != "none" && cfg.General.VerifyAggregateFunctionsOnRestore != "warn" && cfg.General.VerifyAggregateFunctionsOnRestore != "error" {
+		return fmt.Errorf("`verify_aggregate_functions_on_restore: %s` should be `none`, `warn` or `error`", cfg.General.VerifyAggregateFunctionsOnRestore)
+	}
+	if cfg.General.RestoreStreamingTablesMode != "create" && cfg.General.RestoreStreamingTablesMode != "skip" && cfg.General.RestoreStreamingTablesMode != "detach" {
+		return fmt.Errorf("`restore_streaming_tables_mode: %s` should be `create`, `skip` or `detach`", cfg.General.RestoreStreamingTablesMode)
+	}
+	for i, rule := range cfg.General.RestoreColumnExclude {
+		tableColumns := strings.SplitN(rule, ":", 2)
+		if (i == 0 && len(tableColumns) != 2) || (len(tableColumns) == 2 && (!strings.Contains(tableColumns[0], ".") || strings.TrimSpace(tableColumns[1]) == "")) {
+			return fmt.Errorf("`restore_column_exclude` rule '%s' should be in `db.table:col1,col2` format", rule)
+		}
+	}
+	if cfg.General.RestoreCopyMode != "hardlink" && cfg.General.RestoreCopyMode != "copy" && cfg.General.RestoreCopyMode != "reflink" {
+		return fmt.Errorf("`restore_copy_mode: %s` should be `hardlink`, `copy` or `reflink`", cfg.General.RestoreCopyMode)
+	}
 	if cfg.General.WatchInterval != "" {
 		if duration, err := time.ParseDuration(cfg.General.WatchInterval); err != nil {
 			return fmt.Errorf("invalid watch interval: %v", err)
@@ -419,27 +664,43 @@ func DefaultConfig() *Config {
 	}
 	return &Config{
 		General: GeneralConfig{
-			RemoteStorage:           "none",
-			MaxFileSize:             0,
-			BackupsToKeepLocal:      0,
-			BackupsToKeepRemote:     0,
-			LogLevel:                "info",
-			DisableProgressBar:      true,
-			UploadConcurrency:       availableConcurrency,
-			DownloadConcurrency:     availableConcurrency,
-			RestoreSchemaOnCluster:  "",
-			UploadByPart:            true,
-			DownloadByPart:          true,
-			UseResumableState:       true,
-			RetriesOnFailure:        3,
-			RetriesPause:            "30s",
-			RetriesDuration:         100 * time.Millisecond,
-			WatchInterval:           "1h",
-			WatchDuration:           1 * time.Hour,
-			FullInterval:            "24h",
-			FullDuration:            24 * time.Hour,
-			WatchBackupNameTemplate: "shard{shard}-{type}-{time:20060102150405}",
-			RestoreDatabaseMapping:  make(map[string]string, 0),
+			RemoteStorage:                     "none",
+			MaxFileSize:                       0,
+			BackupsToKeepLocal:                0,
+			BackupsToKeepRemote:               0,
+			LogLevel:                          "info",
+			DisableProgressBar:                true,
+			UploadConcurrency:                 availableConcurrency,
+			DownloadConcurrency:               availableConcurrency,
+			RestoreSchemaOnCluster:            "",
+			UploadByPart:                      true,
+			DownloadByPart:                    true,
+			UseResumableState:                 true,
+			RetriesOnFailure:                  3,
+			RetriesPause:                      "30s",
+			RetriesDuration:                   100 * time.Millisecond,
+			WatchInterval:                     "1h",
+			WatchDuration:                     1 * time.Hour,
+			FullInterval:                      "24h",
+			FullDuration:                      24 * time.Hour,
+			WatchBackupNameTemplate:           "shard{shard}-{type}-{time:20060102150405}",
+			RestoreDatabaseMapping:            make(map[string]string, 0),
+			RestoreTableMapping:               make(map[string]string, 0),
+			RestoreDiskNameMapping:            make(map[string]string, 0),
+			RestoreS3PathMapping:              make(map[string]string, 0),
+			RestoreSessionSettings:            make(map[string]string, 0),
+			DictionarySourceMapping:           make(map[string]string, 0),
+			RestoreDistributedClusterMapping:  make(map[string]string, 0),
+			RestoreSchemaTransformRules:       make([]string, 0),
+			RestoreStoragePolicyMapping:       make(map[string]string, 0),
+			RestoreFunctionsMode:              "replace",
+			RestoreStreamingTablesMode:        "create",
+			RestoreLockMode:                   "database",
+			RestoreLockTimeout:                "0s",
+			RestoreCopyMode:                   "hardlink",
+			VerifyActivePartsOnRestore:        "none",
+			VerifyAggregateFunctionsOnRestore: "none",
+			RestoreOverlappingPartsMode:       "force",
 		},
 		ClickHouse: ClickHouseConfig{
 			Username: "default",
@@ -457,9 +718,15 @@ func DefaultConfig() *Config {
 			LogSQLQueries:                    true,
 			ConfigDir:                        "/etc/clickhouse-server/",
 			RestartCommand:                   "systemctl restart clickhouse-server",
+			RestartCommandTimeout:            "3m",
+			RestartCommandTimeoutDuration:    3 * time.Minute,
 			IgnoreNotExistsErrorDuringFreeze: true,
 			CheckReplicasBeforeAttach:        true,
 			UseEmbeddedBackupRestore:         false,
+			UseReflink:                       false,
+		},
+		Filesystem: FilesystemConfig{
+			CopyConcurrency: availableConcurrency,
 		},
 		AzureBlob: AzureBlobConfig{
 			EndpointSchema:    "https",
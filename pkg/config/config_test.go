@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDDLPreamble(t *testing.T) {
+	settings, err := ParseDDLPreamble([]string{
+		" set allow_experimental_object_type = 1; ",
+		"SET allow_experimental_window_view=1, format_csv_delimiter = ',', default_table_engine = 'Merge''Tree'",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"allow_experimental_object_type": "1",
+		"allow_experimental_window_view": "1",
+		"format_csv_delimiter":           ",",
+		"default_table_engine":           "Merge'Tree",
+	}, settings)
+	for _, statement := range []string{
+		"CREATE TABLE t (id UInt64) ENGINE=Memory",
+		"SETTINGS allow_experimental_object_type = 1",
+		"SET allow_experimental_object_type",
+		"SET `name` = 1",
+		"SET a = 1; DROP DATABASE db",
+	} {
+		_, err = ParseDDLPreamble([]string{statement})
+		assert.Error(t, err, statement)
+	}
+}
+
+func TestCheckSessionSettings(t *testing.T) {
+	assert.NoError(t, CheckSessionSettings("restore_session_settings", map[string]string{"max_partitions_per_insert_block": "0"}))
+	assert.EqualError(t, CheckSessionSettings("restore_session_settings", map[string]string{"max_threads": "4", "password": "x", "database": "db"}), "`restore_session_settings` contains reserved connection parameters: password, database")
+
+	cfg := DefaultConfig()
+	cfg.General.RestoreSessionSettings = map[string]string{"username": "admin"}
+	assert.EqualError(t, ValidateConfig(cfg), "`restore_session_settings` contains reserved connection parameters: username")
+	cfg = DefaultConfig()
+	cfg.General.RestoreDDLPreamble = []string{"SET secure = 0"}
+	assert.EqualError(t, ValidateConfig(cfg), "`restore_ddl_preamble` contains reserved connection parameters: secure")
+}
+
+func TestValidateRestoreOverlappingPartsMode(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.NoError(t, ValidateConfig(cfg))
+	cfg.General.RestoreOverlappingPartsMode = "skip"
+	assert.NoError(t, ValidateConfig(cfg))
+	cfg.General.RestoreOverlappingPartsMode = "rename"
+	assert.EqualError(t, ValidateConfig(cfg), "`restore_overlapping_parts_mode: rename` should be `force` or `skip`")
+}
+
+func TestValidateRestoreCopyMode(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, copyMode := range []string{"hardlink", "copy", "reflink"} {
+		cfg.General.RestoreCopyMode = copyMode
+		assert.NoError(t, ValidateConfig(cfg))
+	}
+	cfg.General.RestoreCopyMode = "symlink"
+	assert.EqualError(t, ValidateConfig(cfg), "`restore_copy_mode: symlink` should be `hardlink`, `copy` or `reflink`")
+}
+
+func TestParseRegexpReplaceRules(t *testing.T) {
+	rules, err := ParseRegexpReplaceRules("restore_zookeeper_path_mapping", []string{"^/clickhouse/tables/old/->/clickhouse/tables/new/", "/(a)$->/${1}_b"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(rules))
+	assert.Equal(t, "/clickhouse/tables/new/", rules[0].Replacement)
+	assert.Equal(t, "/x/a_b", rules[1].Regexp.ReplaceAllString("/x/a", rules[1].Replacement))
+
+	_, err = ParseRegexpReplaceRules("restore_zookeeper_path_mapping", []string{"/clickhouse/tables/old"})
+	assert.EqualError(t, err, "`restore_zookeeper_path_mapping` item '/clickhouse/tables/old' should have `regexp->replacement` format")
+
+	cfg := DefaultConfig()
+	cfg.General.RestoreZookeeperPathMapping = []string{"(->/new"}
+	assert.Error(t, ValidateConfig(cfg))
+}
@@ -0,0 +1,174 @@
+package filesystemhelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	apexLog "github.com/apex/log"
+)
+
+const (
+	CopyModeHardlink = "hardlink"
+	CopyModeCopy     = "copy"
+	CopyModeReflink  = "reflink"
+)
+
+// LinkOrCopyFile - create dst from src according to copyMode, hardlink fallback to copy when src and dst placed on different filesystems (EXDEV),
+// read-only mounted backup is always another filesystem than ClickHouse data, src is never changed
+// limiter throttles only copied bytes, hardlink and reflink change metadata only, nil limiter means unlimited
+func LinkOrCopyFile(ctx context.Context, src, dst, copyMode string, limiter *RateLimiter) error {
+	switch copyMode {
+	case CopyModeCopy:
+		return copyFileWithRateLimit(ctx, src, dst, limiter)
+	case CopyModeReflink:
+		if err := Reflink(src, dst); err != nil {
+			apexLog.WithField("logger", "LinkOrCopyFile").Debugf("can't reflink '%s' -> '%s': %v, will copy", src, dst, err)
+			return copyFileWithRateLimit(ctx, src, dst, limiter)
+		}
+		return nil
+	default:
+		if err := os.Link(src, dst); err != nil {
+			if errors.Is(err, syscall.EXDEV) {
+				apexLog.WithField("logger", "LinkOrCopyFile").Debugf("'%s' and '%s' placed on different filesystems, will copy", src, dst)
+				return copyFileWithRateLimit(ctx, src, dst, limiter)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// CopyFile - copy regular file content and permissions from src to dst, dst shall not exist
+func CopyFile(src, dst string) error {
+	return copyFileWithRateLimit(context.Background(), src, dst, nil)
+}
+
+func copyFileWithRateLimit(ctx context.Context, src, dst string, limiter *RateLimiter) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := srcFile.Close(); err != nil {
+			apexLog.Warnf("can't close %s: %v", src, err)
+		}
+	}()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	var w io.Writer = dstFile
+	if limiter != nil {
+		w = &rateLimitedWriter{ctx: ctx, w: dstFile, limiter: limiter}
+	}
+	if _, err = io.Copy(w, srcFile); err != nil {
+		_ = dstFile.Close()
+		return fmt.Errorf("can't copy '%s' -> '%s': %w", src, dst, err)
+	}
+	return dstFile.Close()
+}
+
+// IsReflinkSupported - probe ioctl(FICLONE) on temporary files inside dir, dir shall exist
+func IsReflinkSupported(dir string) (bool, error) {
+	probeFile, err := os.CreateTemp(dir, ".reflink_probe_")
+	if err != nil {
+		return false, err
+	}
+	src := probeFile.Name()
+	dst := src + ".clone"
+	defer func() {
+		for _, f := range []string{src, dst} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				apexLog.Warnf("can't remove %s: %v", f, err)
+			}
+		}
+	}()
+	if _, err = probeFile.WriteString("reflink"); err != nil {
+		_ = probeFile.Close()
+		return false, err
+	}
+	if err = probeFile.Close(); err != nil {
+		return false, err
+	}
+	if err = Reflink(src, dst); err != nil {
+		apexLog.WithField("logger", "IsReflinkSupported").Debugf("reflink is not supported in %s: %v", dir, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// MoveDir - rename src directory to dst, when src and dst placed on different filesystems, files moved one by one with copy fallback and src removed after
+// dst shall not exist, parts are never merged with files left by previous restore
+func MoveDir(ctx context.Context, src, dst string, limiter *RateLimiter) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("can't move '%s' -> '%s': %w", src, dst, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err = filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		dstFilePath := filepath.Join(dst, strings.TrimPrefix(filePath, src))
+		if info.IsDir() {
+			return os.MkdirAll(dstFilePath, info.Mode().Perm())
+		}
+		if renameErr := os.Rename(filePath, dstFilePath); renameErr == nil || !errors.Is(renameErr, syscall.EXDEV) {
+			return renameErr
+		}
+		return copyFileWithRateLimit(ctx, filePath, dstFilePath, limiter)
+	}); err != nil {
+		_ = os.RemoveAll(dst)
+		return fmt.Errorf("can't move '%s' -> '%s': %w", src, dst, err)
+	}
+	return os.RemoveAll(src)
+}
+
+// LinkDir - replace dst directory by hardlinks to src files, files copied when src and dst placed on different filesystems,
+// dst is prepared in temporary directory, so dst is left unchanged when link or copy failed
+func LinkDir(ctx context.Context, src, dst string, limiter *RateLimiter) error {
+	tmpDst := dst + ".tmp"
+	if err := os.RemoveAll(tmpDst); err != nil {
+		return err
+	}
+	if err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		dstFilePath := filepath.Join(tmpDst, strings.TrimPrefix(filePath, src))
+		if info.IsDir() {
+			return os.MkdirAll(dstFilePath, info.Mode().Perm())
+		}
+		return LinkOrCopyFile(ctx, filePath, dstFilePath, CopyModeHardlink, limiter)
+	}); err != nil {
+		_ = os.RemoveAll(tmpDst)
+		return fmt.Errorf("can't link '%s' -> '%s': %w", src, dst, err)
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Rename(tmpDst, dst)
+}
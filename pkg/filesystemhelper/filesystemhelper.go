@@ -1,20 +1,31 @@
 package filesystemhelper
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/partition"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
 	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
 	apexLog "github.com/apex/log"
 )
@@ -28,21 +39,37 @@ var (
 // Chown - set permission on path to clickhouse user
 // This is necessary that the ClickHouse will be able to read parts files on restore
 func Chown(path string, ch *clickhouse.ClickHouse, disks []clickhouse.Disk, recursive bool) error {
-	var (
-		dataPath string
-		err      error
-	)
 	if os.Getuid() != 0 {
 		return nil
 	}
+	chUid, chGid, err := getClickHouseOwner(ch, disks)
+	if err != nil {
+		return err
+	}
+	if !recursive {
+		return os.Chown(path, chUid, chGid)
+	}
+	return filepath.Walk(path, func(fName string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(fName, chUid, chGid)
+	})
+}
+
+// getClickHouseOwner - uid and gid of default data path, detected once
+func getClickHouseOwner(ch *clickhouse.ClickHouse, disks []clickhouse.Disk) (int, int, error) {
+	// Chown could be called concurrently from CopyDataToDetached
 	chownLock.Lock()
+	defer chownLock.Unlock()
 	if uid == nil {
-		if dataPath, err = ch.GetDefaultPath(disks); err != nil {
-			return err
+		dataPath, err := ch.GetDefaultPath(disks)
+		if err != nil {
+			return 0, 0, err
 		}
 		info, err := os.Stat(dataPath)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
 		stat := info.Sys().(*syscall.Stat_t)
 		intUid := int(stat.Uid)
@@ -50,16 +77,70 @@ func Chown(path string, ch *clickhouse.ClickHouse, disks []clickhouse.Disk, recu
 		uid = &intUid
 		gid = &intGid
 	}
-	chownLock.Unlock()
-	if !recursive {
-		return os.Chown(path, *uid, *gid)
+	return *uid, *gid, nil
+}
+
+// FixOwnership - recursively chown files and directories inside path which owned by other user than clickhouse, return fixed paths count
+func FixOwnership(path string, ch *clickhouse.ClickHouse, disks []clickhouse.Disk) (int, error) {
+	if os.Getuid() != 0 {
+		return 0, fmt.Errorf("fix ownership requires root privileges, current uid %d", os.Getuid())
 	}
-	return filepath.Walk(path, func(fName string, f os.FileInfo, err error) error {
+	chUid, chGid, err := getClickHouseOwner(ch, disks)
+	if err != nil {
+		return 0, err
+	}
+	return fixOwnership(path, chUid, chGid)
+}
+
+func fixOwnership(path string, chUid, chGid int) (int, error) {
+	fixed := 0
+	err := filepath.Walk(path, func(fName string, f os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		return os.Chown(fName, *uid, *gid)
+		stat, ok := f.Sys().(*syscall.Stat_t)
+		if ok && int(stat.Uid) == chUid && int(stat.Gid) == chGid {
+			return nil
+		}
+		// restored file could be hardlink to backup file, chown would change backup too, so replace it with own copy before
+		if ok && f.Mode().IsRegular() && stat.Nlink > 1 {
+			if err = replaceWithCopy(fName); err != nil {
+				return err
+			}
+		}
+		if err = os.Lchown(fName, chUid, chGid); err != nil {
+			return err
+		}
+		fixed++
+		return nil
 	})
+	return fixed, err
+}
+
+// replaceWithCopy - break hardlink, fName replaced atomically by copy with the same content and permissions
+func replaceWithCopy(fName string) error {
+	tmpName := fName + ".fix_ownership_tmp"
+	if err := CopyFile(fName, tmpName); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fName); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// isClickHouseOwner - Chown change owner only when running as root, so hardlinked file with other owner would change owner of backup file
+func isClickHouseOwner(info os.FileInfo, ch *clickhouse.ClickHouse, disks []clickhouse.Disk) (bool, error) {
+	if os.Getuid() != 0 {
+		return true, nil
+	}
+	chUid, chGid, err := getClickHouseOwner(ch, disks)
+	if err != nil {
+		return false, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return !ok || (int(stat.Uid) == chUid && int(stat.Gid) == chGid), nil
 }
 
 func Mkdir(name string, ch *clickhouse.ClickHouse, disks []clickhouse.Disk) error {
@@ -115,70 +196,482 @@ func MkdirAll(path string, ch *clickhouse.ClickHouse, disks []clickhouse.Disk) e
 	return nil
 }
 
-// CopyDataToDetached - copy partitions for specific table to detached folder
+// CopyDataToDetached - copy partitions for specific table to detached folder, `general->restore_copy_mode` allow hardlink, copy or reflink files
+// disks processed in parallel according to `filesystem->copy_concurrency`, return summary size of copied files
+// copy fallback throttled according to `filesystem->restore_io_rate_limit`, limit shared between disks
 // TODO: check when disk exists in backup, but miss in ClickHouse
-func CopyDataToDetached(backupName string, backupTable metadata.TableMetadata, disks []clickhouse.Disk, tableDataPaths []string, ch *clickhouse.ClickHouse) error {
-	dstDataPaths := clickhouse.GetDisksByPaths(disks, tableDataPaths)
+// requiredBackups - chain of base backups for incremental backup, parts which absent in backupName will search in them
+func CopyDataToDetached(ctx context.Context, backupName string, requiredBackups []string, backupTable metadata.TableMetadata, disks []clickhouse.Disk, tableDataPaths []string, ch *clickhouse.ClickHouse, cfg *config.Config) (uint64, error) {
+	dstDataPaths := applyDiskNameMapping(clickhouse.GetDisksByPaths(disks, tableDataPaths), cfg.General.RestoreDiskNameMapping)
 	log := apexLog.WithFields(apexLog.Fields{"operation": "CopyDataToDetached"})
 	start := time.Now()
+	size := uint64(0)
+	if err := checkMissingParts(backupName, requiredBackups, backupTable, disks, cfg.General.RestoreSkipMissingParts, log); err != nil {
+		return 0, err
+	}
+	limiter := NewRateLimiter(cfg.Filesystem.RestoreIORateLimit)
+	excludeColumns := cfg.GetRestoreColumnExclude(backupTable.Database, backupTable.Table)
+	if len(excludeColumns) > 0 {
+		if err := checkExcludedColumnsInNotWideParts(backupName, requiredBackups, backupTable, disks, excludeColumns); err != nil {
+			return 0, err
+		}
+	}
+	copySemaphore := semaphore.NewWeighted(int64(cfg.Filesystem.CopyConcurrency))
+	copyGroup, copyCtx := errgroup.WithContext(ctx)
 	for _, backupDisk := range disks {
-		backupDiskName := backupDisk.Name
-		if len(backupTable.Parts[backupDiskName]) == 0 {
+		if len(backupTable.Parts[backupDisk.Name]) == 0 {
 			log.Debugf("%s disk have no parts", backupDisk.Name)
 			continue
 		}
-		detachedParentDir := filepath.Join(dstDataPaths[backupDisk.Name], "detached")
-		for _, part := range backupTable.Parts[backupDiskName] {
-			detachedPath := filepath.Join(detachedParentDir, part.Name)
-			info, err := os.Stat(detachedPath)
+		if err := copySemaphore.Acquire(copyCtx, 1); err != nil {
+			log.Errorf("can't acquire semaphore during CopyDataToDetached: %v", err)
+			break
+		}
+		backupDisk := backupDisk
+		copyGroup.Go(func() error {
+			defer copySemaphore.Release(1)
+			dstDataPath := getDstDataPath(backupDisk, dstDataPaths, tableDataPaths)
+			if _, isTableDisk := dstDataPaths[backupDisk.Name]; !isTableDisk {
+				log.Debugf("%s disk is not used by %s.%s, parts will restored to %s", backupDisk.Name, backupTable.Database, backupTable.Table, dstDataPath)
+			}
+			copyDataPath := dstDataPath
+			if cfg.Filesystem.DetachedStagingPath != "" {
+				copyDataPath = getStagingDataPath(cfg.Filesystem.DetachedStagingPath, dstDataPath)
+			}
+			diskSize, err := copyDiskDataToDetached(copyCtx, backupName, requiredBackups, backupTable, backupDisk, copyDataPath, disks, ch, cfg.General.RestoreCopyMode, cfg.Filesystem.FsyncOnRestore, cfg.Filesystem.ClearImmutableOnRestore, limiter, excludeColumns, cfg.General.RestoreS3PathMapping)
+			atomic.AddUint64(&size, diskSize)
+			if err == nil && copyDataPath != dstDataPath {
+				err = moveStagedParts(copyCtx, backupTable, backupDisk, copyDataPath, dstDataPath, disks, ch, cfg.Filesystem.FsyncOnRestore, limiter)
+			}
+			return err
+		})
+	}
+	if err := copyGroup.Wait(); err != nil {
+		return 0, err
+	}
+	duration := time.Since(start)
+	log = log.WithField("duration", utils.HumanizeDuration(duration))
+	if copiedBytes := limiter.CopiedBytes(); copiedBytes > 0 && duration > 0 {
+		log = log.WithFields(apexLog.Fields{
+			"copied":     utils.FormatBytes(copiedBytes),
+			"throughput": utils.FormatBytes(uint64(float64(copiedBytes)/duration.Seconds())) + "/s",
+		})
+		if cfg.Filesystem.RestoreIORateLimit > 0 {
+			log.Infof("%s.%s copied with `restore_io_rate_limit: %s/s`", backupTable.Database, backupTable.Table, utils.FormatBytes(cfg.Filesystem.RestoreIORateLimit))
+			return size, nil
+		}
+	}
+	log.Debugf("done")
+	return size, nil
+}
+
+// getStagingDataPath - staging directory repeats full table data path, so tables and disks never share the same staging `detached` folder, `filesystem->detached_staging_path`
+func getStagingDataPath(stagingPath, dstDataPath string) string {
+	return filepath.Join(stagingPath, dstDataPath)
+}
+
+// moveStagedParts - move parts from staging `detached` to table `detached` before ATTACH PART, rename when staging path placed on the same filesystem, copy otherwise
+func moveStagedParts(ctx context.Context, backupTable metadata.TableMetadata, backupDisk clickhouse.Disk, stagingDataPath, dstDataPath string, disks []clickhouse.Disk, ch *clickhouse.ClickHouse, fsyncOnRestore bool, limiter *RateLimiter) error {
+	log := apexLog.WithFields(apexLog.Fields{"operation": "CopyDataToDetached", "disk": backupDisk.Name})
+	stagingDetachedDir := filepath.Join(stagingDataPath, "detached")
+	detachedParentDir := filepath.Join(dstDataPath, "detached")
+	if err := MkdirAll(detachedParentDir, ch, disks); err != nil {
+		return fmt.Errorf("can't create '%s': %w", detachedParentDir, err)
+	}
+	for _, part := range backupTable.Parts[backupDisk.Name] {
+		if IsProjection(part.Name) {
+			continue
+		}
+		stagedPath := filepath.Join(stagingDetachedDir, part.Name)
+		detachedPath := filepath.Join(detachedParentDir, part.Name)
+		log.Debugf("move %s -> %s", stagedPath, detachedPath)
+		if err := MoveDir(ctx, stagedPath, detachedPath, limiter); err != nil {
+			return fmt.Errorf("can't move staged part '%s' to '%s': %w", part.Name, detachedParentDir, err)
+		}
+		if err := Chown(detachedPath, ch, disks, true); err != nil {
+			return err
+		}
+		if fsyncOnRestore {
+			syncPaths := make([]string, 0)
+			if err := filepath.Walk(detachedPath, func(filePath string, info os.FileInfo, err error) error {
+				if err == nil {
+					syncPaths = append(syncPaths, filePath)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			if err := SyncPaths(append(syncPaths, detachedParentDir)); err != nil {
+				return fmt.Errorf("can't fsync part '%s': %w", part.Name, err)
+			}
+		}
+	}
+	if err := os.Remove(stagingDetachedDir); err != nil && !os.IsNotExist(err) {
+		log.Debugf("can't remove staging directory %s: %v", stagingDetachedDir, err)
+	}
+	return nil
+}
+
+// applyDiskNameMapping - parts from renamed backup disk shall be placed to table data path on mapped disk, `general->restore_disk_name_mapping`
+func applyDiskNameMapping(dstDataPaths map[string]string, diskNameMapping map[string]string) map[string]string {
+	for backupDiskName, diskName := range diskNameMapping {
+		if dstDataPath, isTableDisk := dstDataPaths[diskName]; isTableDisk {
+			dstDataPaths[backupDiskName] = dstDataPath
+		}
+	}
+	return dstDataPaths
+}
+
+// getDstDataPath - table could use another storage policy than during backup, so place parts to the first disk of current storage policy
+func getDstDataPath(backupDisk clickhouse.Disk, dstDataPaths map[string]string, tableDataPaths []string) string {
+	dstDataPath, isTableDisk := dstDataPaths[backupDisk.Name]
+	if !isTableDisk && len(tableDataPaths) > 0 {
+		dstDataPath = tableDataPaths[0]
+	}
+	return dstDataPath
+}
+
+// GetDetachedPartPaths - paths inside `detached` folder where CopyDataToDetached placed parts of backupTable
+func GetDetachedPartPaths(backupTable metadata.TableMetadata, disks []clickhouse.Disk, tableDataPaths []string, diskNameMapping map[string]string) []string {
+	dstDataPaths := applyDiskNameMapping(clickhouse.GetDisksByPaths(disks, tableDataPaths), diskNameMapping)
+	var detachedPaths []string
+	for _, backupDisk := range disks {
+		for _, part := range backupTable.Parts[backupDisk.Name] {
+			if !IsProjection(part.Name) {
+				detachedPaths = append(detachedPaths, filepath.Join(getDstDataPath(backupDisk, dstDataPaths, tableDataPaths), "detached", part.Name))
+			}
+		}
+	}
+	return detachedPaths
+}
+
+// RemoveEmptyDetachedDirs - remove directories inside `detached` which don't contain any regular file, symlinks are not followed and not removed
+// when dryRun is true, nothing removed, return paths which would be removed
+func RemoveEmptyDetachedDirs(detachedPaths []string, dryRun bool) ([]string, error) {
+	var removedPaths []string
+	for _, detachedPath := range detachedPaths {
+		info, err := os.Lstat(detachedPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removedPaths, err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		isEmpty := true
+		if err = filepath.Walk(detachedPath, func(filePath string, info os.FileInfo, err error) error {
 			if err != nil {
-				if os.IsNotExist(err) {
-					log.Debugf("MkDirAll %s", detachedPath)
-					if mkdirErr := MkdirAll(detachedPath, ch, disks); mkdirErr != nil {
-						log.Warnf("error during Mkdir %+v", mkdirErr)
+				return err
+			}
+			if !info.IsDir() {
+				isEmpty = false
+				return filepath.SkipDir
+			}
+			return nil
+		}); err != nil {
+			return removedPaths, err
+		}
+		if !isEmpty {
+			continue
+		}
+		if !dryRun {
+			if err = os.RemoveAll(detachedPath); err != nil {
+				return removedPaths, err
+			}
+		}
+		removedPaths = append(removedPaths, detachedPath)
+	}
+	return removedPaths, nil
+}
+
+// GetBackupPartPath - return part path inside backupName, or inside first of requiredBackups which contains part, path inside backupName returned when part not found
+func GetBackupPartPath(backupName string, requiredBackups []string, backupTable metadata.TableMetadata, backupDisk clickhouse.Disk, partName string) string {
+	dbAndTableDir := path.Join(common.TablePathEncode(backupTable.Database), common.TablePathEncode(backupTable.Table))
+	for _, name := range append([]string{backupName}, requiredBackups...) {
+		partPath := path.Join(backupDisk.Path, "backup", name, "shadow", dbAndTableDir, backupDisk.Name, partName)
+		if _, err := os.Stat(partPath); err == nil {
+			return partPath
+		}
+		// Legacy backup support
+		partPath = path.Join(backupDisk.Path, "backup", name, "shadow", dbAndTableDir, partName)
+		if _, err := os.Stat(partPath); err == nil {
+			return partPath
+		}
+	}
+	return path.Join(backupDisk.Path, "backup", backupName, "shadow", dbAndTableDir, backupDisk.Name, partName)
+}
+
+// checkExcludedColumnsInNotWideParts - compact and in-memory parts store all columns inside single data file, excluded column data can't be removed from them,
+// parts without columns.txt can't be rewritten too
+// so restore fails before any part copied instead of attach excluded column data, `general->restore_column_exclude`
+func checkExcludedColumnsInNotWideParts(backupName string, requiredBackups []string, backupTable metadata.TableMetadata, disks []clickhouse.Disk, excludeColumns []string) error {
+	var notWideParts []string
+	for _, backupDisk := range disks {
+		for _, part := range backupTable.Parts[backupDisk.Name] {
+			if IsProjection(part.Name) {
+				continue
+			}
+			partPath := GetBackupPartPath(backupName, requiredBackups, backupTable, backupDisk, part.Name)
+			partFormat, err := GetPartFormat(partPath)
+			if err != nil {
+				return fmt.Errorf("can't restore part '%s': %w", part.Name, err)
+			}
+			if partFormat == PartFormatWide {
+				continue
+			}
+			// part without columns.txt can't be checked and rewritten
+			if partFormat == PartFormatUnknown {
+				notWideParts = append(notWideParts, fmt.Sprintf("%s/%s (%s)", backupDisk.Name, part.Name, partFormat))
+				continue
+			}
+			partColumns, err := getPartColumnNames(partPath)
+			if err != nil {
+				return fmt.Errorf("can't read columns of part '%s': %w", part.Name, err)
+			}
+			for _, column := range excludeColumns {
+				if _, exists := partColumns[column]; exists {
+					notWideParts = append(notWideParts, fmt.Sprintf("%s/%s (%s)", backupDisk.Name, part.Name, partFormat))
+					break
+				}
+			}
+		}
+	}
+	if len(notWideParts) > 0 {
+		return fmt.Errorf("`restore_column_exclude` can't remove columns %s from %s.%s parts %s, they store all columns in single file, remove `restore_column_exclude` rule for this table or create backup after parts became wide, see `min_bytes_for_wide_part` and `min_rows_for_wide_part` settings", strings.Join(excludeColumns, ","), backupTable.Database, backupTable.Table, strings.Join(notWideParts, ", "))
+	}
+	return nil
+}
+
+// checkMissingParts - parts from table metadata could be absent in shadow when download was partially completed
+// when skipMissingParts is true, missing parts excluded from backupTable.Parts to avoid ATTACH PART for them
+func checkMissingParts(backupName string, requiredBackups []string, backupTable metadata.TableMetadata, disks []clickhouse.Disk, skipMissingParts bool, log *apexLog.Entry) error {
+	var missingParts []string
+	for _, backupDisk := range disks {
+		existsParts := make([]metadata.Part, 0, len(backupTable.Parts[backupDisk.Name]))
+		for _, part := range backupTable.Parts[backupDisk.Name] {
+			if !IsProjection(part.Name) {
+				if _, err := os.Stat(GetBackupPartPath(backupName, requiredBackups, backupTable, backupDisk, part.Name)); os.IsNotExist(err) {
+					missingParts = append(missingParts, path.Join(backupDisk.Name, part.Name))
+					continue
+				}
+			}
+			existsParts = append(existsParts, part)
+		}
+		if skipMissingParts && len(existsParts) != len(backupTable.Parts[backupDisk.Name]) {
+			backupTable.Parts[backupDisk.Name] = existsParts
+		}
+	}
+	if len(missingParts) == 0 {
+		return nil
+	}
+	if skipMissingParts {
+		log.Warnf("%s.%s parts %s not found in backup '%s', skipped", backupTable.Database, backupTable.Table, strings.Join(missingParts, ", "), backupName)
+		return nil
+	}
+	return fmt.Errorf("%s.%s parts %s not found in backup '%s', looks like download was not completed, run `download` again or set `restore_skip_missing_parts: true` to restore the rest parts", backupTable.Database, backupTable.Table, strings.Join(missingParts, ", "), backupName)
+}
+
+// copyDiskDataToDetached - copy table parts which placed on backupDisk to detached folder inside dstDataPath
+func copyDiskDataToDetached(ctx context.Context, backupName string, requiredBackups []string, backupTable metadata.TableMetadata, backupDisk clickhouse.Disk, dstDataPath string, disks []clickhouse.Disk, ch *clickhouse.ClickHouse, copyMode string, fsyncOnRestore, clearImmutable bool, limiter *RateLimiter, excludeColumns []string, s3PathMapping map[string]string) (uint64, error) {
+	log := apexLog.WithFields(apexLog.Fields{"operation": "CopyDataToDetached", "disk": backupDisk.Name})
+	size := uint64(0)
+	detachedParentDir := filepath.Join(dstDataPath, "detached")
+	// object disk metadata files contain ref_count which ClickHouse changes during ATTACH PART, hardlink would change files inside backup
+	isObjectDisk := IsObjectDiskType(backupDisk.Type)
+	if isObjectDisk && copyMode != CopyModeCopy {
+		log.Debugf("disk type %s, will copy object disk metadata files instead of %s", backupDisk.Type, copyMode)
+		copyMode = CopyModeCopy
+	}
+	for _, part := range backupTable.Parts[backupDisk.Name] {
+		select {
+		case <-ctx.Done():
+			return size, ctx.Err()
+		default:
+		}
+		// old backups could contain projections in parts list, they copied inside parent part directory
+		if IsProjection(part.Name) {
+			log.Debugf("%s is projection, skipping", part.Name)
+			continue
+		}
+		detachedPath := filepath.Join(detachedParentDir, part.Name)
+		info, err := os.Stat(detachedPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				log.Debugf("MkDirAll %s", detachedPath)
+				if mkdirErr := MkdirAll(detachedPath, ch, disks); mkdirErr != nil {
+					log.Warnf("error during Mkdir %+v", mkdirErr)
+				}
+			} else {
+				return size, err
+			}
+		} else if !info.IsDir() {
+			return size, fmt.Errorf("'%s' should be directory or absent", detachedPath)
+		}
+		partPath := GetBackupPartPath(backupName, requiredBackups, backupTable, backupDisk, part.Name)
+		partFormat, err := GetPartFormat(partPath)
+		if err != nil {
+			return size, fmt.Errorf("can't restore part '%s': %w", part.Name, err)
+		}
+		// files of excluded columns skipped, columns.txt, serialization.json and checksums.txt written after walk, `general->restore_column_exclude`
+		skipFiles := map[string]struct{}{}
+		if len(excludeColumns) > 0 && partFormat == PartFormatWide {
+			if skipFiles, err = getExcludedColumnFiles(partPath, excludeColumns); err != nil {
+				return size, fmt.Errorf("can't get excluded column files for part '%s': %w", part.Name, err)
+			}
+			if len(skipFiles) > 0 {
+				for _, name := range partMetadataFiles {
+					skipFiles[name] = struct{}{}
+				}
+			}
+		}
+		// files and directories synced once per part after all files linked, directories after files
+		var syncFiles, syncDirs []string
+		if err := filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// part could contain thousands of files, shall stop promptly when restore canceled
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			filename := strings.Trim(strings.TrimPrefix(filePath, partPath), "/")
+			dstFilePath := filepath.Join(detachedPath, filename)
+			if info.IsDir() {
+				if IsProjection(info.Name()) {
+					if _, err := os.Stat(path.Join(filePath, "checksums.txt")); err != nil {
+						return fmt.Errorf("projection '%s' is broken: %w", filePath, err)
 					}
-				} else {
-					return err
 				}
-			} else if !info.IsDir() {
-				return fmt.Errorf("'%s' should be directory or absent", detachedPath)
+				log.Debugf("MkDir %s", dstFilePath)
+				if fsyncOnRestore {
+					syncDirs = append(syncDirs, dstFilePath)
+				}
+				return Mkdir(dstFilePath, ch, disks)
 			}
-			dbAndTableDir := path.Join(common.TablePathEncode(backupTable.Database), common.TablePathEncode(backupTable.Table))
-			partPath := path.Join(backupDisk.Path, "backup", backupName, "shadow", dbAndTableDir, backupDisk.Name, part.Name)
-			// Legacy backup support
-			if _, err := os.Stat(partPath); os.IsNotExist(err) {
-				partPath = path.Join(backupDisk.Path, "backup", backupName, "shadow", dbAndTableDir, part.Name)
+			if !info.Mode().IsRegular() {
+				log.Debugf("'%s' is not a regular file, skipping.", filePath)
+				return nil
 			}
-			if err := filepath.Walk(partPath, func(filePath string, info os.FileInfo, err error) error {
-				if err != nil {
+			if _, isSkipped := skipFiles[filename]; isSkipped {
+				return nil
+			}
+			// frozen_metadata.txt is local file created by FREEZE for zero-copy replication
+			if isObjectDisk && info.Name() != "frozen_metadata.txt" {
+				if err := ValidateObjectDiskMetadata(filePath); err != nil {
 					return err
 				}
-				filename := strings.Trim(strings.TrimPrefix(filePath, partPath), "/")
-				dstFilePath := filepath.Join(detachedPath, filename)
-				if info.IsDir() {
-					log.Debugf("MkDir %s", dstFilePath)
-					return Mkdir(dstFilePath, ch, disks)
+			}
+			fileCopyMode := copyMode
+			// hardlink share inode with backup file, so Chown after hardlink would change backup file owner
+			if copyMode == CopyModeHardlink {
+				if isOwner, err := isClickHouseOwner(info, ch, disks); err != nil {
+					return err
+				} else if !isOwner {
+					fileCopyMode = CopyModeCopy
 				}
-				if !info.Mode().IsRegular() {
-					log.Debugf("'%s' is not a regular file, skipping.", filePath)
-					return nil
+			}
+			// object keys refer to source bucket prefix, `general->restore_s3_path_mapping`
+			if isObjectDisk && IsS3DiskType(backupDisk.Type) && len(s3PathMapping) > 0 && info.Name() != "frozen_metadata.txt" {
+				changed, err := CopyObjectDiskMetadataWithPathMapping(ctx, filePath, dstFilePath, fileCopyMode, s3PathMapping, limiter)
+				if err != nil {
+					return fmt.Errorf("failed to rewrite object paths '%s' -> '%s': %w", filePath, dstFilePath, err)
 				}
-				log.Debugf("Link %s -> %s", filePath, dstFilePath)
-				if err := os.Link(filePath, dstFilePath); err != nil {
-					if !os.IsExist(err) {
-						return fmt.Errorf("failed to create hard link '%s' -> '%s': %w", filePath, dstFilePath, err)
-					}
+				log.Debugf("%s %s -> %s, %d object paths rewritten", fileCopyMode, filePath, dstFilePath, changed)
+				size += uint64(info.Size())
+				if fsyncOnRestore {
+					syncFiles = append(syncFiles, dstFilePath)
 				}
 				return Chown(dstFilePath, ch, disks, false)
-			}); err != nil {
-				return fmt.Errorf("error during filepath.Walk for part '%s': %w", part.Name, err)
 			}
+			log.Debugf("%s %s -> %s", fileCopyMode, filePath, dstFilePath)
+			err = LinkOrCopyFile(ctx, filePath, dstFilePath, fileCopyMode, limiter)
+			if err != nil && clearImmutable && (errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)) {
+				err = clearImmutableAndRetry(ctx, filePath, dstFilePath, fileCopyMode, limiter, err, log)
+			}
+			if err != nil {
+				if !os.IsExist(err) {
+					return fmt.Errorf("failed to %s '%s' -> '%s': %w", fileCopyMode, filePath, dstFilePath, err)
+				}
+			}
+			size += uint64(info.Size())
+			if fsyncOnRestore {
+				syncFiles = append(syncFiles, dstFilePath)
+			}
+			return Chown(dstFilePath, ch, disks, false)
+		}); err != nil {
+			return size, fmt.Errorf("error during filepath.Walk for part '%s': %w", part.Name, err)
+		}
+		if len(skipFiles) > 0 {
+			writtenFiles, err := writePartMetadataWithoutColumns(partPath, detachedPath, excludeColumns, skipFiles)
+			if err != nil {
+				return size, fmt.Errorf("can't exclude columns %s from part '%s': %w", strings.Join(excludeColumns, ","), part.Name, err)
+			}
+			for _, writtenFile := range writtenFiles {
+				if err = Chown(writtenFile, ch, disks, false); err != nil {
+					return size, err
+				}
+			}
+			if fsyncOnRestore {
+				syncFiles = append(syncFiles, writtenFiles...)
+			}
+			log.Debugf("%s excluded %d column files", detachedPath, len(skipFiles)-len(partMetadataFiles))
+		}
+		if fsyncOnRestore {
+			// deepest directories first, `detached` itself shall contain durable entry for part directory
+			for i := len(syncDirs) - 1; i >= 0; i-- {
+				syncFiles = append(syncFiles, syncDirs[i])
+			}
+			syncFiles = append(syncFiles, detachedParentDir)
+			if err := SyncPaths(syncFiles); err != nil {
+				return size, fmt.Errorf("can't fsync part '%s': %w", part.Name, err)
+			}
+			log.Debugf("fsync %s, %d files and directories", detachedPath, len(syncFiles))
+		}
+	}
+	return size, nil
+}
+
+// clearImmutableAndRetry - frozen parts inside `shadow` could have immutable attribute which not allow hardlink, `filesystem->clear_immutable_on_restore`
+func clearImmutableAndRetry(ctx context.Context, filePath, dstFilePath, copyMode string, limiter *RateLimiter, linkErr error, log *apexLog.Entry) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("%w, `clear_immutable_on_restore: true` require root privileges to clear immutable attribute, run `chattr -i '%s'` manually", linkErr, filePath)
+	}
+	cleared, err := ClearImmutable(filePath)
+	if err != nil {
+		return fmt.Errorf("%w, can't clear immutable attribute on '%s': %v, run `chattr -i` manually", linkErr, filePath, err)
+	}
+	if !cleared {
+		return linkErr
+	}
+	log.Warnf("immutable attribute cleared on %s", filePath)
+	return LinkOrCopyFile(ctx, filePath, dstFilePath, copyMode, limiter)
+}
+
+// SyncPaths - fsync files and directories, to make sure data and directory entries are durable
+func SyncPaths(paths []string) error {
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("fsync '%s': %w", p, err)
 		}
 	}
-	log.WithField("duration", utils.HumanizeDuration(time.Since(start))).Debugf("done")
 	return nil
 }
 
+// IsProjection - part subdirectory which contains materialized projection data
+func IsProjection(partName string) bool {
+	return strings.HasSuffix(partName, ".proj")
+}
+
 func IsPartInPartition(partName string, partitionsBackupMap common.EmptyMap) bool {
 	_, ok := partitionsBackupMap[strings.Split(partName, "_")[0]]
 	return ok
@@ -190,11 +683,17 @@ func IsFileInPartition(disk, fileName string, partitionsBackupMap common.EmptyMa
 	return ok
 }
 
-func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.EmptyMap) ([]metadata.Part, int64, error) {
+func MoveShadow(ctx context.Context, shadowPath, backupPartsPath string, partitionsBackupMap common.EmptyMap, useReflink bool) ([]metadata.Part, int64, error) {
 	log := apexLog.WithField("logger", "MoveShadow")
 	size := int64(0)
 	parts := make([]metadata.Part, 0)
 	err := filepath.Walk(shadowPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
 		// possible relative path
 		// store / 1f9 / 1f9dc899-0de9-41f8-b95c-26c1f0d67d93 / 20181023_2_2_0 / checksums.txt
 		// store / 1f9 / 1f9dc899-0de9-41f8-b95c-26c1f0d67d93 / 20181023_2_2_0 / x.proj / checksums.txt
@@ -210,10 +709,14 @@ func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.E
 		}
 		dstFilePath := filepath.Join(backupPartsPath, pathParts[3])
 		if info.IsDir() {
-			if !strings.HasSuffix(pathParts[3], ".proj") {
+			// projections and other nested directories are moved together with parent part, and shall not be attached separately
+			if !strings.Contains(pathParts[3], "/") && !IsProjection(pathParts[3]) {
 				parts = append(parts, metadata.Part{
 					Name: pathParts[3],
+					Rows: readPartRows(filePath),
 				})
+			} else if IsProjection(pathParts[3]) {
+				log.Debugf("projection %s", pathParts[3])
 			}
 			return os.MkdirAll(dstFilePath, 0750)
 		}
@@ -222,12 +725,33 @@ func MoveShadow(shadowPath, backupPartsPath string, partitionsBackupMap common.E
 			return nil
 		}
 		size += info.Size()
+		if useReflink {
+			reflinkErr := Reflink(filePath, dstFilePath)
+			if reflinkErr == nil {
+				return nil
+			}
+			log.Debugf("can't reflink '%s' -> '%s': %v, will rename", filePath, dstFilePath, reflinkErr)
+		}
 		return os.Rename(filePath, dstFilePath)
 	})
 	return parts, size, err
 }
 
-func IsDuplicatedParts(part1, part2 string) error {
+// readPartRows - return rows count from part count.txt, 0 when count.txt absent
+func readPartRows(partPath string) uint64 {
+	countContent, err := os.ReadFile(filepath.Join(partPath, "count.txt"))
+	if err != nil {
+		return 0
+	}
+	rows, err := strconv.ParseUint(strings.TrimSpace(string(countContent)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return rows
+}
+
+// IsDuplicatedParts - check two parts contain the same files, when compareContent is true, files which are not hard links to the same inode compared by size and content
+func IsDuplicatedParts(part1, part2 string, compareContent bool) error {
 	log := apexLog.WithField("logger", "IsDuplicatedParts")
 	p1, err := os.Open(part1)
 	if err != nil {
@@ -258,6 +782,13 @@ func IsDuplicatedParts(part1, part2 string) error {
 	if len(pf1) != len(pf2) {
 		return fmt.Errorf("files count in parts is different")
 	}
+	// checksums.txt contains hashes for all part files, so when it is the same, size comparison is enough
+	checksumsMatched := false
+	if compareContent {
+		if checksumsMatched, err = IsSameFileContent(path.Join(part1, "checksums.txt"), path.Join(part2, "checksums.txt")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	for _, f := range pf1 {
 		part1File, err := os.Stat(path.Join(part1, f))
 		if err != nil {
@@ -267,57 +798,189 @@ func IsDuplicatedParts(part1, part2 string) error {
 		if err != nil {
 			return err
 		}
-		if !os.SameFile(part1File, part2File) {
+		if os.SameFile(part1File, part2File) {
+			continue
+		}
+		if !compareContent {
 			return fmt.Errorf("file '%s' is different", f)
 		}
+		if part1File.IsDir() || part2File.IsDir() {
+			if part1File.IsDir() && part2File.IsDir() {
+				if err := IsDuplicatedParts(path.Join(part1, f), path.Join(part2, f), compareContent); err != nil {
+					return fmt.Errorf("%s: %v", f, err)
+				}
+				continue
+			}
+			return fmt.Errorf("file '%s' is different", f)
+		}
+		if part1File.Size() != part2File.Size() {
+			return fmt.Errorf("file '%s' size is different", f)
+		}
+		if checksumsMatched {
+			continue
+		}
+		if isSame, err := IsSameFileContent(path.Join(part1, f), path.Join(part2, f)); err != nil {
+			return err
+		} else if !isSame {
+			return fmt.Errorf("file '%s' content is different", f)
+		}
 	}
 	return nil
 }
 
+// IsSameFileContent - compare sha256 hashes of two files
+func IsSameFileContent(file1, file2 string) (bool, error) {
+	hash1, err := calculateFileHash(file1)
+	if err != nil {
+		return false, err
+	}
+	hash2, err := calculateFileHash(file2)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash1, hash2), nil
+}
+
+func calculateFileHash(fileName string) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			apexLog.Warnf("can't close %s: %v", fileName, err)
+		}
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
 var partitionTupleRE = regexp.MustCompile(`\)\s*,\s*\(`)
+var partitionKeywordRE = regexp.MustCompile(`(?i)^PARTITION\s+`)
+var partitionFunctionRE = regexp.MustCompile(`^\w+\s*\(`)
+var partitionTableScopeRE = regexp.MustCompile(`^([^\s:().,'"]+\.[^\s:().,'"]+):(.+)$`)
 
-func CreatePartitionsToBackupMap(ch *clickhouse.ClickHouse, tablesFromClickHouse []clickhouse.Table, tablesFromMetadata []metadata.TableMetadata, partitions []string) (common.EmptyMap, []string) {
-	if len(partitions) == 0 {
-		return make(common.EmptyMap, 0), partitions
+// ParsePartitionTableScope - `db.table:(val)` syntax, partition value applied only to tables matched with db.table pattern, allow ? and * as wildcard
+func ParsePartitionTableScope(partitionArg string) (string, string) {
+	if matches := partitionTableScopeRE.FindStringSubmatch(partitionArg); matches != nil {
+		return matches[1], strings.Trim(matches[2], " \t")
+	}
+	return "", partitionArg
+}
+
+func isPartitionTableInScope(scope, database, table string) bool {
+	if scope == "" {
+		return true
 	}
+	matched, err := filepath.Match(scope, database+"."+table)
+	return err == nil && matched
+}
 
-	partitionsMap := common.EmptyMap{}
+// GetUnmatchedPartitionTableScopes - `db.table:` scopes from --partitions which don't match any table, such values would be silently ignored
+func GetUnmatchedPartitionTableScopes(partitions []string, tables []metadata.TableTitle) []string {
+	var unmatchedScopes []string
+	for _, partitionArg := range partitions {
+		scope, _ := ParsePartitionTableScope(strings.Trim(partitionArg, " \t"))
+		if scope == "" {
+			continue
+		}
+		isMatched := false
+		for _, table := range tables {
+			if isPartitionTableInScope(scope, table.Database, table.Table) {
+				isMatched = true
+				break
+			}
+		}
+		if !isMatched {
+			unmatchedScopes = append(unmatchedScopes, scope)
+		}
+	}
+	return unmatchedScopes
+}
+
+// CreatePartitionsToBackupMap - partition_id filter for each table, `db.table:` scoped values applied only to matched tables, tables which absent in result map are not filtered
+// hashed partition_id depends on PARTITION BY expression, so it calculated for each table separately
+func CreatePartitionsToBackupMap(ch *clickhouse.ClickHouse, tablesFromClickHouse []clickhouse.Table, tablesFromMetadata []metadata.TableMetadata, partitions []string) (map[metadata.TableTitle]common.EmptyMap, error) {
+	partitionsMap := map[metadata.TableTitle]common.EmptyMap{}
+	if len(partitions) == 0 {
+		return partitionsMap, nil
+	}
+	type partitionTable struct {
+		metadata.TableTitle
+		Query string
+	}
+	tables := make([]partitionTable, 0, len(tablesFromClickHouse)+len(tablesFromMetadata))
+	for _, item := range tablesFromClickHouse {
+		tables = append(tables, partitionTable{TableTitle: metadata.TableTitle{Database: item.Database, Table: item.Name}, Query: item.CreateTableQuery})
+	}
+	for _, item := range tablesFromMetadata {
+		tables = append(tables, partitionTable{TableTitle: metadata.TableTitle{Database: item.Database, Table: item.Table}, Query: item.Query})
+	}
+	addPartitionId := func(table metadata.TableTitle, partitionId string) {
+		if _, exists := partitionsMap[table]; !exists {
+			partitionsMap[table] = common.EmptyMap{}
+		}
+		partitionsMap[table][partitionId] = struct{}{}
+	}
+	// resolvePartitionId - add partition_id for partitionValue to table filter, return false when partition_id can't be calculated, for example for not MergeTree table
+	resolvePartitionId := func(table partitionTable, partitionValue string) (bool, error) {
+		err, partitionId := partition.GetPartitionId(ch, table.Database, table.Table, table.Query, partitionValue)
+		if err != nil {
+			return false, err
+		}
+		if partitionId == "" {
+			return false, nil
+		}
+		addPartitionId(table.TableTitle, partitionId)
+		return true, nil
+	}
 
 	// to allow use --partitions val1 --partitions val2, https://github.com/AlexAkulov/clickhouse-backup/issues/425#issuecomment-1149855063
 	for _, partitionArg := range partitions {
-		partitionArg = strings.Trim(partitionArg, " \t")
-		// when PARTITION BY clause return partition_id field as hash, https://github.com/AlexAkulov/clickhouse-backup/issues/602
-		if strings.HasPrefix(partitionArg, "(") {
-			partitionArg = strings.TrimSuffix(strings.TrimPrefix(partitionArg, "("), ")")
-			for _, partitionTuple := range partitionTupleRE.Split(partitionArg, -1) {
-				for _, item := range tablesFromClickHouse {
-					if err, partitionId := partition.GetPartitionId(ch, item.Database, item.Name, item.CreateTableQuery, partitionTuple); err != nil {
-						apexLog.Errorf("partition.GetPartitionId error: %v", err)
-						return make(common.EmptyMap, 0), partitions
-					} else if partitionId != "" {
-						partitionsMap[partitionId] = struct{}{}
-					}
+		scope, partitionArg := ParsePartitionTableScope(strings.Trim(partitionArg, " \t"))
+		// ALTER TABLE ... PARTITION expr style, https://clickhouse.com/docs/en/sql-reference/statements/alter/partition#how-to-set-partition-expression
+		isPartitionExpression := partitionKeywordRE.MatchString(partitionArg)
+		if isPartitionExpression {
+			partitionArg = strings.Trim(partitionKeywordRE.ReplaceAllString(partitionArg, ""), " \t")
+			if partitionFunctionRE.MatchString(partitionArg) {
+				evaluatedValue, err := partition.EvaluatePartitionExpression(ch, partitionArg)
+				if err != nil {
+					return nil, fmt.Errorf("can't resolve PARTITION %s: %v", partitionArg, err)
 				}
-				for _, item := range tablesFromMetadata {
-					if err, partitionId := partition.GetPartitionId(ch, item.Database, item.Table, item.Query, partitionTuple); err != nil {
-						apexLog.Errorf("partition.GetPartitionId error: %v", err)
-						return make(common.EmptyMap, 0), partitions
-					} else if partitionId != "" {
-						partitionsMap[partitionId] = struct{}{}
+				partitionArg = evaluatedValue
+			}
+		}
+		inScope, resolved := false, false
+		for _, table := range tables {
+			if !isPartitionTableInScope(scope, table.Database, table.Table) {
+				continue
+			}
+			inScope = true
+			// when PARTITION BY clause return partition_id field as hash, https://github.com/AlexAkulov/clickhouse-backup/issues/602
+			if strings.HasPrefix(partitionArg, "(") {
+				for _, partitionTuple := range partitionTupleRE.Split(strings.TrimSuffix(strings.TrimPrefix(partitionArg, "("), ")"), -1) {
+					if _, err := resolvePartitionId(table, partitionTuple); err != nil {
+						return nil, fmt.Errorf("can't resolve partition %s for %s.%s: %v", partitionTuple, table.Database, table.Table, err)
 					}
 				}
-			}
-		} else {
-			for _, item := range strings.Split(partitionArg, ",") {
-				partitionsMap[strings.Trim(item, " \t")] = struct{}{}
+			} else if isPartitionExpression {
+				isResolved, err := resolvePartitionId(table, partitionArg)
+				if err != nil {
+					return nil, fmt.Errorf("can't resolve PARTITION %s for %s.%s: %v", partitionArg, table.Database, table.Table, err)
+				}
+				resolved = resolved || isResolved
+			} else {
+				for _, item := range strings.Split(partitionArg, ",") {
+					addPartitionId(table.TableTitle, strings.Trim(item, " \t"))
+				}
 			}
 		}
+		if isPartitionExpression && inScope && !resolved {
+			apexLog.Warnf("PARTITION %s can't be resolved to partition_id, no MergeTree tables in scope", partitionArg)
+		}
 	}
-	newPartitions := make([]string, len(partitionsMap))
-	i := 0
-	for partitionName := range partitionsMap {
-		newPartitions[i] = partitionName
-		i += 1
-	}
-	return partitionsMap, newPartitions
+	return partitionsMap, nil
 }
@@ -0,0 +1,630 @@
+package filesystemhelper
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/clickhouse"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/config"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/metadata"
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func createTestPart(t *testing.T, partPath string, files map[string]string) {
+	assert.NoError(t, os.MkdirAll(partPath, 0750))
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(path.Join(partPath, name), []byte(content), 0640))
+	}
+}
+
+func TestIsDuplicatedParts(t *testing.T) {
+	tmpDir := t.TempDir()
+	part1 := path.Join(tmpDir, "backup1", "all_1_1_0")
+	part2 := path.Join(tmpDir, "backup2", "all_1_1_0")
+	part3 := path.Join(tmpDir, "backup3", "all_1_1_0")
+	createTestPart(t, part1, map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	createTestPart(t, part2, map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	createTestPart(t, part3, map[string]string{"checksums.txt": "checksums2", "data.bin": "atad"})
+
+	// copied files has different inodes
+	assert.Error(t, IsDuplicatedParts(part1, part2, false))
+	assert.NoError(t, IsDuplicatedParts(part1, part2, true))
+	assert.Error(t, IsDuplicatedParts(part1, part3, true))
+
+	hardLinkPart := path.Join(tmpDir, "backup4", "all_1_1_0")
+	assert.NoError(t, os.MkdirAll(hardLinkPart, 0750))
+	for _, f := range []string{"checksums.txt", "data.bin"} {
+		assert.NoError(t, os.Link(path.Join(part1, f), path.Join(hardLinkPart, f)))
+	}
+	assert.NoError(t, IsDuplicatedParts(part1, hardLinkPart, false))
+}
+
+func TestMoveShadowAndCopyDataToDetachedWithProjection(t *testing.T) {
+	tmpDir := t.TempDir()
+	shadowPath := path.Join(tmpDir, "shadow", "backup_uuid")
+	partPath := path.Join(shadowPath, "store", "1f9", "1f9dc899-0de9-41f8-b95c-26c1f0d67d93", "20181023_2_2_0")
+	createTestPart(t, partPath, map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	createTestPart(t, path.Join(partPath, "x.proj"), map[string]string{"checksums.txt": "proj", "data.bin": "projdata"})
+
+	backupShadowPath := path.Join(tmpDir, "backup", "test_backup", "shadow", "db", "table", "default")
+	assert.NoError(t, os.MkdirAll(backupShadowPath, 0750))
+	parts, size, err := MoveShadow(context.Background(), shadowPath, backupShadowPath, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []metadata.Part{{Name: "20181023_2_2_0"}}, parts)
+	assert.Equal(t, int64(len("checksums")+len("data")+len("proj")+len("projdata")), size)
+	assert.FileExists(t, path.Join(backupShadowPath, "20181023_2_2_0", "x.proj", "checksums.txt"))
+
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	tableDataPath := path.Join(tmpDir, "data", "db", "table")
+	backupTable := metadata.TableMetadata{
+		Database: "db",
+		Table:    "table",
+		// old backups could contain projection in parts list
+		Parts: map[string][]metadata.Part{"default": {{Name: "20181023_2_2_0"}, {Name: "20181023_2_2_0/x.proj"}}},
+	}
+	restoredSize, err := CopyDataToDetached(context.Background(), "test_backup", nil, backupTable, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, config.DefaultConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(size), restoredSize)
+	for _, f := range []string{"checksums.txt", "data.bin", "x.proj/checksums.txt", "x.proj/data.bin"} {
+		assert.FileExists(t, path.Join(tableDataPath, "detached", "20181023_2_2_0", f))
+	}
+}
+
+func TestCopyDataToDetachedWithSpecialCharactersInNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	for _, table := range []metadata.TableMetadata{
+		{Database: "db.with.dots", Table: "table with spaces"},
+		{Database: "база", Table: "таблица-1"},
+	} {
+		backupPartPath := path.Join(tmpDir, "backup", "test_backup", "shadow", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table), "default", "all_1_1_0")
+		createTestPart(t, backupPartPath, map[string]string{"checksums.txt": "checksums"})
+		table.Parts = map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}
+		tableDataPath := path.Join(tmpDir, "data", common.TablePathEncode(table.Database), common.TablePathEncode(table.Table))
+		_, err := CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, config.DefaultConfig())
+		assert.NoError(t, err)
+		assert.FileExists(t, path.Join(tableDataPath, "detached", "all_1_1_0", "checksums.txt"))
+	}
+}
+
+func TestValidateObjectDiskMetadata(t *testing.T) {
+	dir := t.TempDir()
+	createTestPart(t, dir, map[string]string{
+		"data.bin":      "3\n1\t100\n100\tabc/xyzobjectkey\n0\n0\n",
+		"empty.bin":     "3\n0\t0\n0\n0\n",
+		"local.bin":     "binary data",
+		"no_object.bin": "3\n0\t100\n0\n0\n",
+	})
+	assert.NoError(t, ValidateObjectDiskMetadata(path.Join(dir, "data.bin")))
+	assert.NoError(t, ValidateObjectDiskMetadata(path.Join(dir, "empty.bin")))
+	assert.Error(t, ValidateObjectDiskMetadata(path.Join(dir, "local.bin")))
+	assert.Error(t, ValidateObjectDiskMetadata(path.Join(dir, "no_object.bin")))
+}
+
+func TestRewriteObjectDiskMetadataPaths(t *testing.T) {
+	mapping := map[string]string{"old/": "new/", "old/cluster1/": "new/cluster2/"}
+	body, changed, err := RewriteObjectDiskMetadataPaths("3\n2\t200\n100\told/cluster1/abc\n100\tother/xyz\n1\n0\n", mapping)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, "3\n2\t200\n100\tnew/cluster2/abc\n100\tother/xyz\n1\n0\n", body)
+
+	body, changed, err = RewriteObjectDiskMetadataPaths("3\n1\t100\n100\told/abc\n0\n0\n", mapping)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, "3\n1\t100\n100\tnew/abc\n0\n0\n", body)
+
+	_, _, err = RewriteObjectDiskMetadataPaths("binary data", mapping)
+	assert.Error(t, err)
+}
+
+func TestCopyObjectDiskMetadataWithPathMapping(t *testing.T) {
+	dir := t.TempDir()
+	mapping := map[string]string{"old/": "new/"}
+	src := path.Join(dir, "data.bin")
+	assert.NoError(t, os.WriteFile(src, []byte("3\n1\t100\n100\told/abc\n0\n0\n"), 0640))
+	// stale file left by interrupted restore is overwritten
+	dst := path.Join(dir, "dst.bin")
+	assert.NoError(t, os.WriteFile(dst, []byte("3\n1\t100\n100\told/abc\n0\n0\n"), 0640))
+	changed, err := CopyObjectDiskMetadataWithPathMapping(context.Background(), src, dst, CopyModeHardlink, mapping, NewRateLimiter(0))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	body, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n1\t100\n100\tnew/abc\n0\n0\n", string(body))
+
+	// metadata without matched paths is linked according to copy mode
+	unchangedSrc := path.Join(dir, "other.bin")
+	assert.NoError(t, os.WriteFile(unchangedSrc, []byte("3\n1\t100\n100\tother/abc\n0\n0\n"), 0640))
+	unchangedDst := path.Join(dir, "other_dst.bin")
+	changed, err = CopyObjectDiskMetadataWithPathMapping(context.Background(), unchangedSrc, unchangedDst, CopyModeHardlink, mapping, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, changed)
+	srcInfo, err := os.Stat(unchangedSrc)
+	assert.NoError(t, err)
+	dstInfo, err := os.Stat(unchangedDst)
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+	assert.True(t, IsS3DiskType("s3"))
+	assert.False(t, IsS3DiskType("s3_plain"))
+}
+
+func TestGetDetachedPartPaths(t *testing.T) {
+	disks := []clickhouse.Disk{
+		{Name: "default", Path: "/var/lib/clickhouse/"},
+		{Name: "hdd", Path: "/hdd/"},
+		{Name: "old", Path: "/old/"},
+	}
+	table := metadata.TableMetadata{
+		Database: "db",
+		Table:    "t",
+		Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_1_1_0/p.proj"}},
+			"hdd":     {{Name: "all_2_2_0"}},
+			"old":     {{Name: "all_3_3_0"}},
+		},
+	}
+	assert.Equal(t, []string{
+		"/var/lib/clickhouse/data/db/t/detached/all_1_1_0",
+		"/hdd/data/db/t/detached/all_2_2_0",
+		"/var/lib/clickhouse/data/db/t/detached/all_3_3_0",
+	}, GetDetachedPartPaths(table, disks, []string{"/var/lib/clickhouse/data/db/t/", "/hdd/data/db/t/"}, nil))
+	assert.Equal(t, []string{
+		"/var/lib/clickhouse/data/db/t/detached/all_1_1_0",
+		"/hdd/data/db/t/detached/all_2_2_0",
+		"/hdd/data/db/t/detached/all_3_3_0",
+	}, GetDetachedPartPaths(table, disks, []string{"/var/lib/clickhouse/data/db/t/", "/hdd/data/db/t/"}, map[string]string{"old": "hdd"}))
+}
+
+func TestRemoveEmptyDetachedDirs(t *testing.T) {
+	detachedDir := path.Join(t.TempDir(), "detached")
+	emptyPart := path.Join(detachedDir, "all_1_1_0")
+	nestedEmptyPart := path.Join(detachedDir, "all_2_2_0")
+	notEmptyPart := path.Join(detachedDir, "all_3_3_0")
+	assert.NoError(t, os.MkdirAll(emptyPart, 0750))
+	assert.NoError(t, os.MkdirAll(path.Join(nestedEmptyPart, "x.proj"), 0750))
+	createTestPart(t, path.Join(notEmptyPart, "x.proj"), map[string]string{"checksums.txt": "checksums"})
+	detachedPaths := []string{emptyPart, nestedEmptyPart, notEmptyPart, path.Join(detachedDir, "all_4_4_0")}
+
+	removedPaths, err := RemoveEmptyDetachedDirs(detachedPaths, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{emptyPart, nestedEmptyPart}, removedPaths)
+	assert.DirExists(t, emptyPart)
+
+	removedPaths, err = RemoveEmptyDetachedDirs(detachedPaths, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{emptyPart, nestedEmptyPart}, removedPaths)
+	assert.NoDirExists(t, emptyPart)
+	assert.NoDirExists(t, nestedEmptyPart)
+	assert.DirExists(t, notEmptyPart)
+}
+
+func TestSyncPaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	createTestPart(t, path.Join(tmpDir, "all_1_1_0"), map[string]string{"checksums.txt": "checksums"})
+	assert.NoError(t, SyncPaths([]string{path.Join(tmpDir, "all_1_1_0", "checksums.txt"), path.Join(tmpDir, "all_1_1_0"), tmpDir}))
+	assert.Error(t, SyncPaths([]string{path.Join(tmpDir, "absent")}))
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	start := time.Now()
+	// first second of traffic allowed as burst, the next 500 bytes shall wait ~0.5s
+	assert.NoError(t, limiter.WaitN(context.Background(), 1000))
+	assert.NoError(t, limiter.WaitN(context.Background(), 500))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, uint64(1500), limiter.CopiedBytes())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, limiter.WaitN(ctx, 1000), context.Canceled)
+
+	var unlimited *RateLimiter
+	assert.NoError(t, unlimited.WaitN(context.Background(), 1<<30))
+	assert.Equal(t, uint64(0), unlimited.CopiedBytes())
+}
+
+func TestWritePartMetadataWithoutColumns(t *testing.T) {
+	partPath := path.Join(t.TempDir(), "all_1_1_0")
+	detachedPath := path.Join(t.TempDir(), "all_1_1_0")
+	checksums := []partChecksum{
+		{Name: "columns.txt", FileSize: 10},
+		{Name: "count.txt", FileSize: 1},
+		{Name: "email.bin", FileSize: 100, IsCompressed: true, UncompressedSize: 200},
+		{Name: "email.mrk2", FileSize: 24},
+		{Name: "id.bin", FileSize: 100, IsCompressed: true, UncompressedSize: 200},
+	}
+	// format version 4 is binary version 3 inside not compressed block with 0x02 method
+	body := writePartChecksums(checksums)[len("checksums format version: 3\n"):]
+	block := make([]byte, 25)
+	block[16] = 0x02
+	binary.LittleEndian.PutUint32(block[17:], uint32(len(body)+9))
+	binary.LittleEndian.PutUint32(block[21:], uint32(len(body)))
+	createTestPart(t, partPath, map[string]string{
+		"checksums.txt":      "checksums format version: 4\n" + string(append(block, body...)),
+		"columns.txt":        "columns format version: 1\n2 columns:\n`id` UInt64\n`email` String\n",
+		"serialization.json": `{"columns":[{"kind":"Default","name":"id","num_defaults":0,"num_rows":1},{"kind":"Default","name":"email","num_defaults":0,"num_rows":1}],"version":0}`,
+		"count.txt":          "1",
+		"id.bin":             "id",
+		"email.bin":          "email",
+		"email.mrk2":         "email",
+	})
+	assert.NoError(t, os.MkdirAll(detachedPath, 0750))
+
+	excludedFiles, err := getExcludedColumnFiles(partPath, []string{"email"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"email.bin": {}, "email.mrk2": {}}, excludedFiles)
+	writtenFiles, err := writePartMetadataWithoutColumns(partPath, detachedPath, []string{"email"}, excludedFiles)
+	assert.NoError(t, err)
+	assert.Len(t, writtenFiles, 3)
+
+	columnsTxt, err := os.ReadFile(path.Join(detachedPath, "columns.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "columns format version: 1\n1 columns:\n`id` UInt64\n", string(columnsTxt))
+	serializationJSON, err := os.ReadFile(path.Join(detachedPath, "serialization.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"columns":[{"kind":"Default","name":"id","num_defaults":0,"num_rows":1}],"version":0}`, string(serializationJSON))
+	checksumsTxt, err := os.ReadFile(path.Join(detachedPath, "checksums.txt"))
+	assert.NoError(t, err)
+	filteredChecksums, err := readPartChecksums(checksumsTxt)
+	assert.NoError(t, err)
+	assert.Len(t, filteredChecksums, 3)
+	assert.Equal(t, "columns.txt", filteredChecksums[0].Name)
+	assert.Equal(t, uint64(len(columnsTxt)), filteredChecksums[0].FileSize)
+	assert.Equal(t, checksums[1], filteredChecksums[1])
+	assert.Equal(t, checksums[4], filteredChecksums[2])
+}
+
+func TestCopyDataToDetachedFromReadOnlyBackup(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	backupPath := path.Join(tmpDir, "backup", "test_backup")
+	createTestPart(t, path.Join(backupPath, "shadow", "db", "table", "default", "all_1_1_0"), map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	snapshot := func() map[string]string {
+		files := map[string]string{}
+		assert.NoError(t, filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			content := ""
+			if !info.IsDir() {
+				body, err := os.ReadFile(filePath)
+				if err != nil {
+					return err
+				}
+				content = string(body)
+			}
+			stat := info.Sys().(*syscall.Stat_t)
+			files[filePath] = fmt.Sprintf("%s %d:%d %d %s %s", info.Mode(), stat.Uid, stat.Gid, info.Size(), info.ModTime(), content)
+			return nil
+		}))
+		return files
+	}
+	// read-only mount can't be created without privileges, so remove write permissions and compare backup before and after restore
+	// root ignores permissions, so backup files owned by other user than ClickHouse data path, Chown after hardlink would change them
+	assert.NoError(t, filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+		if os.Getuid() == 0 {
+			if err := os.Chown(filePath, 12345, 12345); err != nil {
+				return err
+			}
+		}
+		if info.IsDir() {
+			return os.Chmod(filePath, 0555)
+		}
+		return os.Chmod(filePath, 0444)
+	}))
+	t.Cleanup(func() {
+		_ = filepath.Walk(backupPath, func(filePath string, info os.FileInfo, err error) error {
+			return os.Chmod(filePath, 0750)
+		})
+	})
+	before := snapshot()
+	for _, copyMode := range []string{CopyModeHardlink, CopyModeCopy} {
+		cfg := config.DefaultConfig()
+		cfg.General.RestoreCopyMode = copyMode
+		table := metadata.TableMetadata{Database: "db", Table: "table", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}
+		tableDataPath := path.Join(tmpDir, "data", copyMode, "db", "table")
+		_, err := CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, cfg)
+		assert.NoError(t, err)
+		assert.FileExists(t, path.Join(tableDataPath, "detached", "all_1_1_0", "data.bin"))
+	}
+	assert.Equal(t, before, snapshot())
+}
+
+func TestGetPartFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	compactPart := path.Join(tmpDir, "compact", "all_1_1_0")
+	createTestPart(t, compactPart, map[string]string{"checksums.txt": "checksums", "columns.txt": "columns", "count.txt": "1", "data.bin": "data", "data.cmrk3": "marks"})
+	widePart := path.Join(tmpDir, "wide", "all_1_1_0")
+	createTestPart(t, widePart, map[string]string{"checksums.txt": "checksums", "columns.txt": "columns", "count.txt": "1", "data.bin": "data", "data.cmrk2": "marks"})
+	legacyPart := path.Join(tmpDir, "legacy", "all_1_1_0")
+	createTestPart(t, legacyPart, map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	for partPath, expectedFormat := range map[string]string{compactPart: PartFormatCompact, widePart: PartFormatWide, legacyPart: PartFormatUnknown} {
+		partFormat, err := GetPartFormat(partPath)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedFormat, partFormat)
+	}
+	packedPart := path.Join(tmpDir, "packed", "all_1_1_0")
+	assert.NoError(t, os.MkdirAll(path.Dir(packedPart), 0750))
+	assert.NoError(t, os.WriteFile(packedPart, []byte("packed"), 0640))
+	_, err := GetPartFormat(packedPart)
+	assert.ErrorContains(t, err, "packed data parts are not supported")
+}
+
+func TestCopyDataToDetachedCompactPart(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	files := map[string]string{
+		"checksums.txt": "checksums",
+		"columns.txt":   "columns format version: 1\n2 columns:\n`id` UInt64\n`email` String\n",
+		"count.txt":     "1",
+		"data.bin":      "data",
+		"data.cmrk3":    "marks",
+	}
+	createTestPart(t, path.Join(tmpDir, "backup", "test_backup", "shadow", "db", "table", "default", "all_1_1_0"), files)
+	cfg := config.DefaultConfig()
+	// compact part store all columns inside data.bin, excluded column can't be removed, so restore shall fail before copy
+	cfg.General.RestoreColumnExclude = []string{"db.table:email"}
+	table := metadata.TableMetadata{Database: "db", Table: "table", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}
+	tableDataPath := path.Join(tmpDir, "data", "db", "table")
+	_, err := CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, cfg)
+	assert.ErrorContains(t, err, "can't remove columns email from db.table parts default/all_1_1_0 (Compact)")
+	assert.NoDirExists(t, path.Join(tableDataPath, "detached", "all_1_1_0"))
+	// excluded column absent in compact part, nothing to remove
+	cfg.General.RestoreColumnExclude = []string{"db.table:phone"}
+	_, err = CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, cfg)
+	assert.NoError(t, err)
+	for name, content := range files {
+		body, err := os.ReadFile(path.Join(tableDataPath, "detached", "all_1_1_0", name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	}
+}
+
+func TestCopyDataToDetachedWithStaging(t *testing.T) {
+	tmpDir := t.TempDir()
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	files := map[string]string{
+		"checksums.txt": "checksums",
+		"columns.txt":   "columns format version: 1\n1 columns:\n`id` UInt64\n",
+		"count.txt":     "1",
+		"id.bin":        "data",
+		"id.mrk2":       "marks",
+	}
+	createTestPart(t, path.Join(tmpDir, "backup", "test_backup", "shadow", "db", "table", "default", "all_1_1_0"), files)
+	cfg := config.DefaultConfig()
+	cfg.Filesystem.DetachedStagingPath = path.Join(tmpDir, "staging")
+	table := metadata.TableMetadata{Database: "db", Table: "table", Parts: map[string][]metadata.Part{"default": {{Name: "all_1_1_0"}}}}
+	tableDataPath := path.Join(tmpDir, "data", "db", "table")
+	// part left in `detached` by previous restore, staged part shall not be merged into it
+	stalePartPath := path.Join(tableDataPath, "detached", "all_1_1_0")
+	createTestPart(t, stalePartPath, map[string]string{"count.txt": "0"})
+	_, err := CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, cfg)
+	assert.ErrorIs(t, err, os.ErrExist)
+	staleFiles, err := os.ReadDir(stalePartPath)
+	assert.NoError(t, err)
+	assert.Len(t, staleFiles, 1)
+
+	assert.NoError(t, os.RemoveAll(stalePartPath))
+	_, err = CopyDataToDetached(context.Background(), "test_backup", nil, table, disks, []string{tableDataPath}, &clickhouse.ClickHouse{}, cfg)
+	assert.NoError(t, err)
+	for name, content := range files {
+		body, err := os.ReadFile(path.Join(tableDataPath, "detached", "all_1_1_0", name))
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(body))
+	}
+	_, err = os.Stat(path.Join(getStagingDataPath(cfg.Filesystem.DetachedStagingPath, tableDataPath), "detached", "all_1_1_0"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFixOwnership(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	tmpDir := t.TempDir()
+	createTestPart(t, path.Join(tmpDir, "detached", "all_1_1_0"), map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	assert.NoError(t, os.Chown(path.Join(tmpDir, "detached", "all_1_1_0", "data.bin"), 65534, 65534))
+	fixed, err := fixOwnership(tmpDir, os.Getuid(), os.Getgid())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fixed)
+	fixed, err = fixOwnership(tmpDir, os.Getuid(), os.Getgid())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, fixed)
+
+	// restored file hardlinked from backup, backup file owner and content shall stay unchanged
+	backupFile := path.Join(tmpDir, "backup", "data.bin")
+	assert.NoError(t, os.MkdirAll(path.Dir(backupFile), 0750))
+	assert.NoError(t, os.WriteFile(backupFile, []byte("backup data"), 0640))
+	assert.NoError(t, os.Chown(backupFile, 65534, 65534))
+	restoredFile := path.Join(tmpDir, "detached", "all_2_2_0", "data.bin")
+	assert.NoError(t, os.MkdirAll(path.Dir(restoredFile), 0750))
+	assert.NoError(t, os.Chown(path.Dir(restoredFile), os.Getuid(), os.Getgid()))
+	assert.NoError(t, os.Link(backupFile, restoredFile))
+	fixed, err = fixOwnership(path.Join(tmpDir, "detached"), os.Getuid(), os.Getgid())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fixed)
+	backupInfo, err := os.Stat(backupFile)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(65534), backupInfo.Sys().(*syscall.Stat_t).Uid)
+	assert.Equal(t, uint64(1), uint64(backupInfo.Sys().(*syscall.Stat_t).Nlink))
+	restoredInfo, err := os.Stat(restoredFile)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(os.Getuid()), restoredInfo.Sys().(*syscall.Stat_t).Uid)
+	content, err := os.ReadFile(restoredFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "backup data", string(content))
+}
+
+func TestParsePartitionTableScope(t *testing.T) {
+	scope, value := ParsePartitionTableScope("db1.t1:('2023-01-01', 1)")
+	assert.Equal(t, "db1.t1", scope)
+	assert.Equal(t, "('2023-01-01', 1)", value)
+	scope, value = ParsePartitionTableScope("db1.t*: PARTITION 202301")
+	assert.Equal(t, "db1.t*", scope)
+	assert.Equal(t, "PARTITION 202301", value)
+	scope, value = ParsePartitionTableScope("('2023-01-01 00:00:00')")
+	assert.Equal(t, "", scope)
+	assert.Equal(t, "('2023-01-01 00:00:00')", value)
+	assert.True(t, isPartitionTableInScope("db1.t*", "db1", "t1"))
+	assert.False(t, isPartitionTableInScope("db1.t1", "db1", "t2"))
+}
+
+func TestCreatePartitionsToBackupMapWithTableScope(t *testing.T) {
+	tables := []metadata.TableMetadata{{Database: "db1", Table: "t1"}, {Database: "db1", Table: "t2"}, {Database: "db2", Table: "t3"}}
+	partitionsMap, err := CreatePartitionsToBackupMap(nil, nil, tables, []string{"db1.t1:202301,202302", "db1.t2:202303", "db1.t*: 202305"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[metadata.TableTitle]common.EmptyMap{
+		{Database: "db1", Table: "t1"}: {"202301": {}, "202302": {}, "202305": {}},
+		{Database: "db1", Table: "t2"}: {"202303": {}, "202305": {}},
+	}, partitionsMap, "tables out of scope shall not be filtered")
+	partitionsMap, err = CreatePartitionsToBackupMap(nil, nil, tables, []string{"db1.t1:202301", "202304"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[metadata.TableTitle]common.EmptyMap{
+		{Database: "db1", Table: "t1"}: {"202301": {}, "202304": {}},
+		{Database: "db1", Table: "t2"}: {"202304": {}},
+		{Database: "db2", Table: "t3"}: {"202304": {}},
+	}, partitionsMap)
+	partitionsMap, err = CreatePartitionsToBackupMap(nil, nil, tables, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, partitionsMap)
+}
+
+func TestGetUnmatchedPartitionTableScopes(t *testing.T) {
+	tables := []metadata.TableTitle{{Database: "db1", Table: "t1"}, {Database: "db2", Table: "t2"}}
+	assert.Empty(t, GetUnmatchedPartitionTableScopes([]string{"db1.t1:202301", "db2.*:(1)", "202302"}, tables))
+	assert.Equal(t, []string{"db1.t2", "db3.*"}, GetUnmatchedPartitionTableScopes([]string{"db1.t2:202301", "db1.t1:202301", "db3.*:(1)"}, tables))
+}
+
+func TestGetPartDataChecksum(t *testing.T) {
+	checksums := []partChecksum{
+		{Name: "data.bin", FileSize: 100, FileHash: [16]byte{1}},
+		{Name: "columns.txt", FileSize: 10, FileHash: [16]byte{2}},
+	}
+	part1 := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(part1, "checksums.txt"), writePartChecksums(checksums), 0640))
+	// order of entries and files rewritten by ATTACH PART doesn't change checksum
+	part2 := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(part2, "checksums.txt"), writePartChecksums([]partChecksum{checksums[1], {Name: "metadata_version.txt", FileSize: 1}, checksums[0]}), 0640))
+	part3 := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(part3, "checksums.txt"), writePartChecksums([]partChecksum{checksums[1], {Name: "data.bin", FileSize: 100, FileHash: [16]byte{3}}}), 0640))
+	checksum1, err := GetPartDataChecksum(part1)
+	assert.NoError(t, err)
+	checksum2, err := GetPartDataChecksum(part2)
+	assert.NoError(t, err)
+	checksum3, err := GetPartDataChecksum(part3)
+	assert.NoError(t, err)
+	assert.Equal(t, checksum1, checksum2)
+	assert.NotEqual(t, checksum1, checksum3)
+	_, err = GetPartDataChecksum(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestLinkDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := path.Join(tmpDir, "base", "all_1_1_0")
+	dst := path.Join(tmpDir, "increment", "all_1_1_0")
+	createTestPart(t, src, map[string]string{"checksums.txt": "checksums", "data.bin": "data"})
+	createTestPart(t, path.Join(src, "p1.proj"), map[string]string{"data.bin": "projection"})
+	createTestPart(t, dst, map[string]string{"checksums.txt": "checksums", "data.bin": "data", "stale.bin": "stale"})
+
+	assertLinked := func() {
+		for _, fileName := range []string{"checksums.txt", "data.bin", "p1.proj/data.bin"} {
+			srcInfo, err := os.Stat(path.Join(src, fileName))
+			assert.NoError(t, err)
+			dstInfo, err := os.Stat(path.Join(dst, fileName))
+			assert.NoError(t, err)
+			assert.True(t, os.SameFile(srcInfo, dstInfo), fileName)
+		}
+	}
+	assert.NoError(t, LinkDir(context.Background(), src, dst, nil))
+	assertLinked()
+	_, err := os.Stat(path.Join(dst, "stale.bin"))
+	assert.True(t, os.IsNotExist(err))
+
+	// dst is not changed when src can't be linked
+	assert.Error(t, LinkDir(context.Background(), path.Join(tmpDir, "absent"), dst, nil))
+	assertLinked()
+	_, err = os.Stat(dst + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLinkOrCopyFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := path.Join(tmpDir, "src.bin")
+	assert.NoError(t, os.WriteFile(src, []byte("data"), 0640))
+	srcInfo, err := os.Stat(src)
+	assert.NoError(t, err)
+	for _, copyMode := range []string{CopyModeHardlink, CopyModeCopy, CopyModeReflink} {
+		dst := path.Join(tmpDir, copyMode+".bin")
+		assert.NoError(t, LinkOrCopyFile(context.Background(), src, dst, copyMode, nil), copyMode)
+		body, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(body), copyMode)
+		dstInfo, err := os.Stat(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, copyMode == CopyModeHardlink, os.SameFile(srcInfo, dstInfo), copyMode)
+		assert.Equal(t, srcInfo.Mode().Perm(), dstInfo.Mode().Perm(), copyMode)
+		// dst is never overwritten
+		assert.Error(t, LinkOrCopyFile(context.Background(), src, dst, copyMode, nil), copyMode)
+	}
+	// src is not changed by copy
+	assert.NoError(t, os.WriteFile(path.Join(tmpDir, CopyModeCopy+".bin"), []byte("changed"), 0640))
+	body, err := os.ReadFile(src)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(body))
+}
+
+func TestCheckMissingParts(t *testing.T) {
+	tmpDir := t.TempDir()
+	log := apexLog.WithField("logger", "test")
+	disks := []clickhouse.Disk{{Name: "default", Path: tmpDir, Type: "local"}}
+	getTable := func() metadata.TableMetadata {
+		return metadata.TableMetadata{Database: "db", Table: "t", Parts: map[string][]metadata.Part{
+			"default": {{Name: "all_1_1_0"}, {Name: "all_2_2_0"}, {Name: "all_1_1_0/p1.proj"}},
+		}}
+	}
+	createTestPart(t, path.Join(tmpDir, "backup", "test_backup", "shadow", "db", "t", "default", "all_1_1_0"), map[string]string{"checksums.txt": "checksums"})
+
+	table := getTable()
+	err := checkMissingParts("test_backup", nil, table, disks, false, log)
+	assert.EqualError(t, err, "db.t parts default/all_2_2_0 not found in backup 'test_backup', looks like download was not completed, run `download` again or set `restore_skip_missing_parts: true` to restore the rest parts")
+	assert.Len(t, table.Parts["default"], 3)
+
+	assert.NoError(t, checkMissingParts("test_backup", nil, table, disks, true, log))
+	assert.Equal(t, []metadata.Part{{Name: "all_1_1_0"}, {Name: "all_1_1_0/p1.proj"}}, table.Parts["default"])
+
+	createTestPart(t, path.Join(tmpDir, "backup", "test_backup", "shadow", "db", "t", "default", "all_2_2_0"), map[string]string{"checksums.txt": "checksums"})
+	table = getTable()
+	assert.NoError(t, checkMissingParts("test_backup", nil, table, disks, false, log))
+	assert.Len(t, table.Parts["default"], 3)
+}
+
+func TestGetBackupPartPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	disk := clickhouse.Disk{Name: "default", Path: tmpDir}
+	table := metadata.TableMetadata{Database: "db", Table: "t"}
+	shadowPath := func(backupName string) string {
+		return path.Join(tmpDir, "backup", backupName, "shadow", "db", "t")
+	}
+	assert.NoError(t, os.MkdirAll(path.Join(shadowPath("inc"), "default", "all_3_3_0"), 0755))
+	assert.NoError(t, os.MkdirAll(path.Join(shadowPath("inc1"), "default", "all_2_2_0"), 0755))
+	// legacy backup without disk name in path
+	assert.NoError(t, os.MkdirAll(path.Join(shadowPath("full"), "all_1_1_0"), 0755))
+	requiredBackups := []string{"inc1", "full"}
+
+	assert.Equal(t, path.Join(shadowPath("inc"), "default", "all_3_3_0"), GetBackupPartPath("inc", requiredBackups, table, disk, "all_3_3_0"))
+	assert.Equal(t, path.Join(shadowPath("inc1"), "default", "all_2_2_0"), GetBackupPartPath("inc", requiredBackups, table, disk, "all_2_2_0"))
+	assert.Equal(t, path.Join(shadowPath("full"), "all_1_1_0"), GetBackupPartPath("inc", requiredBackups, table, disk, "all_1_1_0"))
+	// missing part path points into backupName
+	assert.Equal(t, path.Join(shadowPath("inc"), "default", "all_4_4_0"), GetBackupPartPath("inc", requiredBackups, table, disk, "all_4_4_0"))
+	assert.Equal(t, path.Join(shadowPath("inc"), "default", "all_2_2_0"), GetBackupPartPath("inc", nil, table, disk, "all_2_2_0"))
+}
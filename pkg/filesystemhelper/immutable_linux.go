@@ -0,0 +1,35 @@
+//go:build linux
+
+package filesystemhelper
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsImmutableFL - FS_IMMUTABLE_FL from linux/fs.h, the same as `chattr +i`
+const fsImmutableFL = 0x00000010
+
+// ClearImmutable - remove immutable attribute from file or directory via ioctl(FS_IOC_SETFLAGS), the same as `chattr -i`, require CAP_LINUX_IMMUTABLE
+// return false when attribute was not set
+func ClearImmutable(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return false, err
+	}
+	if flags&fsImmutableFL == 0 {
+		return false, nil
+	}
+	if err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags&^fsImmutableFL)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filesystemhelper
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// ClearImmutable - ioctl(FS_IOC_SETFLAGS) is available only on linux
+func ClearImmutable(filePath string) (bool, error) {
+	return false, fmt.Errorf("clear immutable attribute on '%s' is not supported on %s", filePath, runtime.GOOS)
+}
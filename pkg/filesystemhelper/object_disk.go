@@ -0,0 +1,145 @@
+package filesystemhelper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IsObjectDiskType - parts on object storage disks contain only small metadata files which refer to objects in remote storage
+func IsObjectDiskType(diskType string) bool {
+	switch strings.ToLower(diskType) {
+	case "s3", "s3_plain", "azure_blob_storage", "hdfs":
+		return true
+	}
+	return false
+}
+
+// ValidateObjectDiskMetadata - check file has ClickHouse object storage metadata format and refers to remote objects
+// https://github.com/ClickHouse/ClickHouse/blob/master/src/Disks/ObjectStorages/DiskObjectStorageMetadata.cpp
+func ValidateObjectDiskMetadata(metadataFile string) error {
+	f, err := os.Open(metadataFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	lines := make([]string, 0, 3)
+	for len(lines) < 3 && scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if len(lines) < 2 {
+		return fmt.Errorf("'%s' is not object disk metadata file, too short", metadataFile)
+	}
+	if version, err := strconv.Atoi(lines[0]); err != nil || version < 1 || version > 4 {
+		return fmt.Errorf("'%s' is not object disk metadata file, unknown version '%s'", metadataFile, lines[0])
+	}
+	header := strings.Fields(lines[1])
+	if len(header) != 2 {
+		return fmt.Errorf("'%s' is not object disk metadata file, wrong objects header '%s'", metadataFile, lines[1])
+	}
+	objectsCount, err := strconv.Atoi(header[0])
+	if err != nil {
+		return fmt.Errorf("'%s' is not object disk metadata file, wrong objects count '%s'", metadataFile, header[0])
+	}
+	totalSize, err := strconv.ParseInt(header[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("'%s' is not object disk metadata file, wrong total size '%s'", metadataFile, header[1])
+	}
+	if totalSize > 0 && (objectsCount == 0 || len(lines) < 3) {
+		return fmt.Errorf("'%s' has size %d but doesn't refer to any remote object", metadataFile, totalSize)
+	}
+	return nil
+}
+
+// IsS3DiskType - `general->restore_s3_path_mapping` applied only to s3 disks,
+// s3_plain disk doesn't use metadata files with object keys, objects placed by local path
+func IsS3DiskType(diskType string) bool {
+	return strings.ToLower(diskType) == "s3"
+}
+
+// RewriteObjectDiskMetadataPaths - replace the longest matched prefix of each object path, lines after objects list like ref_count and read_only stay untouched
+// return rewritten metadata and count of changed object paths
+func RewriteObjectDiskMetadataPaths(body string, pathMapping map[string]string) (string, int, error) {
+	lines := strings.Split(body, "\n")
+	if len(lines) < 2 {
+		return body, 0, fmt.Errorf("not object disk metadata, too short")
+	}
+	header := strings.Fields(lines[1])
+	if len(header) != 2 {
+		return body, 0, fmt.Errorf("not object disk metadata, wrong objects header '%s'", lines[1])
+	}
+	objectsCount, err := strconv.Atoi(header[0])
+	if err != nil || len(lines) < 2+objectsCount {
+		return body, 0, fmt.Errorf("not object disk metadata, wrong objects count '%s'", header[0])
+	}
+	prefixes := make([]string, 0, len(pathMapping))
+	for prefix := range pathMapping {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	changed := 0
+	for i := 2; i < 2+objectsCount; i++ {
+		// `<size>\t<path>`, path could be absent for empty object
+		sizeAndPath := strings.SplitN(lines[i], "\t", 2)
+		if len(sizeAndPath) != 2 {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(sizeAndPath[1], prefix) {
+				lines[i] = sizeAndPath[0] + "\t" + pathMapping[prefix] + strings.TrimPrefix(sizeAndPath[1], prefix)
+				changed++
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n"), changed, nil
+}
+
+// CopyObjectDiskMetadataWithPathMapping - write metadata file with rewritten object paths to dst, existing dst is overwritten, it could be left by interrupted restore with not rewritten paths,
+// metadata without matched paths is linked or copied according to copyMode, limiter throttles written bytes
+func CopyObjectDiskMetadataWithPathMapping(ctx context.Context, src, dst, copyMode string, pathMapping map[string]string, limiter *RateLimiter) (int, error) {
+	body, err := os.ReadFile(src)
+	if err != nil {
+		return 0, err
+	}
+	rewritten, changed, err := RewriteObjectDiskMetadataPaths(string(body), pathMapping)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' %v", src, err)
+	}
+	if err = os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if changed == 0 {
+		return 0, LinkOrCopyFile(ctx, src, dst, copyMode, limiter)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer = f
+	if limiter != nil {
+		w = &rateLimitedWriter{ctx: ctx, w: f, limiter: limiter}
+	}
+	if _, err = io.WriteString(w, rewritten); err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+	return changed, f.Close()
+}
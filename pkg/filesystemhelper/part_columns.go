@@ -0,0 +1,348 @@
+package filesystemhelper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/ClickHouse/clickhouse-go/lib/cityhash102"
+	"github.com/ClickHouse/clickhouse-go/lib/lz4"
+)
+
+// partChecksum - one file entry inside part checksums.txt, see MergeTreeDataPartChecksum in ClickHouse
+type partChecksum struct {
+	Name             string
+	FileSize         uint64
+	FileHash         [16]byte
+	IsCompressed     bool
+	UncompressedSize uint64
+	UncompressedHash [16]byte
+}
+
+// partMetadataFiles - files which describe part columns, rewritten when columns excluded during restore, `general->restore_column_exclude`
+var partMetadataFiles = []string{"checksums.txt", "columns.txt", "serialization.json"}
+
+// getExcludedColumnFiles - files of excluded columns inside wide part, column stored as `escaped_name.bin`, `escaped_name.mrk2`, `escaped_name.null.bin`, `escaped_name.size0.bin` and etc.
+// compact parts store all columns inside single data.bin, so they return nothing
+func getExcludedColumnFiles(partPath string, columns []string) (map[string]struct{}, error) {
+	entries, err := os.ReadDir(partPath)
+	if err != nil {
+		return nil, err
+	}
+	excludedFiles := map[string]struct{}{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		for _, column := range columns {
+			// escapeForFileName escape `.`, so `name.` prefix can't match other column
+			encodedColumn := common.ClickHouseFileNameEncode(column)
+			if strings.HasPrefix(entry.Name(), encodedColumn+".") {
+				excludedFiles[entry.Name()] = struct{}{}
+				break
+			}
+		}
+	}
+	return excludedFiles, nil
+}
+
+// writePartMetadataWithoutColumns - write columns.txt, serialization.json and checksums.txt from partPath to detachedPath without excluded columns and their files
+// files in detachedPath could be hardlinks to backup files, so they replaced instead of overwrite
+func writePartMetadataWithoutColumns(partPath, detachedPath string, columns []string, excludedFiles map[string]struct{}) ([]string, error) {
+	isExcluded := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		isExcluded[column] = struct{}{}
+	}
+	rewrittenFiles := map[string][]byte{}
+	columnsTxt, err := os.ReadFile(path.Join(partPath, "columns.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if rewrittenFiles["columns.txt"], err = filterPartColumnsTxt(columnsTxt, isExcluded); err != nil {
+		return nil, err
+	}
+	serializationJSON, err := os.ReadFile(path.Join(partPath, "serialization.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if rewrittenFiles["serialization.json"], err = filterPartSerializationJSON(serializationJSON, isExcluded); err != nil {
+			return nil, err
+		}
+	}
+	checksumsTxt, err := os.ReadFile(path.Join(partPath, "checksums.txt"))
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := readPartChecksums(checksumsTxt)
+	if err != nil {
+		return nil, err
+	}
+	filteredChecksums := make([]partChecksum, 0, len(checksums))
+	for _, checksum := range checksums {
+		if _, exists := excludedFiles[checksum.Name]; exists {
+			continue
+		}
+		if content, isRewritten := rewrittenFiles[checksum.Name]; isRewritten {
+			checksum = partChecksum{Name: checksum.Name, FileSize: uint64(len(content))}
+			copy(checksum.FileHash[:], cityhash102.CityHash128(content, uint32(len(content))).Bytes())
+		}
+		filteredChecksums = append(filteredChecksums, checksum)
+	}
+	rewrittenFiles["checksums.txt"] = writePartChecksums(filteredChecksums)
+	var writtenFiles []string
+	for _, name := range partMetadataFiles {
+		content, exists := rewrittenFiles[name]
+		if !exists {
+			continue
+		}
+		dstFile := path.Join(detachedPath, name)
+		if err = os.Remove(dstFile); err != nil && !os.IsNotExist(err) {
+			return writtenFiles, err
+		}
+		if err = os.WriteFile(dstFile, content, 0640); err != nil {
+			return writtenFiles, err
+		}
+		writtenFiles = append(writtenFiles, dstFile)
+	}
+	return writtenFiles, nil
+}
+
+// getPartColumnNames - column names from part columns.txt
+func getPartColumnNames(partPath string) (map[string]struct{}, error) {
+	columnsTxt, err := os.ReadFile(path.Join(partPath, "columns.txt"))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(columnsTxt), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != "columns format version: 1" {
+		return nil, fmt.Errorf("unexpected columns.txt format: %.64q", string(columnsTxt))
+	}
+	columns := make(map[string]struct{}, len(lines)-2)
+	for _, line := range lines[2:] {
+		name, _, err := common.ParseBackQuotedName(line)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse columns.txt line %q: %v", line, err)
+		}
+		columns[name] = struct{}{}
+	}
+	return columns, nil
+}
+
+// filterPartColumnsTxt - remove excluded columns from `columns format version: 1` text format
+func filterPartColumnsTxt(data []byte, isExcluded map[string]struct{}) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != "columns format version: 1" {
+		return nil, fmt.Errorf("unexpected columns.txt format: %.64q", string(data))
+	}
+	var columns []string
+	for _, line := range lines[2:] {
+		name, _, err := common.ParseBackQuotedName(line)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse columns.txt line %q: %v", line, err)
+		}
+		if _, exists := isExcluded[name]; !exists {
+			columns = append(columns, line)
+		}
+	}
+	result := bytes.Buffer{}
+	result.WriteString(lines[0] + "\n")
+	result.WriteString(fmt.Sprintf("%d columns:\n", len(columns)))
+	for _, line := range columns {
+		result.WriteString(line + "\n")
+	}
+	return result.Bytes(), nil
+}
+
+// filterPartSerializationJSON - remove excluded columns from `columns` array in serialization.json
+func filterPartSerializationJSON(data []byte, isExcluded map[string]struct{}) ([]byte, error) {
+	var serialization map[string]json.RawMessage
+	if err := json.Unmarshal(data, &serialization); err != nil {
+		return nil, fmt.Errorf("can't parse serialization.json: %v", err)
+	}
+	var columns []map[string]json.RawMessage
+	if err := json.Unmarshal(serialization["columns"], &columns); err != nil {
+		return nil, fmt.Errorf("can't parse serialization.json columns: %v", err)
+	}
+	filteredColumns := make([]map[string]json.RawMessage, 0, len(columns))
+	for _, column := range columns {
+		var name string
+		if err := json.Unmarshal(column["name"], &name); err != nil {
+			return nil, fmt.Errorf("can't parse serialization.json column name: %v", err)
+		}
+		if _, exists := isExcluded[name]; !exists {
+			filteredColumns = append(filteredColumns, column)
+		}
+	}
+	var err error
+	if serialization["columns"], err = json.Marshal(filteredColumns); err != nil {
+		return nil, err
+	}
+	return json.Marshal(serialization)
+}
+
+// readPartChecksums - parse checksums.txt format version 3 (binary) and 4 (binary inside compressed blocks)
+func readPartChecksums(data []byte) ([]partChecksum, error) {
+	headerEnd := bytes.IndexByte(data, '\n')
+	if headerEnd < 0 {
+		return nil, fmt.Errorf("can't read checksums.txt header")
+	}
+	header := string(data[:headerEnd+1])
+	version, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "checksums format version:")))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected checksums.txt header %q", header)
+	}
+	body := data[len(header):]
+	switch version {
+	case 3:
+	case 4:
+		if body, err = decompressClickHouseBlocks(body); err != nil {
+			return nil, fmt.Errorf("can't decompress checksums.txt: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("checksums.txt format version %d is not supported", version)
+	}
+	return readPartChecksumsBinary(body)
+}
+
+func readPartChecksumsBinary(body []byte) ([]partChecksum, error) {
+	r := bytes.NewReader(body)
+	var err error
+	readUvarint := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var v uint64
+		v, err = binary.ReadUvarint(r)
+		return v
+	}
+	count := readUvarint()
+	checksums := make([]partChecksum, 0, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		checksum := partChecksum{}
+		name := make([]byte, readUvarint())
+		if err == nil {
+			_, err = io.ReadFull(r, name)
+		}
+		checksum.Name = string(name)
+		checksum.FileSize = readUvarint()
+		if err == nil {
+			_, err = io.ReadFull(r, checksum.FileHash[:])
+		}
+		var isCompressed byte
+		if err == nil {
+			isCompressed, err = r.ReadByte()
+		}
+		if isCompressed != 0 {
+			checksum.IsCompressed = true
+			checksum.UncompressedSize = readUvarint()
+			if err == nil {
+				_, err = io.ReadFull(r, checksum.UncompressedHash[:])
+			}
+		}
+		checksums = append(checksums, checksum)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse checksums.txt: %v", err)
+	}
+	return checksums, nil
+}
+
+// writePartChecksums - serialize checksums.txt in format version 3, ClickHouse read it as well as compressed version 4
+func writePartChecksums(checksums []partChecksum) []byte {
+	result := bytes.Buffer{}
+	result.WriteString("checksums format version: 3\n")
+	varint := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		result.Write(varint[:binary.PutUvarint(varint, v)])
+	}
+	writeUvarint(uint64(len(checksums)))
+	for _, checksum := range checksums {
+		writeUvarint(uint64(len(checksum.Name)))
+		result.WriteString(checksum.Name)
+		writeUvarint(checksum.FileSize)
+		result.Write(checksum.FileHash[:])
+		if checksum.IsCompressed {
+			result.WriteByte(1)
+			writeUvarint(checksum.UncompressedSize)
+			result.Write(checksum.UncompressedHash[:])
+		} else {
+			result.WriteByte(0)
+		}
+	}
+	return result.Bytes()
+}
+
+// decompressClickHouseBlocks - ClickHouse CompressedWriteBuffer format, each block is 16 bytes checksum, method byte, uint32 compressed size with 9 bytes header, uint32 decompressed size and data
+func decompressClickHouseBlocks(data []byte) ([]byte, error) {
+	const checksumSize, headerSize = 16, 9
+	result := bytes.Buffer{}
+	for len(data) > 0 {
+		if len(data) < checksumSize+headerSize {
+			return nil, fmt.Errorf("unexpected end of compressed block header")
+		}
+		header := data[checksumSize : checksumSize+headerSize]
+		compressedSize := int(binary.LittleEndian.Uint32(header[1:5]))
+		decompressedSize := int(binary.LittleEndian.Uint32(header[5:9]))
+		if compressedSize < headerSize || len(data) < checksumSize+compressedSize {
+			return nil, fmt.Errorf("unexpected end of compressed block")
+		}
+		compressed := data[checksumSize+headerSize : checksumSize+compressedSize]
+		switch header[0] {
+		case 0x02:
+			result.Write(compressed)
+		case 0x82:
+			decompressed := make([]byte, decompressedSize)
+			if _, err := lz4.Decode(decompressed, compressed); err != nil {
+				return nil, err
+			}
+			result.Write(decompressed)
+		default:
+			return nil, fmt.Errorf("compression method 0x%02x is not supported", header[0])
+		}
+		data = data[checksumSize+compressedSize:]
+	}
+	return result.Bytes(), nil
+}
+
+// partChecksumIgnoredFiles - files which ClickHouse could add or rewrite during ATTACH PART, they don't describe part data
+var partChecksumIgnoredFiles = map[string]struct{}{
+	"default_compression_codec.txt": {},
+	"metadata_version.txt":          {},
+	"txn_version.txt":               {},
+	"uuid.txt":                      {},
+}
+
+// GetPartDataChecksum - hash of data files checksums from checksums.txt, doesn't depend on part name,
+// so parts with the same data have the same checksum after ATTACH PART assign new block numbers
+func GetPartDataChecksum(partPath string) (string, error) {
+	checksumsTxt, err := os.ReadFile(path.Join(partPath, "checksums.txt"))
+	if err != nil {
+		return "", err
+	}
+	checksums, err := readPartChecksums(checksumsTxt)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", partPath, err)
+	}
+	sort.Slice(checksums, func(i, j int) bool {
+		return checksums[i].Name < checksums[j].Name
+	})
+	hash := sha256.New()
+	for _, checksum := range checksums {
+		if _, isIgnored := partChecksumIgnoredFiles[checksum.Name]; isIgnored {
+			continue
+		}
+		_, _ = fmt.Fprintf(hash, "%s\t%d\t%x\n", checksum.Name, checksum.FileSize, checksum.FileHash)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
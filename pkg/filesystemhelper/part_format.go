@@ -0,0 +1,52 @@
+package filesystemhelper
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// PartFormatWide - each column stored in separate `.bin` and marks files
+	PartFormatWide = "Wide"
+	// PartFormatCompact - all columns stored in single `data.bin` with `data.mrk3` or `data.cmrk3` marks
+	PartFormatCompact = "Compact"
+	// PartFormatUnknown - part without `columns.txt` and `count.txt`, created by very old ClickHouse versions, copied as is
+	PartFormatUnknown = "Unknown"
+)
+
+// GetPartFormat - detect part storage format by files inside part directory, wide part with column `data` contains `data.bin` with `data.mrk2` or `data.cmrk2` marks,
+// single file instead of part directory is not supported, before this check it was silently restored as empty directory
+func GetPartFormat(partPath string) (string, error) {
+	info, err := os.Stat(partPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("'%s' is single file instead of part directory, packed data parts are not supported, use `use_embedded_backup_restore: true`", partPath)
+	}
+	entries, err := os.ReadDir(partPath)
+	if err != nil {
+		return "", err
+	}
+	files := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files[entry.Name()] = struct{}{}
+		}
+	}
+	isFileExists := func(names ...string) bool {
+		for _, name := range names {
+			if _, exists := files[name]; exists {
+				return true
+			}
+		}
+		return false
+	}
+	if !isFileExists("columns.txt", "count.txt") {
+		return PartFormatUnknown, nil
+	}
+	if isFileExists("data.bin") && isFileExists("data.mrk3", "data.cmrk3") {
+		return PartFormatCompact, nil
+	}
+	return PartFormatWide, nil
+}
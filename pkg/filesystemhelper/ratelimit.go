@@ -0,0 +1,83 @@
+package filesystemhelper
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter - token bucket which limits bytes per second, shared between goroutines which copy files in parallel
+// bytesPerSecond = 0 means unlimited, copied bytes still counted to calculate effective throughput
+type RateLimiter struct {
+	bytesPerSecond float64
+	copiedBytes    uint64
+	mu             sync.Mutex
+	available      float64
+	last           time.Time
+}
+
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	return &RateLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		available:      float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// WaitN - account n bytes and block until bucket allow them, burst limited to one second of traffic
+func (r *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if r == nil {
+		return nil
+	}
+	atomic.AddUint64(&r.copiedBytes, uint64(n))
+	if r.bytesPerSecond <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	now := time.Now()
+	r.available += now.Sub(r.last).Seconds() * r.bytesPerSecond
+	if r.available > r.bytesPerSecond {
+		r.available = r.bytesPerSecond
+	}
+	r.last = now
+	r.available -= float64(n)
+	wait := time.Duration(0)
+	if r.available < 0 {
+		wait = time.Duration(-r.available / r.bytesPerSecond * float64(time.Second))
+	}
+	r.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// CopiedBytes - summary bytes passed through limiter
+func (r *RateLimiter) CopiedBytes() uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.copiedBytes)
+}
+
+type rateLimitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *RateLimiter
+}
+
+func (w *rateLimitedWriter) Write(p []byte) (int, error) {
+	if err := w.limiter.WaitN(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
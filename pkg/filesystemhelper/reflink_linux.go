@@ -0,0 +1,37 @@
+//go:build linux
+
+package filesystemhelper
+
+import (
+	"os"
+
+	apexLog "github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+// Reflink - create copy-on-write clone of src via ioctl(FICLONE), works only on filesystems like Btrfs and XFS
+func Reflink(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := srcFile.Close(); err != nil {
+			apexLog.Warnf("can't close %s: %v", src, err)
+		}
+	}()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err = unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd())); err != nil {
+		_ = dstFile.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return dstFile.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filesystemhelper
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Reflink - ioctl(FICLONE) is available only on linux
+func Reflink(src, dst string) error {
+	return fmt.Errorf("reflink '%s' -> '%s' is not supported on %s", src, dst, runtime.GOOS)
+}
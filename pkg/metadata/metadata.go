@@ -4,6 +4,9 @@ import (
 	"time"
 )
 
+// FormatVersion - version of backup metadata format, increase it when metadata.json or table metadata changes in backward incompatible way
+const FormatVersion = 1
+
 type TableTitle struct {
 	Database string `json:"database"`
 	Table    string `json:"table"`
@@ -13,6 +16,7 @@ type BackupMetadata struct {
 	BackupName              string            `json:"backup_name"`
 	Disks                   map[string]string `json:"disks"` // "default": "/var/lib/clickhouse"
 	ClickhouseBackupVersion string            `json:"version"`
+	FormatVersion           int               `json:"format_version,omitempty"`
 	CreationDate            time.Time         `json:"creation_date"`
 	Tags                    string            `json:"tags,omitempty"` // example "type=manual", "type=scheduled", "hostname": "", "shard="
 	ClickHouseVersion       string            `json:"clickhouse_version,omitempty"`
@@ -47,6 +51,7 @@ type TableMetadata struct {
 	Query                string              `json:"query"`
 	Size                 map[string]int64    `json:"size"`                  // how much size on each disk
 	TotalBytes           uint64              `json:"total_bytes,omitempty"` // total table size
+	TotalRows            uint64              `json:"total_rows,omitempty"`  // total rows in backup parts
 	DependenciesTable    string              `json:"dependencies_table,omitempty"`
 	DependenciesDatabase string              `json:"dependencies_database,omitempty"`
 	MetadataOnly         bool                `json:"metadata_only"`
@@ -63,6 +68,7 @@ type Part struct {
 	PartitionID                       string     `json:"partition_id,omitempty"`
 	ModificationTime                  *time.Time `json:"modification_time,omitempty"`
 	Size                              int64      `json:"size,omitempty"`
+	Rows                              uint64     `json:"rows,omitempty"` // from count.txt
 	// bytes_on_disk, data_compressed_bytes, data_uncompressed_bytes
 }
 
@@ -21,13 +21,13 @@ func splitAndParsePartition(partition string) []interface{} {
 			v = strings.TrimPrefix(v, "(")
 		}
 		if strings.HasSuffix(v, ")") {
-			v = strings.TrimPrefix(v, ")")
+			v = strings.TrimSuffix(v, ")")
 		}
 		v = strings.TrimSpace(v)
-		if strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") {
-			v = strings.TrimSuffix(strings.TrimPrefix(v, "'"), "'")
+		// values passed to INSERT as bound parameters, so quoted string literal is unescaped
+		if len(v) >= 2 && strings.HasPrefix(v, "'") && strings.HasSuffix(v, "'") {
+			v = strings.NewReplacer(`\\`, `\`, `\'`, `'`).Replace(v[1 : len(v)-1])
 		}
-
 		if intVal, err := strconv.ParseInt(v, 10, 64); err == nil {
 			parsedValues[i] = intVal
 		} else if floatVal, err := strconv.ParseFloat(v, 64); err == nil {
@@ -102,6 +102,102 @@ func GetPartitionId(ch *clickhouse.ClickHouse, database, table, createQuery stri
 	return nil, partitionIds[0]
 }
 
+// partitionFunctionNameRE - functions allowed in PARTITION expression, type conversion, date and hash functions which are used in PARTITION BY
+var partitionFunctionNameRE = regexp.MustCompile(`^(to[A-Z]\w*|tuple|intDiv|modulo|plus|minus|multiply|lower|upper|concat|substring|makeDate|makeDateTime|cityHash64|sipHash64|xxHash64|murmurHash3_32|murmurHash3_64)$`)
+
+// ValidatePartitionExpression - expression evaluated in ClickHouse as is, so only nested calls of allowed functions with string and number literals are accepted,
+// `func(arg, ...)` where arg is function call, number or single quoted string with escaped quotes
+func ValidatePartitionExpression(expression string) error {
+	pos, err := parsePartitionExpressionItem(expression, 0, true)
+	if err != nil {
+		return fmt.Errorf("invalid partition expression %s: %v", expression, err)
+	}
+	if pos = skipSpaces(expression, pos); pos != len(expression) {
+		return fmt.Errorf("invalid partition expression %s: unexpected '%s' at position %d", expression, expression[pos:], pos)
+	}
+	return nil
+}
+
+func skipSpaces(s string, pos int) int {
+	for pos < len(s) && (s[pos] == ' ' || s[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// parsePartitionExpressionItem - parse function call or literal started from pos, return position after it
+func parsePartitionExpressionItem(s string, pos int, isFunctionRequired bool) (int, error) {
+	pos = skipSpaces(s, pos)
+	if pos >= len(s) {
+		return pos, fmt.Errorf("unexpected end of expression")
+	}
+	start := pos
+	switch {
+	case s[pos] == '\'' && !isFunctionRequired:
+		for pos++; pos < len(s); pos++ {
+			if s[pos] == '\\' {
+				pos++
+				continue
+			}
+			if s[pos] == '\'' {
+				return pos + 1, nil
+			}
+		}
+		return pos, fmt.Errorf("unterminated string literal at position %d", start)
+	case (s[pos] >= '0' && s[pos] <= '9' || s[pos] == '-') && !isFunctionRequired:
+		for pos++; pos < len(s) && (s[pos] >= '0' && s[pos] <= '9' || s[pos] == '.'); pos++ {
+		}
+		if _, err := strconv.ParseFloat(s[start:pos], 64); err != nil {
+			return pos, fmt.Errorf("invalid number '%s' at position %d", s[start:pos], start)
+		}
+		return pos, nil
+	}
+	for pos < len(s) && (s[pos] == '_' || s[pos] >= 'a' && s[pos] <= 'z' || s[pos] >= 'A' && s[pos] <= 'Z' || s[pos] >= '0' && s[pos] <= '9' && pos > start) {
+		pos++
+	}
+	name := s[start:pos]
+	if !partitionFunctionNameRE.MatchString(name) {
+		return pos, fmt.Errorf("function '%s' at position %d is not allowed", name, start)
+	}
+	if pos = skipSpaces(s, pos); pos >= len(s) || s[pos] != '(' {
+		return pos, fmt.Errorf("expected '(' after %s", name)
+	}
+	if pos = skipSpaces(s, pos+1); pos < len(s) && s[pos] == ')' {
+		return pos + 1, nil
+	}
+	for {
+		var err error
+		if pos, err = parsePartitionExpressionItem(s, pos, false); err != nil {
+			return pos, err
+		}
+		if pos = skipSpaces(s, pos); pos >= len(s) {
+			return pos, fmt.Errorf("expected ')' after %s arguments", name)
+		}
+		if s[pos] == ')' {
+			return pos + 1, nil
+		}
+		if s[pos] != ',' {
+			return pos, fmt.Errorf("unexpected '%c' at position %d", s[pos], pos)
+		}
+		pos++
+	}
+}
+
+// EvaluatePartitionExpression - calculate expression like toYYYYMM(toDate('2023-01-15')) in ClickHouse and return result as partition value
+func EvaluatePartitionExpression(ch *clickhouse.ClickHouse, expression string) (string, error) {
+	if err := ValidatePartitionExpression(expression); err != nil {
+		return "", err
+	}
+	result := make([]string, 0)
+	if err := ch.Select(&result, fmt.Sprintf("SELECT toString(%s)", expression)); err != nil {
+		return "", fmt.Errorf("can't evaluate partition expression %s: %v", expression, err)
+	}
+	if len(result) != 1 {
+		return "", fmt.Errorf("partition expression %s shall return one value, got %d", expression, len(result))
+	}
+	return result[0], nil
+}
+
 func dropPartitionIdTable(ch *clickhouse.ClickHouse, database string, partitionIdTable string) error {
 	sql := fmt.Sprintf("DROP TABLE `%s`.`%s`", database, partitionIdTable)
 	if isAtomic, err := ch.IsAtomic(database); isAtomic {
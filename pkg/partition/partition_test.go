@@ -0,0 +1,43 @@
+package partition
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAndParsePartition(t *testing.T) {
+	assert.Equal(t, []interface{}{int64(202301)}, splitAndParsePartition("202301"))
+	assert.Equal(t, []interface{}{"2023-01-15", int64(1), 1.5}, splitAndParsePartition("('2023-01-15', 1, 1.5)"))
+	assert.Equal(t, []interface{}{"it's", `back\slash`}, splitAndParsePartition(`'it\'s','back\\slash'`))
+}
+
+func TestValidatePartitionExpression(t *testing.T) {
+	for _, expression := range []string{
+		"toYYYYMM(toDate('2023-01-15'))",
+		"toYYYYMMDD( toDateTime('2023-01-15 00:00:00') )",
+		"tuple(toYYYYMM(toDate('2023-01-15')), 'it\\'s', -1, 2.5)",
+		"tuple()",
+		"intDiv(123, 10)",
+	} {
+		assert.NoError(t, ValidatePartitionExpression(expression), expression)
+	}
+	for _, expression := range []string{
+		"",
+		"'2023-01'",
+		"202301",
+		"file('/etc/passwd')",
+		"toString((SELECT password FROM system.users))",
+		"toYYYYMM(toDate('2023-01-15')) FROM system.one",
+		"toYYYYMM(now()) SETTINGS readonly=0",
+		"toYYYYMM(toDate('2023-01-15')); DROP TABLE t",
+		"toDate('2023-01-15' || 'x')",
+		"toDate('unterminated)",
+		"toDate",
+		"toDate(1",
+		"toDate(1 2)",
+		"toDate(1.2.3)",
+	} {
+		assert.Error(t, ValidatePartitionExpression(expression), expression)
+	}
+}
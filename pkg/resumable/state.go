@@ -21,12 +21,20 @@ type State struct {
 }
 
 func NewState(defaultDiskPath, backupName, command string, params map[string]interface{}) *State {
+	return NewStateFile(path.Join(defaultDiskPath, "backup", backupName, fmt.Sprintf("%s.state", command)), params)
+}
+
+// NewStateFile - state stored in stateFile, parent directory created when absent
+func NewStateFile(stateFile string, params map[string]interface{}) *State {
 	s := State{
-		stateFile:    path.Join(defaultDiskPath, "backup", backupName, fmt.Sprintf("%s.state", command)),
+		stateFile:    stateFile,
 		currentState: "",
 		mx:           &sync.RWMutex{},
 		log:          apexLog.WithField("logger", "resumable"),
 	}
+	if err := os.MkdirAll(path.Dir(s.stateFile), 0750); err != nil {
+		s.log.Warnf("can't create %s error: %v", path.Dir(s.stateFile), err)
+	}
 	fp, err := os.OpenFile(s.stateFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		s.log.Warnf("can't open %s error: %v", s.stateFile, err)
@@ -63,18 +71,45 @@ func (s *State) LoadState() {
 	s.mx.Lock()
 	state, err := os.ReadFile(s.stateFile)
 	if err == nil {
-		s.currentState = string(state)
+		var corruptedLines int
+		s.currentState, corruptedLines = parseState(string(state))
+		if corruptedLines > 0 {
+			s.log.Warnf("%s contains %d corrupted lines, they will be processed again", s.stateFile, corruptedLines)
+		}
 	} else {
 		s.currentState = ""
 		if !os.IsNotExist(err) {
 			s.log.Warnf("can't read %s error: %v", s.stateFile, err)
 		} else {
-			s.log.Warnf("%s empty, will continue from scratch error: %v", s.stateFile, err)
+			s.log.Debugf("%s not exists, will continue from scratch", s.stateFile)
 		}
 	}
 	s.mx.Unlock()
 }
 
+// parseState - each line has `path:size` format and ends with new line, last line without new line is written partially when process killed
+func parseState(state string) (string, int) {
+	lines := strings.Split(state, "\n")
+	validLines := make([]string, 0, len(lines))
+	corruptedLines := 0
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		sizeIndex := strings.LastIndex(line, ":")
+		if sizeIndex < 0 || i == len(lines)-1 {
+			corruptedLines++
+			continue
+		}
+		if _, err := strconv.ParseInt(line[sizeIndex+1:], 10, 64); err != nil {
+			corruptedLines++
+			continue
+		}
+		validLines = append(validLines, line+"\n")
+	}
+	return strings.Join(validLines, ""), corruptedLines
+}
+
 func (s *State) AppendToState(path string, size int64) {
 	path = fmt.Sprintf("%s:%d", path, size)
 	s.mx.Lock()
@@ -117,3 +152,11 @@ func (s *State) IsAlreadyProcessed(path string) (bool, int64) {
 func (s *State) Close() {
 	_ = s.fp.Close()
 }
+
+// Cleanup - close and remove state file when operation successfully completed
+func (s *State) Cleanup() {
+	s.Close()
+	if err := os.Remove(s.stateFile); err != nil && !os.IsNotExist(err) {
+		s.log.Warnf("can't remove %s error: %v", s.stateFile, err)
+	}
+}
@@ -0,0 +1,45 @@
+package resumable
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseState(t *testing.T) {
+	state, corruptedLines := parseState("")
+	assert.Equal(t, "", state)
+	assert.Equal(t, 0, corruptedLines)
+
+	state, corruptedLines = parseState("{\"tables\":\"db.*\"}:0\n`db`.`t`.uuid/default/all_1_1_0:0\n")
+	assert.Equal(t, "{\"tables\":\"db.*\"}:0\n`db`.`t`.uuid/default/all_1_1_0:0\n", state)
+	assert.Equal(t, 0, corruptedLines)
+
+	state, corruptedLines = parseState("`db`.`t`.uuid/default/all_1_1_0:0\nbroken line\n`db`.`t`.uuid/default/all_2_2_0:abc\n`db`.`t`.uuid/default/all_3_3_0:")
+	assert.Equal(t, "`db`.`t`.uuid/default/all_1_1_0:0\n", state)
+	assert.Equal(t, 3, corruptedLines)
+}
+
+func TestStateFile(t *testing.T) {
+	stateFile := path.Join(t.TempDir(), "backup", "test", "attach.state")
+	s := NewStateFile(stateFile, nil)
+	assert.False(t, s.IsAlreadyProcessedBool("`db`.`t`.uuid/default/all_1_1_0"))
+	s.AppendToState("`db`.`t`.uuid/default/all_1_1_0", 0)
+	s.Close()
+
+	// partially written line is ignored after restart
+	fp, err := os.OpenFile(stateFile, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = fp.WriteString("`db`.`t`.uuid/default/all_2_2_0")
+	assert.NoError(t, err)
+	assert.NoError(t, fp.Close())
+
+	s = NewStateFile(stateFile, nil)
+	assert.True(t, s.IsAlreadyProcessedBool("`db`.`t`.uuid/default/all_1_1_0"))
+	assert.False(t, s.IsAlreadyProcessedBool("`db`.`t`.uuid/default/all_2_2_0"))
+	s.Cleanup()
+	_, err = os.Stat(stateFile)
+	assert.True(t, os.IsNotExist(err))
+}
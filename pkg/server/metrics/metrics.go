@@ -157,6 +157,8 @@ func (m *APIMetrics) RegisterMetrics() {
 		m.NumberBackupsLocalExpected,
 	)
 
+	Restore.Register()
+
 	for _, command := range commandList {
 		m.LastStatus[command].Set(2) // 0=failed, 1=success, 2=unknown
 	}
@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	apexLog "github.com/apex/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// RestoreMetrics - restore progress labeled by backup name, updated inside backup package for API server and CLI commands
+type RestoreMetrics struct {
+	Duration     *prometheus.GaugeVec
+	Bytes        *prometheus.CounterVec
+	Tables       *prometheus.CounterVec
+	Errors       *prometheus.CounterVec
+	registerOnce sync.Once
+}
+
+var Restore = &RestoreMetrics{
+	Duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "restore_duration_seconds",
+		Help:      "Last restore duration in seconds",
+	}, []string{"backup"}),
+	Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "restore_bytes_total",
+		Help:      "Bytes of data parts copied to detached during restore",
+	}, []string{"backup"}),
+	Tables: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "restore_tables_total",
+		Help:      "Tables which data successfully restored",
+	}, []string{"backup"}),
+	Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clickhouse_backup",
+		Name:      "restore_errors_total",
+		Help:      "Errors during restore schema and data",
+	}, []string{"backup"}),
+}
+
+// Register - register restore metrics in default prometheus registry, safe to call multiple times
+func (m *RestoreMetrics) Register() {
+	m.registerOnce.Do(func() {
+		prometheus.MustRegister(m.Duration, m.Bytes, m.Tables, m.Errors)
+	})
+}
+
+// ListenAndServe - expose default prometheus registry on listenAddress/metrics during long-running CLI commands, returned function stops listener
+func ListenAndServe(listenAddress string) (func(), error) {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			apexLog.Errorf("metrics listener on %s stopped: %v", listenAddress, err)
+		}
+	}()
+	apexLog.Infof("serve metrics on http://%s/metrics", listener.Addr().String())
+	return func() {
+		if err := server.Close(); err != nil {
+			apexLog.Warnf("can't close metrics listener: %v", err)
+		}
+	}, nil
+}
+
+// GetCounters - current tables, bytes and errors counters for backupName, restore summary calculated as difference before and after restore
+func (m *RestoreMetrics) GetCounters(backupName string) (tables, bytes, errors uint64, err error) {
+	registry := prometheus.NewRegistry()
+	if err = registry.Register(m.Tables); err != nil {
+		return 0, 0, 0, err
+	}
+	if err = registry.Register(m.Bytes); err != nil {
+		return 0, 0, 0, err
+	}
+	if err = registry.Register(m.Errors); err != nil {
+		return 0, 0, 0, err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			isBackup := false
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "backup" && label.GetValue() == backupName {
+					isBackup = true
+				}
+			}
+			if !isBackup {
+				continue
+			}
+			value := uint64(metric.GetCounter().GetValue())
+			switch family.GetName() {
+			case "clickhouse_backup_restore_tables_total":
+				tables = value
+			case "clickhouse_backup_restore_bytes_total":
+				bytes = value
+			case "clickhouse_backup_restore_errors_total":
+				errors = value
+			}
+		}
+	}
+	return tables, bytes, errors, nil
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreMetricsGetCounters(t *testing.T) {
+	Restore.Register()
+	// second call shall not panic with duplicate registration
+	Restore.Register()
+	Restore.Tables.WithLabelValues("test_counters").Add(2)
+	Restore.Bytes.WithLabelValues("test_counters").Add(1024)
+	Restore.Errors.WithLabelValues("test_counters").Inc()
+	Restore.Tables.WithLabelValues("test_counters_other").Add(5)
+
+	tables, bytes, errors, err := Restore.GetCounters("test_counters")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), tables)
+	assert.Equal(t, uint64(1024), bytes)
+	assert.Equal(t, uint64(1), errors)
+
+	tables, bytes, errors, err = Restore.GetCounters("test_counters_unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{0, 0, 0}, []uint64{tables, bytes, errors})
+}
+
+func TestRestoreMetricsListenAndServe(t *testing.T) {
+	Restore.Register()
+	Restore.Tables.WithLabelValues("test_listen").Inc()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listenAddress := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	stop, err := ListenAndServe(listenAddress)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stop()
+	resp, err := http.Get("http://" + listenAddress + "/metrics")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		assert.NoError(t, resp.Body.Close())
+	}()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `clickhouse_backup_restore_tables_total{backup="test_listen"} 1`)
+
+	// listen address already in use
+	_, err = ListenAndServe(listenAddress)
+	assert.Error(t, err)
+}
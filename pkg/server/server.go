@@ -1089,6 +1089,7 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 	}
 	vars := mux.Vars(r)
 	tablePattern := ""
+	functionsPattern := ""
 	databaseMappingToRestore := make([]string, 0)
 	partitionsToBackup := make([]string, 0)
 	schemaOnly := false
@@ -1097,6 +1098,20 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 	ignoreDependencies := false
 	rbacOnly := false
 	configsOnly := false
+	skipAttach := false
+	attachIncrementally := false
+	parts := make([]string, 0)
+	forceDrop := false
+	freezeAfterRestore := false
+	replacePartitions := false
+	onlyNewPartitions := false
+	noRestart := false
+	syncParts := false
+	syncPartsDetach := false
+	schemaAsAttach := true
+	schemaOutput := ""
+	schemaOutputOnly := false
+	lastPartitions := 0
 	fullCommand := "restore"
 
 	query := r.URL.Query()
@@ -1104,6 +1119,27 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		tablePattern = tp[0]
 		fullCommand = fmt.Sprintf("%s --tables=\"%s\"", fullCommand, tablePattern)
 	}
+	if tablesFileQuery, exist := query["tables_file"]; exist {
+		tablesFile, err := getAPIFilePath(api.config.API.RestoreFilesPath, "tables_file", tablesFileQuery[0])
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", err)
+			return
+		}
+		patternsFromFile, err := backup.LoadRestoreTablesFile(tablesFile)
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", err)
+			return
+		}
+		if tablePattern != "" {
+			patternsFromFile = tablePattern + "," + patternsFromFile
+		}
+		tablePattern = patternsFromFile
+		fullCommand = fmt.Sprintf("%s --tables-file=\"%s\"", fullCommand, tablesFile)
+	}
+	if fp, exist := query["restore_functions_pattern"]; exist {
+		functionsPattern = fp[0]
+		fullCommand = fmt.Sprintf("%s --restore-functions-pattern=\"%s\"", fullCommand, functionsPattern)
+	}
 	if databaseMappingQuery, exist := query["restore_database_mapping"]; exist {
 		for _, databaseMapping := range databaseMappingQuery {
 			mappingItems := strings.Split(databaseMapping, ",")
@@ -1119,10 +1155,31 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 
 		fullCommand = fmt.Sprintf("%s --restore-database-mapping=\"%s\"", fullCommand, strings.Join(databaseMappingToRestore, ","))
 	}
+	if mappingFileQuery, exist := query["restore_mapping_file"]; exist {
+		mappingFile, err := getAPIFilePath(api.config.API.RestoreFilesPath, "restore_mapping_file", mappingFileQuery[0])
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", err)
+			return
+		}
+		mappingFromFile, err := backup.LoadRestoreDatabaseMappingFile(mappingFile)
+		if err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", err)
+			return
+		}
+		// inline restore_database_mapping rules have priority
+		databaseMappingToRestore = append(mappingFromFile, databaseMappingToRestore...)
+		fullCommand = fmt.Sprintf("%s --restore-mapping-file=\"%s\"", fullCommand, mappingFile)
+	}
 	if partitions, exist := query["partitions"]; exist {
 		partitionsToBackup = partitions
 		fullCommand = fmt.Sprintf("%s --partitions=\"%s\"", fullCommand, strings.Join(partitions, ","))
 	}
+	if partNames, exist := query["part"]; exist {
+		for _, partName := range partNames {
+			parts = append(parts, strings.Split(partName, ",")...)
+		}
+		fullCommand = fmt.Sprintf("%s --part=\"%s\"", fullCommand, strings.Join(parts, ","))
+	}
 	if _, exist := query["schema"]; exist {
 		schemaOnly = true
 		fullCommand += " --schema"
@@ -1139,6 +1196,10 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		dropTable = true
 		fullCommand += " --rm"
 	}
+	if _, exist := query["force_drop"]; exist {
+		forceDrop = true
+		fullCommand += " --force-drop"
+	}
 	if _, exists := query["ignore_dependencies"]; exists {
 		ignoreDependencies = true
 		fullCommand += " --ignore-dependencies"
@@ -1151,6 +1212,66 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		configsOnly = true
 		fullCommand += " --configs"
 	}
+	if _, exist := query["skip_attach"]; exist {
+		skipAttach = true
+		fullCommand += " --skip-attach"
+	}
+	if schemaAsAttachQuery, exist := query["schema_as_attach"]; exist {
+		var err error
+		if schemaAsAttach, err = strconv.ParseBool(schemaAsAttachQuery[0]); err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", fmt.Errorf("invalid value for schema_as_attach %s: %v", schemaAsAttachQuery[0], err))
+			return
+		}
+		fullCommand = fmt.Sprintf("%s --schema-as-attach=%v", fullCommand, schemaAsAttach)
+	}
+	if lastPartitionsQuery, exist := query["last_partitions"]; exist {
+		var err error
+		if lastPartitions, err = strconv.Atoi(lastPartitionsQuery[0]); err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", fmt.Errorf("invalid value for last_partitions %s: %v", lastPartitionsQuery[0], err))
+			return
+		}
+		fullCommand = fmt.Sprintf("%s --last-partitions=%d", fullCommand, lastPartitions)
+	}
+	if schemaOutputQuery, exist := query["schema_output"]; exist {
+		var err error
+		if schemaOutput, err = getAPIFilePath(api.config.API.RestoreFilesPath, "schema_output", schemaOutputQuery[0]); err != nil {
+			api.writeError(w, http.StatusBadRequest, "restore", err)
+			return
+		}
+		fullCommand = fmt.Sprintf("%s --schema-output=\"%s\"", fullCommand, schemaOutput)
+	}
+	if _, exist := query["schema_output_only"]; exist {
+		schemaOutputOnly = true
+		fullCommand += " --schema-output-only"
+	}
+	if _, exist := query["attach_incrementally"]; exist {
+		attachIncrementally = true
+		fullCommand += " --attach-incrementally"
+	}
+	if _, exist := query["freeze_after_restore"]; exist {
+		freezeAfterRestore = true
+		fullCommand += " --freeze-after-restore"
+	}
+	if _, exist := query["replace_partitions"]; exist {
+		replacePartitions = true
+		fullCommand += " --replace-partitions"
+	}
+	if _, exist := query["only_new_partitions"]; exist {
+		onlyNewPartitions = true
+		fullCommand += " --only-new-partitions"
+	}
+	if _, exist := query["no_restart"]; exist {
+		noRestart = true
+		fullCommand += " --no-restart"
+	}
+	if _, exist := query["sync_parts"]; exist {
+		syncParts = true
+		fullCommand += " --sync-parts"
+	}
+	if _, exist := query["sync_parts_detach"]; exist {
+		syncPartsDetach = true
+		fullCommand += " --sync-parts-detach"
+	}
 
 	name := utils.CleanBackupNameRE.ReplaceAllString(vars["name"], "")
 	fullCommand += fmt.Sprintf(" %s", name)
@@ -1159,7 +1280,32 @@ func (api *APIServer) httpRestoreHandler(w http.ResponseWriter, r *http.Request)
 		commandId, _ := status.Current.Start(fullCommand)
 		err, _ := api.metrics.ExecuteWithMetrics("restore", 0, func() error {
 			b := backup.NewBackuper(api.config)
-			return b.Restore(name, tablePattern, databaseMappingToRestore, partitionsToBackup, schemaOnly, dataOnly, dropTable, ignoreDependencies, rbacOnly, configsOnly, commandId)
+			return b.Restore(name, backup.RestoreOptions{
+				TablePattern:        tablePattern,
+				FunctionsPattern:    functionsPattern,
+				DatabaseMapping:     databaseMappingToRestore,
+				Partitions:          partitionsToBackup,
+				Parts:               parts,
+				LastPartitions:      lastPartitions,
+				SchemaOnly:          schemaOnly,
+				DataOnly:            dataOnly,
+				DropTable:           dropTable,
+				ForceDrop:           forceDrop,
+				IgnoreDependencies:  ignoreDependencies,
+				RBACOnly:            rbacOnly,
+				ConfigsOnly:         configsOnly,
+				SkipAttach:          skipAttach,
+				AttachIncrementally: attachIncrementally,
+				FreezeAfterRestore:  freezeAfterRestore,
+				ReplacePartitions:   replacePartitions,
+				OnlyNewPartitions:   onlyNewPartitions,
+				NoRestart:           noRestart,
+				SyncParts:           syncParts,
+				SyncPartsDetach:     syncPartsDetach,
+				SchemaAsAttach:      schemaAsAttach,
+				SchemaOutput:        schemaOutput,
+				SchemaOutputOnly:    schemaOutputOnly,
+			}, commandId)
 		})
 		status.Current.Stop(commandId, err)
 		if err != nil {
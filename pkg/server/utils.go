@@ -4,9 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"reflect"
 )
 
+// getAPIFilePath - query arguments can't point to arbitrary server files, only file name inside `api->restore_files_path` allowed
+func getAPIFilePath(filesPath, argName, fileName string) (string, error) {
+	if filesPath == "" {
+		return "", fmt.Errorf("%s requires `api->restore_files_path` in config", argName)
+	}
+	if fileName == "" || fileName == "." || fileName == ".." || filepath.Base(fileName) != fileName {
+		return "", fmt.Errorf("%s shall be file name inside `api->restore_files_path` without directories", argName)
+	}
+	return filepath.Join(filesPath, fileName), nil
+}
+
 func (api *APIServer) flushOutput(w http.ResponseWriter, out string) {
 	if _, err := fmt.Fprintln(w, out); err != nil {
 		api.log.Warnf("can't write to http.ResponseWriter: %v", err)
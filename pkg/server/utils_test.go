@@ -0,0 +1,26 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAPIFilePath(t *testing.T) {
+	filePath, err := getAPIFilePath("/etc/clickhouse-backup/restore", "tables_file", "tables.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/clickhouse-backup/restore/tables.txt", filePath)
+	_, err = getAPIFilePath("", "tables_file", "tables.txt")
+	assert.EqualError(t, err, "tables_file requires `api->restore_files_path` in config")
+	filePath, err = getAPIFilePath("/etc/clickhouse-backup/restore", "schema_output", "schema.sql")
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/clickhouse-backup/restore/schema.sql", filePath)
+	_, err = getAPIFilePath("/etc/clickhouse-backup/restore", "schema_output", "/tmp/schema.sql")
+	assert.EqualError(t, err, "schema_output shall be file name inside `api->restore_files_path` without directories")
+	_, err = getAPIFilePath("/etc/clickhouse-backup/restore", "restore_mapping_file", "/etc/passwd")
+	assert.EqualError(t, err, "restore_mapping_file shall be file name inside `api->restore_files_path` without directories")
+	for _, fileName := range []string{"", ".", "..", "../tables.txt", "/etc/passwd", "dir/tables.txt"} {
+		_, err = getAPIFilePath("/etc/clickhouse-backup/restore", "tables_file", fileName)
+		assert.Error(t, err, fileName)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/AlexAkulov/clickhouse-backup/pkg/common"
+	"github.com/AlexAkulov/clickhouse-backup/pkg/utils"
 	apexLog "github.com/apex/log"
 	"strings"
 	"sync"
@@ -30,11 +31,35 @@ type AsyncStatus struct {
 }
 
 type ActionRowStatus struct {
-	Command string `json:"command"`
-	Status  string `json:"status"`
-	Start   string `json:"start,omitempty"`
-	Finish  string `json:"finish,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Command  string                `json:"command"`
+	Status   string                `json:"status"`
+	Start    string                `json:"start,omitempty"`
+	Finish   string                `json:"finish,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Tables   []TableProgressStatus `json:"tables,omitempty"`
+	Progress *ProgressStatus       `json:"progress,omitempty"`
+}
+
+// ProgressStatus - progress of a single long-running statement like embedded RESTORE, ETA is empty until progress is known
+type ProgressStatus struct {
+	FilesDone  uint64  `json:"files_done"`
+	FilesTotal uint64  `json:"files_total"`
+	BytesDone  uint64  `json:"bytes_done"`
+	BytesTotal uint64  `json:"bytes_total"`
+	Percent    float64 `json:"percent"`
+	ETA        string  `json:"eta,omitempty"`
+	Updated    string  `json:"updated"`
+}
+
+// TableProgressStatus - per table progress for long-running commands like restore
+type TableProgressStatus struct {
+	Table    string `json:"table"`
+	Status   string `json:"status"`
+	Start    string `json:"start"`
+	Finish   string `json:"finish,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+	started  time.Time
 }
 
 type ActionRow struct {
@@ -119,6 +144,56 @@ func (status *AsyncStatus) Stop(commandId int, err error) {
 	status.log.Debugf("api.status.stop -> status.commands[%d] == %+v", commandId, status.commands[commandId])
 }
 
+// StartTable - mark table in progress for commandId, ignored for commands not from API
+func (status *AsyncStatus) StartTable(commandId int, table string) {
+	status.Lock()
+	defer status.Unlock()
+	if commandId == NotFromAPI || commandId >= len(status.commands) {
+		return
+	}
+	now := time.Now()
+	status.commands[commandId].Tables = append(status.commands[commandId].Tables, TableProgressStatus{
+		Table:   table,
+		Status:  InProgressStatus,
+		Start:   now.Format(common.TimeFormat),
+		started: now,
+	})
+}
+
+// FinishTable - mark last started table with the same name as finished for commandId
+func (status *AsyncStatus) FinishTable(commandId int, table string, err error) {
+	status.Lock()
+	defer status.Unlock()
+	if commandId == NotFromAPI || commandId >= len(status.commands) {
+		return
+	}
+	tables := status.commands[commandId].Tables
+	for i := len(tables) - 1; i >= 0; i-- {
+		if tables[i].Table != table || tables[i].Status != InProgressStatus {
+			continue
+		}
+		tables[i].Status = SuccessStatus
+		if err != nil {
+			tables[i].Status = ErrorStatus
+			tables[i].Error = err.Error()
+		}
+		tables[i].Finish = time.Now().Format(common.TimeFormat)
+		tables[i].Duration = utils.HumanizeDuration(time.Since(tables[i].started))
+		return
+	}
+}
+
+// SetProgress - replace progress of commandId, ignored for commands not from API
+func (status *AsyncStatus) SetProgress(commandId int, progress ProgressStatus) {
+	status.Lock()
+	defer status.Unlock()
+	if commandId == NotFromAPI || commandId >= len(status.commands) {
+		return
+	}
+	progress.Updated = time.Now().Format(common.TimeFormat)
+	status.commands[commandId].Progress = &progress
+}
+
 func (status *AsyncStatus) Cancel(command string, err error) error {
 	status.Lock()
 	defer status.Unlock()
@@ -194,13 +269,19 @@ func (status *AsyncStatus) GetStatus(current bool, filter string, last int) []Ac
 	for _, command := range status.commands {
 		if filter == "" || (strings.Contains(command.Command, filter) || strings.Contains(command.Status, filter) || strings.Contains(command.Error, filter)) {
 			// copy without context and cancel
-			filteredCommands = append(filteredCommands, ActionRowStatus{
+			row := ActionRowStatus{
 				Command: command.Command,
 				Status:  command.Status,
 				Start:   command.Start,
 				Finish:  command.Finish,
 				Error:   command.Error,
-			})
+				Tables:  append([]TableProgressStatus(nil), command.Tables...),
+			}
+			if command.Progress != nil {
+				progress := *command.Progress
+				row.Progress = &progress
+			}
+			filteredCommands = append(filteredCommands, row)
 		}
 	}
 	if len(filteredCommands) == 0 {
@@ -0,0 +1,42 @@
+package status
+
+import (
+	"fmt"
+	"testing"
+
+	apexLog "github.com/apex/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableProgress(t *testing.T) {
+	status := &AsyncStatus{log: apexLog.WithField("logger", "test")}
+	commandId, _ := status.Start("restore backup1")
+	status.StartTable(commandId, "db.t1")
+	status.StartTable(commandId, "db.t2")
+	status.FinishTable(commandId, "db.t1", nil)
+	status.FinishTable(commandId, "db.t2", fmt.Errorf("can't attach"))
+	// retried table gets new row, finished rows don't change
+	status.StartTable(commandId, "db.t2")
+
+	tables := status.GetStatus(true, "", 0)[0].Tables
+	assert.Len(t, tables, 3)
+	assert.Equal(t, "db.t1", tables[0].Table)
+	assert.Equal(t, SuccessStatus, tables[0].Status)
+	assert.NotEmpty(t, tables[0].Finish)
+	assert.NotEmpty(t, tables[0].Duration)
+	assert.Equal(t, ErrorStatus, tables[1].Status)
+	assert.Equal(t, "can't attach", tables[1].Error)
+	assert.Equal(t, InProgressStatus, tables[2].Status)
+	assert.Empty(t, tables[2].Finish)
+
+	// returned tables are copy, status changes don't affect them
+	status.FinishTable(commandId, "db.t2", nil)
+	assert.Equal(t, InProgressStatus, tables[2].Status)
+	assert.Equal(t, SuccessStatus, status.GetStatus(true, "", 0)[0].Tables[2].Status)
+
+	// commands not from API and unknown commands ignored
+	status.StartTable(NotFromAPI, "db.t3")
+	status.StartTable(commandId+1, "db.t3")
+	status.FinishTable(NotFromAPI, "db.t3", nil)
+	assert.Len(t, status.GetStatus(true, "", 0)[0].Tables, 3)
+}
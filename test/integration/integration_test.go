@@ -747,6 +747,97 @@ func TestRestoreDatabaseMapping(t *testing.T) {
 	fullCleanup(r, ch, []string{testBackupName}, []string{"local"}, databaseList, true)
 }
 
+func TestRestoreReplacePartitions(t *testing.T) {
+	r := require.New(t)
+	r.NoError(dockerCP("config-s3.yml", "clickhouse:/etc/clickhouse-backup/config.yml"))
+	ch := &TestClickHouse{}
+	ch.connectWithWait(r, 500*time.Millisecond)
+	defer ch.chbackend.Close()
+	checkRecordset := func(expectedCount int, query string) {
+		result := make([]int, 0)
+		r.NoError(ch.chbackend.Select(&result, query))
+		r.Equal(1, len(result))
+		r.Equal(expectedCount, result[0], "expect count=%d for %s", expectedCount, query)
+	}
+
+	testBackupName := "test_restore_replace_partitions"
+	databaseList := []string{"replace_db"}
+	isReplicatedDatabase := compareVersion(os.Getenv("CLICKHOUSE_VERSION"), "22.3") >= 0
+	if isReplicatedDatabase {
+		databaseList = append(databaseList, "replace_replicated_db")
+	}
+	fullCleanup(r, ch, []string{testBackupName}, []string{"local"}, databaseList, false)
+
+	ch.queryWithNoError(r, "CREATE DATABASE replace_db")
+	ch.queryWithNoError(r, "CREATE TABLE replace_db.t1 (dt Date, v UInt64) ENGINE=MergeTree() PARTITION BY toYYYYMM(dt) ORDER BY v")
+	ch.queryWithNoError(r, "INSERT INTO replace_db.t1 SELECT '2022-01-01', number FROM numbers(10)")
+	ch.queryWithNoError(r, "INSERT INTO replace_db.t1 SELECT '2022-02-01', number FROM numbers(10)")
+	if isReplicatedDatabase {
+		r.NoError(dockerExec("clickhouse", "clickhouse-client", "--allow_experimental_database_replicated=1", "-q", "CREATE DATABASE replace_replicated_db ENGINE=Replicated('/clickhouse/databases/replace_replicated_db', '{shard}', '{replica}')"))
+		ch.queryWithNoError(r, "CREATE TABLE replace_replicated_db.t1 (dt Date, v UInt64) ENGINE=ReplicatedMergeTree() PARTITION BY toYYYYMM(dt) ORDER BY v")
+		ch.queryWithNoError(r, "INSERT INTO replace_replicated_db.t1 SELECT '2022-01-01', number FROM numbers(10)")
+	}
+
+	log.Info("Create backup")
+	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "create", "--tables", "replace*.*", testBackupName))
+
+	log.Info("Change data after backup")
+	ch.queryWithNoError(r, "INSERT INTO replace_db.t1 SELECT '2022-01-01', number FROM numbers(5)")
+	ch.queryWithNoError(r, "INSERT INTO replace_db.t1 SELECT '2022-03-01', number FROM numbers(5)")
+	if isReplicatedDatabase {
+		ch.queryWithNoError(r, "INSERT INTO replace_replicated_db.t1 SELECT '2022-01-01', number FROM numbers(5)")
+	}
+
+	log.Info("Restore with --replace-partitions")
+	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "restore", "--data", "--replace-partitions", "--tables", "replace*.*", testBackupName))
+
+	log.Info("Check restored partitions replaced, other partitions untouched")
+	checkRecordset(10, "SELECT count() FROM replace_db.t1 WHERE toYYYYMM(dt)=202201")
+	checkRecordset(10, "SELECT count() FROM replace_db.t1 WHERE toYYYYMM(dt)=202202")
+	checkRecordset(5, "SELECT count() FROM replace_db.t1 WHERE toYYYYMM(dt)=202203")
+	if isReplicatedDatabase {
+		checkRecordset(10, "SELECT count() FROM replace_replicated_db.t1")
+	}
+	checkRecordset(0, "SELECT count() FROM system.tables WHERE name LIKE '__restore_replace_%'")
+
+	fullCleanup(r, ch, []string{testBackupName}, []string{"local"}, databaseList, true)
+	// database for temporary tables of Replicated databases is left after restore
+	ch.queryWithNoError(r, "DROP DATABASE IF EXISTS _clickhouse_backup_staging")
+}
+
+func TestRestoreDefaultDatabase(t *testing.T) {
+	r := require.New(t)
+	r.NoError(dockerCP("config-s3.yml", "clickhouse:/etc/clickhouse-backup/config.yml"))
+	ch := &TestClickHouse{}
+	ch.connectWithWait(r, 500*time.Millisecond)
+	defer ch.chbackend.Close()
+
+	testBackupName := "test_restore_default_database"
+	fullCleanup(r, ch, []string{testBackupName}, []string{"local"}, nil, false)
+	ch.queryWithNoError(r, "DROP TABLE IF EXISTS default.t_restore_default SYNC")
+	ch.queryWithNoError(r, "CREATE TABLE default.t_restore_default (id UInt64) ENGINE=MergeTree() ORDER BY id")
+	ch.queryWithNoError(r, "INSERT INTO default.t_restore_default SELECT number FROM numbers(100)")
+	engineBefore := make([]string, 0)
+	r.NoError(ch.chbackend.Select(&engineBefore, "SELECT engine FROM system.databases WHERE name='default'"))
+
+	log.Info("Create backup")
+	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "create", "--tables", "default.t_restore_default", testBackupName))
+
+	log.Info("Restore default.* tables, `default` database shall not re-created")
+	ch.queryWithNoError(r, "DROP TABLE default.t_restore_default SYNC")
+	r.NoError(dockerExec("clickhouse", "clickhouse-backup", "restore", "--rm", "--tables", "default.*", testBackupName))
+
+	result := make([]uint64, 0)
+	r.NoError(ch.chbackend.Select(&result, "SELECT count() FROM default.t_restore_default"))
+	r.Equal([]uint64{100}, result)
+	engineAfter := make([]string, 0)
+	r.NoError(ch.chbackend.Select(&engineAfter, "SELECT engine FROM system.databases WHERE name='default'"))
+	r.Equal(engineBefore, engineAfter)
+
+	ch.queryWithNoError(r, "DROP TABLE default.t_restore_default SYNC")
+	fullCleanup(r, ch, []string{testBackupName}, []string{"local"}, nil, true)
+}
+
 func TestMySQLMaterialized(t *testing.T) {
 	t.Skipf("Wait when fix DROP TABLE not supported by MaterializedMySQL, just attach will not help")
 	if compareVersion(os.Getenv("CLICKHOUSE_VERSION"), "22.12") == -1 {